@@ -15,6 +15,7 @@ require (
 	go.opentelemetry.io/otel/sdk v1.28.0
 	go.opentelemetry.io/otel/trace v1.28.0
 	golang.org/x/sync v0.7.0
+	golang.org/x/time v0.5.0
 )
 
 require (
@@ -0,0 +1,252 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"io"
+	"slices"
+)
+
+type (
+	// CompactionStrategy plans the compactions of Reader.Compact
+	CompactionStrategy interface {
+		// PlanCompaction picks the segments to compact from a snapshot of all segments. Return a CompactionPlan
+		// with no Inputs if there is nothing to compact.
+		PlanCompaction(segments []SegmentRecord) (CompactionPlan, error)
+	}
+
+	// CompactionPlan is a merge of input segments into a single output segment
+	CompactionPlan struct {
+		// Inputs are merged into the output segment, then dropped
+		Inputs []SegmentRecord
+		// OutputID is the ID of the output segment, which is passed to the writer factory. It must not be the ID of
+		// an input, as the inputs are still being read while the output is written.
+		OutputID string
+		// OutputLevel is the level of the output segment
+		OutputLevel int
+		// WriterOptions are used to write the output segment. Row sequence numbers are kept if
+		// WriterOptions.RowSequence is enabled.
+		WriterOptions sst.SegmentWriterOptions
+		// DropTombstones leaves the winning tombstones out of the output segment, which is only safe when no
+		// segment outside the inputs at the output level or below may hold the deleted keys.
+		DropTombstones bool
+	}
+
+	// CompactionResult is the change Reader.Compact applied with UpdateSegments
+	CompactionResult struct {
+		// Added is the output segment, empty if there was nothing to compact, or if every row was a dropped
+		// tombstone
+		Added []SegmentRecord
+		// Dropped are the input segments
+		Dropped []SegmentRecord
+	}
+
+	// L0CompactionStrategy is a CompactionStrategy that merges every L0 segment, along with the L1 segments they
+	// overlap, into a single L1 segment, once there are at least MinSegments L0 segments. This keeps L1 segments
+	// from overlapping each other. The output segment is not split by size.
+	L0CompactionStrategy struct {
+		// MinSegments is the number of L0 segments needed to compact, at least 1
+		MinSegments int
+		// NewSegmentID creates the ID of the output segment
+		NewSegmentID func() string
+		// WriterOptions are used to write the output segment. If WriterOptions.BloomFilter is not nil, a new bloom
+		// filter is sized for the inputs with sst.MergedBloomFilter, which requires the input metadata row counts.
+		WriterOptions sst.SegmentWriterOptions
+	}
+
+	// lazyWriteCloser creates the underlying writer on the first write, so nothing is created if nothing is written
+	lazyWriteCloser struct {
+		open   func() (io.WriteCloser, error)
+		writer io.WriteCloser
+	}
+)
+
+// PlanCompaction plans the merge of all L0 segments and their overlapping L1 segments into a new L1 segment.
+// Tombstones are dropped if no segment below L1 overlaps the output.
+func (s L0CompactionStrategy) PlanCompaction(segments []SegmentRecord) (CompactionPlan, error) {
+	var inputs []SegmentRecord
+	var firstKey, lastKey []byte
+	for _, segment := range segments {
+		if segment.Level != 0 {
+			continue
+		}
+		inputs = append(inputs, segment)
+		if firstKey == nil || bytes.Compare(segment.Metadata.FirstKey, firstKey) < 0 {
+			firstKey = segment.Metadata.FirstKey
+		}
+		if bytes.Compare(segment.Metadata.LastKey, lastKey) > 0 {
+			lastKey = segment.Metadata.LastKey
+		}
+	}
+	if len(inputs) == 0 || len(inputs) < s.MinSegments {
+		return CompactionPlan{}, nil
+	}
+
+	overlaps := func(segment SegmentRecord) bool {
+		return bytes.Compare(segment.Metadata.FirstKey, lastKey) <= 0 && bytes.Compare(segment.Metadata.LastKey, firstKey) >= 0
+	}
+	dropTombstones := true
+	for _, segment := range segments {
+		if segment.Level == 1 && overlaps(segment) {
+			inputs = append(inputs, segment)
+		}
+		if segment.Level > 1 && overlaps(segment) {
+			dropTombstones = false
+		}
+	}
+
+	writerOptions := s.WriterOptions
+	if writerOptions.BloomFilter != nil {
+		metadata := make([]*sst.SegmentMetadata, len(inputs))
+		for i := range inputs {
+			metadata[i] = &inputs[i].Metadata
+		}
+		writerOptions.BloomFilter = sst.MergedBloomFilter(sst.DefaultBloomFilterFalsePositiveRate, metadata...)
+	}
+
+	return CompactionPlan{
+		Inputs:         inputs,
+		OutputID:       s.NewSegmentID(),
+		OutputLevel:    1,
+		WriterOptions:  writerOptions,
+		DropTombstones: dropTombstones,
+	}, nil
+}
+
+// Compact runs a compaction cycle: it plans a compaction from a snapshot of the segments with the strategy, merges
+// the inputs into an output segment written to the writer from writerFactory, then atomically drops the inputs and
+// adds the output with UpdateSegments. Rows are merged with the same semantics as reads, so reads are unchanged by
+// the compaction. The writer is closed once the output segment is written.
+//
+// Compactions should not run concurrently, as they may plan to compact the same segments. Reads can run
+// concurrently with a compaction. The input segment files are not deleted, as reads of an earlier snapshot may
+// still be using them.
+func (r *Reader) Compact(ctx context.Context, strategy CompactionStrategy, writerFactory func(id string) (io.WriteCloser, error)) (CompactionResult, error) {
+	var segments []SegmentRecord
+	r.indexMu.RLock()
+	r.segmentIDTree.Ascend(func(record SegmentRecord) bool {
+		segments = append(segments, record)
+		return true
+	})
+	r.indexMu.RUnlock()
+
+	plan, err := strategy.PlanCompaction(segments)
+	if err != nil {
+		return CompactionResult{}, fmt.Errorf("error in PlanCompaction: %w", err)
+	}
+	if len(plan.Inputs) == 0 {
+		return CompactionResult{}, nil
+	}
+
+	output, err := r.writeCompaction(ctx, plan, writerFactory)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+
+	result := CompactionResult{
+		Added:   output,
+		Dropped: plan.Inputs,
+	}
+	r.UpdateSegments(result.Added, result.Dropped)
+
+	return result, nil
+}
+
+// writeCompaction merges the inputs of the plan into the output segment, returning its record, or nothing if no rows
+// were written
+func (r *Reader) writeCompaction(ctx context.Context, plan CompactionPlan, writerFactory func(id string) (io.WriteCloser, error)) ([]SegmentRecord, error) {
+	inputs := slices.Clone(plan.Inputs)
+	sortSegmentsByPrecedence(inputs)
+
+	var opts []RangeOption
+	if !plan.DropTombstones {
+		opts = append(opts, IncludeTombstones())
+	}
+	iter, err := r.mergeSegments(ctx, inputs, nil, sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending, nil, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error in mergeSegments: %w", err)
+	}
+	defer iter.Close()
+
+	out := &lazyWriteCloser{
+		open: func() (io.WriteCloser, error) {
+			return writerFactory(plan.OutputID)
+		},
+	}
+	w := sst.NewSegmentWriter(out, plan.WriterOptions)
+	for {
+		if err := ctx.Err(); err != nil {
+			out.Close()
+			return nil, err
+		}
+
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return nil, fmt.Errorf("error in MergeIter.Next: %w", err)
+		}
+
+		err = w.WriteKVPair(row)
+		if err != nil {
+			out.Close()
+			return nil, fmt.Errorf("error writing row %x: %w", row.Key, err)
+		}
+	}
+
+	_, metaBytes, err := w.Close()
+	if errors.Is(err, sst.ErrNoRowsWritten) {
+		// every row was a dropped tombstone
+		return nil, nil
+	}
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("error in SegmentWriter.Close: %w", err)
+	}
+	err = out.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error closing output segment writer: %w", err)
+	}
+
+	metadata, err := (&sst.SegmentReader{}).BytesToMetadata(metaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in BytesToMetadata for output segment: %w", err)
+	}
+
+	return []SegmentRecord{{
+		ID:       plan.OutputID,
+		Level:    plan.OutputLevel,
+		Metadata: *metadata,
+	}}, nil
+}
+
+func (l *lazyWriteCloser) Write(p []byte) (int, error) {
+	if l.writer == nil {
+		writer, err := l.open()
+		if err != nil {
+			return 0, fmt.Errorf("error in writer factory: %w", err)
+		}
+		l.writer = writer
+	}
+	return l.writer.Write(p)
+}
+
+// Sync syncs the underlying writer if it is an sst.Syncer, see sst.SegmentWriterOptions.Sync
+func (l *lazyWriteCloser) Sync() error {
+	if syncer, ok := l.writer.(sst.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (l *lazyWriteCloser) Close() error {
+	if l.writer == nil {
+		return nil
+	}
+	return l.writer.Close()
+}
@@ -0,0 +1,164 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"io"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+
+	// each newer L0 segment updates and deletes some keys of the older ones
+	segments := map[string][]byte{}
+	var records []SegmentRecord
+	for i := 0; i < 4; i++ {
+		var rows []sst.KVPair
+		for j := i * 50; j < i*50+100; j++ {
+			rows = append(rows, sst.KVPair{Key: []byte(fmt.Sprintf("key%04d", j)), Value: []byte(fmt.Sprintf("value%d-%d", i, j))})
+		}
+		rows[0] = sst.NewTombstone(rows[0].Key)
+		segment := prepareTestSegment(t, fmt.Sprintf("0-%d", i), 0, opts, rows)
+		segments[segment.record.ID] = segment.bytes
+		records = append(records, segment.record)
+	}
+	// an L1 segment that only some of the L0 segments overlap
+	var rows []sst.KVPair
+	for j := 0; j < 400; j += 3 {
+		rows = append(rows, sst.KVPair{Key: []byte(fmt.Sprintf("key%04d", j)), Value: []byte(fmt.Sprintf("old%d", j))})
+	}
+	segment := prepareTestSegment(t, "1-0", 1, opts, rows)
+	segments[segment.record.ID] = segment.bytes
+	records = append(records, segment.record)
+
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		b, found := segments[record.ID]
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrSegmentGone, record.ID)
+		}
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(b)}, len(b))
+		return &reader, nil
+	})
+	snapReader.UpdateSegments(records, nil)
+
+	expected, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1000, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy := L0CompactionStrategy{
+		MinSegments: 2,
+		NewSegmentID: func() string {
+			return "1-1"
+		},
+		WriterOptions: opts,
+	}
+	writerFactory := func(id string) (io.WriteCloser, error) {
+		buf := &bytes.Buffer{}
+		segments[id] = nil
+		return writeCloserFunc{
+			Writer: buf,
+			close: func() error {
+				segments[id] = buf.Bytes()
+				return nil
+			},
+		}, nil
+	}
+	result, err := snapReader.Compact(context.Background(), strategy, writerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 1 || result.Added[0].Level != 1 || result.Added[0].ID != "1-1" {
+		t.Fatal("unexpected added segments", result.Added)
+	}
+	if len(result.Dropped) != len(records) {
+		t.Fatal("expected every segment to be dropped, got", len(result.Dropped))
+	}
+	if snapReader.segmentIDTree.Len() != 1 {
+		t.Fatal("expected a single segment, got", snapReader.segmentIDTree.Len())
+	}
+	// no lower level, so the tombstones are dropped
+	if result.Added[0].Metadata.TombstoneCount != 0 {
+		t.Fatal("expected tombstones to be dropped, got", result.Added[0].Metadata.TombstoneCount)
+	}
+
+	// the dropped segments are no longer read
+	for _, record := range result.Dropped {
+		delete(segments, record.ID)
+	}
+	actual, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1000, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatal("expected", len(expected), "rows, got", len(actual))
+	}
+	for i := range expected {
+		if !bytes.Equal(actual[i].Key, expected[i].Key) || !bytes.Equal(actual[i].Value, expected[i].Value) {
+			t.Fatal("unexpected row", string(actual[i].Key), string(actual[i].Value), "expected", string(expected[i].Key), string(expected[i].Value))
+		}
+	}
+	_, err = snapReader.GetRow([]byte("key0050"))
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected the deleted key to stay deleted, got", err)
+	}
+
+	// nothing left to compact
+	result, err = snapReader.Compact(context.Background(), strategy, writerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 || len(result.Dropped) != 0 {
+		t.Fatal("expected no compaction, got", result)
+	}
+}
+
+func TestCompactKeepsTombstones(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	l0 := prepareTestSegment(t, "0-0", 0, opts, []sst.KVPair{
+		sst.NewTombstone([]byte("key1")),
+		{Key: []byte("key2"), Value: []byte("new")},
+	})
+	l2 := prepareTestSegment(t, "2-0", 2, opts, []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("old")},
+		{Key: []byte("key2"), Value: []byte("old")},
+	})
+	snapReader := prepareTestSegmentReader(l0, l2)
+
+	var output *bytes.Buffer
+	_, err := snapReader.Compact(context.Background(), L0CompactionStrategy{
+		NewSegmentID: func() string {
+			return "1-0"
+		},
+		WriterOptions: opts,
+	}, func(id string) (io.WriteCloser, error) {
+		output = &bytes.Buffer{}
+		return sst.BytesWriteCloser{Buffer: output}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the L2 segment still holds the key, so the tombstone must shadow it
+	reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(output.Bytes())}, output.Len())
+	row, err := reader.GetRow([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !row.IsTombstone() {
+		t.Fatal("expected the tombstone to be kept, got", string(row.Value))
+	}
+}
+
+type writeCloserFunc struct {
+	io.Writer
+	close func() error
+}
+
+func (w writeCloserFunc) Close() error {
+	return w.close()
+}
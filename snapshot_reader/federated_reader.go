@@ -0,0 +1,91 @@
+package snapshot_reader
+
+import (
+	"context"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"strconv"
+)
+
+type (
+	// FederatedReader provides unified reads across multiple independent Readers (e.g. shards), merging their
+	// results with the same semantics as merging segments within a Reader.
+	//
+	// Readers are provided in priority order: when the same key exists in multiple readers with the same sequence
+	// number, the earlier reader wins.
+	FederatedReader struct {
+		readers []*Reader
+	}
+)
+
+func NewFederatedReader(readers ...*Reader) *FederatedReader {
+	return &FederatedReader{
+		readers: readers,
+	}
+}
+
+// GetRow will fetch a single row from across all readers, returning sst.ErrNoRows if not found.
+func (f *FederatedReader) GetRow(key []byte) ([]byte, error) {
+	var winner *sst.KVPair
+	for i, reader := range f.readers {
+		row, _, err := reader.getWinningRow(context.Background(), key)
+		if err != nil {
+			return nil, fmt.Errorf("error in getWinningRow for reader %d: %w", i, err)
+		}
+		if row == nil {
+			continue
+		}
+
+		if winner == nil || winsConflict(*row, *winner) {
+			winner = row
+		}
+	}
+
+	return winningValue(winner)
+}
+
+// GetRange will fetch a range of rows from across all readers up to a limit, see Reader.GetRange.
+func (f *FederatedReader) GetRange(start []byte, end []byte, limit, direction int, opts ...RangeOption) ([]sst.KVPair, bool, error) {
+	iter, err := f.MergeIter(start, end, direction, opts...)
+	if err != nil {
+		return nil, false, fmt.Errorf("error in MergeIter: %w", err)
+	}
+	defer iter.Close()
+
+	return collectRows(iter, limit)
+}
+
+// MergeIter creates a MergeIter that merges the MergeIter of each reader, see Reader.MergeIter.
+//
+// The MergeIter must be closed to close the underlying segment readers.
+func (f *FederatedReader) MergeIter(start, end []byte, direction int, opts ...RangeOption) (*MergeIter, error) {
+	m, err := newMergeIter(start, end, direction, len(f.readers), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// tombstones must be resolved in the final merge, as they may delete a row in another reader
+	readerOpts := append([]RangeOption{}, opts...)
+	readerOpts = append(readerOpts, IncludeTombstones())
+
+	for i, reader := range f.readers {
+		iter, err := reader.MergeIter(start, end, direction, readerOpts...)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("error in MergeIter for reader %d: %w", i, err)
+		}
+		m.sources[i] = rowSource{
+			name:  "reader " + strconv.Itoa(i),
+			next:  iter.Next,
+			close: iter.Close,
+		}
+
+		err = m.advance(i)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
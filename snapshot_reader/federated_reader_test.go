@@ -0,0 +1,113 @@
+package snapshot_reader
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestFederatedReader(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	readerA := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("a")},
+			{Key: []byte("key2"), Value: []byte("a")},
+			{Key: []byte("key3"), Value: []byte("a")},
+			{Key: []byte("key4"), Value: []byte("a")},
+			{Key: []byte("key5"), Value: []byte("a")},
+		}),
+	)
+	readerB := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key2"), Tombstone: true},
+			{Key: []byte("key4"), Value: []byte("b")},
+			{Key: []byte("key5"), Value: []byte("b")},
+		}),
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			{Key: []byte("key6"), Value: []byte("b")},
+			{Key: []byte("key7"), Value: []byte("b")},
+		}),
+	)
+	readerC := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("xkey1"), Value: []byte("c")},
+			{Key: []byte("xkey2"), Value: []byte("c")},
+		}),
+	)
+
+	// overlapping, B has priority
+	federated := NewFederatedReader(readerB, readerA)
+	expected := []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("a")},
+		{Key: []byte("key3"), Value: []byte("a")},
+		{Key: []byte("key4"), Value: []byte("b")},
+		{Key: []byte("key5"), Value: []byte("b")},
+		{Key: []byte("key6"), Value: []byte("b")},
+		{Key: []byte("key7"), Value: []byte("b")},
+	}
+
+	rows, _, err := federated.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(expected) {
+		logRows(t, rows)
+		t.Fatal("Got wrong rows length, got", len(rows))
+	}
+	for i, row := range rows {
+		if string(row.Key) != string(expected[i].Key) || string(row.Value) != string(expected[i].Value) {
+			logRows(t, rows)
+			t.Fatal("unexpected row at", i)
+		}
+	}
+
+	rows, _, err = federated.GetRange(sst.UnboundStart, sst.UnboundEnd, 3, sst.DirectionDescending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || string(rows[0].Key) != "key7" || string(rows[2].Key) != "key5" || string(rows[2].Value) != "b" {
+		logRows(t, rows)
+		t.Fatal("unexpected descending rows")
+	}
+
+	for _, row := range expected {
+		val, err := federated.GetRow(row.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != string(row.Value) {
+			t.Fatal("unexpected GetRow value for", string(row.Key), "got", string(val))
+		}
+	}
+
+	// deleted in B, which has priority over A
+	_, err = federated.GetRow([]byte("key2"))
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	_, err = federated.GetRow([]byte("key9"))
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+
+	// disjoint
+	federated = NewFederatedReader(readerA, readerC)
+	rows, _, err = federated.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 || string(rows[5].Key) != "xkey1" || string(rows[6].Key) != "xkey2" {
+		logRows(t, rows)
+		t.Fatal("unexpected disjoint rows")
+	}
+	val, err := federated.GetRow([]byte("xkey2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "c" {
+		t.Fatal("unexpected GetRow value", string(val))
+	}
+}
@@ -0,0 +1,62 @@
+package snapshot_reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"golang.org/x/sync/errgroup"
+	"sync"
+)
+
+// GetRowsConcurrent runs GetRowContext for each key with at most concurrency lookups at a time, such as for cache
+// warming with many scattered, independent keys. If concurrency <= 0, DefaultSetupConcurrency is used. The result is
+// keyed by string(key), and keys that do not exist are left out.
+//
+// Stops at the first error or when the context is cancelled, returning the rows found so far along with the error.
+//
+// Each lookup runs on its own snapshot of segments, so concurrent segment updates may be visible to some lookups
+// and not others.
+func (r *Reader) GetRowsConcurrent(ctx context.Context, keys [][]byte, concurrency int) (map[string][]byte, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultSetupConcurrency
+	}
+
+	rows := make(map[string][]byte, len(keys))
+	mu := &sync.Mutex{}
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	stopped := false
+	for _, key := range keys {
+		if gCtx.Err() != nil {
+			// don't queue more lookups after an error or cancellation
+			stopped = true
+			break
+		}
+		g.Go(func() error {
+			if err := gCtx.Err(); err != nil {
+				return err
+			}
+
+			value, err := r.GetRowContext(gCtx, key)
+			if errors.Is(err, sst.ErrNoRows) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error in GetRowContext for key %x: %w", key, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			rows[string(key)] = value
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err == nil && stopped {
+		// cancelled before any lookup saw it
+		err = ctx.Err()
+	}
+	return rows, err
+}
@@ -0,0 +1,102 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestGetRowsConcurrent(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	var older, newer []sst.KVPair
+	for i := 0; i < 200; i++ {
+		older = append(older, sst.KVPair{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte(fmt.Sprintf("old%d", i))})
+		if i%2 == 0 {
+			newer = append(newer, sst.KVPair{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte(fmt.Sprintf("new%d", i))})
+		}
+	}
+	newer[0] = sst.NewTombstone(newer[0].Key)
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, older),
+		prepareTestSegment(t, "2", 0, opts, newer),
+	)
+
+	var keys [][]byte
+	for i := 0; i < 220; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%04d", i)))
+	}
+	rows, err := snapReader.GetRowsConcurrent(context.Background(), keys, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the deleted key and the keys past the end are left out
+	if len(rows) != 199 {
+		t.Fatal("expected 199 rows, got", len(rows))
+	}
+	for _, key := range keys {
+		expected, err := snapReader.GetRow(key)
+		if errors.Is(err, sst.ErrNoRows) {
+			if _, found := rows[string(key)]; found {
+				t.Fatal("expected missing key", string(key), "to be left out")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rows[string(key)], expected) {
+			t.Fatal("unexpected value", string(rows[string(key)]), "for key", string(key))
+		}
+	}
+
+	// the concurrency is bounded
+	var inFlight, maxInFlight atomic.Int64
+	factory := snapReader.readerFactory
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			current := maxInFlight.Load()
+			if n <= current || maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		return factory(ctx, record)
+	}
+	_, err = snapReader.GetRowsConcurrent(context.Background(), keys, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxInFlight.Load() > 4 {
+		t.Fatal("expected at most 4 lookups at once, got", maxInFlight.Load())
+	}
+
+	// stops at the first error with partial results
+	injected := errors.New("injected")
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		if record.ID == "2" {
+			return nil, injected
+		}
+		return factory(ctx, record)
+	}
+	_, err = snapReader.GetRowsConcurrent(context.Background(), keys, 4)
+	if !errors.Is(err, injected) {
+		t.Fatal("expected injected error, got", err)
+	}
+
+	// respects cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rows, err = snapReader.GetRowsConcurrent(ctx, keys, 4)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if len(rows) != 0 {
+		t.Fatal("expected no rows after cancellation, got", len(rows))
+	}
+}
@@ -0,0 +1,105 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"sync"
+)
+
+type (
+	// MemorySegmentStore keeps segment files in memory by ID, such as for tests and small embedded datasets.
+	//
+	// Write segments with NewSegmentWriter, and use ReaderFactory as the SegmentReaderFactoryFunc of a Reader.
+	MemorySegmentStore struct {
+		segments map[string][]byte
+		mu       *sync.RWMutex
+	}
+
+	// MemorySegmentWriter writes a segment into a MemorySegmentStore, which is stored once closed
+	MemorySegmentWriter struct {
+		*sst.SegmentWriter
+		store  *MemorySegmentStore
+		buf    *bytes.Buffer
+		id     string
+		level  int
+		closed bool
+	}
+)
+
+func NewMemorySegmentStore() *MemorySegmentStore {
+	return &MemorySegmentStore{
+		segments: map[string][]byte{},
+		mu:       &sync.RWMutex{},
+	}
+}
+
+// NewSegmentWriter creates a writer for the segment with the ID and level. The segment is not readable until the
+// writer is closed.
+func (m *MemorySegmentStore) NewSegmentWriter(id string, level int, opts sst.SegmentWriterOptions) *MemorySegmentWriter {
+	buf := &bytes.Buffer{}
+	w := sst.NewSegmentWriter(sst.BytesWriteCloser{Buffer: buf}, opts)
+	return &MemorySegmentWriter{
+		SegmentWriter: &w,
+		store:         m,
+		buf:           buf,
+		id:            id,
+		level:         level,
+	}
+}
+
+// Close closes the segment writer and stores the segment, returning its SegmentRecord for Reader.UpdateSegments.
+func (w *MemorySegmentWriter) Close() (SegmentRecord, error) {
+	if w.closed {
+		return SegmentRecord{}, fmt.Errorf("segment %s already closed", w.id)
+	}
+	w.closed = true
+
+	_, metaBytes, err := w.SegmentWriter.Close()
+	if err != nil {
+		return SegmentRecord{}, fmt.Errorf("error in SegmentWriter.Close: %w", err)
+	}
+
+	metadata, err := (&sst.SegmentReader{}).BytesToMetadata(metaBytes)
+	if err != nil {
+		return SegmentRecord{}, fmt.Errorf("error in BytesToMetadata: %w", err)
+	}
+
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.segments[w.id] = w.buf.Bytes()
+
+	return SegmentRecord{
+		ID:       w.id,
+		Level:    w.level,
+		Metadata: *metadata,
+	}, nil
+}
+
+// ReaderFactory is a SegmentReaderFactoryFunc reading segments from the store. Segments that are not in the store
+// return ErrSegmentGone.
+func (m *MemorySegmentStore) ReaderFactory(record SegmentRecord) (*sst.SegmentReader, error) {
+	m.mu.RLock()
+	b, found := m.segments[record.ID]
+	m.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("segment %s not in memory store: %w", record.ID, ErrSegmentGone)
+	}
+
+	reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(b)}, len(b))
+	return &reader, nil
+}
+
+// Delete removes the segment from the store, such as after compaction drops it from the Reader
+func (m *MemorySegmentStore) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.segments, id)
+}
+
+// Len returns the number of segments in the store
+func (m *MemorySegmentStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.segments)
+}
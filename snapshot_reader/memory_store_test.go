@@ -0,0 +1,82 @@
+package snapshot_reader
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestMemorySegmentStore(t *testing.T) {
+	store := NewMemorySegmentStore()
+	opts := sst.DefaultSegmentWriterOptions()
+
+	// each segment overwrites the keys divisible by its number
+	var records []SegmentRecord
+	for s := 1; s <= 3; s++ {
+		w := store.NewSegmentWriter(fmt.Sprintf("%d", s), 0, opts)
+		for i := 0; i < 100; i++ {
+			if i%s != 0 {
+				continue
+			}
+			err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", s)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		record, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Metadata.FirstKey) != "key000" || record.Metadata.RowCount == 0 {
+			t.Fatal("unexpected record metadata", string(record.Metadata.FirstKey), record.Metadata.RowCount)
+		}
+		_, err = w.Close()
+		if err == nil {
+			t.Fatal("expected an error closing twice")
+		}
+		records = append(records, record)
+	}
+	if store.Len() != 3 {
+		t.Fatal("expected 3 segments, got", store.Len())
+	}
+
+	reader := NewReader(store.ReaderFactory)
+	reader.UpdateSegments(records, nil)
+
+	rows, _, err := reader.GetRange([]byte("key000"), []byte("key100"), 1000, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 100 {
+		t.Fatal("expected 100 rows, got", len(rows))
+	}
+	for i, row := range rows {
+		expected := "value1"
+		if i%3 == 0 {
+			expected = "value3"
+		} else if i%2 == 0 {
+			expected = "value2"
+		}
+		if string(row.Value) != expected {
+			t.Fatal("expected", expected, "got", string(row.Value), "for", string(row.Key))
+		}
+	}
+
+	// drop the newest segment like compaction would
+	reader.UpdateSegments(nil, records[2:])
+	store.Delete(records[2].ID)
+	val, err := reader.GetRow([]byte("key006"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value2" {
+		t.Fatal("expected value2, got", string(val))
+	}
+
+	_, err = store.ReaderFactory(records[2])
+	if !errors.Is(err, ErrSegmentGone) {
+		t.Fatal("expected ErrSegmentGone, got", err)
+	}
+}
@@ -0,0 +1,485 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"golang.org/x/sync/errgroup"
+	"io"
+)
+
+type (
+	// MergeIter streams the merged rows of all segments in a range, only returning the winning version of each key.
+	// Tombstones are removed, so each live key appears once, unless IncludeTombstones is used.
+	MergeIter struct {
+		sources   []rowSource
+		cursors   []sst.KVPair
+		exhausted []bool
+		start     []byte
+		end       []byte
+		direction int
+		options   rangeOptions
+		done      bool
+		// overlay indicates that the first source is an Overlay, which wins regardless of sequence number
+		overlay bool
+		// heap holds the unexhausted sources by their cursor, built on the first Next once every source is set up
+		heap *mergeIterHeap
+		// nextIndexes is reused by Next for the sources on the next key
+		nextIndexes []int
+	}
+
+	// mergeIterHeap orders the indexes of MergeIter sources by their cursor key in the direction of iteration, then
+	// by index, so the source with the highest precedence comes first for the same key
+	mergeIterHeap struct {
+		indexes   []int
+		cursors   []sst.KVPair
+		direction int
+	}
+
+	// rowSource is a sorted source of rows for a MergeIter, such as a segment or another MergeIter
+	rowSource struct {
+		name  string
+		next  func() (sst.KVPair, error)
+		close func() error
+		// skipPast optionally seeks the source past all keys under the prefix in the direction of iteration. If nil,
+		// rows under the prefix are skipped one at a time.
+		skipPast func(prefix []byte) error
+	}
+)
+
+// newMergeIter validates the range, and creates a MergeIter with room for the number of sources
+func newMergeIter(start, end []byte, direction int, numSources int, opts []RangeOption) (*MergeIter, error) {
+	options := applyRangeOptions(opts)
+
+	if cmp := bytes.Compare(start, end); cmp > 0 || (cmp == 0 && !options.endInclusive) {
+		return nil, fmt.Errorf("%w: end must be strictly greater than start", ErrInvalidRange)
+	}
+
+	return &MergeIter{
+		sources:   make([]rowSource, numSources),
+		cursors:   make([]sst.KVPair, numSources),
+		exhausted: make([]bool, numSources),
+		start:     start,
+		end:       end,
+		direction: direction,
+		options:   options,
+	}, nil
+}
+
+// MergeIter creates a new MergeIter over the range [start, end) when sst.DirectionAscending, and (start, end] when
+// sst.DirectionDescending, the same as GetRange.
+//
+// Runs on a snapshot of segments when invoked, can run concurrently with segment updates. Segments that are dropped
+// before their reader is created are left out, see ErrSegmentGone. The MergeIter must be closed to close the
+// underlying segment readers.
+//
+// See sst.UnboundStart and sst.UnboundEnd helper vars, and RangeOption
+func (r *Reader) MergeIter(start, end []byte, direction int, opts ...RangeOption) (*MergeIter, error) {
+	return r.mergeIter(context.Background(), start, end, direction, nil, opts)
+}
+
+// MergeIterContext is like MergeIter, but passes the context to the SegmentReaderFactoryFuncCtx. The context should
+// outlive the MergeIter, as the segment readers are used until it is closed.
+func (r *Reader) MergeIterContext(ctx context.Context, start, end []byte, direction int, opts ...RangeOption) (*MergeIter, error) {
+	return r.mergeIter(ctx, start, end, direction, nil, opts)
+}
+
+// mergeIter creates a MergeIter, taking segment readers from readers if not nil. Readers from the cache are left
+// open when the MergeIter is closed, so they can be reused by the next page of an Iter.
+func (r *Reader) mergeIter(ctx context.Context, start, end []byte, direction int, readers *segmentReaderCache, opts []RangeOption) (*MergeIter, error) {
+	possibleSegments := r.getPossibleSegmentsForRange(start, end)
+	sortSegmentsByPrecedence(possibleSegments)
+	overlay := r.getOverlay()
+
+	if skip := applyRangeOptions(opts).skip; skip > 0 {
+		var exhausted bool
+		var err error
+		start, end, exhausted, err = r.skipRows(ctx, possibleSegments, overlay, start, end, direction, skip, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error in skipRows: %w", err)
+		}
+		if exhausted {
+			// nothing left after the skip
+			return newMergeIter(start, end, direction, 0, opts)
+		}
+	}
+
+	return r.mergeSegments(ctx, possibleSegments, overlay, start, end, direction, readers, opts)
+}
+
+// skipRows discards the first skip rows of the range with a keys only MergeIter, returning the range starting at
+// the first row after them, or exhausted if there are none.
+func (r *Reader) skipRows(ctx context.Context, segments []SegmentRecord, overlay Overlay, start, end []byte, direction, skip int, opts []RangeOption) ([]byte, []byte, bool, error) {
+	opts = append(opts[:len(opts):len(opts)], func(options *rangeOptions) {
+		options.skip = 0
+		options.keysOnly = true
+	})
+	iter, err := r.mergeSegments(ctx, segments, overlay, start, end, direction, nil, opts)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("error in mergeSegments: %w", err)
+	}
+	defer iter.Close()
+
+	for i := 0; i < skip; i++ {
+		_, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return start, end, true, nil
+		}
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("error in MergeIter.Next: %w", err)
+		}
+	}
+
+	// the first row after the skip, which the range now starts at
+	row, err := iter.Next()
+	if errors.Is(err, io.EOF) {
+		return start, end, true, nil
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("error in MergeIter.Next: %w", err)
+	}
+	if direction == sst.DirectionDescending {
+		return start, bytes.Clone(row.Key), false, nil
+	}
+	return bytes.Clone(row.Key), end, false, nil
+}
+
+// mergeSegments creates a MergeIter over the segments, which must be sorted with sortSegmentsByPrecedence, and the
+// overlay if not nil.
+func (r *Reader) mergeSegments(ctx context.Context, possibleSegments []SegmentRecord, overlay Overlay, start, end []byte, direction int, readers *segmentReaderCache, opts []RangeOption) (*MergeIter, error) {
+	numSources := len(possibleSegments)
+	if overlay != nil {
+		numSources++
+	}
+
+	m, err := newMergeIter(start, end, direction, numSources, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentIndexOffset := 0
+	if overlay != nil {
+		m.overlay = true
+		segmentIndexOffset = 1
+		iter, err := overlay.RangeIter(start, end, direction)
+		if err != nil {
+			return nil, fmt.Errorf("error in overlay.RangeIter: %w", err)
+		}
+		m.sources[0] = rowSource{
+			name:  "overlay",
+			next:  iter.Next,
+			close: iter.Close,
+		}
+		err = m.advance(0)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	startRange := start // what to seek to
+	if direction == sst.DirectionDescending {
+		startRange = end
+	}
+
+	// open every segment and load its metadata up front, so the merge starts with all metadata resident
+	iters := make([]*sst.RowIter, len(possibleSegments))
+	g := errgroup.Group{}
+	g.SetLimit(r.setupConcurrency())
+	for segmentIndex, segment := range possibleSegments {
+		i := segmentIndex + segmentIndexOffset
+		g.Go(func() error {
+			var reader *sst.SegmentReader
+			var err error
+			if readers != nil {
+				reader, err = readers.get(segment, func(segment SegmentRecord) (*sst.SegmentReader, error) {
+					return r.openSegment(ctx, segment)
+				})
+			} else {
+				reader, err = r.openSegment(ctx, segment)
+			}
+			if errors.Is(err, ErrSegmentGone) {
+				// dropped since we took our snapshot, leave it out of the merge
+				m.exhausted[i] = true
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error in r.readerFactor for segment %s: %w", segment.ID, err)
+			}
+
+			// loads the metadata if the reader doesn't have it
+			iter, err := reader.RowIter(direction)
+			if err != nil {
+				if readers == nil {
+					// not a source yet, so MergeIter.Close won't close it
+					reader.Close()
+				}
+				return fmt.Errorf("error in reader.RowIter for segment %s: %w", segment.ID, err)
+			}
+			if m.options.keysOnly {
+				iter.KeysOnly()
+			}
+			m.sources[i] = rowSource{
+				name: "segment " + segment.ID,
+				next: iter.Next,
+				skipPast: func(prefix []byte) error {
+					return seekPastPrefix(iter, prefix, direction)
+				},
+			}
+			if readers == nil {
+				m.sources[i].close = iter.CloseReader
+			}
+			iters[segmentIndex] = iter
+			return nil
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("error loading segment metadata: %w", err)
+	}
+
+	// then read the first block of each segment
+	g = errgroup.Group{}
+	g.SetLimit(r.setupConcurrency())
+	for segmentIndex, segment := range possibleSegments {
+		i := segmentIndex + segmentIndexOffset
+		iter := iters[segmentIndex]
+		if iter == nil {
+			// segment gone
+			continue
+		}
+		g.Go(func() error {
+			err := iter.Seek(startRange)
+			if err != nil {
+				return fmt.Errorf("error in iter.Seek to start range for segment %s: %w", segment.ID, err)
+			}
+
+			return m.advance(i)
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("error setting up segment iterators: %w", err)
+	}
+
+	return m, nil
+}
+
+// ExportIter creates a MergeIter over the entire key space of the snapshot, useful for exporting a consistent dump.
+func (r *Reader) ExportIter(direction int) (*MergeIter, error) {
+	return r.MergeIter(sst.UnboundStart, sst.UnboundEnd, direction)
+}
+
+func (h *mergeIterHeap) Len() int {
+	return len(h.indexes)
+}
+
+func (h *mergeIterHeap) Less(i, j int) bool {
+	if cmp := firstValue(h.cursors[h.indexes[i]].Key, h.cursors[h.indexes[j]].Key, h.direction); cmp != 0 {
+		return cmp > 0
+	}
+	return h.indexes[i] < h.indexes[j]
+}
+
+func (h *mergeIterHeap) Swap(i, j int) {
+	h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i]
+}
+
+func (h *mergeIterHeap) Push(x any) {
+	h.indexes = append(h.indexes, x.(int))
+}
+
+func (h *mergeIterHeap) Pop() any {
+	index := h.indexes[len(h.indexes)-1]
+	h.indexes = h.indexes[:len(h.indexes)-1]
+	return index
+}
+
+// initHeap (re)builds the heap from every unexhausted source
+func (m *MergeIter) initHeap() {
+	if m.heap == nil {
+		m.heap = &mergeIterHeap{cursors: m.cursors, direction: m.direction}
+	}
+	m.heap.indexes = m.heap.indexes[:0]
+	for i := range m.sources {
+		if !m.exhausted[i] {
+			m.heap.indexes = append(m.heap.indexes, i)
+		}
+	}
+	heap.Init(m.heap)
+}
+
+// advance loads the next row for the source at index i into its cursor
+func (m *MergeIter) advance(i int) error {
+	pair, err := m.sources[i].next()
+	if errors.Is(err, io.EOF) {
+		m.exhausted[i] = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error in next for %s: %w", m.sources[i].name, err)
+	}
+
+	m.cursors[i] = pair
+	return nil
+}
+
+// inRange returns whether the key is within the bounds of the iterator, only checking the bound in the direction
+// of iteration, as the seek handles the other.
+func (m *MergeIter) inRange(key []byte) bool {
+	if m.direction == sst.DirectionDescending {
+		cmp := bytes.Compare(key, m.start)
+		return cmp > 0 || (cmp == 0 && m.options.endInclusive)
+	}
+
+	if bytes.Equal(m.end, sst.UnboundEnd) {
+		return true
+	}
+	cmp := bytes.Compare(key, m.end)
+	return cmp < 0 || (cmp == 0 && m.options.endInclusive)
+}
+
+// skippedPrefix returns the prefix of the key from the SkipPrefixes option, or nil if it is not skipped
+func (m *MergeIter) skippedPrefix(key []byte) []byte {
+	for _, prefix := range m.options.skipPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+	return nil
+}
+
+// skipPrefix moves every source with a cursor under the prefix past it
+func (m *MergeIter) skipPrefix(prefix []byte) error {
+	for i, source := range m.sources {
+		if m.exhausted[i] || !bytes.HasPrefix(m.cursors[i].Key, prefix) {
+			continue
+		}
+
+		if source.skipPast != nil {
+			err := source.skipPast(prefix)
+			if err != nil {
+				return fmt.Errorf("error in skipPast for %s: %w", source.name, err)
+			}
+			err = m.advance(i)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for !m.exhausted[i] && bytes.HasPrefix(m.cursors[i].Key, prefix) {
+			err := m.advance(i)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// seekPastPrefix seeks the iterator such that the next row is past all keys under the prefix in the direction
+func seekPastPrefix(iter *sst.RowIter, prefix []byte, direction int) error {
+	if direction == sst.DirectionDescending {
+		// every key under the prefix sorts at or after the prefix
+		return iter.SeekPast(prefix)
+	}
+
+	end := prefixEnd(prefix)
+	if end == nil {
+		// nothing sorts after the prefix, seek to the end
+		return iter.Seek(sst.UnboundEnd)
+	}
+	return iter.Seek(end)
+}
+
+// Next returns the next live row, returning io.EOF when there are no more rows.
+//
+// The sources are merged with a heap, so each row costs O(log n) for n sources.
+func (m *MergeIter) Next() (sst.KVPair, error) {
+	if m.heap == nil {
+		m.initHeap()
+	}
+	for !m.done {
+		if m.heap.Len() == 0 {
+			m.done = true
+			break
+		}
+
+		// pop the sources with the next key in our direction, in order of precedence
+		nextIndexes := m.nextIndexes[:0]
+		key := m.cursors[m.heap.indexes[0]].Key
+		for m.heap.Len() > 0 && bytes.Equal(m.cursors[m.heap.indexes[0]].Key, key) {
+			nextIndexes = append(nextIndexes, heap.Pop(m.heap).(int))
+		}
+		m.nextIndexes = nextIndexes
+
+		var row sst.KVPair
+		if m.overlay && nextIndexes[0] == 0 {
+			// the overlay shadows all segments
+			row = m.cursors[0]
+		} else {
+			row = m.cursors[winningIndex(m.cursors, nextIndexes)]
+		}
+		if !m.inRange(row.Key) {
+			m.done = true
+			break
+		}
+
+		if prefix := m.skippedPrefix(row.Key); prefix != nil {
+			err := m.skipPrefix(prefix)
+			if err != nil {
+				return sst.KVPair{}, err
+			}
+			// any source may have moved
+			m.initHeap()
+			continue
+		}
+
+		// roll forward all matching cursors
+		for _, ind := range nextIndexes {
+			err := m.advance(ind)
+			if err != nil {
+				return sst.KVPair{}, err
+			}
+			if !m.exhausted[ind] {
+				heap.Push(m.heap, ind)
+			}
+		}
+
+		if row.IsTombstone() && !m.options.includeTombstones {
+			// this row is deleted
+			continue
+		}
+
+		if m.options.keyFilter != nil && !m.options.keyFilter(row.Key) {
+			continue
+		}
+
+		return row, nil
+	}
+
+	return sst.KVPair{}, io.EOF
+}
+
+// Close closes all underlying segment readers
+func (m *MergeIter) Close() error {
+	var errs []error
+	for _, source := range m.sources {
+		if source.close == nil {
+			continue
+		}
+		err := source.close()
+		if err != nil && !errors.Is(err, sst.ErrAlreadyClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
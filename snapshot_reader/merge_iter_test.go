@@ -0,0 +1,541 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestExportIter(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// add a newer L0 segment with a tombstone
+	tombstoneSeg := &bytes.Buffer{}
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := sst.NewSegmentWriter(
+		sst.BytesWriteCloser{
+			Buffer: tombstoneSeg,
+		}, opts)
+	err := w.WriteTombstone([]byte("key050"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstoneSegLength, tombstoneSegMetaBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstoneSegMeta, err := (&sst.SegmentReader{}).BytesToMetadata(tombstoneSegMetaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerFactory := snapReader.readerFactory
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		if record.ID == "3-0" {
+			reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{
+				Reader: bytes.NewReader(tombstoneSeg.Bytes()),
+			}, int(tombstoneSegLength))
+			return &reader, nil
+		}
+		return readerFactory(ctx, record)
+	}
+	snapReader.UpdateSegments([]SegmentRecord{
+		{
+			ID:       "3-0",
+			Level:    0,
+			Metadata: *tombstoneSegMeta,
+		},
+	}, nil)
+
+	// every live key and its winning value
+	expected := map[string]string{
+		"key0010": "value0010",
+		"key900":  "value900",
+	}
+	for i := 0; i < 200; i++ {
+		expected[fmt.Sprintf("key%03d", i)] = fmt.Sprintf("value%03d", i)
+	}
+	delete(expected, "key050")
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		iter, err := snapReader.ExportIter(direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rows []sst.KVPair
+		seen := map[string]bool{}
+		for {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[string(row.Key)] {
+				t.Fatal("key appeared more than once:", string(row.Key))
+			}
+			seen[string(row.Key)] = true
+			if expectedValue, found := expected[string(row.Key)]; !found {
+				t.Fatal("unexpected key:", string(row.Key))
+			} else if expectedValue != string(row.Value) {
+				t.Fatal("unexpected value for key", string(row.Key), "got", string(row.Value))
+			}
+			rows = append(rows, row)
+		}
+
+		err = iter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rows) != len(expected) {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+		if !isSliceInOrder(rows, func(a sst.KVPair, b sst.KVPair) bool {
+			if direction == sst.DirectionDescending {
+				return bytes.Compare(a.Key, b.Key) > 0
+			}
+			return bytes.Compare(a.Key, b.Key) < 0
+		}) {
+			logRows(t, rows)
+			t.Fatal("rows were not in expected order")
+		}
+	}
+}
+
+func TestGetRangeConcurrentDrop(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	kept := prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("a")},
+		{Key: []byte("key3"), Value: []byte("a")},
+	})
+	dropped := prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+		{Key: []byte("key2"), Value: []byte("b")},
+		{Key: []byte("key4"), Value: []byte("b")},
+	})
+
+	// segment files are deleted after they are dropped from the reader
+	var mu sync.Mutex
+	segmentBytes := map[string][]byte{
+		kept.record.ID:    kept.bytes,
+		dropped.record.ID: dropped.bytes,
+	}
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		b, found := segmentBytes[record.ID]
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrSegmentGone, record.ID)
+		}
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{
+			Reader: bytes.NewReader(b),
+		}, len(b))
+		return &reader, nil
+	})
+
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		segmentBytes[dropped.record.ID] = dropped.bytes
+		mu.Unlock()
+		snapReader.UpdateSegments([]SegmentRecord{kept.record, dropped.record}, nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			snapReader.UpdateSegments(nil, []SegmentRecord{dropped.record})
+			mu.Lock()
+			delete(segmentBytes, dropped.record.ID)
+			mu.Unlock()
+		}()
+
+		rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+		<-done
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// either the dropped segment was included, or it was not
+		var keys []string
+		for _, row := range rows {
+			keys = append(keys, string(row.Key))
+		}
+		switch fmt.Sprint(keys) {
+		case "[key1 key2 key3 key4]", "[key1 key3]":
+		default:
+			t.Fatal("unexpected rows", keys)
+		}
+	}
+}
+
+func TestMergeIterSeekedState(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	// multiple blocks per segment, so a stale copy of the iterator from before the seek would return rows from
+	// the wrong block
+	var rowsA, rowsB []sst.KVPair
+	for i := 0; i < 1000; i++ {
+		row := sst.KVPair{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte(fmt.Sprintf("value%04d", i))}
+		if i%2 == 0 {
+			rowsA = append(rowsA, row)
+		} else {
+			rowsB = append(rowsB, row)
+		}
+	}
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, rowsA),
+		prepareTestSegment(t, "2", 0, opts, rowsB),
+	)
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		rows, _, err := snapReader.GetRange([]byte("key0500"), []byte("key0700"), 10, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := 500
+		step := 1
+		if direction == sst.DirectionDescending {
+			first = 700
+			step = -1
+		}
+		if len(rows) != 10 {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+		for i, row := range rows {
+			if expected := fmt.Sprintf("key%04d", first+i*step); string(row.Key) != expected {
+				logRows(t, rows)
+				t.Fatal("unexpected row at", i, "expected", expected)
+			}
+		}
+	}
+}
+
+// offsetTrackingReader records the offset of every Read
+type offsetTrackingReader struct {
+	sst.BytesReadSeekCloser
+	mu      *sync.Mutex
+	offsets map[int64]bool
+}
+
+func (o offsetTrackingReader) Read(p []byte) (int, error) {
+	offset, err := o.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	o.mu.Lock()
+	o.offsets[offset] = true
+	o.mu.Unlock()
+	return o.BytesReadSeekCloser.Read(p)
+}
+
+func TestSkipPrefixes(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	var rows []sst.KVPair
+	for _, prefix := range []string{"a/", "skip/", "z/"} {
+		count := 100
+		if prefix == "skip/" {
+			count = 1000
+		}
+		for i := 0; i < count; i++ {
+			rows = append(rows, sst.KVPair{
+				Key:   []byte(fmt.Sprintf("%s%04d", prefix, i)),
+				Value: bytes.Repeat([]byte("v"), 100),
+			})
+		}
+	}
+	older := prepareTestSegment(t, "1", 1, opts, rows)
+	newer := prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+		{Key: []byte("a/0001"), Value: []byte("new")},
+		{Key: []byte("skip/0005"), Value: []byte("new")},
+		{Key: []byte("z/0002"), Tombstone: true},
+	})
+
+	mu := &sync.Mutex{}
+	offsets := map[int64]bool{}
+	snapReader := prepareTestSegmentReader(older, newer)
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		b := older.bytes
+		if record.ID == newer.record.ID {
+			b = newer.bytes
+		}
+		reader := sst.NewSegmentReader(offsetTrackingReader{
+			BytesReadSeekCloser: sst.BytesReadSeekCloser{Reader: bytes.NewReader(b)},
+			mu:                  mu,
+			offsets:             offsets,
+		}, len(b))
+		return &reader, nil
+	}
+
+	// blocks of the older segment that only hold skipped keys
+	var skippedBlocks []sst.BlockStat
+	var prev *sst.BlockStat
+	older.record.Metadata.BlockIndex.Ascend(func(item sst.BlockStat) bool {
+		if prev != nil && bytes.HasPrefix(prev.FirstKey, []byte("skip/")) && bytes.HasPrefix(item.FirstKey, []byte("skip/")) {
+			skippedBlocks = append(skippedBlocks, *prev)
+		}
+		prev = &item
+		return true
+	})
+	if len(skippedBlocks) < 2 {
+		t.Fatal("expected the skipped prefix to span multiple blocks, got", len(skippedBlocks))
+	}
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		clear(offsets)
+		got, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 10_000, direction, SkipPrefixes([]byte("skip/")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 199 {
+			t.Fatal("unexpected number of rows", len(got))
+		}
+		for i, row := range got {
+			if bytes.HasPrefix(row.Key, []byte("skip/")) || string(row.Key) == "z/0002" {
+				t.Fatal("unexpected row", string(row.Key))
+			}
+			if string(row.Key) == "a/0001" && string(row.Value) != "new" {
+				t.Fatal("unexpected value", string(row.Value))
+			}
+			if i > 0 && firstValue(row.Key, got[i-1].Key, direction) >= 0 {
+				t.Fatal("rows out of order at", i)
+			}
+		}
+		for _, stat := range skippedBlocks {
+			if offsets[int64(stat.Offset)] {
+				t.Fatal("read skipped block", string(stat.FirstKey), "direction", direction)
+			}
+		}
+	}
+
+	// skipping the end of the key space, and a prefix that doesn't exist
+	got, _, err := snapReader.GetRange([]byte("a/0098"), sst.UnboundEnd, 100, sst.DirectionAscending, SkipPrefixes([]byte("skip/"), []byte("z/"), []byte("b/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[0].Key) != "a/0098" || string(got[1].Key) != "a/0099" {
+		logRows(t, got)
+		t.Fatal("unexpected rows")
+	}
+}
+
+// slowTrailerReader counts how many segment trailers are being read at once, holding each read open for a while
+type slowTrailerReader struct {
+	*bytes.Reader
+	inFlight    *atomic.Int64
+	maxInFlight *atomic.Int64
+}
+
+func (r slowTrailerReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		n := r.inFlight.Add(1)
+		for {
+			current := r.maxInFlight.Load()
+			if n <= current || r.maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		r.inFlight.Add(-1)
+	}
+	return r.Reader.Seek(offset, whence)
+}
+
+func (r slowTrailerReader) Close() error {
+	return nil
+}
+
+func TestMergeIterPrefetchMetadata(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	segmentBytes := map[string][]byte{}
+	var records []SegmentRecord
+	for s := 0; s < 16; s++ {
+		segment := prepareTestSegment(t, fmt.Sprintf("%02d", s), 0, opts, []sst.KVPair{
+			{Key: []byte(fmt.Sprintf("key%02d", s)), Value: []byte("value")},
+		})
+		segmentBytes[segment.record.ID] = segment.bytes
+		records = append(records, segment.record)
+	}
+
+	var inFlight, maxInFlight atomic.Int64
+	readerOpts := DefaultReaderOptions()
+	readerOpts.SetupConcurrency = 4
+	snapReader := NewReaderWithOptions(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		b := segmentBytes[record.ID]
+		reader := sst.NewSegmentReader(slowTrailerReader{
+			Reader:      bytes.NewReader(b),
+			inFlight:    &inFlight,
+			maxInFlight: &maxInFlight,
+		}, len(b))
+		return &reader, nil
+	}, readerOpts)
+	snapReader.UpdateSegments(records, nil)
+
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 16 {
+		t.Fatal("expected 16 rows, got", len(rows))
+	}
+
+	// the metadata loads overlap, up to the setup concurrency
+	if maxInFlight.Load() < 2 || maxInFlight.Load() > 4 {
+		t.Fatal("expected between 2 and 4 concurrent metadata loads, got", maxInFlight.Load())
+	}
+}
+
+// closeCountingReader counts the closes of segment readers
+type closeCountingReader struct {
+	sst.BytesReadSeekCloser
+	closes *atomic.Int64
+}
+
+func (c closeCountingReader) Close() error {
+	c.closes.Add(1)
+	return nil
+}
+
+func TestMergeIterClosesReaderOnError(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	segment := prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("value1")},
+	})
+	corrupt := prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+		{Key: []byte("key2"), Value: []byte("value2")},
+	})
+	// truncate the trailer so the metadata can't be loaded
+	corrupt.bytes = corrupt.bytes[:len(corrupt.bytes)-10]
+
+	var opened, closes atomic.Int64
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		b := segment.bytes
+		if record.ID == corrupt.record.ID {
+			b = corrupt.bytes
+		}
+		opened.Add(1)
+		reader := sst.NewSegmentReader(closeCountingReader{sst.BytesReadSeekCloser{Reader: bytes.NewReader(b)}, &closes}, len(b))
+		return &reader, nil
+	})
+	snapReader.UpdateSegments([]SegmentRecord{segment.record, corrupt.record}, nil)
+
+	_, err := snapReader.MergeIter(sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending)
+	if err == nil {
+		t.Fatal("expected an error for the corrupt segment")
+	}
+	if opened.Load() != 2 || closes.Load() != 2 {
+		t.Fatal("expected both readers to be closed, opened", opened.Load(), "closed", closes.Load())
+	}
+
+	// point reads close every reader they open
+	opened.Store(0)
+	closes.Store(0)
+	_, err = snapReader.GetRow([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closes.Load() != opened.Load() {
+		t.Fatal("expected every reader to be closed, opened", opened.Load(), "closed", closes.Load())
+	}
+}
+
+func TestMergeIterHeapPrecedence(t *testing.T) {
+	// many overlapping sources, where the highest sequence number wins a key, then the earliest source
+	const numSources = 20
+	sources := make([][]sst.KVPair, numSources)
+	for i := range sources {
+		for key := i % 3; key < 100; key += 1 + i%4 {
+			sources[i] = append(sources[i], sst.KVPair{
+				Key:   []byte(fmt.Sprintf("key%03d", key)),
+				Value: []byte(fmt.Sprintf("source%02d", i)),
+				Seq:   uint64((key * (i + 7)) % 5),
+			})
+		}
+	}
+
+	expected := map[string]sst.KVPair{}
+	var expectedKeys []string
+	for _, rows := range sources {
+		for _, row := range rows {
+			winner, found := expected[string(row.Key)]
+			if !found {
+				expectedKeys = append(expectedKeys, string(row.Key))
+			}
+			if !found || row.Seq > winner.Seq {
+				expected[string(row.Key)] = row
+			}
+		}
+	}
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		m, err := newMergeIter(sst.UnboundStart, sst.UnboundEnd, direction, numSources, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rows := range sources {
+			rows := slices.Clone(rows)
+			if direction == sst.DirectionDescending {
+				slices.Reverse(rows)
+			}
+			m.sources[i] = rowSource{
+				name: fmt.Sprintf("source %d", i),
+				next: func() (sst.KVPair, error) {
+					if len(rows) == 0 {
+						return sst.KVPair{}, io.EOF
+					}
+					row := rows[0]
+					rows = rows[1:]
+					return row, nil
+				},
+			}
+			err = m.advance(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got []string
+		for {
+			row, err := m.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			winner := expected[string(row.Key)]
+			if !bytes.Equal(row.Value, winner.Value) {
+				t.Fatal("expected", string(winner.Value), "to win", string(row.Key), "got", string(row.Value))
+			}
+			got = append(got, string(row.Key))
+		}
+		if len(got) != len(expectedKeys) {
+			t.Fatal("expected", len(expectedKeys), "keys, got", len(got))
+		}
+		if !slices.IsSortedFunc(got, func(a, b string) int {
+			return firstValue([]byte(b), []byte(a), direction)
+		}) {
+			t.Fatal("expected keys in order for direction", direction)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package snapshot_reader
+
+import "github.com/danthegoodman1/objectkv/sst"
+
+type (
+	// Overlay is an in-memory layer of recent writes, such as a memtable that has not been flushed to a segment yet.
+	// When set with Reader.SetOverlay, it is consulted at the highest precedence (above L0) in reads, so its rows and
+	// tombstones shadow the segments regardless of sequence number.
+	//
+	// Rows with sst.KVPair.Tombstone set are tombstones (see sst.NewTombstone), rows with an empty value are live.
+	// Must be safe for concurrent use.
+	Overlay interface {
+		// GetRow returns the row for a key, with found false if the overlay does not have the key.
+		GetRow(key []byte) (row sst.KVPair, found bool, err error)
+		// RangeIter returns the rows of the overlay, including tombstones, starting from start (inclusive) when
+		// sst.DirectionAscending, and from end (inclusive) when sst.DirectionDescending. Reads stop at the other
+		// bound of the range, so the iterator does not need to check it.
+		RangeIter(start, end []byte, direction int) (OverlayIter, error)
+	}
+
+	// OverlayIter iterates over the rows of an Overlay in order
+	OverlayIter interface {
+		// Next returns io.EOF when there are no more rows
+		Next() (sst.KVPair, error)
+		Close() error
+	}
+)
@@ -0,0 +1,142 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+// testOverlay is a sorted slice of rows
+type testOverlay struct {
+	rows []sst.KVPair
+}
+
+func (o *testOverlay) GetRow(key []byte) (sst.KVPair, bool, error) {
+	for _, row := range o.rows {
+		if bytes.Equal(row.Key, key) {
+			return row, true, nil
+		}
+	}
+	return sst.KVPair{}, false, nil
+}
+
+func (o *testOverlay) RangeIter(start, end []byte, direction int) (OverlayIter, error) {
+	var rows []sst.KVPair
+	for _, row := range o.rows {
+		if direction == sst.DirectionAscending && bytes.Compare(row.Key, start) >= 0 {
+			rows = append(rows, row)
+		}
+		if direction == sst.DirectionDescending && (bytes.Equal(end, sst.UnboundEnd) || bytes.Compare(row.Key, end) <= 0) {
+			rows = append(rows, row)
+		}
+	}
+	if direction == sst.DirectionDescending {
+		slices.Reverse(rows)
+	}
+	return &testOverlayIter{rows: rows}, nil
+}
+
+type testOverlayIter struct {
+	rows []sst.KVPair
+}
+
+func (i *testOverlayIter) Next() (sst.KVPair, error) {
+	if len(i.rows) == 0 {
+		return sst.KVPair{}, io.EOF
+	}
+	row := i.rows[0]
+	i.rows = i.rows[1:]
+	return row, nil
+}
+
+func (i *testOverlayIter) Close() error {
+	return nil
+}
+
+func TestOverlay(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.RowSequence = true
+
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("segment"), Seq: 10},
+			{Key: []byte("key2"), Value: []byte("segment"), Seq: 10},
+			{Key: []byte("key3"), Value: []byte("segment"), Seq: 10},
+		}),
+		prepareTestSegment(t, "2", 1, opts, []sst.KVPair{
+			{Key: []byte("key4"), Value: []byte("segment"), Seq: 1},
+			{Key: []byte("key5"), Value: []byte("segment"), Seq: 1},
+		}),
+	)
+	snapReader.SetOverlay(&testOverlay{
+		rows: []sst.KVPair{
+			{Key: []byte("key0"), Value: []byte("overlay")},
+			{Key: []byte("key2"), Value: []byte("overlay")}, // shadows a higher sequence number
+			{Key: []byte("key3"), Tombstone: true},          // tombstone over L0
+			{Key: []byte("key5"), Tombstone: true},          // tombstone over L1
+			{Key: []byte("key6"), Tombstone: true},          // tombstone for nothing
+		},
+	})
+
+	expected := []sst.KVPair{
+		{Key: []byte("key0"), Value: []byte("overlay")},
+		{Key: []byte("key1"), Value: []byte("segment")},
+		{Key: []byte("key2"), Value: []byte("overlay")},
+		{Key: []byte("key4"), Value: []byte("segment")},
+	}
+
+	for _, row := range expected {
+		val, err := snapReader.GetRow(row.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, row.Value) {
+			t.Fatal("unexpected value for", string(row.Key), "got", string(val))
+		}
+	}
+	for _, key := range []string{"key3", "key5", "key6"} {
+		_, err := snapReader.GetRow([]byte(key))
+		if !errors.Is(err, sst.ErrNoRows) {
+			t.Fatal("expected no rows for", key, "got", err)
+		}
+	}
+
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(expected) {
+		logRows(t, rows)
+		t.Fatal("Got wrong rows length, got", len(rows))
+	}
+	for i, row := range rows {
+		if !bytes.Equal(row.Key, expected[i].Key) || !bytes.Equal(row.Value, expected[i].Value) {
+			logRows(t, rows)
+			t.Fatal("unexpected row at", i)
+		}
+	}
+
+	rows, _, err = snapReader.GetRange([]byte("key1"), []byte("key4"), 100, sst.DirectionDescending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || string(rows[0].Key) != "key4" || string(rows[1].Key) != "key2" || string(rows[1].Value) != "overlay" {
+		logRows(t, rows)
+		t.Fatal("unexpected descending rows")
+	}
+
+	// removing the overlay exposes the segments again
+	snapReader.SetOverlay(nil)
+	val, err := snapReader.GetRow([]byte("key3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "segment" {
+		t.Fatal("unexpected value", string(val))
+	}
+}
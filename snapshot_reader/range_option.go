@@ -0,0 +1,72 @@
+package snapshot_reader
+
+type (
+	rangeOptions struct {
+		endInclusive bool
+		keyFilter    func(key []byte) bool
+		skipPrefixes [][]byte
+		// includeTombstones returns winning tombstones rather than removing them, see IncludeTombstones
+		includeTombstones bool
+		// keysOnly skips decompressing values in the segment iterators, used by CountRange
+		keysOnly bool
+		// skip is the number of rows to discard from the start of the range, see Skip
+		skip int
+	}
+
+	// RangeOption modifies the behavior of GetRange and MergeIter
+	RangeOption func(options *rangeOptions)
+)
+
+// EndInclusive makes the range [start, end] in either direction, rather than [start, end) when
+// sst.DirectionAscending and (start, end] when sst.DirectionDescending. Allows start to equal end.
+//
+// Has no effect on sst.UnboundEnd.
+func EndInclusive() RangeOption {
+	return func(options *rangeOptions) {
+		options.endInclusive = true
+	}
+}
+
+// KeyFilter will only return rows where filter returns true. The filter is applied after merging and tombstone
+// resolution, so filtered rows do not count towards the GetRange limit.
+func KeyFilter(filter func(key []byte) bool) RangeOption {
+	return func(options *rangeOptions) {
+		options.keyFilter = filter
+	}
+}
+
+// SkipPrefixes leaves out all keys under any of the prefixes. Unlike KeyFilter, segment iterators seek past a
+// skipped prefix when they reach it, so blocks entirely within a skipped prefix are never read.
+func SkipPrefixes(prefixes ...[]byte) RangeOption {
+	return func(options *rangeOptions) {
+		options.skipPrefixes = append(options.skipPrefixes, prefixes...)
+	}
+}
+
+// IncludeTombstones returns a row for every key whose newest version is a tombstone (see sst.KVPair.IsTombstone),
+// rather than leaving the key out, such as for replicating deletes downstream. The newest version of a key still
+// wins, and tombstones count towards the GetRange limit.
+func IncludeTombstones() RangeOption {
+	return func(options *rangeOptions) {
+		options.includeTombstones = true
+	}
+}
+
+// Skip discards the first n rows of the range, after merging, tombstone resolution, and filtering, before any rows
+// are returned, such as for deep pagination without a cursor. The skipped rows are read without decompressing their
+// values, but every skipped row is still read, so paginating from the last returned key is preferred for large
+// skips.
+func Skip(n int) RangeOption {
+	return func(options *rangeOptions) {
+		options.skip = n
+	}
+}
+
+// applyRangeOptions creates the rangeOptions from the defaults and opts
+func applyRangeOptions(opts []RangeOption) rangeOptions {
+	options := rangeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
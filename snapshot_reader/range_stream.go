@@ -0,0 +1,61 @@
+package snapshot_reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/objectkv/sst"
+	"io"
+)
+
+// GetRangeStream streams the rows of a range as they are merged, see MergeIter for the range semantics. The rows
+// channel is unbuffered, so a slow consumer applies backpressure to the merge. The context is passed to the
+// SegmentReaderFactoryFuncCtx.
+//
+// The rows channel is closed when the range is exhausted, an error occurs, or the context is cancelled. At most one
+// error (including the context error on cancellation) is sent on the error channel, which is closed after the rows
+// channel.
+func (r *Reader) GetRangeStream(ctx context.Context, start, end []byte, direction int, opts ...RangeOption) (<-chan sst.KVPair, <-chan error) {
+	rows := make(chan sst.KVPair)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(rows)
+
+		err := r.streamRange(ctx, rows, start, end, direction, opts)
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	return rows, errs
+}
+
+func (r *Reader) streamRange(ctx context.Context, rows chan<- sst.KVPair, start, end []byte, direction int, opts []RangeOption) error {
+	iter, err := r.MergeIterContext(ctx, start, end, direction, opts...)
+	if err != nil {
+		return fmt.Errorf("error in MergeIter: %w", err)
+	}
+	defer iter.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error in iter.Next: %w", err)
+		}
+
+		select {
+		case rows <- row:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
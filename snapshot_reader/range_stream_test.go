@@ -0,0 +1,64 @@
+package snapshot_reader
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestGetRangeStream(t *testing.T) {
+	snapReader := prepareTestReader(t).reader
+
+	expected, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1000, sst.DirectionDescending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drain fully
+	rows, errs := snapReader.GetRangeStream(context.Background(), sst.UnboundStart, sst.UnboundEnd, sst.DirectionDescending)
+	var got []sst.KVPair
+	for row := range rows {
+		got = append(got, row)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) {
+		t.Fatal("Got wrong rows length, got", len(got))
+	}
+	for i, row := range got {
+		if string(row.Key) != string(expected[i].Key) || string(row.Value) != string(expected[i].Value) {
+			logRows(t, got)
+			t.Fatal("unexpected row at", i)
+		}
+	}
+
+	// cancel early
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, errs = snapReader.GetRangeStream(ctx, sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending)
+	for i := 0; i < 10; i++ {
+		<-rows
+	}
+	cancel()
+	for range rows {
+		// drain whatever was in flight
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context canceled, got", err)
+	}
+
+	// injected failure
+	injected := errors.New("injected")
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		return nil, injected
+	}
+	rows, errs = snapReader.GetRangeStream(context.Background(), sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending)
+	for range rows {
+		t.Fatal("expected no rows")
+	}
+	if err := <-errs; !errors.Is(err, injected) {
+		t.Fatal("expected injected error, got", err)
+	}
+}
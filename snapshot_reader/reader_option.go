@@ -0,0 +1,38 @@
+package snapshot_reader
+
+import "github.com/rs/zerolog"
+
+type ReaderOptions struct {
+	// TreeDegree is the degree of the btrees indexing segments, larger degrees reduce allocations and improve lookup
+	// locality for snapshots with many segments. Uses DefaultTreeDegree if 0.
+	TreeDegree int
+	// IsNotExist reports whether a SegmentReaderFactoryFunc error means the segment file no longer exists, such as
+	// when compaction deleted it after the snapshot was taken. Matching segments are skipped like ErrSegmentGone,
+	// rather than failing the read. Disabled if nil.
+	IsNotExist func(err error) bool
+	// Logger logs segments skipped by IsNotExist. Disabled if nil.
+	Logger *zerolog.Logger
+	// SetupConcurrency bounds how many segments are opened (loading their metadata) and seeked at once when setting
+	// up a MergeIter. Uses DefaultSetupConcurrency if 0.
+	SetupConcurrency int
+	// OnSegmentsDropped is called by UpdateSegments with the segments it dropped or replaced, such as to evict their
+	// metadata and blocks from caches held by the SegmentReaderFactoryFunc. It is called after the segment indexes
+	// are unlocked, so it may use the Reader. Reads of an earlier snapshot may still open the segments afterward.
+	// Disabled if nil.
+	OnSegmentsDropped func(dropped []SegmentRecord)
+}
+
+const (
+	DefaultTreeDegree       = 32
+	DefaultSetupConcurrency = 32
+)
+
+func DefaultReaderOptions() ReaderOptions {
+	return ReaderOptions{
+		TreeDegree:        DefaultTreeDegree,
+		IsNotExist:        nil,
+		Logger:            nil,
+		SetupConcurrency:  DefaultSetupConcurrency,
+		OnSegmentsDropped: nil,
+	}
+}
@@ -0,0 +1,72 @@
+package snapshot_reader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
+
+func TestSelfCheck(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	var keys [][]byte
+	for i := 0; i < 10; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	seqOpts := sst.DefaultSegmentWriterOptions()
+	seqOpts.RowSequence = true
+	snapReader := prepareTestSegmentReader(
+		// overlapping segments of the same level, the newer one wins
+		prepareTestSegment(t, "1-0", 1, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("a")},
+			{Key: []byte("key4"), Value: []byte("a")},
+			{Key: []byte("key5"), Value: []byte("a")},
+		}),
+		prepareTestSegment(t, "1-1", 1, opts, []sst.KVPair{
+			{Key: []byte("key3"), Value: []byte("b")},
+			{Key: []byte("key4"), Value: []byte("b")},
+			sst.NewTombstone([]byte("key5")),
+			{Key: []byte("key9"), Value: []byte("b")},
+		}),
+		prepareTestSegment(t, "0-0", 0, seqOpts, []sst.KVPair{
+			sst.NewTombstone([]byte("key1")),
+			{Key: []byte("key3"), Tombstone: true},
+			{Key: []byte("key6"), Value: []byte("old"), Seq: 2},
+		}),
+		prepareTestSegment(t, "0-1", 0, seqOpts, []sst.KVPair{
+			{Key: []byte("key6"), Value: []byte("older"), Seq: 1},
+		}),
+	)
+	err := snapReader.SelfCheck(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := snapReader.GetRow([]byte("key4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "b" {
+		t.Fatal("expected the newer overlapping segment to win, got", string(value))
+	}
+
+	// detects a disagreement, from a factory serving a different version of the segment each time
+	segments := []testSegment{
+		prepareTestSegment(t, "0-0", 0, opts, []sst.KVPair{{Key: []byte("key1"), Value: []byte("a")}}),
+		prepareTestSegment(t, "0-0", 0, opts, []sst.KVPair{{Key: []byte("key1"), Value: []byte("b")}}),
+	}
+	calls := 0
+	snapReader = NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		segment := segments[calls%2]
+		calls++
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(segment.bytes)}, len(segment.bytes))
+		return &reader, nil
+	})
+	snapReader.UpdateSegments([]SegmentRecord{segments[0].record}, nil)
+	err = snapReader.SelfCheck([][]byte{[]byte("key1")})
+	if !errors.Is(err, ErrSelfCheckMismatch) {
+		t.Fatal("expected ErrSelfCheckMismatch, got", err)
+	}
+}
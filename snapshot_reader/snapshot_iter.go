@@ -3,9 +3,13 @@ package snapshot_reader
 import (
 	"bytes"
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/danthegoodman1/objectkv/sst"
 	"io"
+	"sync"
+	"time"
 )
 
 type (
@@ -16,10 +20,30 @@ type (
 		rowBuffer *list.List
 		options   iterOptions
 		done      bool
+		// bufferSize is the number of rows to load on the next refill, adapted between the min and max buffer size
+		bufferSize int
+		// lastLoad is when the buffer was last loaded, to measure how quickly the consumer drains it
+		lastLoad time.Time
+		// fetched is the total number of rows loaded
+		fetched int
+		// readers are the segment readers kept open between GetRange requests
+		readers *segmentReaderCache
+	}
+
+	// segmentReaderCache holds the segment readers of a multi-page scan by segment ID, so each page doesn't reopen
+	// the same segments through the SegmentReaderFactoryFunc. It is safe for concurrent use.
+	segmentReaderCache struct {
+		mu      sync.Mutex
+		readers map[string]*sst.SegmentReader
+		// used is the IDs of the segments read since the last evictUnused
+		used map[string]bool
 	}
 
 	iterOptions struct {
-		bufferSize int
+		minBufferSize int
+		maxBufferSize int
+		// slowDrain is how long the consumer can take to drain a buffer before it is considered slow
+		slowDrain time.Duration
 	}
 
 	IterOption func(options *iterOptions)
@@ -27,7 +51,9 @@ type (
 
 var (
 	defaultIterOptions = iterOptions{
-		bufferSize: 100,
+		minBufferSize: 10,
+		maxBufferSize: 1000,
+		slowDrain:     100 * time.Millisecond,
 	}
 )
 
@@ -82,14 +108,23 @@ func (i *Iter) checkLoadBuffer() error {
 		endKey = sst.UnboundEnd
 	}
 
-	// load the range
-	rows, err := i.reader.GetRange(startKey, endKey, i.options.bufferSize, i.direction)
+	i.adaptBufferSize()
+
+	// load the range, with room for the last key that is returned again
+	limit := i.bufferSize
+	if i.lastKey != nil {
+		limit++
+	}
+	rows, _, err := i.reader.getRange(context.Background(), startKey, endKey, limit, i.direction, i.readers, nil)
 	if err != nil {
 		return fmt.Errorf("error in Reader.GetRange: %w", err)
 	}
-	if len(rows) == 0 {
-		i.done = true
-		return io.EOF
+	i.fetched += len(rows)
+
+	// segments dropped from the snapshot since the last page won't be read again
+	err = i.readers.evictUnused()
+	if err != nil {
+		return fmt.Errorf("error in evictUnused: %w", err)
 	}
 
 	// add the rows to the linked list
@@ -103,14 +138,119 @@ func (i *Iter) checkLoadBuffer() error {
 
 		i.rowBuffer.PushBack(row)
 	}
+	if i.rowBuffer.Len() == 0 {
+		i.done = true
+		err = i.readers.close()
+		if err != nil {
+			return fmt.Errorf("error closing segment readers: %w", err)
+		}
+		return io.EOF
+	}
 
 	// Set the last key
 	i.lastKey = i.rowBuffer.Back().Value.(sst.KVPair).Key
 	return nil
 }
 
+// Close closes the segment readers kept open between pages. Not needed if the Iter was read to io.EOF.
+func (i *Iter) Close() error {
+	i.done = true
+	i.rowBuffer = list.New()
+	return i.readers.close()
+}
+
+// adaptBufferSize grows the buffer size toward the max when the consumer drained the last buffer quickly, and
+// shrinks it toward the min when it did not. The first load uses the min, so partial scans don't over-fetch.
+func (i *Iter) adaptBufferSize() {
+	now := time.Now()
+	defer func() {
+		i.lastLoad = now
+	}()
+
+	if i.bufferSize == 0 {
+		i.bufferSize = i.options.minBufferSize
+		return
+	}
+
+	if now.Sub(i.lastLoad) < i.options.slowDrain {
+		i.bufferSize = min(i.bufferSize*2, i.options.maxBufferSize)
+	} else {
+		i.bufferSize = max(i.bufferSize/2, i.options.minBufferSize)
+	}
+}
+
+// RowBufferSize sets a fixed number of rows to load per GetRange, rather than adapting to the consumer
+// (see AdaptiveRowBufferSize).
 func RowBufferSize(size int) IterOption {
 	return func(options *iterOptions) {
-		options.bufferSize = size
+		options.minBufferSize = size
+		options.maxBufferSize = size
 	}
 }
+
+// AdaptiveRowBufferSize sets the bounds of the number of rows to load per GetRange, which starts at minSize and
+// doubles toward maxSize while the consumer quickly drains the buffer, and halves when it does not. This keeps
+// partial scans from over-fetching, while full scans make fewer GetRange calls. Defaults to 10 and 1000.
+func AdaptiveRowBufferSize(minSize, maxSize int) IterOption {
+	return func(options *iterOptions) {
+		options.minBufferSize = minSize
+		options.maxBufferSize = maxSize
+	}
+}
+
+func newSegmentReaderCache() *segmentReaderCache {
+	return &segmentReaderCache{
+		readers: map[string]*sst.SegmentReader{},
+		used:    map[string]bool{},
+	}
+}
+
+// get returns the open reader for the segment, creating it with factory if there isn't one
+func (c *segmentReaderCache) get(segment SegmentRecord, factory SegmentReaderFactoryFunc) (*sst.SegmentReader, error) {
+	c.mu.Lock()
+	c.used[segment.ID] = true
+	reader, found := c.readers[segment.ID]
+	c.mu.Unlock()
+	if found {
+		return reader, nil
+	}
+
+	reader, err := factory(segment)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readers[segment.ID] = reader
+	return reader, nil
+}
+
+// evictUnused closes the readers of segments that have not been read since the last evictUnused
+func (c *segmentReaderCache) evictUnused() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for id, reader := range c.readers {
+		if c.used[id] {
+			continue
+		}
+		err := reader.Close()
+		if err != nil && !errors.Is(err, sst.ErrAlreadyClosed) {
+			errs = append(errs, err)
+		}
+		delete(c.readers, id)
+	}
+	clear(c.used)
+
+	return errors.Join(errs...)
+}
+
+// close closes all the readers
+func (c *segmentReaderCache) close() error {
+	c.mu.Lock()
+	clear(c.used)
+	c.mu.Unlock()
+	return c.evictUnused()
+}
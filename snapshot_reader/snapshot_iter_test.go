@@ -1,6 +1,15 @@
 package snapshot_reader
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/danthegoodman1/objectkv/sst"
+)
 
 func TestSnapshotIter(t *testing.T) {
 	// todo test reading forward to end
@@ -11,3 +20,131 @@ func TestSnapshotIter(t *testing.T) {
 
 	// todo test adjusted row buffer size
 }
+
+func TestSnapshotIterAdaptiveBuffer(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// stopping early only fetches about as many rows as were consumed
+	consume := func(iter *Iter, count int) {
+		for n := 0; n < count; n++ {
+			_, err := iter.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	iter := snapReader.RowIter(sst.UnboundStart, sst.DirectionAscending)
+	consume(iter, 25)
+	if iter.fetched > 2*25 {
+		t.Fatal("fetched too many rows for early termination", iter.fetched)
+	}
+	fixed := snapReader.RowIter(sst.UnboundStart, sst.DirectionAscending, RowBufferSize(100))
+	consume(fixed, 25)
+	if fixed.fetched < 100 {
+		t.Fatal("expected a fixed buffer to fetch a full buffer, got", fixed.fetched)
+	}
+
+	// a fast full scan grows to the max, and returns every row once in order
+	expected, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1000, sst.DirectionDescending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter = snapReader.RowIter(sst.UnboundEnd, sst.DirectionDescending, AdaptiveRowBufferSize(2, 16))
+	for ind := 0; ; ind++ {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			if ind != len(expected) {
+				t.Fatal("unexpected row count", ind)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(row.Key, expected[ind].Key) {
+			t.Fatal("unexpected row", string(row.Key), "at", ind)
+		}
+	}
+	if iter.bufferSize != 16 {
+		t.Fatal("expected the buffer to grow to the max, got", iter.bufferSize)
+	}
+
+	// a slow consumer shrinks back to the min
+	iter = snapReader.RowIter(sst.UnboundStart, sst.DirectionAscending, AdaptiveRowBufferSize(2, 16))
+	consume(iter, 50)
+	iter.options.slowDrain = 0
+	consume(iter, 50)
+	if iter.bufferSize != 2 {
+		t.Fatal("expected the buffer to shrink to the min, got", iter.bufferSize)
+	}
+}
+
+func TestSnapshotIterReusesSegmentReaders(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	var even, odd []sst.KVPair
+	for i := 0; i < 200; i++ {
+		row := sst.KVPair{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte(fmt.Sprintf("value%03d", i))}
+		if i%2 == 0 {
+			even = append(even, row)
+		} else {
+			odd = append(odd, row)
+		}
+	}
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "a", 0, opts, even),
+		prepareTestSegment(t, "b", 0, opts, odd),
+	)
+
+	// count the readers created for each segment
+	created := map[string]int{}
+	factory := snapReader.readerFactory
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		created[record.ID]++
+		return factory(ctx, record)
+	}
+
+	iter := snapReader.RowIter(sst.UnboundStart, sst.DirectionAscending, RowBufferSize(10))
+	count := 0
+	for {
+		_, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 200 {
+		t.Fatal("expected 200 rows, got", count)
+	}
+	if created["a"] != 1 || created["b"] != 1 {
+		t.Fatal("expected each segment reader to be created once across pages, got", created)
+	}
+	if len(iter.readers.readers) != 0 {
+		t.Fatal("expected the segment readers to be closed at the end of the scan, got", len(iter.readers.readers))
+	}
+
+	// a segment dropped between pages is evicted from the cache
+	iter = snapReader.RowIter(sst.UnboundStart, sst.DirectionAscending, RowBufferSize(10))
+	_, err := iter.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapReader.UpdateSegments(nil, []SegmentRecord{{ID: "b", Level: 0}})
+	for n := 0; n < 10; n++ {
+		_, err = iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, found := iter.readers.readers["b"]; found {
+		t.Fatal("expected the dropped segment reader to be evicted")
+	}
+	err = iter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,75 +3,134 @@ package snapshot_reader
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/danthegoodman1/objectkv/sst"
 	"github.com/google/btree"
-	"golang.org/x/sync/errgroup"
 	"io"
+	"slices"
 	"sort"
 	"sync"
+	"time"
 )
 
 type (
 	Reader struct {
 		segmentIDTree  *btree.BTreeG[SegmentRecord]
-		blockRangeTree *btree.BTreeG[SegmentRecord]
+		blockRangeTree *btree.BTreeG[blockRangeItem]
 		indexMu        *sync.RWMutex
-		readerFactory  SegmentReaderFactoryFunc
+		readerFactory  SegmentReaderFactoryFuncCtx
+		overlay        Overlay
+		options        ReaderOptions
 	}
 
 	// SegmentReaderFactoryFunc is used to create the readers for segment files. May be used to read data or metadata.
+	//
+	// Reads run on a snapshot of segments, so the factory may be called for a segment that was concurrently dropped
+	// with UpdateSegments. If the segment no longer exists, return an error wrapping ErrSegmentGone to have the read
+	// skip it, or see ReaderOptions.IsNotExist.
 	SegmentReaderFactoryFunc func(record SegmentRecord) (*sst.SegmentReader, error)
+
+	// SegmentReaderFactoryFuncCtx is a SegmentReaderFactoryFunc that is passed the context of the request, such as
+	// for a remote factory to respect cancellation and timeouts when opening the segment. Requests without a context
+	// pass context.Background().
+	//
+	// The returned reader may be used after the factory returns, but not after the request does, so a factory may
+	// tie the reader to the context.
+	SegmentReaderFactoryFuncCtx func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error)
 )
 
-func blockRangeLessFunc(a, b SegmentRecord) bool {
-	// Compare FirstKey first
-	cmp := bytes.Compare(a.Metadata.FirstKey, b.Metadata.FirstKey)
-	if cmp != 0 {
-		return cmp < 0
+// WithContext adapts the SegmentReaderFactoryFunc to a SegmentReaderFactoryFuncCtx that ignores the context
+func (f SegmentReaderFactoryFunc) WithContext() SegmentReaderFactoryFuncCtx {
+	return func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		return f(record)
 	}
+}
 
-	// We are looking up where a key belongs in the range ("unbound" range)
-	if len(a.Metadata.LastKey) == 0 {
-		return false
-	}
-	if len(b.Metadata.LastKey) == 0 {
-		return true
+// ErrSegmentGone indicates that a segment was dropped before it could be read, see SegmentReaderFactoryFunc
+var ErrSegmentGone = errors.New("segment gone")
+
+// blockRangeItem is an entry in the block range tree, which is either a segment or a search bound
+type blockRangeItem struct {
+	record SegmentRecord
+	// bound sorts after every segment with the same first key, so descending from it visits all of them
+	bound bool
+}
+
+// searchBound creates a blockRangeItem to descend from, visiting every segment with a first key <= key
+func searchBound(key []byte) blockRangeItem {
+	return blockRangeItem{
+		record: SegmentRecord{Metadata: sst.SegmentMetadata{FirstKey: key}},
+		bound:  true,
 	}
+}
 
-	// Check the last key, reverse order, so the largest range comes first when descending
-	cmp = bytes.Compare(a.Metadata.LastKey, b.Metadata.LastKey)
+func blockRangeLessFunc(a, b blockRangeItem) bool {
+	// Compare FirstKey first
+	cmp := bytes.Compare(a.record.Metadata.FirstKey, b.record.Metadata.FirstKey)
 	if cmp != 0 {
 		return cmp < 0
 	}
 
-	// this is a bit of a hack to prevent duplicates, while allowing for search
-	// if the ID is blank then we are searching for potentials, so return the opposite
-	if a.ID == "" {
-		return false
+	// a search bound comes after every segment with the same first key
+	if a.bound != b.bound {
+		return b.bound
 	}
-	if b.ID == "" {
-		return true
+
+	// Check the last key, so the largest range comes first when descending
+	cmp = bytes.Compare(a.record.Metadata.LastKey, b.record.Metadata.LastKey)
+	if cmp != 0 {
+		return cmp < 0
 	}
 
 	// If FirstKey and LastKey is the same, compare ID (so everything is unique)
-	return a.ID < b.ID
+	return a.record.ID < b.record.ID
 }
 
 func NewReader(f SegmentReaderFactoryFunc) *Reader {
+	return NewReaderWithOptions(f, DefaultReaderOptions())
+}
+
+func NewReaderWithOptions(f SegmentReaderFactoryFunc, opts ReaderOptions) *Reader {
+	return NewReaderWithContextFactory(f.WithContext(), opts)
+}
+
+// NewReaderWithContextFactory creates a Reader whose factory is passed the context of the request, see
+// SegmentReaderFactoryFuncCtx.
+func NewReaderWithContextFactory(f SegmentReaderFactoryFuncCtx, opts ReaderOptions) *Reader {
+	degree := opts.TreeDegree
+	if degree == 0 {
+		degree = DefaultTreeDegree
+	}
+
 	sr := &Reader{
-		segmentIDTree: btree.NewG[SegmentRecord](2, func(a, b SegmentRecord) bool {
+		segmentIDTree: btree.NewG[SegmentRecord](degree, func(a, b SegmentRecord) bool {
 			return a.ID < b.ID
 		}),
-		blockRangeTree: btree.NewG[SegmentRecord](2, blockRangeLessFunc),
+		blockRangeTree: btree.NewG[blockRangeItem](degree, blockRangeLessFunc),
 		indexMu:        &sync.RWMutex{},
 		readerFactory:  f,
+		options:        opts,
 	}
 
 	return sr
 }
 
+// SetOverlay sets the Overlay that is consulted above all segments, or removes it if nil.
+func (r *Reader) SetOverlay(overlay Overlay) {
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+	r.overlay = overlay
+}
+
+// getOverlay returns the current Overlay, which may be nil
+func (r *Reader) getOverlay() Overlay {
+	r.indexMu.RLock()
+	defer r.indexMu.RUnlock()
+	return r.overlay
+}
+
 // UpdateSegments will obtain a write lock over segment indexes, and perform all the modifications at once.
 // This allows you to atomically drop and add segment files for use cases like compaction.
 //
@@ -79,73 +138,237 @@ func NewReader(f SegmentReaderFactoryFunc) *Reader {
 //
 // The minimum information to have within a SegmentRecord is the ID, Metadata.FirstKey, Metadata.LastKey
 func (r *Reader) UpdateSegments(add []SegmentRecord, drop []SegmentRecord) {
+	dropped := r.updateSegments(add, drop)
+	if len(dropped) > 0 && r.options.OnSegmentsDropped != nil {
+		r.options.OnSegmentsDropped(dropped)
+	}
+}
+
+// updateSegments updates the segment indexes, returning the records that were dropped or replaced
+func (r *Reader) updateSegments(add []SegmentRecord, drop []SegmentRecord) []SegmentRecord {
 	r.indexMu.Lock()
 	defer r.indexMu.Unlock()
 
+	var dropped []SegmentRecord
+
 	// handle deletes first
 	for _, toDrop := range drop {
-		_, found := r.segmentIDTree.Delete(toDrop)
+		existing, found := r.segmentIDTree.Delete(toDrop)
 		if !found {
 			continue
 		}
-		r.blockRangeTree.Delete(toDrop)
+		r.blockRangeTree.Delete(blockRangeItem{record: existing})
+		dropped = append(dropped, existing)
 	}
 
 	// handle adds
 	for _, toAdd := range add {
-		r.segmentIDTree.ReplaceOrInsert(toAdd)
-		r.blockRangeTree.ReplaceOrInsert(toAdd)
+		existing, replaced := r.segmentIDTree.ReplaceOrInsert(toAdd)
+		if replaced {
+			// the keys may have changed
+			r.blockRangeTree.Delete(blockRangeItem{record: existing})
+			dropped = append(dropped, existing)
+		}
+		r.blockRangeTree.ReplaceOrInsert(blockRangeItem{record: toAdd})
 	}
+
+	return dropped
+}
+
+// TombstoneRatio returns the fraction of rows across all segments that are tombstones, useful for scheduling
+// compaction. Returns 0 if there are no rows. See sst.SegmentMetadata.TombstoneRatio for per-segment ratios.
+//
+// Requires the SegmentRecord metadata to have the row stats loaded.
+func (r *Reader) TombstoneRatio() float64 {
+	r.indexMu.RLock()
+	defer r.indexMu.RUnlock()
+
+	var rowCount, tombstoneCount uint64
+	r.segmentIDTree.Ascend(func(record SegmentRecord) bool {
+		rowCount += record.Metadata.RowCount
+		tombstoneCount += record.Metadata.TombstoneCount
+		return true
+	})
+
+	if rowCount == 0 {
+		return 0
+	}
+	return float64(tombstoneCount) / float64(rowCount)
+}
+
+// SegmentsOlderThan returns the segments created more than d ago, ordered by ID, such as to drop segments past a
+// retention window with UpdateSegments. Segments without a sst.SegmentMetadata.CreatedAt are not returned.
+func (r *Reader) SegmentsOlderThan(d time.Duration) []SegmentRecord {
+	cutoff := time.Now().Add(-d)
+
+	r.indexMu.RLock()
+	defer r.indexMu.RUnlock()
+
+	var segments []SegmentRecord
+	r.segmentIDTree.Ascend(func(record SegmentRecord) bool {
+		if !record.Metadata.CreatedAt.IsZero() && record.Metadata.CreatedAt.Before(cutoff) {
+			segments = append(segments, record)
+		}
+		return true
+	})
+	return segments
 }
 
 // GetRow will fetch a single row, returning sst.ErrNoRows if not found.
 //
 // Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
 func (r *Reader) GetRow(key []byte) ([]byte, error) {
+	return r.GetRowContext(context.Background(), key)
+}
+
+// GetRowContext is like GetRow, but passes the context to the SegmentReaderFactoryFuncCtx.
+func (r *Reader) GetRowContext(ctx context.Context, key []byte) ([]byte, error) {
+	winner, _, err := r.getWinningRow(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return winningValue(winner)
+}
+
+// GetRowFull is like GetRow, but returns the full row, including its sequence number, and the record of the segment
+// that served it, for callers that need provenance (e.g. caches or audit logs). A row served by the Overlay has a
+// SegmentRecord with only Level 0 set.
+//
+// Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
+func (r *Reader) GetRowFull(key []byte) (sst.KVPair, SegmentRecord, error) {
+	winner, winnerSegment, err := r.getWinningRow(context.Background(), key)
+	if err != nil {
+		return sst.KVPair{}, SegmentRecord{}, err
+	}
+
+	_, err = winningValue(winner)
+	if err != nil {
+		return sst.KVPair{}, SegmentRecord{}, err
+	}
+
+	return *winner, winnerSegment, nil
+}
+
+// GetRowAsOf is like GetRow, but reads the row as of the given epoch, ignoring segments with a higher
+// sst.SegmentMetadata.Epoch. The overlay is not consulted, as it holds writes that are not yet in an epoch.
+//
+// Segments without an epoch have an epoch of 0, so are always included.
+func (r *Reader) GetRowAsOf(key []byte, epoch uint64) ([]byte, error) {
+	winner, _, err := r.getWinningSegmentRow(context.Background(), key, func(segment SegmentRecord) bool {
+		return segment.Metadata.Epoch <= epoch
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return winningValue(winner)
+}
+
+// winningValue returns the value of the winning row, or sst.ErrNoRows if there is none or it is a delete
+func winningValue(winner *sst.KVPair) ([]byte, error) {
+	if winner == nil {
+		// we never found anything
+		return nil, sst.ErrNoRows
+	}
+
+	if winner.IsTombstone() {
+		// this is a delete, row does not exist. Tombstones are usually in L0, but compaction keeps them in higher
+		// levels while a lower level may still hold the key, see CompactionPlan.DropTombstones
+		return nil, sst.ErrNoRows
+	}
+
+	// otherwise we have a row
+	return winner.Value, nil
+}
+
+// getWinningRow finds the winning version of a row across the overlay and segments, which may be a tombstone.
+// Returns a nil row if the key does not exist in any segment.
+func (r *Reader) getWinningRow(ctx context.Context, key []byte) (*sst.KVPair, SegmentRecord, error) {
+	if overlay := r.getOverlay(); overlay != nil {
+		row, found, err := overlay.GetRow(key)
+		if err != nil {
+			return nil, SegmentRecord{}, fmt.Errorf("error in overlay.GetRow: %w", err)
+		}
+		if found {
+			// the overlay shadows all segments, and its tombstones count as L0
+			return &row, SegmentRecord{Level: 0}, nil
+		}
+	}
+
+	return r.getWinningSegmentRow(ctx, key, nil)
+}
+
+// getWinningSegmentRow finds the winning version of a row across segments, only considering segments for which
+// include returns true (all segments if nil).
+func (r *Reader) getWinningSegmentRow(ctx context.Context, key []byte, include func(segment SegmentRecord) bool) (*sst.KVPair, SegmentRecord, error) {
 	// figure out possible segments
 	possibleSegments := r.getPossibleSegmentsForKey(key)
+	if include != nil {
+		possibleSegments = slices.DeleteFunc(possibleSegments, func(segment SegmentRecord) bool {
+			return !include(segment)
+		})
+	}
 
-	// Sort them in desc ID order
-	sort.Slice(possibleSegments, func(i, j int) bool {
-		if possibleSegments[i].Level != possibleSegments[j].Level {
-			// ascending by level
-			return possibleSegments[i].Level < possibleSegments[j].Level
-		}
-		// descending by ID
-		return possibleSegments[i].ID > possibleSegments[j].ID
-	})
+	sortSegmentsByPrecedence(possibleSegments)
 
+	var winner *sst.KVPair
+	var winnerSegment SegmentRecord
 	for _, segment := range possibleSegments {
+		if winner != nil && !segment.Metadata.RowSequence {
+			// rows without sequence numbers can't win over an earlier row, see winsConflict
+			continue
+		}
+
 		// generate a reader for the segment
-		reader, err := r.readerFactory(segment)
+		reader, err := r.openSegment(ctx, segment)
+		if errors.Is(err, ErrSegmentGone) {
+			// dropped since we took our snapshot
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error running reader factory for segment level=%d id=%s: %w", segment.Level, segment.ID, err)
+			return nil, SegmentRecord{}, fmt.Errorf("error running reader factory for segment level=%d id=%s: %w", segment.Level, segment.ID, err)
 		}
-		defer reader.Close()
 
-		// delegate the reader to the segment reader
+		// delegate the reader to the segment reader, closing it before the next segment is opened
 		row, err := reader.GetRow(key)
+		reader.Close()
 		if errors.Is(err, sst.ErrNoRows) {
 			// not in this segment, go to the next
 			continue
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error in reader.GetRow: %w", err)
+			return nil, SegmentRecord{}, fmt.Errorf("error in reader.GetRow: %w", err)
 		}
 
-		if bytes.Equal([]byte{}, row.Value) && segment.Level == 0 {
-			// this is a delete, row does not exist
-			return nil, sst.ErrNoRows
-			// NOTE should we panic if this is not level 0? that should never happen,
-			// but it's not detrimental, but it means we are not operating as we expect!
+		if winner == nil || winsConflict(row, *winner) {
+			winner = &row
+			winnerSegment = segment
 		}
+	}
+
+	return winner, winnerSegment, nil
+}
 
-		// otherwise we have a row
-		return row.Value, nil
+// openSegment creates a reader for the segment with the factory, wrapping ErrSegmentGone around errors matching
+// ReaderOptions.IsNotExist so the read skips the segment
+func (r *Reader) openSegment(ctx context.Context, segment SegmentRecord) (*sst.SegmentReader, error) {
+	reader, err := r.readerFactory(ctx, segment)
+	if err != nil && r.options.IsNotExist != nil && r.options.IsNotExist(err) {
+		if r.options.Logger != nil {
+			r.options.Logger.Warn().Err(err).Str("segmentID", segment.ID).Int("level", segment.Level).Msg("segment does not exist, skipping")
+		}
+		return nil, fmt.Errorf("%w: %w", ErrSegmentGone, err)
 	}
+	return reader, err
+}
 
-	// we never found anything
-	return nil, sst.ErrNoRows
+// setupConcurrency returns ReaderOptions.SetupConcurrency, or DefaultSetupConcurrency if unset
+func (r *Reader) setupConcurrency() int {
+	if r.options.SetupConcurrency <= 0 {
+		return DefaultSetupConcurrency
+	}
+	return r.options.SetupConcurrency
 }
 
 // getPossibleSegmentsForKey will get all segments a key could live in
@@ -156,20 +379,29 @@ func (r *Reader) getPossibleSegmentsForKey(key []byte) []SegmentRecord {
 	r.indexMu.RLock()
 	defer r.indexMu.RUnlock()
 
-	// Descend from the key until we hit something too small
-	r.blockRangeTree.DescendLessOrEqual(SegmentRecord{
-		Metadata: sst.SegmentMetadata{FirstKey: key},
-	}, func(record SegmentRecord) bool {
+	// Descend from the key through every segment starting at or before it
+	r.blockRangeTree.DescendLessOrEqual(searchBound(key), func(item blockRangeItem) bool {
+		record := item.record
 		keyInRange := bytes.Compare(key, record.Metadata.FirstKey) >= 0 && bytes.Compare(key, record.Metadata.LastKey) <= 0
 		if keyInRange {
 			possibleSegments = append(possibleSegments, record)
 		}
-		return keyInRange
+		// keep going, as a segment with a smaller first key may still have a larger last key
+		return true
 	})
 
 	return possibleSegments
 }
 
+// SegmentsForRange returns the segments that overlap the range [start, end), which a range read would merge, such
+// as for reasoning about the fan-out of a scan before issuing it. A segment starting at end is included, as it
+// overlaps the range (start, end] of a descending read. The segments are not sorted.
+//
+// Returns a copy of the records, taken under the read lock.
+func (r *Reader) SegmentsForRange(start, end []byte) []SegmentRecord {
+	return r.getPossibleSegmentsForRange(start, end)
+}
+
 // getPossibleSegmentsForRange returns all possible segments a range of keys could live in
 func (r *Reader) getPossibleSegmentsForRange(start, end []byte) []SegmentRecord {
 	// NOTE maybe we can pre-create this to segment size
@@ -178,17 +410,25 @@ func (r *Reader) getPossibleSegmentsForRange(start, end []byte) []SegmentRecord
 	r.indexMu.RLock()
 	defer r.indexMu.RUnlock()
 
-	// Descend from the key until we hit something too small
-	r.blockRangeTree.DescendLessOrEqual(SegmentRecord{
-		Metadata: sst.SegmentMetadata{FirstKey: end},
-	}, func(record SegmentRecord) bool {
+	isUnboundEnd := bytes.Equal(end, sst.UnboundEnd)
+	collect := func(item blockRangeItem) bool {
+		record := item.record
 		// easier to check the conditions it can't overlap in
-		keyInRange := !(bytes.Compare(start, record.Metadata.LastKey) > 0 || bytes.Compare(end, record.Metadata.FirstKey) < 0)
+		keyInRange := !(bytes.Compare(start, record.Metadata.LastKey) > 0 || (!isUnboundEnd && bytes.Compare(end, record.Metadata.FirstKey) < 0))
 		if keyInRange {
 			possibleSegments = append(possibleSegments, record)
 		}
-		return keyInRange
-	})
+		// keep going, as a segment with a smaller first key may still have a larger last key
+		return true
+	}
+
+	if isUnboundEnd {
+		// keys can sort after the UnboundEnd sentinel (e.g. 0xff01), so visit every segment
+		r.blockRangeTree.Descend(collect)
+	} else {
+		// Descend from the end through every segment starting at or before it
+		r.blockRangeTree.DescendLessOrEqual(searchBound(end), collect)
+	}
 
 	return possibleSegments
 }
@@ -196,182 +436,193 @@ func (r *Reader) getPossibleSegmentsForRange(start, end []byte) []SegmentRecord
 var ErrInvalidRange = errors.New("invalid range")
 
 // GetRange will fetch a range of rows up to a limit, starting from some direction.
-// Internally it uses RowIter, and is a convenience wrapper around it.
+// Internally it uses MergeIter, and is a convenience wrapper around it.
 //
 // `end` must be greater than `start`, with the range [start, end) when sst.DirectionAscending
 // and (start, end] when sst.DirectionDescending. This means you can paginate without
-// worrying about overlap.
+// worrying about overlap. See EndInclusive to include both bounds, and Skip to discard the first rows.
+//
+// The returned bool is true if the limit was reached and there are more rows in the range, so paginating callers
+// know to fetch another page.
 //
 // Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
 //
-// See sst.UnboundStart and sst.UnboundEnd helper vars
-func (r *Reader) GetRange(start []byte, end []byte, limit, direction int) ([]sst.KVPair, error) {
-	if bytes.Compare(start, end) >= 0 {
-		return nil, fmt.Errorf("%w: end must be strictly greater than start", ErrInvalidRange)
-	}
+// See sst.UnboundStart and sst.UnboundEnd helper vars, and RangeOption
+func (r *Reader) GetRange(start []byte, end []byte, limit, direction int, opts ...RangeOption) ([]sst.KVPair, bool, error) {
+	return r.getRange(context.Background(), start, end, limit, direction, nil, opts)
+}
 
-	// get all potential blocks
-	possibleSegments := r.getPossibleSegmentsForRange(start, end)
+// GetRangeContext is like GetRange, but passes the context to the SegmentReaderFactoryFuncCtx.
+func (r *Reader) GetRangeContext(ctx context.Context, start []byte, end []byte, limit, direction int, opts ...RangeOption) ([]sst.KVPair, bool, error) {
+	return r.getRange(ctx, start, end, limit, direction, nil, opts)
+}
 
-	if len(possibleSegments) == 0 {
-		// exit early
-		return nil, nil
+// getRange is GetRange, taking segment readers from readers if not nil
+func (r *Reader) getRange(ctx context.Context, start []byte, end []byte, limit, direction int, readers *segmentReaderCache, opts []RangeOption) ([]sst.KVPair, bool, error) {
+	iter, err := r.mergeIter(ctx, start, end, direction, readers, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("error in MergeIter: %w", err)
 	}
+	defer iter.Close()
 
-	// sort them based on level, id if level 0, then direction
-	sort.Slice(possibleSegments, func(i, j int) bool {
-		if possibleSegments[i].Level != possibleSegments[j].Level {
-			// ascending by level
-			return possibleSegments[i].Level < possibleSegments[j].Level
-		}
-
-		// If both levels are 0, sort by ID to ensure that we see the newest L0 segment first
-		if possibleSegments[i].Level == 0 && possibleSegments[j].Level == 0 {
-			// desc by ID, we assume that there are no duplicates
-			return possibleSegments[i].ID > possibleSegments[j].ID
-		}
+	return collectRows(iter, limit)
+}
 
-		// Sort by FirstKey or LastKey based on the direction
-		if direction == sst.DirectionAscending {
-			// ascending by FirstKey
-			return bytes.Compare(possibleSegments[i].Metadata.FirstKey, possibleSegments[j].Metadata.FirstKey) < 0
-		}
-		// otherwise descending by LastKey
-		return bytes.Compare(possibleSegments[i].Metadata.LastKey, possibleSegments[j].Metadata.LastKey) > 0
+// CountRange returns the number of live keys in the range, with the same range semantics and options as GetRange.
+// Each key is counted once across segments, and deleted keys are not counted.
+//
+// Values are not decompressed, as only the keys are needed.
+//
+// Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
+func (r *Reader) CountRange(start, end []byte, direction int, opts ...RangeOption) (int64, error) {
+	opts = append(opts[:len(opts):len(opts)], func(options *rangeOptions) {
+		options.keysOnly = true
 	})
+	iter, err := r.MergeIter(start, end, direction, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("error in MergeIter: %w", err)
+	}
+	defer iter.Close()
 
-	// get row iters for all possible segments
-	segmentIters := make([]sst.RowIter, len(possibleSegments))
-	cursors := make([]sst.KVPair, len(possibleSegments)) // a buffer for the next key
-	startRange := start                                  // what to seek to
-	if direction == sst.DirectionDescending {
-		startRange = end
-	}
-
-	for i, segment := range possibleSegments {
-		g := errgroup.Group{}
-		g.Go(func() error {
-			reader, err := r.readerFactory(segment)
-			if err != nil {
-				return fmt.Errorf("error in r.readerFactor for segment %s: %w", segment.ID, err)
-			}
-
-			iter, err := reader.RowIter(direction)
-			if err != nil {
-				return fmt.Errorf("error in reader.RowIter for segment %s: %w", segment.ID, err)
-			}
-
-			// Seek it
-			err = iter.Seek(startRange)
-			if err != nil {
-				return fmt.Errorf("error in iter.Seek to start range for segment %s: %w", segment.ID, err)
-			}
-
-			segmentIters[i] = *iter
-			pair, err := segmentIters[i].Next()
-			if err != nil {
-				return fmt.Errorf("error in sst.RowIter.Next() after start range for segment %s: %w", segment.ID, err)
-			}
-			cursors[i] = pair
-			return nil
-		})
-		err := g.Wait()
+	var count int64
+	for {
+		_, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error setting up segment iterators: %w", err)
+			return 0, fmt.Errorf("error in MergeIter.Next: %w", err)
 		}
+		count++
+	}
+}
+
+// FirstKey returns the smallest live (not deleted) key across the snapshot, or sst.ErrNoRows if there are none.
+//
+// Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
+func (r *Reader) FirstKey() ([]byte, error) {
+	return r.liveBoundKey(sst.DirectionAscending)
+}
+
+// LastKey returns the largest live (not deleted) key across the snapshot, or sst.ErrNoRows if there are none.
+//
+// Runs on a snapshot of segments when invoked, can run concurrently with segment updates.
+func (r *Reader) LastKey() ([]byte, error) {
+	return r.liveBoundKey(sst.DirectionDescending)
+}
+
+// liveBoundKey bounds a MergeIter to the smallest segment first key and largest segment last key, and returns the
+// first row in the direction, skipping over tombstones.
+func (r *Reader) liveBoundKey(direction int) ([]byte, error) {
+	start, end, found := r.segmentKeyBounds()
+	if r.getOverlay() != nil {
+		// the overlay may hold keys outside of any segment
+		start, end, found = sst.UnboundStart, sst.UnboundEnd, true
+	}
+	if !found {
+		return nil, sst.ErrNoRows
 	}
 
-	for _, iter := range segmentIters {
-		// Close all the readers at the end
-		defer iter.CloseReader()
+	iter, err := r.MergeIter(start, end, direction, EndInclusive())
+	if err != nil {
+		return nil, fmt.Errorf("error in MergeIter: %w", err)
 	}
+	defer iter.Close()
 
-	rows := make([]sst.KVPair, limit)
-	addedRowIndex := 0
-	var lastKey []byte // sst.KVPair.Key can never be empty, so if this is empty we know we haven't set it yet
-	for {
-		// get the index of the cursors with the next value in the direction we want
-		nextIndexes := findMaxIndexes(cursors, func(a, b sst.KVPair) int {
-			return firstValue(a.Key, b.Key, direction)
-		})
-		if len(nextIndexes) == 0 {
-			return nil, ErrNoNextIndexFound
-		}
+	row, err := iter.Next()
+	if errors.Is(err, io.EOF) {
+		return nil, sst.ErrNoRows
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in MergeIter.Next: %w", err)
+	}
 
-		// Check if the first value is a L0 tombstone
-		if possibleSegments[nextIndexes[0]].Level == 0 && cursors[nextIndexes[0]].Value == nil {
-			// this row is deleted, roll forward all matching indexes and continue
-			// roll them forward concurrently
-			g := errgroup.Group{}
-			for _, ind := range nextIndexes {
-				g.Go(func() (err error) {
-					cursors[ind], err = segmentIters[ind].Next()
-					if err != nil {
-						return fmt.Errorf("error in sst.RowIter.Next() when rolling forward non matching for segment %s: %w", possibleSegments[ind].ID, err)
-					}
-					return
-				})
-				err := g.Wait()
-				if err != nil {
-					return nil, fmt.Errorf("error in errgroup.Group.Wait: %w", err)
-				}
-			}
-			continue
-		}
+	return row.Key, nil
+}
 
-		// Get the first value from our cursors
-		row := cursors[nextIndexes[0]]
-		if !bytes.Equal([]byte{}, lastKey) && bytes.Equal(row.Key, lastKey) {
-			// this is the same value, there will be no more values in this direction
-			break
-		}
+// segmentKeyBounds returns the smallest first key and largest last key across all segments
+func (r *Reader) segmentKeyBounds() ([]byte, []byte, bool) {
+	r.indexMu.RLock()
+	defer r.indexMu.RUnlock()
 
-		// verify that this row is in our range
-		if direction == sst.DirectionAscending && bytes.Compare(row.Key, end) >= 0 {
-			break
-		}
-		if direction == sst.DirectionDescending && bytes.Compare(row.Key, start) <= 0 {
-			// The start is the end bound
-			break
-		}
+	first, found := r.blockRangeTree.Min()
+	if !found {
+		return nil, nil, false
+	}
 
-		// otherwise we have the next value in the range
-		lastKey = row.Key
-		rows[addedRowIndex] = row
-		addedRowIndex++
-		if addedRowIndex >= limit {
-			// we have hit the limit
-			break
+	// segments are sorted by first key, so any of them may have the largest last key
+	var lastKey []byte
+	r.blockRangeTree.Ascend(func(item blockRangeItem) bool {
+		if bytes.Compare(item.record.Metadata.LastKey, lastKey) > 0 {
+			lastKey = item.record.Metadata.LastKey
 		}
+		return true
+	})
 
-		// roll forward all matching indexes
-		g := errgroup.Group{}
-		for _, ind := range nextIndexes {
-			g.Go(func() (err error) {
-				newCursor, err := segmentIters[ind].Next()
-				if errors.Is(err, io.EOF) {
-					// We can't load anymore
-					return nil
-				}
-				if err != nil {
-					return fmt.Errorf("error in sst.RowIter.Next() for rolling forward matching for segment %s: %w", possibleSegments[ind].ID, err)
-				}
-
-				cursors[ind] = newCursor
-				return
-			})
+	return first.record.Metadata.FirstKey, lastKey, true
+}
+
+// collectRows reads rows from the MergeIter up to the limit. If the limit is reached, it peeks at the next row to
+// tell whether there are more.
+func collectRows(iter *MergeIter, limit int) ([]sst.KVPair, bool, error) {
+	var rows []sst.KVPair
+	for len(rows) < limit {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return rows, false, nil
 		}
-		err := g.Wait()
 		if err != nil {
-			return nil, fmt.Errorf("error in errgroup.Group.Wait: %w", err)
+			return nil, false, fmt.Errorf("error in MergeIter.Next: %w", err)
 		}
+
+		rows = append(rows, row)
+	}
+
+	_, err := iter.Next()
+	if errors.Is(err, io.EOF) {
+		return rows, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error in MergeIter.Next: %w", err)
 	}
 
-	// Only return a slice of what actually returned
-	return rows[:addedRowIndex], nil
+	return rows, true, nil
 }
 
-var ErrNoNextIndexFound = errors.New("did not find a next index, this is a bug, please report")
+// winsConflict returns whether row wins over winner, a version of the same key found earlier in precedence order
+// (see sortSegmentsByPrecedence). The highest sequence number wins regardless of precedence, so a row without one
+// (0) loses to any row with one, and ties (such as rows without sequence numbers) go to the earlier row. GetRow,
+// MergeIter, and FederatedReader must all resolve conflicts with this, otherwise they disagree about a key.
+func winsConflict(row, winner sst.KVPair) bool {
+	return row.Seq > winner.Seq
+}
+
+// winningIndex returns the index of the winning row among cursors that have the same key, with the indexes in
+// precedence order, see winsConflict.
+func winningIndex(cursors []sst.KVPair, indexes []int) int {
+	winner := indexes[0]
+	for _, ind := range indexes[1:] {
+		if winsConflict(cursors[ind], cursors[winner]) {
+			winner = ind
+		}
+	}
+	return winner
+}
+
+// sortSegmentsByPrecedence sorts segments by ascending level, then descending ID, such that the first segment
+// containing a key has the winning version of it (without sequence numbers). GetRow and MergeIter must share this
+// order, otherwise they disagree about keys in overlapping segments of the same level.
+func sortSegmentsByPrecedence(possibleSegments []SegmentRecord) {
+	sort.Slice(possibleSegments, func(i, j int) bool {
+		if possibleSegments[i].Level != possibleSegments[j].Level {
+			// ascending by level
+			return possibleSegments[i].Level < possibleSegments[j].Level
+		}
+
+		// desc by ID to see the newest segment first, we assume that there are no duplicates
+		return possibleSegments[i].ID > possibleSegments[j].ID
+	})
+}
 
 // firstValue returns 1 if a is first by direction, 0 if they are the same, -1 if b is more significant.
 // like bytes.Compare but takes the direction into account.
@@ -396,34 +647,10 @@ func firstValue(a, b []byte, direction int) int {
 	return -1
 }
 
-// intCompareFunc is a type for the comparison function, expects the same format results as bytes.Compare
-type intCompareFunc[T any] func(a, b T) int
-
-// findMaxIndexes is a generic function to find indexes of the largest value
-func findMaxIndexes[T any](arr []T, compare intCompareFunc[T]) []int {
-	if len(arr) == 0 {
-		return nil
-	}
-
-	max := arr[0]
-	indexes := []int{0}
-
-	for i := 1; i < len(arr); i++ {
-		cmp := compare(arr[i], max)
-		if cmp > 0 {
-			max = arr[i]
-			indexes = []int{i} // reset indexes slice
-		} else if cmp == 0 {
-			indexes = append(indexes, i)
-		}
-	}
-
-	return indexes
-}
-
 // RowIter creates a new row iter for a given range. Internally, it manages multiple
-// GetRange requests and buffers their response, so it's very much a convenience API
-// and provides no performance benefits.
+// GetRange requests and buffers their response. Segment readers are kept open between
+// GetRange requests, so segments are not reopened for every page. Close the Iter if it
+// is not read to io.EOF.
 //
 // See sst.UnboundStart and sst.UnboundEnd helper vars.
 func (r *Reader) RowIter(start []byte, direction int, opts ...IterOption) *Iter {
@@ -433,6 +660,7 @@ func (r *Reader) RowIter(start []byte, direction int, opts ...IterOption) *Iter
 		direction: direction,
 		options:   defaultIterOptions,
 		rowBuffer: list.New(), // give an initial list so it knows to fill
+		readers:   newSegmentReaderCache(),
 	}
 
 	for _, opt := range opts {
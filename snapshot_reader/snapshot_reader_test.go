@@ -2,12 +2,17 @@ package snapshot_reader
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/danthegoodman1/objectkv/sst"
+	"github.com/rs/zerolog"
 )
 
 type prepareTestReaderReturn struct {
@@ -280,7 +285,7 @@ func TestGetRangeAscending(t *testing.T) {
 	snapReader := r.reader
 
 	// get a range of rows that exist
-	rows, err := snapReader.GetRange([]byte("key000"), []byte("key006"), 100, sst.DirectionAscending)
+	rows, _, err := snapReader.GetRange([]byte("key000"), []byte("key006"), 100, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -297,7 +302,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get same rows but limit
-	rows, err = snapReader.GetRange([]byte("key000"), []byte("key006"), 2, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key006"), 2, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -315,7 +320,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get some middle range
-	rows, err = snapReader.GetRange([]byte("key010"), []byte("key106"), 10, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key010"), []byte("key106"), 10, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -333,7 +338,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 in middle, ensure only 1
-	rows, err = snapReader.GetRange([]byte("key00"), []byte("key0000"), 2, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key00"), []byte("key0000"), 2, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -343,7 +348,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 from start, ensure first key
-	rows, err = snapReader.GetRange([]byte("key000"), []byte("key0000"), 2, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key0000"), 2, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -353,7 +358,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 from end, ensure last key
-	rows, err = snapReader.GetRange([]byte("key900"), []byte("key901"), 2, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key900"), []byte("key901"), 2, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -363,7 +368,7 @@ func TestGetRangeAscending(t *testing.T) {
 	}
 
 	// get an empty range
-	rows, err = snapReader.GetRange([]byte("key901"), []byte("key910"), 100, sst.DirectionAscending)
+	rows, _, err = snapReader.GetRange([]byte("key901"), []byte("key910"), 100, sst.DirectionAscending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -382,7 +387,7 @@ func TestGetRangeDescending(t *testing.T) {
 	snapReader := r.reader
 
 	// get a range of rows that exist
-	rows, err := snapReader.GetRange([]byte("key000"), []byte("key006"), 100, sst.DirectionDescending)
+	rows, _, err := snapReader.GetRange([]byte("key000"), []byte("key006"), 100, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -400,7 +405,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get same rows but limit
-	rows, err = snapReader.GetRange([]byte("key000"), []byte("key006"), 2, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key006"), 2, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -418,7 +423,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get some middle range
-	rows, err = snapReader.GetRange([]byte("key010"), []byte("key106"), 10, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key010"), []byte("key106"), 10, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -436,7 +441,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 in middle, ensure only 1
-	rows, err = snapReader.GetRange([]byte("key00"), []byte("key0000"), 2, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key00"), []byte("key0000"), 2, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -446,7 +451,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 from start, ensure first key
-	rows, err = snapReader.GetRange([]byte("key00"), []byte("key000"), 2, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key00"), []byte("key000"), 2, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -456,7 +461,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get a range of rows that would only have 1 from end, ensure last key
-	rows, err = snapReader.GetRange([]byte("key899"), []byte("key901"), 2, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key899"), []byte("key901"), 2, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -466,7 +471,7 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 
 	// get an empty range
-	rows, err = snapReader.GetRange([]byte("key901"), []byte("key910"), 100, sst.DirectionDescending)
+	rows, _, err = snapReader.GetRange([]byte("key901"), []byte("key910"), 100, sst.DirectionDescending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -478,52 +483,1204 @@ func TestGetRangeDescending(t *testing.T) {
 	}
 }
 
-func TestFindMaxIndexes(t *testing.T) {
-	items := []sst.KVPair{
-		{
-			Key: []byte("b"),
+func TestGetRangeHasMore(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// [key000, key006) has 7 rows (including key0010)
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		for _, tc := range []struct {
+			limit   int
+			hasMore bool
+		}{
+			{limit: 2, hasMore: true},
+			{limit: 6, hasMore: true},
+			{limit: 7, hasMore: false},
+			{limit: 100, hasMore: false},
+		} {
+			rows, hasMore, err := snapReader.GetRange([]byte("key000"), []byte("key006"), tc.limit, direction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != min(tc.limit, 7) {
+				logRows(t, rows)
+				t.Fatal("Got wrong rows length, got", len(rows), "for limit", tc.limit)
+			}
+			if hasMore != tc.hasMore {
+				t.Fatal("expected hasMore", tc.hasMore, "for limit", tc.limit, "direction", direction)
+			}
+		}
+	}
+
+	// an empty range has no more
+	rows, hasMore, err := snapReader.GetRange([]byte("key901"), []byte("key910"), 1, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 || hasMore {
+		t.Fatal("expected no rows and no more, got", len(rows), hasMore)
+	}
+}
+
+// blockCountingReader counts the data blocks read from a segment
+type blockCountingReader struct {
+	sst.BytesReadSeekCloser
+	blockSize  int
+	blocksRead *int
+}
+
+func (c blockCountingReader) Read(p []byte) (int, error) {
+	if len(p)%c.blockSize == 0 {
+		*c.blocksRead += len(p) / c.blockSize
+	}
+	return c.BytesReadSeekCloser.Read(p)
+}
+
+func TestGetRangeTailScan(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	var rows []sst.KVPair
+	for i := 0; i < 5000; i++ {
+		rows = append(rows, sst.KVPair{
+			Key:   []byte(fmt.Sprintf("key%05d", i)),
+			Value: []byte(fmt.Sprintf("value%05d", i)),
+		})
+	}
+	segment := prepareTestSegment(t, "1", 0, opts, rows)
+	if segment.record.Metadata.BlockIndex.Len() < 20 {
+		t.Fatal("expected many blocks, got", segment.record.Metadata.BlockIndex.Len())
+	}
+
+	blocksRead := 0
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		reader := sst.NewSegmentReader(blockCountingReader{
+			BytesReadSeekCloser: sst.BytesReadSeekCloser{Reader: bytes.NewReader(segment.bytes)},
+			blockSize:           int(opts.DataBlockSize),
+			blocksRead:          &blocksRead,
+		}, len(segment.bytes))
+		return &reader, nil
+	})
+	snapReader.UpdateSegments([]SegmentRecord{segment.record}, nil)
+
+	for _, tc := range []struct {
+		start, end []byte
+		lastKey    int
+	}{
+		{start: []byte("key01000"), end: []byte("key04000"), lastKey: 4000},
+		{start: sst.UnboundStart, end: sst.UnboundEnd, lastKey: 4999},
+	} {
+		blocksRead = 0
+		got, _, err := snapReader.GetRange(tc.start, tc.end, 10, sst.DirectionDescending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 10 {
+			t.Fatal("expected 10 rows, got", len(got))
+		}
+		for i, row := range got {
+			if string(row.Key) != fmt.Sprintf("key%05d", tc.lastKey-i) {
+				t.Fatal("unexpected key", string(row.Key), "at", i)
+			}
+		}
+
+		// the block with the end, possibly the one before it for the rest of the rows, and one more for hasMore
+		if blocksRead > 3 {
+			t.Fatal("expected to only read the blocks near the end, read", blocksRead, "blocks")
+		}
+	}
+}
+
+type testSegment struct {
+	record SegmentRecord
+	bytes  []byte
+}
+
+// prepareTestSegment writes the rows to a new segment, using the row sequence if enabled, see SegmentWriter.WriteKVPair
+func prepareTestSegment(t *testing.T, id string, level int, opts sst.SegmentWriterOptions, rows []sst.KVPair) testSegment {
+	seg := &bytes.Buffer{}
+	w := sst.NewSegmentWriter(
+		sst.BytesWriteCloser{
+			Buffer: seg,
+		}, opts)
+	for _, row := range rows {
+		err := w.WriteKVPair(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metaBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := (&sst.SegmentReader{}).BytesToMetadata(metaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testSegment{
+		record: SegmentRecord{
+			ID:       id,
+			Level:    level,
+			Metadata: *meta,
 		},
-		{
-			Key: []byte("b"),
+		bytes: seg.Bytes(),
+	}
+}
+
+// prepareTestSegmentReader creates a snapshot reader over the provided segments
+func prepareTestSegmentReader(segments ...testSegment) *Reader {
+	segmentBytes := map[string][]byte{}
+	var records []SegmentRecord
+	for _, segment := range segments {
+		segmentBytes[segment.record.ID] = segment.bytes
+		records = append(records, segment.record)
+	}
+
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		b, found := segmentBytes[record.ID]
+		if !found {
+			panic("unexpected record id: " + record.ID)
+		}
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{
+			Reader: bytes.NewReader(b),
+		}, len(b))
+		return &reader, nil
+	})
+	snapReader.UpdateSegments(records, nil)
+
+	return snapReader
+}
+
+func TestRowSequenceConflictResolution(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.RowSequence = true
+
+	// the newer segment has an older sequence number for key1
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("new"), Seq: 10},
+			{Key: []byte("key2"), Value: []byte("old"), Seq: 1},
+		}),
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("old"), Seq: 5},
+			{Key: []byte("key2"), Value: []byte("new"), Seq: 6},
+			{Key: []byte("key3"), Value: []byte("new"), Seq: 0},
+		}),
+		prepareTestSegment(t, "3", 1, opts, []sst.KVPair{
+			{Key: []byte("key3"), Value: []byte("old"), Seq: 0},
+		}),
+	)
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		val, err := snapReader.GetRow([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "new" {
+			t.Fatal("unexpected GetRow value for", key, "got", string(val))
+		}
+	}
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		rows, _, err := snapReader.GetRange([]byte("key0"), []byte("key9"), 10, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 3 {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+		for _, row := range rows {
+			if string(row.Value) != "new" {
+				logRows(t, rows)
+				t.Fatal("unexpected GetRange value for", string(row.Key))
+			}
+		}
+	}
+}
+
+func TestRowSequenceMixedConflictResolution(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	seqOpts := opts
+	seqOpts.RowSequence = true
+
+	// the newest segment has no sequence numbers, so its rows only win ties
+	newest := prepareTestSegment(t, "3", 0, opts, []sst.KVPair{
+		sst.NewTombstone([]byte("a")),
+		{Key: []byte("b"), Value: []byte("win")},
+		{Key: []byte("c"), Value: []byte("win")},
+	})
+	sequenced := prepareTestSegment(t, "2", 0, seqOpts, []sst.KVPair{
+		{Key: []byte("a"), Value: []byte("win"), Seq: 5},
+		{Key: []byte("b"), Value: []byte("lose"), Seq: 0},
+		{Key: []byte("d"), Value: []byte("win"), Seq: 3},
+	})
+	oldest := prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+		{Key: []byte("c"), Value: []byte("lose")},
+		{Key: []byte("d"), Value: []byte("lose")},
+	})
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+
+	snapReader := prepareTestSegmentReader(newest, sequenced, oldest)
+	for _, key := range keys {
+		val, err := snapReader.GetRow(key)
+		if err != nil {
+			t.Fatal(err, "for", string(key))
+		}
+		if string(val) != "win" {
+			t.Fatal("unexpected GetRow value for", string(key), "got", string(val))
+		}
+	}
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		rows, _, err := snapReader.GetRange([]byte("0"), []byte("z"), 10, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(keys) {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+		for _, row := range rows {
+			if string(row.Value) != "win" {
+				logRows(t, rows)
+				t.Fatal("unexpected GetRange value for", string(row.Key))
+			}
+		}
+	}
+	err := snapReader.SelfCheck(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same rule resolves conflicts across federated readers
+	federated := NewFederatedReader(prepareTestSegmentReader(newest), prepareTestSegmentReader(sequenced))
+	val, err := federated.GetRow([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "win" {
+		t.Fatal("unexpected federated GetRow value, got", string(val))
+	}
+	rows, _, err := federated.GetRange([]byte("a"), []byte("z"), 10, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || string(rows[0].Key) != "a" || string(rows[0].Value) != "win" {
+		logRows(t, rows)
+		t.Fatal("unexpected federated GetRange rows")
+	}
+}
+
+func TestGetRowAsOf(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	epochSegment := func(id string, level int, epoch uint64, rows []sst.KVPair) testSegment {
+		epochOpts := opts
+		epochOpts.Epoch = epoch
+		segment := prepareTestSegment(t, id, level, epochOpts, rows)
+		if segment.record.Metadata.Epoch != epoch {
+			t.Fatal("unexpected segment epoch", segment.record.Metadata.Epoch)
+		}
+		return segment
+	}
+
+	snapReader := prepareTestSegmentReader(
+		epochSegment("3", 0, 3, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("v3")},
+			{Key: []byte("key2"), Tombstone: true},
+		}),
+		epochSegment("2", 0, 2, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("v2")},
+			{Key: []byte("key3"), Value: []byte("v2")},
+		}),
+		epochSegment("1", 1, 1, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("v1")},
+			{Key: []byte("key2"), Value: []byte("v1")},
+		}),
+		// without an epoch
+		prepareTestSegment(t, "0", 2, opts, []sst.KVPair{
+			{Key: []byte("key4"), Value: []byte("v0")},
+		}),
+	)
+
+	tests := []struct {
+		epoch    uint64
+		key      string
+		expected string // empty for sst.ErrNoRows
+	}{
+		{epoch: 0, key: "key1"},
+		{epoch: 0, key: "key4", expected: "v0"},
+		{epoch: 1, key: "key1", expected: "v1"},
+		{epoch: 1, key: "key2", expected: "v1"},
+		{epoch: 1, key: "key3"},
+		{epoch: 2, key: "key1", expected: "v2"},
+		{epoch: 2, key: "key2", expected: "v1"},
+		{epoch: 2, key: "key3", expected: "v2"},
+		{epoch: 3, key: "key1", expected: "v3"},
+		{epoch: 3, key: "key2"},
+		{epoch: 100, key: "key1", expected: "v3"},
+		{epoch: 100, key: "key4", expected: "v0"},
+	}
+	for _, test := range tests {
+		val, err := snapReader.GetRowAsOf([]byte(test.key), test.epoch)
+		if test.expected == "" {
+			if !errors.Is(err, sst.ErrNoRows) {
+				t.Fatal("expected no rows for", test.key, "at epoch", test.epoch, "got", string(val), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != test.expected {
+			t.Fatal("unexpected value for", test.key, "at epoch", test.epoch, "got", string(val))
+		}
+	}
+
+	// the latest epoch matches GetRow
+	val, err := snapReader.GetRow([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "v3" {
+		t.Fatal("unexpected GetRow value", string(val))
+	}
+}
+
+func TestGetRangeEndInclusive(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// ascending
+	rows, _, err := snapReader.GetRange([]byte("key000"), []byte("key005"), 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 || string(rows[len(rows)-1].Key) != "key004" {
+		logRows(t, rows)
+		t.Fatal("Got wrong exclusive rows, got length", len(rows))
+	}
+
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key005"), 100, sst.DirectionAscending, EndInclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 || string(rows[len(rows)-1].Key) != "key005" {
+		logRows(t, rows)
+		t.Fatal("Got wrong inclusive rows, got length", len(rows))
+	}
+
+	// descending
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key005"), 100, sst.DirectionDescending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 || string(rows[len(rows)-1].Key) != "key001" {
+		logRows(t, rows)
+		t.Fatal("Got wrong exclusive rows, got length", len(rows))
+	}
+
+	rows, _, err = snapReader.GetRange([]byte("key000"), []byte("key005"), 100, sst.DirectionDescending, EndInclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 || string(rows[len(rows)-1].Key) != "key000" {
+		logRows(t, rows)
+		t.Fatal("Got wrong inclusive rows, got length", len(rows))
+	}
+
+	// a single key range is only valid when inclusive
+	_, _, err = snapReader.GetRange([]byte("key005"), []byte("key005"), 100, sst.DirectionAscending)
+	if !errors.Is(err, ErrInvalidRange) {
+		t.Fatal("did not get invalid range error, got:", err)
+	}
+	rows, _, err = snapReader.GetRange([]byte("key005"), []byte("key005"), 100, sst.DirectionAscending, EndInclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || string(rows[0].Key) != "key005" {
+		logRows(t, rows)
+		t.Fatal("Got wrong single key rows, got length", len(rows))
+	}
+
+	// unbound end is unaffected
+	rows, _, err = snapReader.GetRange([]byte("key199"), sst.UnboundEnd, 100, sst.DirectionAscending, EndInclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || string(rows[len(rows)-1].Key) != "key900" {
+		logRows(t, rows)
+		t.Fatal("Got wrong unbound rows, got length", len(rows))
+	}
+}
+
+func TestTombstoneRatio(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	snapReader := prepareTestSegmentReader()
+	if ratio := snapReader.TombstoneRatio(); ratio != 0 {
+		t.Fatal("unexpected empty tombstone ratio", ratio)
+	}
+
+	snapReader = prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Tombstone: true},
+			{Key: []byte("key2"), Value: []byte("value2")},
+		}),
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("value1")},
+			{Key: []byte("key3"), Tombstone: true},
+			{Key: []byte("key4"), Value: []byte("value4")},
+			{Key: []byte("key5"), Value: []byte("value5")},
+		}),
+	)
+	if ratio := snapReader.TombstoneRatio(); ratio != 2.0/6.0 {
+		t.Fatal("unexpected tombstone ratio", ratio)
+	}
+}
+
+func TestGetRangeKeyFilter(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// only keep even keys
+	evenKeys := KeyFilter(func(key []byte) bool {
+		return key[len(key)-1]%2 == 0
+	})
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		rows, _, err := snapReader.GetRange([]byte("key000"), []byte("key100"), 10, direction, evenKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the limit only applies to rows that survive the filter
+		if len(rows) != 10 {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+		for _, row := range rows {
+			if row.Key[len(row.Key)-1]%2 != 0 {
+				logRows(t, rows)
+				t.Fatal("got filtered key", string(row.Key))
+			}
+		}
+	}
+
+	// filter everything
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 10, sst.DirectionAscending, KeyFilter(func(key []byte) bool {
+		return false
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		logRows(t, rows)
+		t.Fatal("Got wrong rows length, got", len(rows))
+	}
+}
+
+func TestTombstoneOnlySegment(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	tombstones := prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+		{Key: []byte("key2"), Tombstone: true},
+		{Key: []byte("key3"), Tombstone: true},
+	})
+	if tombstones.record.Metadata.TombstoneCount != 2 || tombstones.record.Metadata.TombstoneRatio() != 1 {
+		t.Fatal("expected a tombstone only segment")
+	}
+
+	snapReader := prepareTestSegmentReader(
+		tombstones,
+		prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("value1")},
+			{Key: []byte("key2"), Value: []byte("value2")},
+			{Key: []byte("key4"), Value: []byte("value4")},
+		}),
+	)
+
+	_, err := snapReader.GetRow([]byte("key2"))
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected the tombstone to shadow key2, got", err)
+	}
+	val, err := snapReader.GetRow([]byte("key4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value4" {
+		t.Fatal("unexpected value", string(val))
+	}
+
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || string(rows[0].Key) != "key1" || string(rows[1].Key) != "key4" {
+		logRows(t, rows)
+		t.Fatal("unexpected rows")
+	}
+}
+
+func TestFirstLastKey(t *testing.T) {
+	r := prepareTestReader(t)
+	first, err := r.reader.FirstKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "key000" {
+		t.Fatal("unexpected first key", string(first))
+	}
+	last, err := r.reader.LastKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(last) != "key900" {
+		t.Fatal("unexpected last key", string(last))
+	}
+
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	// the bounds of the segments are deleted
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Tombstone: true},
+			{Key: []byte("key2"), Tombstone: true},
+			{Key: []byte("key5"), Tombstone: true},
+		}),
+		prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("value1")},
+			{Key: []byte("key2"), Value: []byte("value2")},
+			{Key: []byte("key3"), Value: []byte("value3")},
+			{Key: []byte("key4"), Value: []byte("value4")},
+			{Key: []byte("key5"), Value: []byte("value5")},
+		}),
+	)
+	first, err = snapReader.FirstKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err = snapReader.LastKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "key3" || string(last) != "key4" {
+		t.Fatal("unexpected live bounds", string(first), string(last))
+	}
+
+	// everything is deleted
+	snapReader = prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Tombstone: true},
+		}),
+	)
+	_, err = snapReader.FirstKey()
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	_, err = snapReader.LastKey()
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+
+	// no segments
+	_, err = prepareTestSegmentReader().FirstKey()
+	if !errors.Is(err, sst.ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+}
+
+func TestBoundaryKeys(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+
+	// keys equal to and after the UnboundEnd sentinel
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+			{Key: []byte{0x00}, Value: []byte("a")},
+			{Key: []byte{0xff}, Value: []byte("a")},
+		}),
+		prepareTestSegment(t, "2", 2, opts, []sst.KVPair{
+			{Key: []byte{0xff}, Value: []byte("b")},
+			{Key: []byte{0xff, 0x01}, Value: []byte("b")},
+		}),
+		prepareTestSegment(t, "3", 0, opts, []sst.KVPair{
+			{Key: []byte{0xff, 0xff}, Value: []byte("c")},
+		}),
+	)
+
+	for key, expected := range map[string]string{
+		"\x00":     "a",
+		"\xff":     "a",
+		"\xff\x01": "b",
+		"\xff\xff": "c",
+	} {
+		val, err := snapReader.GetRow([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != expected {
+			t.Fatalf("unexpected value for %x: %s", key, val)
+		}
+	}
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 4 {
+			logRows(t, rows)
+			t.Fatal("Got wrong rows length, got", len(rows))
+		}
+	}
+
+	// replacing a segment with different keys, and dropping by ID only
+	snapReader.UpdateSegments([]SegmentRecord{
+		{ID: "3", Level: 0, Metadata: sst.SegmentMetadata{FirstKey: []byte{0x01}, LastKey: []byte{0x02}}},
+	}, nil)
+	if segments := snapReader.getPossibleSegmentsForKey([]byte{0xff, 0xff}); len(segments) != 0 {
+		t.Fatal("expected replaced segment to be removed from the range tree")
+	}
+	snapReader.UpdateSegments(nil, []SegmentRecord{{ID: "3"}})
+	if segments := snapReader.getPossibleSegmentsForKey([]byte{0x01}); len(segments) != 1 || segments[0].ID != "1" {
+		t.Fatal("expected dropped segment to be removed from the range tree, got", segments)
+	}
+}
+
+func TestSegmentsForRange(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	segment := func(id string, keys ...string) testSegment {
+		var rows []sst.KVPair
+		for _, key := range keys {
+			rows = append(rows, sst.KVPair{Key: []byte(key), Value: []byte("v")})
+		}
+		return prepareTestSegment(t, id, 0, opts, rows)
+	}
+	snapReader := prepareTestSegmentReader(
+		segment("1", "a00", "a09"),
+		segment("2", "b00", "b09"),
+		segment("3", "a05", "b05"),
+	)
+
+	tests := []struct {
+		start, end []byte
+		expected   []string
+	}{
+		{start: []byte("a00"), end: []byte("a03"), expected: []string{"1"}},
+		{start: []byte("b06"), end: []byte("b07"), expected: []string{"2"}},
+		{start: []byte("a06"), end: []byte("b01"), expected: []string{"1", "2", "3"}},
+		{start: []byte("a08"), end: []byte("a09"), expected: []string{"1", "3"}},
+		{start: sst.UnboundStart, end: sst.UnboundEnd, expected: []string{"1", "2", "3"}},
+		{start: []byte("c00"), end: []byte("c01"), expected: nil},
+		{start: []byte("0"), end: []byte("1"), expected: nil},
+	}
+	for _, tc := range tests {
+		var ids []string
+		for _, record := range snapReader.SegmentsForRange(tc.start, tc.end) {
+			ids = append(ids, record.ID)
+		}
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+			t.Fatal("expected segments", tc.expected, "got", ids, "for range", string(tc.start), string(tc.end))
+		}
+	}
+}
+
+func TestTombstonePredicate(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			sst.NewTombstone([]byte("key1")),
+			{Key: []byte("key2"), Tombstone: true},
+			{Key: []byte("key3"), Value: []byte("v2")},
+			{Key: []byte("key4"), Value: []byte{}},
+		}),
+		prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("v1")},
+			{Key: []byte("key2"), Value: []byte("v1")},
+			{Key: []byte("key3"), Value: []byte("v1")},
+			{Key: []byte("key4"), Value: []byte("v1")},
+		}),
+	)
+
+	// the rows as written read back as tombstones
+	iter, err := snapReader.MergeIter(sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending, func(options *rangeOptions) {
+		options.includeTombstones = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for _, expected := range []bool{true, true, false, false} {
+		row, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.IsTombstone() != expected {
+			t.Fatal("expected IsTombstone", expected, "for", string(row.Key))
+		}
+	}
+
+	// GetRow and GetRange both treat them as deleted
+	for _, key := range []string{"key1", "key2"} {
+		_, err := snapReader.GetRow([]byte(key))
+		if !errors.Is(err, sst.ErrNoRows) {
+			t.Fatal("expected sst.ErrNoRows for", key, "got", err)
+		}
+	}
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || string(rows[0].Key) != "key3" || rows[0].IsTombstone() {
+		logRows(t, rows)
+		t.Fatal("expected key3 and key4")
+	}
+
+	// an empty value is a live row that shadows older values
+	value, err := snapReader.GetRow([]byte("key4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 0 || len(rows[1].Value) != 0 {
+		t.Fatal("expected an empty value for key4, got", string(value), string(rows[1].Value))
+	}
+}
+
+func TestGetRangeIncludeTombstones(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("v1")},
+			{Key: []byte("key2"), Value: []byte("v1")},
+			{Key: []byte("key3"), Value: []byte("v1")},
+			{Key: []byte("key4"), Value: []byte("v1")},
+		}),
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			sst.NewTombstone([]byte("key2")),
+			sst.NewTombstone([]byte("key4")),
+			sst.NewTombstone([]byte("key5")),
+		}),
+		prepareTestSegment(t, "3", 0, opts, []sst.KVPair{
+			{Key: []byte("key4"), Value: []byte("v3")},
+		}),
+	)
+
+	for _, tc := range []struct {
+		opts     []RangeOption
+		expected string
+	}{
+		{expected: "key1=v1 key3=v1 key4=v3"},
+		{opts: []RangeOption{IncludeTombstones()}, expected: "key1=v1 key2= key3=v1 key4=v3 key5="},
+	} {
+		rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range rows {
+			got = append(got, string(row.Key)+"="+string(row.Value))
+			if row.IsTombstone() != (string(row.Key) == "key2" || string(row.Key) == "key5") {
+				t.Fatal("unexpected IsTombstone", row.IsTombstone(), "for", string(row.Key))
+			}
+		}
+		if strings.Join(got, " ") != tc.expected {
+			t.Fatal("expected", tc.expected, "got", strings.Join(got, " "))
+		}
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	r := prepareTestReader(t)
+	snapReader := r.reader
+
+	// add a newer segment with tombstones, and compressed values
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.ValueCompressionThreshold = 8
+	segment := prepareTestSegment(t, "3-0", 0, opts, []sst.KVPair{
+		sst.NewTombstone([]byte("key003")),
+		{Key: []byte("key004"), Value: bytes.Repeat([]byte("compressed"), 10)},
+		sst.NewTombstone([]byte("key050")),
+		sst.NewTombstone([]byte("key0500")), // never existed
+		{Key: []byte("key1000"), Value: bytes.Repeat([]byte("new"), 10)},
+	})
+	readerFactory := snapReader.readerFactory
+	snapReader.readerFactory = func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		if record.ID == segment.record.ID {
+			reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(segment.bytes)}, len(segment.bytes))
+			return &reader, nil
+		}
+		return readerFactory(ctx, record)
+	}
+	snapReader.UpdateSegments([]SegmentRecord{segment.record}, nil)
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		for _, bounds := range [][2][]byte{
+			{sst.UnboundStart, sst.UnboundEnd},
+			{[]byte("key000"), []byte("key006")},
+			{[]byte("key040"), []byte("key060")},
+			{[]byte("key901"), []byte("key910")},
+		} {
+			rows, _, err := snapReader.GetRange(bounds[0], bounds[1], 10_000, direction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := snapReader.CountRange(bounds[0], bounds[1], direction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(len(rows)) {
+				t.Fatal("expected count", len(rows), "got", count, "for range", string(bounds[0]), string(bounds[1]))
+			}
+		}
+	}
+
+	// 200 keys, plus key0010, key900, and key1000, minus the 2 deleted
+	count, err := snapReader.CountRange(sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 201 {
+		t.Fatal("expected 201 live keys, got", count)
+	}
+}
+
+func TestReaderIsNotExist(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	kept := prepareTestSegment(t, "1", 0, opts, []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("a")},
+		{Key: []byte("key3"), Value: []byte("a")},
+	})
+	deleted := prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("b")},
+		{Key: []byte("key2"), Value: []byte("b")},
+	})
+
+	// the file of the newer segment was deleted by compaction
+	factory := func(record SegmentRecord) (*sst.SegmentReader, error) {
+		if record.ID == deleted.record.ID {
+			return nil, fmt.Errorf("error opening segment %s: %w", record.ID, fs.ErrNotExist)
+		}
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{
+			Reader: bytes.NewReader(kept.bytes),
+		}, len(kept.bytes))
+		return &reader, nil
+	}
+
+	snapReader := NewReader(factory)
+	snapReader.UpdateSegments([]SegmentRecord{kept.record, deleted.record}, nil)
+	_, err := snapReader.GetRow([]byte("key1"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("expected fs.ErrNotExist without IsNotExist, got", err)
+	}
+
+	logs := &bytes.Buffer{}
+	logger := zerolog.New(logs)
+	readerOpts := DefaultReaderOptions()
+	readerOpts.IsNotExist = func(err error) bool {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	readerOpts.Logger = &logger
+	snapReader = NewReaderWithOptions(factory, readerOpts)
+	snapReader.UpdateSegments([]SegmentRecord{kept.record, deleted.record}, nil)
+
+	val, err := snapReader.GetRow([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "a" {
+		t.Fatal("expected the value from the remaining segment, got", string(val))
+	}
+
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 100, sst.DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || string(rows[0].Key) != "key1" || string(rows[1].Key) != "key3" {
+		t.Fatal("unexpected rows", rows)
+	}
+
+	if !strings.Contains(logs.String(), `"segmentID":"2"`) {
+		t.Fatal("expected the skipped segment to be logged, got", logs.String())
+	}
+}
+
+func TestGetRowFull(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.RowSequence = true
+
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 1, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("l1"), Seq: 1},
+			{Key: []byte("key2"), Value: []byte("l1"), Seq: 2},
+			{Key: []byte("key3"), Value: []byte("l1"), Seq: 3},
+		}),
+		prepareTestSegment(t, "2", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("old"), Seq: 4},
+			{Key: []byte("key2"), Value: []byte("old"), Seq: 5},
+		}),
+		prepareTestSegment(t, "3", 0, opts, []sst.KVPair{
+			{Key: []byte("key1"), Value: []byte("new"), Seq: 6},
+			{Key: []byte("key4"), Tombstone: true, Seq: 7},
+		}),
+	)
+
+	for _, tc := range []struct {
+		key     string
+		value   string
+		seq     uint64
+		segment string
+		level   int
+	}{
+		{key: "key1", value: "new", seq: 6, segment: "3", level: 0},
+		{key: "key2", value: "old", seq: 5, segment: "2", level: 0},
+		{key: "key3", value: "l1", seq: 3, segment: "1", level: 1},
+	} {
+		row, segment, err := snapReader.GetRowFull([]byte(tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(row.Key) != tc.key || string(row.Value) != tc.value || row.Seq != tc.seq {
+			t.Fatal("unexpected row for", tc.key, string(row.Key), string(row.Value), row.Seq)
+		}
+		if segment.ID != tc.segment || segment.Level != tc.level {
+			t.Fatal("expected", tc.key, "from segment", tc.segment, "got", segment.ID, "level", segment.Level)
+		}
+	}
+
+	// deleted and missing keys are not found, like GetRow
+	for _, key := range []string{"key4", "key5"} {
+		_, _, err := snapReader.GetRowFull([]byte(key))
+		if !errors.Is(err, sst.ErrNoRows) {
+			t.Fatal("expected sst.ErrNoRows for", key, "got", err)
+		}
+	}
+}
+
+func TestContextFactory(t *testing.T) {
+	segment := prepareTestSegment(t, "1", 0, sst.DefaultSegmentWriterOptions(), []sst.KVPair{
+		{Key: []byte("key1"), Value: []byte("value1")},
+		{Key: []byte("key2"), Value: []byte("value2")},
+	})
+
+	// blocks until the request is cancelled, like a hung remote open
+	snapReader := NewReaderWithContextFactory(func(ctx context.Context, record SegmentRecord) (*sst.SegmentReader, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, DefaultReaderOptions())
+	snapReader.UpdateSegments([]SegmentRecord{segment.record}, nil)
+
+	requests := map[string]func(ctx context.Context) error{
+		"GetRowContext": func(ctx context.Context) error {
+			_, err := snapReader.GetRowContext(ctx, []byte("key1"))
+			return err
 		},
-		{
-			Key: []byte("a"),
+		"GetRangeContext": func(ctx context.Context) error {
+			_, _, err := snapReader.GetRangeContext(ctx, sst.UnboundStart, sst.UnboundEnd, 10, sst.DirectionAscending)
+			return err
 		},
-		{
-			Key: []byte("b"),
+		"MergeIterContext": func(ctx context.Context) error {
+			_, err := snapReader.MergeIterContext(ctx, sst.UnboundStart, sst.UnboundEnd, sst.DirectionAscending)
+			return err
 		},
 	}
+	for name, request := range requests {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		started := time.Now()
+		err := request(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("expected context.DeadlineExceeded for", name, "got", err)
+		}
+		if time.Since(started) > time.Second {
+			t.Fatal("expected", name, "to return promptly, took", time.Since(started))
+		}
+	}
 
-	indexes := findMaxIndexes(items, func(a, b sst.KVPair) int {
-		return bytes.Compare(a.Key, b.Key)
+	// the old signature is adapted
+	snapReader = NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{Reader: bytes.NewReader(segment.bytes)}, len(segment.bytes))
+		return &reader, nil
 	})
+	snapReader.UpdateSegments([]SegmentRecord{segment.record}, nil)
+	value, err := snapReader.GetRowContext(context.Background(), []byte("key2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value2" {
+		t.Fatal("unexpected value", string(value))
+	}
+}
 
-	// verify result is []int{0, 1, 3}
-	expected := []int{0, 1, 3}
+func TestGetRangeSkip(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
 
-	if len(indexes) != len(expected) {
-		t.Errorf("Expected %d indexes, but got %d", len(expected), len(indexes))
+	var older, newer []sst.KVPair
+	for i := 0; i < 100; i++ {
+		older = append(older, sst.KVPair{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte(fmt.Sprintf("old%d", i))})
+		if i%3 == 0 {
+			newer = append(newer, sst.NewTombstone([]byte(fmt.Sprintf("key%03d", i))))
+		} else if i%5 == 0 {
+			newer = append(newer, sst.KVPair{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte(fmt.Sprintf("new%d", i))})
+		}
 	}
+	snapReader := prepareTestSegmentReader(
+		prepareTestSegment(t, "1", 0, opts, older),
+		prepareTestSegment(t, "2", 0, opts, newer),
+	)
+
+	for _, direction := range []int{sst.DirectionAscending, sst.DirectionDescending} {
+		all, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1000, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	for i, v := range expected {
-		if i >= len(indexes) || indexes[i] != v {
-			t.Errorf("Mismatch at position %d: expected %d, got %d", i, v, indexes[i])
+		for _, skip := range []int{0, 1, 10, len(all) - 5, len(all), len(all) + 10} {
+			rows, hasMore, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 10, direction, Skip(skip))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := all[min(skip, len(all)):min(skip+10, len(all))]
+			if len(rows) != len(expected) {
+				t.Fatal("expected", len(expected), "rows, got", len(rows), "for skip", skip, "direction", direction)
+			}
+			for i := range expected {
+				if !bytes.Equal(rows[i].Key, expected[i].Key) || !bytes.Equal(rows[i].Value, expected[i].Value) {
+					t.Fatal("unexpected row", string(rows[i].Key), string(rows[i].Value), "expected", string(expected[i].Key), "for skip", skip)
+				}
+			}
+			if hasMore != (skip+10 < len(all)) {
+				t.Fatal("unexpected hasMore", hasMore, "for skip", skip)
+			}
 		}
 	}
 
-	indexes = findMaxIndexes(items, func(a, b sst.KVPair) int {
-		return bytes.Compare(a.Key, b.Key) * -1
-	})
+	// the skip counts rows after filtering
+	rows, _, err := snapReader.GetRange(sst.UnboundStart, sst.UnboundEnd, 1, sst.DirectionAscending, Skip(2), KeyFilter(func(key []byte) bool {
+		return bytes.HasSuffix(key, []byte("0"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key000 and key030 are deleted, so key010, key020, then key040
+	if len(rows) != 1 || string(rows[0].Key) != "key040" {
+		t.Fatal("unexpected rows", rows)
+	}
+}
 
-	expected = []int{2}
+func TestOnSegmentsDropped(t *testing.T) {
+	opts := sst.DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	var segments []testSegment
+	for i := 0; i < 3; i++ {
+		segments = append(segments, prepareTestSegment(t, fmt.Sprint(i), 0, opts, []sst.KVPair{
+			{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte("a")},
+		}))
+	}
+
+	// the factory caches readers with their loaded metadata by segment ID
+	cache := map[string]*sst.SegmentReader{}
+	factory := func(record SegmentRecord) (*sst.SegmentReader, error) {
+		if reader, found := cache[record.ID]; found {
+			return reader, nil
+		}
+		for _, segment := range segments {
+			if segment.record.ID == record.ID {
+				reader := sst.NewSegmentReader(sst.BytesReadSeekCloser{
+					Reader: bytes.NewReader(segment.bytes),
+				}, len(segment.bytes))
+				cache[record.ID] = &reader
+				return &reader, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrSegmentGone, record.ID)
+	}
 
-	if len(indexes) != len(expected) {
-		t.Errorf("Expected %d indexes, but got %d", len(expected), len(indexes))
+	var dropped []string
+	readerOpts := DefaultReaderOptions()
+	readerOpts.OnSegmentsDropped = func(records []SegmentRecord) {
+		for _, record := range records {
+			dropped = append(dropped, record.ID)
+			delete(cache, record.ID)
+		}
+	}
+	snapReader := NewReaderWithOptions(factory, readerOpts)
+	snapReader.UpdateSegments([]SegmentRecord{segments[0].record, segments[1].record, segments[2].record}, nil)
+	if len(dropped) != 0 {
+		t.Fatal("expected nothing to be dropped, got", dropped)
 	}
 
-	for i, v := range expected {
-		if i >= len(indexes) || indexes[i] != v {
-			t.Errorf("Mismatch at position %d: expected %d, got %d", i, v, indexes[i])
+	for i := 0; i < 3; i++ {
+		_, err := snapReader.GetRow([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
 		}
 	}
+	if len(cache) != 3 {
+		t.Fatal("expected 3 cached readers, got", len(cache))
+	}
+
+	// drop one segment and replace another, an unknown segment isn't reported
+	snapReader.UpdateSegments([]SegmentRecord{segments[1].record}, []SegmentRecord{segments[0].record, {ID: "unknown"}})
+	sort.Strings(dropped)
+	if len(dropped) != 2 || dropped[0] != "0" || dropped[1] != "1" {
+		t.Fatal("unexpected dropped segments", dropped)
+	}
+	if _, found := cache["0"]; found {
+		t.Fatal("expected the dropped segment to be evicted")
+	}
+	if _, found := cache["1"]; found {
+		t.Fatal("expected the replaced segment to be evicted")
+	}
+	if _, found := cache["2"]; !found {
+		t.Fatal("expected the remaining segment to stay cached")
+	}
+}
+
+func TestSegmentsOlderThan(t *testing.T) {
+	now := time.Now()
+	var records []SegmentRecord
+	for i, age := range []time.Duration{time.Hour, time.Minute, 2 * time.Hour} {
+		opts := sst.DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.CreatedAt = now.Add(-age)
+		segment := prepareTestSegment(t, fmt.Sprint(i), 0, opts, []sst.KVPair{
+			{Key: []byte("key"), Value: []byte("value")},
+		})
+		if !segment.record.Metadata.CreatedAt.Equal(opts.CreatedAt) {
+			t.Fatal("expected created at", opts.CreatedAt, "got", segment.record.Metadata.CreatedAt)
+		}
+		records = append(records, segment.record)
+	}
+	// a segment written before the created at was stored
+	records = append(records, SegmentRecord{ID: "3", Metadata: sst.SegmentMetadata{FirstKey: []byte("key"), LastKey: []byte("key")}})
+
+	snapReader := NewReader(func(record SegmentRecord) (*sst.SegmentReader, error) {
+		return nil, fmt.Errorf("unexpected read of segment %s", record.ID)
+	})
+	snapReader.UpdateSegments(records, nil)
+
+	older := snapReader.SegmentsOlderThan(30 * time.Minute)
+	if len(older) != 2 || older[0].ID != "0" || older[1].ID != "2" {
+		t.Fatal("unexpected segments", older)
+	}
+	if older := snapReader.SegmentsOlderThan(3 * time.Hour); len(older) != 0 {
+		t.Fatal("expected no segments, got", older)
+	}
 }
@@ -22,3 +22,17 @@ func NextPossibleKey(key []byte, direction int) []byte {
 	// Otherwise we do nothing since we don't know the direction
 	return nextKey
 }
+
+// prefixEnd returns the first key that sorts after every key with the prefix, or nil if there is none (the prefix
+// is only 0xff bytes).
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
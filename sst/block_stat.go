@@ -3,6 +3,8 @@ package sst
 import (
 	"bytes"
 	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 type (
@@ -20,6 +22,23 @@ type (
 		CompressedSize uint64
 		// final block bytes hash (incl compression)
 		Hash uint64
+		// number of rows in the block
+		RowCount uint64
+		// number of rows in the block that are tombstones, see KVPair.Tombstone
+		TombstoneCount uint64
+		// smallest and largest value lengths in the block, excluding tombstones
+		MinValueLength uint32
+		MaxValueLength uint32
+	}
+
+	// BlockRange is the key range of a data block, see SegmentReader.BlockRanges
+	BlockRange struct {
+		Stat BlockStat
+		// EndKey is the FirstKey of the next block (exclusive), or the LastKey of the segment (inclusive) for the
+		// last block
+		EndKey []byte
+		// Last is whether this is the last block, where EndKey is inclusive
+		Last bool
 	}
 )
 
@@ -37,6 +56,13 @@ func (bs BlockStat) toBytes() []byte {
 	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, bs.OriginalSize))
 	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, bs.CompressedSize))
 	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, bs.Hash))
+	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, bs.RowCount))
+	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, bs.TombstoneCount))
+	blockBytes.Write(binary.LittleEndian.AppendUint32([]byte{}, bs.MinValueLength))
+	blockBytes.Write(binary.LittleEndian.AppendUint32([]byte{}, bs.MaxValueLength))
+
+	// write the checksum of the entry so a corrupt entry can be localized
+	blockBytes.Write(binary.LittleEndian.AppendUint64([]byte{}, xxhash.Sum64(blockBytes.Bytes())))
 
 	return blockBytes.Bytes()
 }
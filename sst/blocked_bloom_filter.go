@@ -0,0 +1,134 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// blockedBloomFilterBlockWords is the number of uint64 in a block of a BlockedBloomFilter, a 64 byte cache line
+	blockedBloomFilterBlockWords = 8
+	blockedBloomFilterBlockBits  = blockedBloomFilterBlockWords * 64
+)
+
+// BlockedBloomFilter is a bloom filter split into cache line sized blocks, where every bit for a key is set in a
+// single block. Probing a key touches one cache line rather than one per hash function, at the cost of a slightly
+// higher false positive rate than a bloom.BloomFilter of the same size.
+//
+// Use as SegmentWriterOptions.BlockedBloomFilter, it is exposed to readers as SegmentMetadata.BlockedBloomFilter.
+type BlockedBloomFilter struct {
+	blocks []uint64
+	k      uint64
+}
+
+// NewBlockedBloomFilterWithEstimates creates a BlockedBloomFilter sized for n keys with about falsePositiveRate
+// chance of a false positive, like bloom.NewWithEstimates
+func NewBlockedBloomFilterWithEstimates(n uint, falsePositiveRate float64) *BlockedBloomFilter {
+	n = max(n, 1)
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := uint64(max(1, math.Round(m/float64(n)*math.Ln2)))
+	numBlocks := max(1, uint64(math.Ceil(m/blockedBloomFilterBlockBits)))
+	return &BlockedBloomFilter{
+		blocks: make([]uint64, numBlocks*blockedBloomFilterBlockWords),
+		k:      k,
+	}
+}
+
+// locate returns the first word of the block for the key, and the hashes to derive its bits from
+func (f *BlockedBloomFilter) locate(key []byte) (block uint64, h1, h2 uint32) {
+	h := xxhash.Sum64(key)
+	numBlocks := uint64(len(f.blocks) / blockedBloomFilterBlockWords)
+	// the high bits pick the block, so they are remixed for the bits within it
+	hi, _ := bits.Mul64(h, numBlocks)
+	mixed := h * 0x9e3779b97f4a7c15
+	return hi * blockedBloomFilterBlockWords, uint32(mixed), uint32(mixed>>32) | 1
+}
+
+// Add adds the key to the filter
+func (f *BlockedBloomFilter) Add(key []byte) {
+	block, h1, h2 := f.locate(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + uint32(i)*h2) % blockedBloomFilterBlockBits
+		f.blocks[block+uint64(bit/64)] |= 1 << (bit % 64)
+	}
+}
+
+// Test returns false if the key was definitely not added, and true if it may have been
+func (f *BlockedBloomFilter) Test(key []byte) bool {
+	block, h1, h2 := f.locate(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + uint32(i)*h2) % blockedBloomFilterBlockBits
+		if f.blocks[block+uint64(bit/64)]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy returns a copy of the filter
+func (f *BlockedBloomFilter) Copy() *BlockedBloomFilter {
+	return &BlockedBloomFilter{
+		blocks: append([]uint64(nil), f.blocks...),
+		k:      f.k,
+	}
+}
+
+// Equal returns whether the filters have the same size and bits
+func (f *BlockedBloomFilter) Equal(other *BlockedBloomFilter) bool {
+	if f.k != other.k || len(f.blocks) != len(other.blocks) {
+		return false
+	}
+	for i := range f.blocks {
+		if f.blocks[i] != other.blocks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes the filter as the uint64 hash count, uint64 block count, then the blocks as little endian uint64
+func (f *BlockedBloomFilter) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 16+len(f.blocks)*8)
+	buf = binary.LittleEndian.AppendUint64(buf, f.k)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(f.blocks)/blockedBloomFilterBlockWords))
+	for _, word := range f.blocks {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom reads a filter written with WriteTo, replacing the filter
+func (f *BlockedBloomFilter) ReadFrom(r io.Reader) (int64, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, fmt.Errorf("error in io.ReadFull for blocked bloom filter header: %w", ioError(err))
+	}
+	k := binary.LittleEndian.Uint64(header[0:8])
+	numBlocks := binary.LittleEndian.Uint64(header[8:16])
+	if k == 0 || k > blockedBloomFilterBlockBits || numBlocks == 0 || numBlocks > math.MaxInt32 {
+		return 16, fmt.Errorf("%w: invalid blocked bloom filter with k=%d blocks=%d", ErrInvalidMetaBlock, k, numBlocks)
+	}
+
+	// copied rather than allocated up front, so a corrupt block count doesn't allocate more than the reader holds
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, r, int64(numBlocks*blockedBloomFilterBlockWords*8))
+	if err != nil {
+		return 16, fmt.Errorf("error in io.CopyN for blocked bloom filter blocks: %w", ioError(err))
+	}
+	words := buf.Bytes()
+
+	f.k = k
+	f.blocks = make([]uint64, numBlocks*blockedBloomFilterBlockWords)
+	for i := range f.blocks {
+		f.blocks[i] = binary.LittleEndian.Uint64(words[i*8:])
+	}
+	return int64(16 + len(words)), nil
+}
@@ -0,0 +1,130 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bits-and-blooms/bloom"
+)
+
+func TestBlockedBloomFilterRoundTrip(t *testing.T) {
+	filter := NewBlockedBloomFilterWithEstimates(10_000, DefaultBloomFilterFalsePositiveRate)
+	for i := 0; i < 10_000; i++ {
+		filter.Add([]byte(fmt.Sprintf("key%08d", i)))
+	}
+
+	b := &bytes.Buffer{}
+	written, err := filter.WriteTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read BlockedBloomFilter
+	n, err := read.ReadFrom(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != written || int(n) != b.Len() {
+		t.Fatal("expected to read", written, "bytes, got", n)
+	}
+	if !read.Equal(filter) {
+		t.Fatal("expected the read filter to equal the written filter")
+	}
+	for i := 0; i < 10_000; i++ {
+		if !read.Test([]byte(fmt.Sprintf("key%08d", i))) {
+			t.Fatal("expected the filter to contain key", i)
+		}
+	}
+
+	// truncated filters are corrupt
+	_, err = (&BlockedBloomFilter{}).ReadFrom(bytes.NewReader(b.Bytes()[:b.Len()-1]))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt, got", err)
+	}
+}
+
+func TestBlockedBloomFilterFalsePositiveRate(t *testing.T) {
+	const keys = 100_000
+	const falsePositiveRate = 0.01
+	blocked := NewBlockedBloomFilterWithEstimates(keys, falsePositiveRate)
+	standard := bloom.NewWithEstimates(keys, falsePositiveRate)
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		blocked.Add(key)
+		standard.Add(key)
+	}
+
+	var blockedFalsePositives, standardFalsePositives int
+	for i := keys; i < keys*2; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		if blocked.Test(key) {
+			blockedFalsePositives++
+		}
+		if standard.Test(key) {
+			standardFalsePositives++
+		}
+	}
+	blockedRate := float64(blockedFalsePositives) / keys
+	standardRate := float64(standardFalsePositives) / keys
+	t.Log("blocked false positive rate", blockedRate, "standard", standardRate)
+
+	// blocked filters trade a slightly higher rate for cache locality
+	if blockedRate > falsePositiveRate*2 {
+		t.Fatal("expected a blocked false positive rate near", falsePositiveRate, "got", blockedRate)
+	}
+}
+
+func TestSegmentBlockedBloomFilter(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BlockedBloomFilter = NewBlockedBloomFilterWithEstimates(2_000, DefaultBloomFilterFalsePositiveRate)
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 2_000; i += 2 {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readerOpts := DefaultSegmentReaderOptions()
+		readerOpts.LazyBloomFilter = lazy
+		r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length), readerOpts)
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.BloomFilter != nil || metadata.BlockedBloomFilter == nil {
+			t.Fatal("expected only a blocked bloom filter for lazy", lazy)
+		}
+		if !metadata.BlockedBloomFilter.Equal(opts.BlockedBloomFilter) {
+			t.Fatal("expected the read filter to equal the written filter for lazy", lazy)
+		}
+
+		for i := 0; i < 2_000; i++ {
+			row, err := r.GetRow([]byte(fmt.Sprintf("key%08d", i)))
+			if i%2 == 1 {
+				if !errors.Is(err, ErrNoRows) {
+					t.Fatal("expected ErrNoRows for", i, "got", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(row.Value) != fmt.Sprintf("value%08d", i) {
+				t.Fatal("unexpected value", string(row.Value), "for", i)
+			}
+		}
+
+		_, err = r.ReadBloomFilter()
+		if !errors.Is(err, ErrNoBloomFilter) {
+			t.Fatal("expected ErrNoBloomFilter, got", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+)
+
+type (
+	// BloomFilterCache is a small LRU of lazily loaded bloom filters (and other Filters). It is thread safe, and
+	// should be shared between segment readers.
+	BloomFilterCache struct {
+		size  int
+		order *list.List
+		items map[bloomFilterCacheKey]*list.Element
+		mu    *sync.Mutex
+	}
+
+	// bloomFilterKey is the identity of a lazily loaded bloom filter. It is a pointer so that copies of the
+	// SegmentMetadata share the same cache entry.
+	bloomFilterKey struct {
+		_ byte // zero sized allocations are not guaranteed unique addresses
+	}
+
+	// bloomFilterCacheKey identifies a bloom filter in the cache, either by segment ID and the offset of the filter
+	// from the start of the metadata source, or by the metadata parse if the reader has no
+	// SegmentReaderOptions.SegmentID
+	bloomFilterCacheKey struct {
+		segmentID string
+		offset    int64
+		parse     *bloomFilterKey
+	}
+
+	bloomFilterCacheEntry struct {
+		key    bloomFilterCacheKey
+		filter Filter
+	}
+)
+
+// NewBloomFilterCache creates a cache that will hold at most `size` bloom filters in memory.
+func NewBloomFilterCache(size int) *BloomFilterCache {
+	return &BloomFilterCache{
+		size:  size,
+		order: list.New(),
+		items: map[bloomFilterCacheKey]*list.Element{},
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (c *BloomFilterCache) get(key bloomFilterCacheKey) (Filter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(bloomFilterCacheEntry).filter, true
+}
+
+func (c *BloomFilterCache) put(key bloomFilterCacheKey, filter Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.items[key]; found {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(bloomFilterCacheEntry{key: key, filter: filter})
+	for c.order.Len() > c.size {
+		// evict the least recently used
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(bloomFilterCacheEntry).key)
+	}
+}
+
+// Len returns the number of bloom filters currently held in memory.
+func (c *BloomFilterCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,157 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Codec compresses whole data blocks, see SegmentWriterOptions.Codec. The ID is stored as the compression format of
+// the meta block, so readers can find the codec, see RegisterCodec.
+type Codec interface {
+	// ID identifies the codec in the meta block
+	ID() byte
+	// Compress appends the compression of src to dst
+	Compress(src, dst []byte) ([]byte, error)
+	// Decompress appends the decompression of src, which decompresses to size bytes, to dst. Errors for invalid
+	// src should wrap ErrCorruptCompressedData.
+	Decompress(src, dst []byte, size int) ([]byte, error)
+}
+
+// Codec IDs of the meta block compression format. Zstd is not a Codec, as it streams blocks, see
+// SegmentWriterOptions.ZSTDCompressionLevel.
+const (
+	CodecIDNone   = 0
+	CodecIDZSTD   = 1
+	CodecIDLZ4    = 2
+	CodecIDSnappy = 3
+
+	userCodecIDStart = 0x40
+	userCodecIDEnd   = 0x7f
+)
+
+var (
+	ErrInvalidCodecID      = errors.New("invalid codec ID, must be in the user codec range [0x40, 0x7f]")
+	ErrCodecIDAlreadyInUse = errors.New("codec ID already in use")
+	ErrUnknownCodec        = errors.New("unknown codec, see RegisterCodec")
+	registeredCodecsMu     = &sync.RWMutex{}
+	registeredCodecs       = map[byte]Codec{
+		CodecIDLZ4:    lz4Codec{},
+		CodecIDSnappy: SnappyCodec{},
+	}
+)
+
+// RegisterCodec allows segments compressed with a custom Codec to be read. The ID must be in the user codec range
+// [0x40, 0x7f], the other IDs are reserved for built in codecs.
+//
+// Codecs should be registered before any segments using them are read, such as in an init function.
+func RegisterCodec(codec Codec) error {
+	id := codec.ID()
+	if id < userCodecIDStart || id > userCodecIDEnd {
+		return fmt.Errorf("%w: got %02x", ErrInvalidCodecID, id)
+	}
+
+	registeredCodecsMu.Lock()
+	defer registeredCodecsMu.Unlock()
+
+	if _, exists := registeredCodecs[id]; exists {
+		return fmt.Errorf("%w: %02x", ErrCodecIDAlreadyInUse, id)
+	}
+	registeredCodecs[id] = codec
+	return nil
+}
+
+// lookupCodec returns the codec registered for the ID
+func lookupCodec(id byte) (Codec, bool) {
+	registeredCodecsMu.RLock()
+	defer registeredCodecsMu.RUnlock()
+	codec, found := registeredCodecs[id]
+	return codec, found
+}
+
+// validateWriterCodec checks that segments written with the codec can be read, as the ID is all that is stored. The
+// ID must be a built in codec or registered with RegisterCodec.
+func validateWriterCodec(codec Codec) error {
+	id := codec.ID()
+	if id == CodecIDNone || id == CodecIDZSTD {
+		return fmt.Errorf("%w: codec ID %02x is reserved for uncompressed and zstd blocks", ErrInvalidCodecID, id)
+	}
+	if _, found := lookupCodec(id); !found {
+		return fmt.Errorf("%w: codec ID %02x, see RegisterCodec", ErrUnknownCodec, id)
+	}
+	return nil
+}
+
+// lz4Codec is the LZ4 block format, used with SegmentWriterOptions.LZ4Compression
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte {
+	return CodecIDLZ4
+}
+
+func (lz4Codec) Compress(src, dst []byte) ([]byte, error) {
+	return lz4CompressBlock(src, dst), nil
+}
+
+func (lz4Codec) Decompress(src, dst []byte, size int) ([]byte, error) {
+	return lz4DecompressBlock(src, dst, size)
+}
+
+// SnappyCodec is the Snappy block format, which is fast to compress and decompress at a lower ratio than zstd
+type SnappyCodec struct{}
+
+func (SnappyCodec) ID() byte {
+	return CodecIDSnappy
+}
+
+func (SnappyCodec) Compress(src, dst []byte) ([]byte, error) {
+	return append(dst, s2.EncodeSnappy(nil, src)...), nil
+}
+
+func (SnappyCodec) Decompress(src, dst []byte, size int) ([]byte, error) {
+	start := len(dst)
+	dst = slices.Grow(dst, size)
+	decoded, err := s2.Decode(dst[start:start+size], src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptCompressedData, err)
+	}
+	if len(decoded) != size {
+		return nil, fmt.Errorf("%w: snappy block decompressed to %d bytes, expected %d", ErrCorruptCompressedData, len(decoded), size)
+	}
+	return dst[:start+size], nil
+}
+
+// codecBlockWriter buffers the rows of a data block, writing them compressed with the codec to out on Close. Rows
+// that don't compress are written as is, which readers tell apart by BlockStat.CompressedSize matching OriginalSize.
+type codecBlockWriter struct {
+	codec  Codec
+	raw    []byte
+	out    io.Writer
+	closed bool
+}
+
+func (w *codecBlockWriter) Write(p []byte) (int, error) {
+	w.raw = append(w.raw, p...)
+	return len(p), nil
+}
+
+func (w *codecBlockWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	block, err := w.codec.Compress(w.raw, nil)
+	if err != nil {
+		return fmt.Errorf("error in Codec.Compress: %w", err)
+	}
+	if len(block) >= len(w.raw) {
+		block = w.raw
+	}
+	_, err = w.out.Write(block)
+	return err
+}
@@ -0,0 +1,168 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// testCodec is snappy with a custom ID
+type testCodec struct {
+	SnappyCodec
+	id byte
+}
+
+func (c testCodec) ID() byte {
+	return c.id
+}
+
+func TestRegisterCodec(t *testing.T) {
+	for _, id := range []byte{CodecIDNone, CodecIDZSTD, CodecIDLZ4, CodecIDSnappy, 0x3f, 0x80, 0xff} {
+		err := RegisterCodec(testCodec{id: id})
+		if !errors.Is(err, ErrInvalidCodecID) {
+			t.Fatal("expected ErrInvalidCodecID for", id, "got", err)
+		}
+	}
+
+	err := RegisterCodec(testCodec{id: 0x7d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterCodec(testCodec{id: 0x7d})
+	if !errors.Is(err, ErrCodecIDAlreadyInUse) {
+		t.Fatal("expected ErrCodecIDAlreadyInUse, got", err)
+	}
+}
+
+func TestSnappyCodecCorrupt(t *testing.T) {
+	src := bytes.Repeat([]byte("abc"), 1_000)
+	compressed, err := SnappyCodec{}.Compress(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := SnappyCodec{}.Decompress(compressed, []byte("prefix"), len(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, append([]byte("prefix"), src...)) {
+		t.Fatal("round trip mismatch")
+	}
+
+	_, err = SnappyCodec{}.Decompress(compressed, nil, len(src)-1)
+	if !errors.Is(err, ErrCorruptCompressedData) {
+		t.Fatal("expected ErrCorruptCompressedData for the wrong size, got", err)
+	}
+	_, err = SnappyCodec{}.Decompress(compressed[:len(compressed)/2], nil, len(src))
+	if !errors.Is(err, ErrCorruptCompressedData) {
+		t.Fatal("expected ErrCorruptCompressedData for a truncated block, got", err)
+	}
+}
+
+func writeCodecSegment(t *testing.T, codec Codec) []byte {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.Codec = codec
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 2_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSegmentWriterCodec(t *testing.T) {
+	err := RegisterCodec(testCodec{id: 0x7e})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []Codec{SnappyCodec{}, testCodec{id: 0x7e}} {
+		segment := writeCodecSegment(t, codec)
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.Codec == nil || metadata.Codec.ID() != codec.ID() || metadata.LZ4Compression || metadata.ZSTDCompression {
+			t.Fatal("unexpected compression for codec", codec.ID(), metadata.Codec)
+		}
+
+		var compressedSize, originalSize uint64
+		metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+			compressedSize += stat.CompressedSize
+			originalSize += stat.OriginalSize
+			return true
+		})
+		if compressedSize >= originalSize {
+			t.Fatal("expected the blocks to be compressed, got", compressedSize, originalSize)
+		}
+
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				if i != 2_000 {
+					t.Fatal("expected 2000 rows, got", i)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(row.Key) != fmt.Sprintf("key%08d", i) || string(row.Value) != fmt.Sprintf("value%08d", i) {
+				t.Fatal("unexpected row", string(row.Key), string(row.Value))
+			}
+		}
+	}
+
+	// readers without the codec registered can't read the segment
+	err = RegisterCodec(testCodec{id: 0x7f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := writeCodecSegment(t, testCodec{id: 0x7f})
+	registeredCodecsMu.Lock()
+	delete(registeredCodecs, 0x7f)
+	registeredCodecsMu.Unlock()
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	_, err = r.FetchAndLoadMetadata()
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Fatal("expected ErrUnknownCodec, got", err)
+	}
+}
+
+func TestSegmentWriterInvalidCodec(t *testing.T) {
+	for _, tc := range []struct {
+		id       byte
+		expected error
+	}{
+		{CodecIDNone, ErrInvalidCodecID},
+		{CodecIDZSTD, ErrInvalidCodecID},
+		{0x3f, ErrUnknownCodec},
+		{0x7c, ErrUnknownCodec},
+	} {
+		opts := DefaultSegmentWriterOptions()
+		opts.Codec = testCodec{id: tc.id}
+		w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+		err := w.WriteRow([]byte("key"), []byte("value"))
+		if !errors.Is(err, tc.expected) {
+			t.Fatal("expected", tc.expected, "for codec ID", tc.id, "got", err)
+		}
+		err = w.WriteRawBlock(nil, BlockStat{}, nil)
+		if !errors.Is(err, tc.expected) {
+			t.Fatal("expected", tc.expected, "from WriteRawBlock for codec ID", tc.id, "got", err)
+		}
+	}
+}
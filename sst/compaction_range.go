@@ -1,12 +1,24 @@
 package sst
 
-type RangeCompactionStrategy struct {
-	rangeSplitThresholdBytes int64
-	rangeSplitThresholdRows  int64
-}
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	RangeCompactionStrategy struct {
+		rangeSplitThresholdBytes int64
+		rangeSplitThresholdRows  int64
+	}
+
+	// RangeCompactionOption configures a RangeCompactionStrategy, returning an error if it is misconfigured
+	RangeCompactionOption func(r *RangeCompactionStrategy) error
+)
 
-func (r *RangeCompactionStrategy) Init() {
+var ErrInvalidCompactionOption = errors.New("invalid compaction option")
 
+func (r *RangeCompactionStrategy) Init() error {
+	return nil
 }
 
 func DefaultRangeCompactionStrategy() RangeCompactionStrategy {
@@ -15,3 +27,35 @@ func DefaultRangeCompactionStrategy() RangeCompactionStrategy {
 		rangeSplitThresholdRows:  100_000,
 	}
 }
+
+// NewRangeCompactionStrategy creates a RangeCompactionStrategy from the defaults, then applies the options,
+// returning the first option error.
+func NewRangeCompactionStrategy(opts ...RangeCompactionOption) (*RangeCompactionStrategy, error) {
+	r := DefaultRangeCompactionStrategy()
+	err := r.Init()
+	if err != nil {
+		return nil, fmt.Errorf("error in Init: %w", err)
+	}
+
+	for _, opt := range opts {
+		err = opt(&r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &r, nil
+}
+
+// WithRangeSplitThreshold sets how many bytes or rows an output segment can reach before the range is split into
+// a new segment. Both must be positive.
+func WithRangeSplitThreshold(bytes, rows int64) RangeCompactionOption {
+	return func(r *RangeCompactionStrategy) error {
+		if bytes <= 0 || rows <= 0 {
+			return fmt.Errorf("%w: range split threshold must be positive, got bytes=%d rows=%d", ErrInvalidCompactionOption, bytes, rows)
+		}
+		r.rangeSplitThresholdBytes = bytes
+		r.rangeSplitThresholdRows = rows
+		return nil
+	}
+}
@@ -0,0 +1,40 @@
+package sst
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewRangeCompactionStrategy(t *testing.T) {
+	r, err := NewRangeCompactionStrategy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *r != DefaultRangeCompactionStrategy() {
+		t.Fatal("expected the default strategy, got", *r)
+	}
+
+	r, err = NewRangeCompactionStrategy(WithRangeSplitThreshold(500, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.rangeSplitThresholdBytes != 500 || r.rangeSplitThresholdRows != 10 {
+		t.Fatal("unexpected thresholds", r.rangeSplitThresholdBytes, r.rangeSplitThresholdRows)
+	}
+}
+
+func TestNewRangeCompactionStrategyInvalidOption(t *testing.T) {
+	// a misconfiguration returns an error, rather than terminating the process
+	for _, opt := range []RangeCompactionOption{
+		WithRangeSplitThreshold(0, 10),
+		WithRangeSplitThreshold(500, -1),
+	} {
+		r, err := NewRangeCompactionStrategy(opt)
+		if !errors.Is(err, ErrInvalidCompactionOption) {
+			t.Fatal("expected ErrInvalidCompactionOption, got", err)
+		}
+		if r != nil {
+			t.Fatal("expected no strategy")
+		}
+	}
+}
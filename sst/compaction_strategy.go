@@ -2,6 +2,6 @@ package sst
 
 type CompactionStrategy interface {
 	// Init should set any default options. Options will be applied after this returns.
-	// Anything that errors here should crash the process with logger.Fatal
-	Init()
+	// Errors should be returned rather than crashing the process, as this runs within whatever embeds the library.
+	Init() error
 }
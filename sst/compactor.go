@@ -1,6 +1,30 @@
 package sst
 
+import "github.com/bits-and-blooms/bloom"
+
 type (
 	Compactor struct {
 	}
 )
+
+// DefaultBloomFilterFalsePositiveRate is the false positive rate of the default segment writer bloom filter
+const DefaultBloomFilterFalsePositiveRate = 0.000001
+
+// MergedBloomFilter creates a bloom filter sized for the sum of the input segment row counts, to be used as the
+// SegmentWriterOptions.BloomFilter when merging segments.
+//
+// Bloom filters of different sizes can't be unioned, and the default bloom filter is sized for 100k rows, so this
+// gives the output segment an appropriate false positive rate for the number of rows it will hold.
+func MergedBloomFilter(falsePositiveRate float64, inputs ...*SegmentMetadata) *bloom.BloomFilter {
+	var rowCount uint64
+	for _, input := range inputs {
+		rowCount += input.RowCount
+	}
+
+	if rowCount == 0 {
+		// can't size a filter for nothing
+		rowCount = 1
+	}
+
+	return bloom.NewWithEstimates(uint(rowCount), falsePositiveRate)
+}
@@ -0,0 +1,64 @@
+package sst
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/bits-and-blooms/bloom"
+)
+
+func writeTestSegmentMetadata(t *testing.T, prefix string, rows int) *SegmentMetadata {
+	opts := DefaultSegmentWriterOptions()
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			&bytes.Buffer{},
+		}, opts)
+	for i := 0; i < rows; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("%s%05d", prefix, i)), []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func TestMergedBloomFilter(t *testing.T) {
+	small := MergedBloomFilter(DefaultBloomFilterFalsePositiveRate,
+		writeTestSegmentMetadata(t, "a", 300),
+		writeTestSegmentMetadata(t, "b", 700),
+	)
+	expectedBits, expectedHashes := bloom.EstimateParameters(1000, DefaultBloomFilterFalsePositiveRate)
+	if small.Cap() != expectedBits || small.K() != expectedHashes {
+		t.Fatal("unexpected bloom filter size", small.Cap(), small.K())
+	}
+
+	large := MergedBloomFilter(DefaultBloomFilterFalsePositiveRate,
+		writeTestSegmentMetadata(t, "a", 3000),
+		writeTestSegmentMetadata(t, "b", 7000),
+	)
+	ratio := float64(large.Cap()) / float64(small.Cap())
+	if ratio < 9.9 || ratio > 10.1 {
+		t.Fatal("expected bloom filter to be sized proportionally to the input rows, got ratio", ratio)
+	}
+
+	// the default filter is far larger than needed for a small merge
+	if small.Cap() >= DefaultSegmentWriterOptions().BloomFilter.Cap() {
+		t.Fatal("expected merged bloom filter to be smaller than the default")
+	}
+
+	// no rows still makes a usable filter
+	empty := MergedBloomFilter(DefaultBloomFilterFalsePositiveRate, &SegmentMetadata{})
+	if empty.Cap() == 0 {
+		t.Fatal("expected a non-empty bloom filter")
+	}
+}
@@ -0,0 +1,27 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Error categories, so callers can map failures (e.g. to 404, 500, or retry) with errors.Is
+var (
+	// ErrNotFound is the same as ErrNoRows
+	ErrNotFound = ErrNoRows
+	// ErrCorrupt is wrapped by errors from invalid, damaged, or truncated segment data, such as hash mismatches,
+	// out of bounds blocks, and format issues
+	ErrCorrupt = fmt.Errorf("%w: corrupt segment", FatalError)
+	// ErrIO is wrapped by errors from the underlying reader, which may be retried
+	ErrIO = errors.New("io error")
+)
+
+// ioError categorizes an error from the underlying reader. An EOF means the segment is truncated, which is not
+// wrapped so that it's not confused with the end of an iterator.
+func ioError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated (%s)", ErrCorrupt, err)
+	}
+	return fmt.Errorf("%w: %w", ErrIO, err)
+}
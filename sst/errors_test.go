@@ -0,0 +1,140 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// failingReadSeekCloser fails every read after the first failAfter bytes
+type failingReadSeekCloser struct {
+	BytesReadSeekCloser
+	failAfter int
+	read      int
+}
+
+var errInjectedIO = errors.New("injected io error")
+
+func (f *failingReadSeekCloser) Read(p []byte) (int, error) {
+	if f.read >= f.failAfter {
+		return 0, errInjectedIO
+	}
+	n, err := f.BytesReadSeekCloser.Read(p)
+	f.read += n
+	return n, err
+}
+
+func TestErrorCategories(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+	for i := 0; i < 200; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentBytes := b.Bytes()
+
+	newReader := func(segment []byte) SegmentReader {
+		return NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(segment),
+		}, len(segment))
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		r := newReader(segmentBytes)
+		_, err := r.GetRow([]byte("key999"))
+		if !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrNoRows) {
+			t.Fatal("expected not found, got", err)
+		}
+		if errors.Is(err, ErrCorrupt) || errors.Is(err, ErrIO) {
+			t.Fatal("not found should not be another category", err)
+		}
+	})
+
+	t.Run("corrupt block", func(t *testing.T) {
+		corrupted := bytes.Clone(segmentBytes)
+		corrupted[10]++
+		r := newReader(corrupted)
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		firstBlock, _ := metadata.BlockIndex.Min()
+		_, err = r.ReadRawBlock(firstBlock)
+		if !errors.Is(err, ErrCorrupt) || !errors.Is(err, ErrMismatchedBlockHash) || !errors.Is(err, FatalError) {
+			t.Fatal("expected corrupt, got", err)
+		}
+	})
+
+	t.Run("corrupt metadata", func(t *testing.T) {
+		corrupted := bytes.Clone(segmentBytes)
+		corrupted[len(corrupted)-30]++
+		r := newReader(corrupted)
+		_, err := r.FetchAndLoadMetadata()
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatal("expected corrupt, got", err)
+		}
+	})
+
+	t.Run("out of bounds", func(t *testing.T) {
+		r := newReader(segmentBytes)
+		_, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.ReadBlockWithStat(BlockStat{Offset: segmentLength, BlockSize: 4096})
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatal("expected corrupt, got", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		r := newReader(segmentBytes)
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the data is cut off before the last block
+		lastBlock, _ := metadata.BlockIndex.Max()
+		truncated := NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(segmentBytes[:lastBlock.Offset]),
+		}, 0)
+		truncated.LoadCachedMetadata(metadata)
+		_, err = truncated.ReadBlockWithStat(lastBlock)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatal("expected corrupt, got", err)
+		}
+		if errors.Is(err, io.EOF) {
+			t.Fatal("truncation should not look like the end of an iterator", err)
+		}
+	})
+
+	t.Run("io", func(t *testing.T) {
+		r := NewSegmentReader(&failingReadSeekCloser{
+			BytesReadSeekCloser: BytesReadSeekCloser{
+				Reader: bytes.NewReader(segmentBytes),
+			},
+			failAfter: 0,
+		}, len(segmentBytes))
+		_, err := r.FetchAndLoadMetadata()
+		if !errors.Is(err, ErrIO) || !errors.Is(err, errInjectedIO) {
+			t.Fatal("expected io, got", err)
+		}
+		if errors.Is(err, ErrCorrupt) {
+			t.Fatal("io should not be corrupt", err)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+type (
+	// ExternalSorter builds a segment from rows added in any order, using bounded memory. Rows are buffered up to
+	// ExternalSorterOptions.MemoryBudget, then sorted and spilled to a temporary segment (a run). Finish merges the
+	// runs into the final segment.
+	//
+	// When the same key is added more than once, the last added row wins.
+	ExternalSorter struct {
+		options       ExternalSorterOptions
+		rows          []KVPair
+		bufferedBytes int
+		runs          []externalSortRun
+		finished      bool
+	}
+
+	ExternalSorterOptions struct {
+		// MemoryBudget is roughly how many bytes of rows are buffered before they are spilled to a run
+		MemoryBudget int
+		// TempDir is the directory runs are written to, uses os.TempDir if empty
+		TempDir string
+		// RunOptions are the options runs are written with, the rows are rewritten with the options given to
+		// Finish, so runs should favor write speed (e.g. no bloom filter)
+		RunOptions SegmentWriterOptions
+	}
+
+	externalSortRun struct {
+		file   *os.File
+		length int
+	}
+)
+
+// kvPairOverhead is roughly the memory of a buffered KVPair beyond its key and value
+const kvPairOverhead = 56
+
+func DefaultExternalSorterOptions() ExternalSorterOptions {
+	runOptions := DefaultSegmentWriterOptions()
+	runOptions.BloomFilter = nil
+	runOptions.DisableBlockPadding = true
+	return ExternalSorterOptions{
+		MemoryBudget: 64 * 1024 * 1024,
+		TempDir:      "",
+		RunOptions:   runOptions,
+	}
+}
+
+var ErrSorterFinished = errors.New("external sorter finished")
+
+func NewExternalSorter(opts ExternalSorterOptions) *ExternalSorter {
+	return &ExternalSorter{
+		options: opts,
+	}
+}
+
+// Add buffers a row, spilling the buffered rows to a run if the memory budget is reached. The key and value are
+// copied.
+func (e *ExternalSorter) Add(key, value []byte) error {
+	return e.add(KVPair{Key: bytes.Clone(key), Value: bytes.Clone(value)})
+}
+
+// AddTombstone buffers a tombstone for the key, see Add. The key is copied.
+func (e *ExternalSorter) AddTombstone(key []byte) error {
+	return e.add(NewTombstone(bytes.Clone(key)))
+}
+
+func (e *ExternalSorter) add(row KVPair) error {
+	if e.finished {
+		return ErrSorterFinished
+	}
+
+	e.rows = append(e.rows, row)
+	e.bufferedBytes += len(row.Key) + len(row.Value) + kvPairOverhead
+	if e.bufferedBytes >= e.options.MemoryBudget {
+		err := e.spill()
+		if err != nil {
+			return fmt.Errorf("error in spill: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sortRows sorts the buffered rows, keeping only the last added row for each key
+func (e *ExternalSorter) sortRows() {
+	slices.SortStableFunc(e.rows, func(a, b KVPair) int {
+		return bytes.Compare(a.Key, b.Key)
+	})
+	deduped := e.rows[:0]
+	for i, row := range e.rows {
+		if i+1 < len(e.rows) && bytes.Equal(row.Key, e.rows[i+1].Key) {
+			// a later row has the same key
+			continue
+		}
+		deduped = append(deduped, row)
+	}
+	e.rows = deduped
+}
+
+// spill sorts the buffered rows and writes them to a new run
+func (e *ExternalSorter) spill() error {
+	if len(e.rows) == 0 {
+		return nil
+	}
+	e.sortRows()
+
+	file, err := os.CreateTemp(e.options.TempDir, "objectkv-sort-*.seg")
+	if err != nil {
+		return fmt.Errorf("error in os.CreateTemp: %w", err)
+	}
+	// track the run first, so Close removes it if writing fails
+	e.runs = append(e.runs, externalSortRun{file: file})
+
+	w := NewSegmentWriter(nopWriteCloser{file}, e.options.RunOptions)
+	for _, row := range e.rows {
+		err = w.WriteKVPair(row)
+		if err != nil {
+			return fmt.Errorf("error in WriteKVPair for run: %w", err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		return fmt.Errorf("error in SegmentWriter.Close for run: %w", err)
+	}
+	e.runs[len(e.runs)-1].length = int(length)
+
+	e.rows = nil
+	e.bufferedBytes = 0
+	return nil
+}
+
+// Finish writes every added row to out as a segment with opts, merging the spilled runs, and returns the results of
+// SegmentWriter.Close. Rows can't be added after Finish. Close must still be called to remove the runs.
+func (e *ExternalSorter) Finish(out io.Writer, opts SegmentWriterOptions) (uint64, []byte, error) {
+	if e.finished {
+		return 0, nil, ErrSorterFinished
+	}
+	e.finished = true
+
+	if len(e.runs) == 0 {
+		// everything fit in memory
+		e.sortRows()
+		w := NewSegmentWriter(nopWriteCloser{out}, opts)
+		for _, row := range e.rows {
+			err := w.WriteKVPair(row)
+			if err != nil {
+				return 0, nil, fmt.Errorf("error in WriteKVPair: %w", err)
+			}
+		}
+		e.rows = nil
+		return w.Close()
+	}
+
+	err := e.spill()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in spill: %w", err)
+	}
+
+	// later runs win ties, so the last added row for a key wins
+	readers := make([]*SegmentReader, len(e.runs))
+	for i, run := range e.runs {
+		reader := NewSegmentReader(nopReadSeekCloser{run.file}, run.length)
+		readers[i] = &reader
+	}
+
+	length, metaBytes, err := MergeSegments(readers, out, opts)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in MergeSegments: %w", err)
+	}
+
+	return length, metaBytes, nil
+}
+
+// Close removes the spilled runs
+func (e *ExternalSorter) Close() error {
+	var errs []error
+	for _, run := range e.runs {
+		errs = append(errs, run.file.Close(), os.Remove(run.file.Name()))
+	}
+	e.runs = nil
+	e.rows = nil
+	return errors.Join(errs...)
+}
+
+// nopReadSeekCloser adapts a run file for a SegmentReader, leaving closing to the ExternalSorter
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
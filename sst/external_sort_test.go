@@ -0,0 +1,85 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestExternalSorter(t *testing.T) {
+	for _, memoryBudget := range []int{256 * 1024, 64 * 1024 * 1024} {
+		dir := t.TempDir()
+		opts := DefaultExternalSorterOptions()
+		opts.MemoryBudget = memoryBudget
+		opts.TempDir = dir
+		sorter := NewExternalSorter(opts)
+
+		const rows = 50_000
+		order := rand.New(rand.NewSource(1)).Perm(rows)
+		for _, i := range order {
+			err := sorter.Add([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("old%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the last added row wins, even across runs
+		for i := 0; i < rows; i += 100 {
+			err := sorter.Add([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("new%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		spilled := len(sorter.runs) > 0
+		if spilled != (memoryBudget < 1024*1024) {
+			t.Fatal("unexpected spill with", len(sorter.runs), "runs for memory budget", memoryBudget)
+		}
+
+		out := &bytes.Buffer{}
+		length, _, err := sorter.Finish(out, DefaultSegmentWriterOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(length) != out.Len() {
+			t.Fatal("expected length", out.Len(), "got", length)
+		}
+		err = sorter.Add([]byte("key"), []byte("value"))
+		if !errors.Is(err, ErrSorterFinished) {
+			t.Fatal("expected ErrSorterFinished, got", err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(out.Bytes())}, out.Len())
+		err = r.VerifyOrder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sorted := readAllRows(t, out.Bytes())
+		if len(sorted) != rows {
+			t.Fatal("expected", rows, "rows, got", len(sorted))
+		}
+		for i, row := range sorted {
+			expected := fmt.Sprintf("old%08d", i)
+			if i%100 == 0 {
+				expected = fmt.Sprintf("new%08d", i)
+			}
+			if string(row.Key) != fmt.Sprintf("key%08d", i) || string(row.Value) != expected {
+				t.Fatal("unexpected row", string(row.Key), string(row.Value), "at", i)
+			}
+		}
+
+		err = sorter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatal("expected the runs to be removed, got", len(entries), "files")
+		}
+	}
+}
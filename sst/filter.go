@@ -0,0 +1,370 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Filter is a set of keys that may have false positives, probed before reading data blocks. bloom.BloomFilter,
+// BlockedBloomFilter, XorFilter and RibbonFilter are all Filters.
+type Filter interface {
+	// Test returns false if the key was definitely not added, and true if it may have been
+	Test(key []byte) bool
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// KeyFilterType selects a filter that is built from every key of the segment at Close, see
+// SegmentWriterOptions.KeyFilter
+type KeyFilterType int
+
+const (
+	KeyFilterNone KeyFilterType = iota
+	// KeyFilterXor is an XorFilter, about 9.9 bits per key
+	KeyFilterXor
+	// KeyFilterRibbon is a RibbonFilter, about 8.6 bits per key, but slower to build and probe than KeyFilterXor
+	KeyFilterRibbon
+)
+
+const (
+	// xorFilterMaxAttempts is how many seeds are tried to build an XorFilter, each fails with a tiny probability
+	xorFilterMaxAttempts = 100
+	// ribbonFilterWidth is the number of solution rows each key spans in a RibbonFilter
+	ribbonFilterWidth = 64
+	// ribbonFilterAttemptsPerSize is how many seeds are tried to build a RibbonFilter before it is grown
+	ribbonFilterAttemptsPerSize = 4
+)
+
+// XorFilter is a static filter of 8 bit fingerprints, where each key is the xor of 3 fingerprints. It has a false
+// positive rate of about 0.4%, using about 9.9 bits per key, less than a bloom filter at the same rate. Keys can't
+// be added after it is built.
+//
+// See https://arxiv.org/abs/1912.08258
+type XorFilter struct {
+	seed         uint64
+	blockLength  uint32
+	fingerprints []uint8
+}
+
+// RibbonFilter is a static filter that solves a banded linear system for an 8 bit result per key. It has a false
+// positive rate of about 0.4%, using about 8.6 bits per key, less than an XorFilter, but is slower to build and
+// probe. Keys can't be added after it is built.
+//
+// See https://arxiv.org/abs/2103.02515
+type RibbonFilter struct {
+	seed     uint64
+	solution []uint8
+}
+
+// NewXorFilter builds an XorFilter of the keys
+func NewXorFilter(keys [][]byte) (*XorFilter, error) {
+	return newXorFilter(hashFilterKeys(keys))
+}
+
+// NewRibbonFilter builds a RibbonFilter of the keys
+func NewRibbonFilter(keys [][]byte) (*RibbonFilter, error) {
+	return newRibbonFilter(hashFilterKeys(keys))
+}
+
+// buildKeyFilter builds the filter of the filterType from the key hashes
+func buildKeyFilter(filterType KeyFilterType, hashes []uint64) (Filter, error) {
+	switch filterType {
+	case KeyFilterXor:
+		return newXorFilter(hashes)
+	case KeyFilterRibbon:
+		return newRibbonFilter(hashes)
+	default:
+		return nil, fmt.Errorf("unknown key filter type %d", filterType)
+	}
+}
+
+// keyFilterSize returns the serialized size of a filter of the filterType for n keys. For KeyFilterRibbon it is
+// the size before any growth from failed builds.
+func keyFilterSize(filterType KeyFilterType, n int) int {
+	switch filterType {
+	case KeyFilterXor:
+		return 16 + int(xorFilterCapacity(n))
+	case KeyFilterRibbon:
+		return 16 + int(ribbonFilterSize(n))
+	default:
+		return 0
+	}
+}
+
+// hashFilterKeys returns the hash of each key, which is all that filters are built from
+func hashFilterKeys(keys [][]byte) []uint64 {
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = xxhash.Sum64(key)
+	}
+	return hashes
+}
+
+// filterMix is the murmur3 64 bit finalizer, used to derive the positions of a key hash with a seed
+func filterMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// filterReduce maps h onto [0, n) without a modulo
+func filterReduce(h uint32, n uint32) uint32 {
+	return uint32((uint64(h) * uint64(n)) >> 32)
+}
+
+// xorFilterCapacity returns the number of fingerprints for n keys, a multiple of 3
+func xorFilterCapacity(n int) uint32 {
+	return (32 + uint32(math.Ceil(1.23*float64(n)))) / 3 * 3
+}
+
+// newXorFilter builds an XorFilter of the key hashes by peeling: fingerprints used by a single key are assigned
+// last, in reverse of the order they were peeled
+func newXorFilter(hashes []uint64) (*XorFilter, error) {
+	// peeling never finishes with duplicate hashes
+	hashes = slices.Clone(hashes)
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	capacity := xorFilterCapacity(len(hashes))
+	f := &XorFilter{
+		blockLength:  capacity / 3,
+		fingerprints: make([]uint8, capacity),
+	}
+
+	type xorSet struct {
+		mask  uint64
+		count uint32
+	}
+	type peeled struct {
+		hash  uint64
+		index uint32
+	}
+	sets := make([]xorSet, capacity)
+	queue := make([]uint32, 0, capacity)
+	stack := make([]peeled, 0, len(hashes))
+	for attempt := 0; attempt < xorFilterMaxAttempts; attempt++ {
+		f.seed = filterMix(uint64(attempt) + 0x9e3779b97f4a7c15)
+		clear(sets)
+		queue, stack = queue[:0], stack[:0]
+
+		for _, hash := range hashes {
+			h := filterMix(hash + f.seed)
+			for _, index := range f.positions(h) {
+				sets[index].mask ^= h
+				sets[index].count++
+			}
+		}
+		for index := range sets {
+			if sets[index].count == 1 {
+				queue = append(queue, uint32(index))
+			}
+		}
+		for len(queue) > 0 {
+			index := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if sets[index].count != 1 {
+				// peeled since it was queued
+				continue
+			}
+			h := sets[index].mask
+			stack = append(stack, peeled{hash: h, index: index})
+			for _, other := range f.positions(h) {
+				sets[other].mask ^= h
+				sets[other].count--
+				if sets[other].count == 1 {
+					queue = append(queue, other)
+				}
+			}
+		}
+		if len(stack) < len(hashes) {
+			continue
+		}
+
+		for i := len(stack) - 1; i >= 0; i-- {
+			positions := f.positions(stack[i].hash)
+			f.fingerprints[stack[i].index] = xorFingerprint(stack[i].hash) ^ f.fingerprints[positions[0]] ^ f.fingerprints[positions[1]] ^ f.fingerprints[positions[2]]
+		}
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("could not build xor filter of %d keys after %d attempts", len(hashes), xorFilterMaxAttempts)
+}
+
+// positions returns the fingerprint of the mixed hash in each of the 3 blocks
+func (f *XorFilter) positions(h uint64) [3]uint32 {
+	return [3]uint32{
+		filterReduce(uint32(h), f.blockLength),
+		filterReduce(uint32(bits.RotateLeft64(h, 21)), f.blockLength) + f.blockLength,
+		filterReduce(uint32(bits.RotateLeft64(h, 42)), f.blockLength) + 2*f.blockLength,
+	}
+}
+
+func xorFingerprint(h uint64) uint8 {
+	return uint8(h ^ (h >> 32))
+}
+
+// Test returns false if the key was definitely not in the filter, and true if it may have been
+func (f *XorFilter) Test(key []byte) bool {
+	h := filterMix(xxhash.Sum64(key) + f.seed)
+	positions := f.positions(h)
+	return xorFingerprint(h) == f.fingerprints[positions[0]]^f.fingerprints[positions[1]]^f.fingerprints[positions[2]]
+}
+
+// WriteTo writes the filter as the uint64 seed, uint64 fingerprint count, then the fingerprints
+func (f *XorFilter) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 16+len(f.fingerprints))
+	buf = binary.LittleEndian.AppendUint64(buf, f.seed)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(f.fingerprints)))
+	buf = append(buf, f.fingerprints...)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom reads a filter written with WriteTo, replacing the filter
+func (f *XorFilter) ReadFrom(r io.Reader) (int64, error) {
+	seed, length, fingerprints, err := readFilter(r, "xor")
+	if err != nil {
+		return 16, err
+	}
+	if length == 0 || length%3 != 0 || length > math.MaxUint32 {
+		return 16, fmt.Errorf("%w: invalid xor filter with %d fingerprints", ErrInvalidMetaBlock, length)
+	}
+
+	f.seed = seed
+	f.blockLength = uint32(length / 3)
+	f.fingerprints = fingerprints
+	return int64(16 + len(fingerprints)), nil
+}
+
+// readFilter reads the uint64 seed and uint64 length header of a filter, then length bytes
+func readFilter(r io.Reader, name string) (seed, length uint64, data []byte, err error) {
+	header := make([]byte, 16)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("error in io.ReadFull for %s filter header: %w", name, ioError(err))
+	}
+	seed = binary.LittleEndian.Uint64(header[0:8])
+	length = binary.LittleEndian.Uint64(header[8:16])
+
+	// copied rather than allocated up front, so a corrupt length doesn't allocate more than the reader holds
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, r, int64(min(length, math.MaxInt64)))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("error in io.CopyN for %s filter: %w", name, ioError(err))
+	}
+	return seed, length, buf.Bytes(), nil
+}
+
+// ribbonFilterSize returns the number of solution rows for n keys, with enough slack for most builds to succeed
+func ribbonFilterSize(n int) uint64 {
+	return uint64(math.Ceil(1.07*float64(n))) + ribbonFilterWidth
+}
+
+// newRibbonFilter builds a RibbonFilter of the key hashes, inserting each key's row into the band with on the fly
+// Gaussian elimination, then back substituting for the solution. The filter is grown if a seed can't be found.
+func newRibbonFilter(hashes []uint64) (*RibbonFilter, error) {
+	size := ribbonFilterSize(len(hashes))
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && attempt%ribbonFilterAttemptsPerSize == 0 {
+			size += size / 20
+		}
+		f := &RibbonFilter{
+			seed:     filterMix(uint64(attempt) + 0x9e3779b97f4a7c15),
+			solution: make([]uint8, size),
+		}
+		if f.solve(hashes) {
+			return f, nil
+		}
+		if attempt > 100 {
+			return nil, fmt.Errorf("could not build ribbon filter of %d keys after %d attempts", len(hashes), attempt)
+		}
+	}
+}
+
+// solve fills the solution for the hashes, returning false if the keys are inconsistent with the seed
+func (f *RibbonFilter) solve(hashes []uint64) bool {
+	coefficients := make([]uint64, len(f.solution))
+	results := make([]uint8, len(f.solution))
+	for _, hash := range hashes {
+		start, coefficient, result := f.row(hash)
+		for {
+			if coefficients[start] == 0 {
+				coefficients[start] = coefficient
+				results[start] = result
+				break
+			}
+			coefficient ^= coefficients[start]
+			result ^= results[start]
+			if coefficient == 0 {
+				// a duplicate key is consistent, anything else means this seed can't be solved
+				if result != 0 {
+					return false
+				}
+				break
+			}
+			shift := bits.TrailingZeros64(coefficient)
+			coefficient >>= shift
+			start += uint64(shift)
+		}
+	}
+
+	for i := len(f.solution) - 1; i >= 0; i-- {
+		result := results[i]
+		for rest := coefficients[i] &^ 1; rest != 0; rest &= rest - 1 {
+			result ^= f.solution[i+bits.TrailingZeros64(rest)]
+		}
+		f.solution[i] = result
+	}
+	return true
+}
+
+// row returns the first solution row of the key hash, the coefficients of the rows from it, and the result
+func (f *RibbonFilter) row(hash uint64) (uint64, uint64, uint8) {
+	h := filterMix(hash + f.seed)
+	start, _ := bits.Mul64(h, uint64(len(f.solution))-ribbonFilterWidth+1)
+	coefficient := filterMix(h^0xc2b2ae3d27d4eb4f) | 1
+	return start, coefficient, uint8(h)
+}
+
+// Test returns false if the key was definitely not in the filter, and true if it may have been
+func (f *RibbonFilter) Test(key []byte) bool {
+	start, coefficient, result := f.row(xxhash.Sum64(key))
+	for ; coefficient != 0; coefficient &= coefficient - 1 {
+		result ^= f.solution[start+uint64(bits.TrailingZeros64(coefficient))]
+	}
+	return result == 0
+}
+
+// WriteTo writes the filter as the uint64 seed, uint64 solution row count, then the solution rows
+func (f *RibbonFilter) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 16+len(f.solution))
+	buf = binary.LittleEndian.AppendUint64(buf, f.seed)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(f.solution)))
+	buf = append(buf, f.solution...)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom reads a filter written with WriteTo, replacing the filter
+func (f *RibbonFilter) ReadFrom(r io.Reader) (int64, error) {
+	seed, length, solution, err := readFilter(r, "ribbon")
+	if err != nil {
+		return 16, err
+	}
+	if length < ribbonFilterWidth {
+		return 16, fmt.Errorf("%w: invalid ribbon filter with %d rows", ErrInvalidMetaBlock, length)
+	}
+
+	f.seed = seed
+	f.solution = solution
+	return int64(16 + len(solution)), nil
+}
@@ -0,0 +1,176 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type readableFilter interface {
+	Filter
+	io.ReaderFrom
+}
+
+func TestKeyFilterRoundTrip(t *testing.T) {
+	for _, filterType := range []KeyFilterType{KeyFilterXor, KeyFilterRibbon} {
+		for _, count := range []int{0, 1, 100, 100_000} {
+			keys := make([][]byte, count)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key%08d", i))
+			}
+
+			var filter, read readableFilter
+			var err error
+			if filterType == KeyFilterXor {
+				filter, err = NewXorFilter(keys)
+				read = &XorFilter{}
+			} else {
+				filter, err = NewRibbonFilter(keys)
+				read = &RibbonFilter{}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := &bytes.Buffer{}
+			written, err := filter.WriteTo(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(written) != keyFilterSize(filterType, count) {
+				t.Fatal("expected a filter of", keyFilterSize(filterType, count), "bytes, got", written)
+			}
+			n, err := read.ReadFrom(bytes.NewReader(b.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != written {
+				t.Fatal("expected to read", written, "bytes, got", n)
+			}
+
+			for _, key := range keys {
+				if !read.Test(key) {
+					t.Fatal("expected filter", filterType, "to contain", string(key))
+				}
+			}
+
+			var falsePositives int
+			for i := count; i < count+100_000; i++ {
+				if read.Test([]byte(fmt.Sprintf("key%08d", i))) {
+					falsePositives++
+				}
+			}
+			// 8 bit fingerprints are about 1/256
+			if count > 0 && falsePositives > 100_000/128 {
+				t.Fatal("expected a false positive rate near 0.4% for filter", filterType, "got", falsePositives, "in 100000")
+			}
+
+			// truncated filters are corrupt
+			_, err = read.ReadFrom(bytes.NewReader(b.Bytes()[:b.Len()-1]))
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatal("expected ErrCorrupt, got", err)
+			}
+		}
+	}
+}
+
+func TestKeyFilterDuplicateKeys(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("a")}
+	xor, err := NewXorFilter(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ribbon, err := NewRibbonFilter(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !xor.Test(key) || !ribbon.Test(key) {
+			t.Fatal("expected the filters to contain", string(key))
+		}
+	}
+}
+
+func TestSegmentKeyFilter(t *testing.T) {
+	for _, filterType := range []KeyFilterType{KeyFilterXor, KeyFilterRibbon} {
+		for _, bulk := range []bool{false, true} {
+			// bulk segments are read with a lazily loaded filter
+			b := &bytes.Buffer{}
+			opts := DefaultSegmentWriterOptions()
+			opts.KeyFilter = filterType
+			opts.BulkMode = bulk
+			opts.BloomFilterZSTDCompression = bulk
+			var rows []KVPair
+			for i := 0; i < 2_000; i += 2 {
+				rows = append(rows, KVPair{Key: []byte(fmt.Sprintf("key%08d", i)), Value: []byte(fmt.Sprintf("value%08d", i))})
+			}
+			w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+			for _, row := range rows {
+				err := w.WriteRow(row.Key, row.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			length, _, err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bulk {
+				estimate, err := EstimateSegmentSize(rows, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if estimate != int64(length) {
+					t.Fatal("expected an exact estimate of", length, "got", estimate)
+				}
+			}
+
+			readerOpts := DefaultSegmentReaderOptions()
+			readerOpts.LazyBloomFilter = bulk
+			readerOpts.BloomFilterCache = NewBloomFilterCache(1)
+			r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length), readerOpts)
+			metadata, err := r.FetchAndLoadMetadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.BloomFilter != nil || metadata.BlockedBloomFilter != nil || (metadata.KeyFilter == nil) != bulk {
+				t.Fatal("expected only a key filter for", filterType, "loaded unless lazy", bulk)
+			}
+
+			var falsePositives int
+			for i := 0; i < 2_000; i++ {
+				key := []byte(fmt.Sprintf("key%08d", i))
+				if i%2 == 1 {
+					if !r.MayContain(key) {
+						falsePositives++
+					}
+					_, err := r.GetRow(key)
+					if !errors.Is(err, ErrNoRows) {
+						t.Fatal("expected ErrNoRows for", i, "got", err)
+					}
+					continue
+				}
+				row, err := r.GetRow(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(row.Value) != fmt.Sprintf("value%08d", i) {
+					t.Fatal("unexpected value", string(row.Value), "for", i)
+				}
+			}
+			if falsePositives > 20 {
+				t.Fatal("expected few false positives, got", falsePositives)
+			}
+			if bulk && readerOpts.BloomFilterCache.Len() != 1 {
+				t.Fatal("expected the lazily loaded filter to be cached")
+			}
+
+			_, err = r.ReadBloomFilter()
+			if !errors.Is(err, ErrNoBloomFilter) {
+				t.Fatal("expected ErrNoBloomFilter, got", err)
+			}
+		}
+	}
+}
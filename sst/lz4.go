@@ -0,0 +1,155 @@
+package sst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// The LZ4 block format (https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md), used for data blocks with
+// SegmentWriterOptions.LZ4Compression. Blocks are compressed whole, as the format has no framing.
+
+const (
+	lz4MinMatch  = 4
+	lz4MaxOffset = 65535
+	// lz4MFLimit is how close to the end of the block a match may start
+	lz4MFLimit = 12
+	// lz4LastLiterals is how many bytes at the end of the block must be literals
+	lz4LastLiterals = 5
+	lz4HashLog      = 12
+)
+
+// lz4CompressBlock appends the LZ4 block compression of src to dst, with a greedy single pass match finder
+func lz4CompressBlock(src, dst []byte) []byte {
+	// positions+1 of the last 4 bytes with each hash, so 0 is empty
+	var table [1 << lz4HashLog]int32
+
+	anchor := 0
+	limit := len(src) - lz4MFLimit
+	for i := 0; i < limit; {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		hash := (sequence * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != sequence {
+			i++
+			continue
+		}
+
+		// extend the match, leaving the last literals
+		matchLen := lz4MinMatch
+		for i+matchLen < len(src)-lz4LastLiterals && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+
+		literals := src[anchor:i]
+		dst = append(dst, byte(min(len(literals), 15)<<4)|byte(min(matchLen-lz4MinMatch, 15)))
+		dst = lz4AppendLength(dst, len(literals))
+		dst = append(dst, literals...)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(i-ref))
+		dst = lz4AppendLength(dst, matchLen-lz4MinMatch)
+
+		i += matchLen
+		anchor = i
+	}
+
+	// the last sequence is only literals
+	literals := src[anchor:]
+	dst = append(dst, byte(min(len(literals), 15)<<4))
+	dst = lz4AppendLength(dst, len(literals))
+	return append(dst, literals...)
+}
+
+// lz4AppendLength appends the extra bytes of a literal or match length that doesn't fit in the token
+func lz4AppendLength(dst []byte, length int) []byte {
+	if length < 15 {
+		return dst
+	}
+	length -= 15
+	for ; length >= 255; length -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(length))
+}
+
+// lz4DecompressBlock appends the decompression of the LZ4 block src to dst, which must be size bytes. Errors wrap
+// ErrCorruptCompressedData.
+func lz4DecompressBlock(src, dst []byte, size int) ([]byte, error) {
+	start := len(dst)
+	dst = slices.Grow(dst, size)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		literalLen := int(token >> 4)
+		if literalLen == 15 {
+			var err error
+			literalLen, i, err = lz4ReadLength(src, i, literalLen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if literalLen > len(src)-i || literalLen > size-(len(dst)-start) {
+			return nil, fmt.Errorf("%w: lz4 literals at offset %d extend past the block", ErrCorruptCompressedData, i)
+		}
+		dst = append(dst, src[i:i+literalLen]...)
+		i += literalLen
+		if i == len(src) {
+			// the last sequence
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("%w: lz4 match offset: %w", ErrCorruptCompressedData, io.ErrUnexpectedEOF)
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst)-start {
+			return nil, fmt.Errorf("%w: invalid lz4 match offset %d", ErrCorruptCompressedData, offset)
+		}
+
+		matchLen := int(token & 0xf)
+		if matchLen == 15 {
+			var err error
+			matchLen, i, err = lz4ReadLength(src, i, matchLen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		matchLen += lz4MinMatch
+		if matchLen > size-(len(dst)-start) {
+			return nil, fmt.Errorf("%w: lz4 match extends past the block", ErrCorruptCompressedData)
+		}
+
+		pos := len(dst) - offset
+		if offset >= matchLen {
+			dst = append(dst, dst[pos:pos+matchLen]...)
+			continue
+		}
+		// the match overlaps itself, repeating the last offset bytes
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[pos+k])
+		}
+	}
+
+	if len(dst)-start != size {
+		return nil, fmt.Errorf("%w: lz4 block decompressed to %d bytes, expected %d", ErrCorruptCompressedData, len(dst)-start, size)
+	}
+	return dst, nil
+}
+
+// lz4ReadLength reads the extra bytes of a literal or match length at i, returning the length and the next offset
+func lz4ReadLength(src []byte, i, length int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, fmt.Errorf("%w: lz4 length: %w", ErrCorruptCompressedData, io.ErrUnexpectedEOF)
+		}
+		b := src[i]
+		i++
+		length += int(b)
+		if b != 255 {
+			return length, i, nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package sst
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	random := make([]byte, 10_000)
+	_, err := rand.Read(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []byte
+	for i := 0; i < 1_000; i++ {
+		rows = append(rows, fmt.Sprintf("key%08dvalue%08d", i, i)...)
+	}
+
+	for name, src := range map[string][]byte{
+		"empty":                    {},
+		"short":                    []byte("abc"),
+		"below limit":              []byte("aaaaaaaaaaaa"),
+		"repeated":                 bytes.Repeat([]byte("a"), 10_000),
+		"overlapping":              bytes.Repeat([]byte("abc"), 1_000),
+		"long literals then match": append(bytes.Clone(random[:1_000]), random[:1_000]...),
+		"random":                   random,
+		"rows":                     rows,
+	} {
+		compressed := lz4CompressBlock(src, nil)
+		decompressed, err := lz4DecompressBlock(compressed, nil, len(src))
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if !bytes.Equal(decompressed, src) {
+			t.Fatal("round trip mismatch for", name)
+		}
+		t.Log(name, len(src), "->", len(compressed))
+	}
+
+	// appends to dst
+	compressed := lz4CompressBlock(rows, []byte("prefix"))
+	if !bytes.HasPrefix(compressed, []byte("prefix")) || len(compressed) >= len(rows) {
+		t.Fatal("expected the compressed rows appended to the prefix")
+	}
+	decompressed, err := lz4DecompressBlock(compressed[6:], []byte("prefix"), len(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed[6:], rows) || string(decompressed[:6]) != "prefix" {
+		t.Fatal("expected the decompressed rows appended to the prefix")
+	}
+}
+
+func TestLZ4Corrupt(t *testing.T) {
+	src := bytes.Repeat([]byte("hello world "), 100)
+	compressed := lz4CompressBlock(src, nil)
+
+	for name, tc := range map[string]struct {
+		block []byte
+		size  int
+	}{
+		"truncated":           {compressed[:len(compressed)/2], len(src)},
+		"wrong size":          {compressed, len(src) - 1},
+		"offset before start": {[]byte{0x10, 'a', 0x05, 0x00}, 10},
+		"zero offset":         {[]byte{0x10, 'a', 0x00, 0x00}, 10},
+		"literals past end":   {[]byte{0xf0, 0xff}, 10},
+	} {
+		_, err := lz4DecompressBlock(tc.block, nil, tc.size)
+		if !errors.Is(err, ErrCorruptCompressedData) {
+			t.Fatal("expected ErrCorruptCompressedData for", name, "got", err)
+		}
+	}
+}
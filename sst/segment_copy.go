@@ -0,0 +1,87 @@
+package sst
+
+import (
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"io"
+)
+
+// CopySegment copies the segment to dst block by block, without decoding any rows, such as for tiering or
+// replication. The data blocks are read with ReadRawBlock, then the meta block and trailer are copied verbatim, so
+// the copy is byte identical. Returns the number of bytes written.
+//
+// If verify, each block and the meta block are checked against their hashes before they are written, so a
+// corrupted source is not copied. The meta block hash is otherwise only verified when the metadata is loaded.
+//
+// Fetches the metadata if not already loaded. Works with SegmentReaderOptions.MetadataReader, in which case the copy
+// joins the data and metadata into a single segment file.
+func CopySegment(r *SegmentReader, dst io.Writer, verify bool) (int64, error) {
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		return 0, fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
+	}
+
+	err = r.loadBlockIndex()
+	if err != nil {
+		return 0, fmt.Errorf("error in loadBlockIndex: %w", err)
+	}
+
+	var written int64
+	var blockErr error
+	copyBlock := func(stat BlockStat) bool {
+		if stat.Offset != uint64(written) {
+			blockErr = fmt.Errorf("%w: block at offset %d does not follow the previous block ending at %d", ErrCorruptBlockIndexEntry, stat.Offset, written)
+			return false
+		}
+
+		raw, err := r.readRawBlock(stat, verify)
+		if err != nil {
+			blockErr = fmt.Errorf("error in readRawBlock at offset %d: %w", stat.Offset, err)
+			return false
+		}
+
+		n, err := dst.Write(raw)
+		written += int64(n)
+		if err != nil {
+			blockErr = fmt.Errorf("error writing block at offset %d: %w", stat.Offset, err)
+			return false
+		}
+		return true
+	}
+	metadata.BlockIndex.Ascend(copyBlock)
+	if blockErr == nil && metadata.IndexPartitions != nil {
+		// the index partitions follow the data blocks
+		metadata.IndexPartitions.Ascend(copyBlock)
+	}
+	if blockErr != nil {
+		return written, blockErr
+	}
+
+	trailer, err := r.readTrailer()
+	if err != nil {
+		return written, fmt.Errorf("error in readTrailer: %w", err)
+	}
+	reader, fileBytes := r.metadataSource()
+	_, err = reader.Seek(int64(trailer.metaBlockOffset), io.SeekStart)
+	if err != nil {
+		return written, fmt.Errorf("error in reader.Seek to meta block offset: %w", ioError(err))
+	}
+	metaBytes := make([]byte, fileBytes-int(trailer.metaBlockOffset))
+	_, err = io.ReadFull(reader, metaBytes)
+	if err != nil {
+		return written, fmt.Errorf("error reading meta block and trailer: %w", ioError(err))
+	}
+	if verify {
+		if calculatedHash := xxhash.Sum64(metaBytes[:len(metaBytes)-25]); calculatedHash != trailer.metaBlockHash {
+			return written, fmt.Errorf("%w: expected=%d got=%d", ErrMismatchedMetaBlockHash, trailer.metaBlockHash, calculatedHash)
+		}
+	}
+
+	n, err := dst.Write(metaBytes)
+	written += int64(n)
+	if err != nil {
+		return written, fmt.Errorf("error writing meta block and trailer: %w", err)
+	}
+
+	return written, nil
+}
@@ -0,0 +1,68 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCopySegment(t *testing.T) {
+	for _, zstdLevel := range []int{0, 1} {
+		buf, length := writeLargeSegment(t, 5_000, zstdLevel)
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+
+		dst := &bytes.Buffer{}
+		written, err := CopySegment(&r, dst, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != int64(length) || !bytes.Equal(dst.Bytes(), buf.Bytes()) {
+			t.Fatal("expected a byte identical copy for zstd level", zstdLevel, "got", written, "of", length, "bytes")
+		}
+	}
+
+	// joins separate metadata
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _ := metadata.BlockIndex.Max()
+	split := int(last.Offset + last.BlockSize)
+	readerOpts := DefaultSegmentReaderOptions()
+	readerOpts.MetadataReader = BytesReadSeekCloser{bytes.NewReader(buf.Bytes()[split:])}
+	readerOpts.MetadataBytes = int(length) - split
+	r = NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(buf.Bytes()[:split])}, split, readerOpts)
+	dst := &bytes.Buffer{}
+	_, err = CopySegment(&r, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), buf.Bytes()) {
+		t.Fatal("expected the copy of separate metadata to be the joined segment")
+	}
+}
+
+func TestCopySegmentCorrupted(t *testing.T) {
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	corrupted := bytes.Clone(buf.Bytes())
+	// the first block starts with the key length of the first row
+	corrupted[10] ^= 0xff
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(corrupted)}, int(length))
+	_, err := CopySegment(&r, &bytes.Buffer{}, true)
+	if !errors.Is(err, ErrMismatchedBlockHash) {
+		t.Fatal("expected ErrMismatchedBlockHash, got", err)
+	}
+
+	// copied verbatim without verification
+	dst := &bytes.Buffer{}
+	_, err = CopySegment(&r, dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), corrupted) {
+		t.Fatal("expected a byte identical copy of the corrupted segment")
+	}
+}
@@ -0,0 +1,189 @@
+package sst
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// estimateSampleBytes is roughly how many bytes of rows EstimateSegmentSize compresses to estimate a compression ratio
+const estimateSampleBytes = 64 * 1024
+
+// EstimateSegmentSize predicts the size of the segment file that writing rows with opts would produce, without
+// writing it, such as for choosing a write target ahead of time. Rows must be in order, as for WriteRow.
+//
+// The estimate accounts for row headers, block padding, the bloom filter, the meta block, and the trailer, and is
+// exact without compression. With ZSTDCompressionLevel or ValueCompressionThreshold, compressed sizes are estimated
+// from the compression ratio of a sample of the rows, so the estimate is approximate. With
+// MetaBlockZSTDCompression or BloomFilterZSTDCompression, the uncompressed size is used, so the estimate is an upper
+// bound on the meta block. With LZ4Compression, the uncompressed size is used, so the estimate is an upper bound.
+// With ZSTDDictionarySampleBytes, the compression ratio is estimated without the dictionary. With KeyFilterRibbon,
+// the filter is assumed to build at its initial size, which it almost always does.
+func EstimateSegmentSize(rows []KVPair, opts SegmentWriterOptions) (int64, error) {
+	if len(rows) == 0 {
+		return 0, ErrNoRowsWritten
+	}
+
+	threshold, err := opts.dataBlockThreshold()
+	if err != nil {
+		return 0, err
+	}
+	useZSTD := opts.ZSTDCompressionLevel > 0
+	headerLen := (&SegmentWriter{options: opts}).rowHeaderLength()
+
+	var rawBytes int
+	for _, row := range rows {
+		if len(row.Key) > math.MaxUint16 {
+			return 0, fmt.Errorf("%w, got length %d", ErrKeyTooLarge, len(row.Key))
+		}
+		if len(row.Value) > math.MaxUint32 {
+			return 0, fmt.Errorf("%w, got length %d", ErrValueTooLarge, len(row.Value))
+		}
+		if len(row.Key) == 0 {
+			return 0, fmt.Errorf("key cannot be empty :%w", ErrInvalidKey)
+		}
+		rawBytes += headerLen + len(row.Key) + len(row.Value)
+	}
+
+	// estimate the compression ratios from a sample of rows spread across the segment
+	blockRatio, valueRatio := 1.0, 1.0
+	if useZSTD || opts.ValueCompressionThreshold > 0 {
+		blockRatio, valueRatio, err = sampleCompressionRatios(rows, rawBytes, opts)
+		if err != nil {
+			return 0, fmt.Errorf("error in sampleCompressionRatios: %w", err)
+		}
+	}
+
+	// split the rows into blocks like SegmentWriter.writeRow, and pad them like flushCurrentDataBlock
+	var dataBytes, blockIndexBytes, topLevelIndexBytes int64
+	var blocks int
+	var blockLen float64
+	blockOpen := false
+	flush := func() {
+		size := int64(math.Ceil(blockLen))
+		if !opts.DisableBlockPadding {
+			size += int64(opts.DataBlockSize) - size%int64(opts.DataBlockSize)
+		}
+		dataBytes += size
+		blockOpen = false
+	}
+	for _, row := range rows {
+		if !blockOpen {
+			blockOpen = true
+			blockLen = 0
+			// index entry: key length, key, 8 uint64 and 2 uint32 stats, and the checksum
+			blockIndexBytes += 2 + int64(len(row.Key)) + 64 + 8
+			if opts.BlockIndexPartitionEntries > 0 && blocks%opts.BlockIndexPartitionEntries == 0 {
+				// the top level index entry of the partition
+				topLevelIndexBytes += 2 + int64(len(row.Key)) + 64 + 8
+			}
+			blocks++
+		}
+
+		valueLen := float64(len(row.Value))
+		if opts.ValueCompressionThreshold > 0 && len(row.Value) > 0 && uint32(len(row.Value)) >= opts.ValueCompressionThreshold {
+			valueLen = math.Ceil(valueLen * valueRatio)
+		}
+		rowLen := float64(headerLen+len(row.Key)) + valueLen
+		if useZSTD {
+			rowLen *= blockRatio
+		}
+		blockLen += rowLen
+
+		if blockLen >= float64(threshold) {
+			flush()
+		}
+	}
+	if blockOpen {
+		flush()
+	}
+
+	// the meta block, see SEGMENT.md
+	metaBytes := int64(2+len(rows[0].Key)+2+len(rows[len(rows)-1].Key)) + 1
+	if opts.KeyFilter != KeyFilterNone {
+		metaBytes += 8 + int64(keyFilterSize(opts.KeyFilter, len(rows)))
+	} else if opts.BlockedBloomFilter != nil {
+		bloomBytes, err := opts.BlockedBloomFilter.WriteTo(io.Discard)
+		if err != nil {
+			return 0, fmt.Errorf("error in BlockedBloomFilter.WriteTo: %w", err)
+		}
+		metaBytes += 8 + bloomBytes
+	} else if opts.BloomFilter != nil {
+		bloomBytes, err := opts.BloomFilter.WriteTo(io.Discard)
+		if err != nil {
+			return 0, fmt.Errorf("error in BloomFilter.WriteTo: %w", err)
+		}
+		metaBytes += 8 + bloomBytes
+	}
+	metaBytes += 2 // compression and row format
+	if opts.Epoch > 0 {
+		metaBytes += 8
+	}
+	if opts.BlockIndexPartitionEntries > 0 && blocks > opts.BlockIndexPartitionEntries {
+		// the partitions are written after the data blocks, each with an entry count
+		partitions := (blocks + opts.BlockIndexPartitionEntries - 1) / opts.BlockIndexPartitionEntries
+		dataBytes += blockIndexBytes + 8*int64(partitions)
+		blockIndexBytes = topLevelIndexBytes
+	}
+	metaBytes += 1 + 8 + blockIndexBytes
+	if len(opts.UserMetadata) > 0 {
+		metaBytes += 4 + int64(len(opts.UserMetadata))
+	}
+	metaBytes += 8 + 8 + 1 // block size, threshold, and padding
+	if !opts.CreatedAt.IsZero() || !opts.Deterministic {
+		metaBytes += 8
+	}
+	if useZSTD && opts.ZSTDDictionarySampleBytes > 0 {
+		// the dictionary holds about the sampled rows
+		metaBytes += 4 + int64(min(uint64(rawBytes), opts.ZSTDDictionarySampleBytes))
+	}
+
+	return dataBytes + metaBytes + 25, nil
+}
+
+// sampleCompressionRatios returns the ratio of compressed to raw bytes for blocks and individually compressed
+// values, by compressing up to about estimateSampleBytes of evenly spaced rows
+func sampleCompressionRatios(rows []KVPair, rawBytes int, opts SegmentWriterOptions) (float64, float64, error) {
+	stride := max(1, rawBytes/estimateSampleBytes)
+
+	var blockSample []byte
+	var valueSample [][]byte
+	for i := 0; i < len(rows); i += stride {
+		row := rows[i]
+		blockSample = append(blockSample, row.Key...)
+		blockSample = append(blockSample, row.Value...)
+		if opts.ValueCompressionThreshold > 0 && len(row.Value) > 0 && uint32(len(row.Value)) >= opts.ValueCompressionThreshold {
+			valueSample = append(valueSample, row.Value)
+		}
+	}
+
+	blockRatio := 1.0
+	if opts.ZSTDCompressionLevel > 0 {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(opts.ZSTDCompressionLevel)))
+		if err != nil {
+			return 0, 0, fmt.Errorf("error in zstd.NewWriter: %w", err)
+		}
+		defer enc.Close()
+		blockRatio = float64(len(enc.EncodeAll(blockSample, nil))) / float64(len(blockSample))
+	}
+
+	valueRatio := 1.0
+	if len(valueSample) > 0 {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error in zstd.NewWriter for values: %w", err)
+		}
+		defer enc.Close()
+		// values are compressed individually, so each keeps its frame overhead
+		var raw, compressed int
+		for _, value := range valueSample {
+			raw += len(value)
+			compressed += len(enc.EncodeAll(value, nil))
+		}
+		valueRatio = float64(compressed) / float64(raw)
+	}
+
+	return blockRatio, valueRatio, nil
+}
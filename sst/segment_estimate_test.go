@@ -0,0 +1,99 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// estimateRows returns rows of varied, partly compressible values, with a tombstone every 50 rows
+func estimateRows(n int) []KVPair {
+	rows := make([]KVPair, n)
+	for i := range rows {
+		rows[i] = KVPair{
+			Key:   []byte(fmt.Sprintf("key%08d", i)),
+			Value: bytes.Repeat([]byte(fmt.Sprintf("value%d", i*7919)), 1+i%30),
+			Seq:   uint64(i + 1),
+		}
+		if i%50 == 0 {
+			rows[i].Value = nil
+		}
+	}
+	return rows
+}
+
+func writeEstimateSegment(t *testing.T, rows []KVPair, opts SegmentWriterOptions) int64 {
+	w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+	for _, row := range rows {
+		var err error
+		if opts.RowSequence {
+			err = w.WriteRowWithSeq(row.Key, row.Value, row.Seq)
+		} else {
+			err = w.WriteRow(row.Key, row.Value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(length)
+}
+
+func TestEstimateSegmentSize(t *testing.T) {
+	rows := estimateRows(5_000)
+
+	noPadding := DefaultSegmentWriterOptions()
+	noPadding.DisableBlockPadding = true
+	noBloom := DefaultSegmentWriterOptions()
+	noBloom.BloomFilter = nil
+	rowFormat := DefaultSegmentWriterOptions()
+	rowFormat.RowSequence = true
+	rowFormat.Epoch = 7
+	rowFormat.UserMetadata = []byte("user metadata")
+	partitionedIndex := DefaultSegmentWriterOptions()
+	partitionedIndex.BlockIndexPartitionEntries = 16
+	for name, opts := range map[string]SegmentWriterOptions{
+		"default":           DefaultSegmentWriterOptions(),
+		"no padding":        noPadding,
+		"no bloom":          noBloom,
+		"row format":        rowFormat,
+		"partitioned index": partitionedIndex,
+	} {
+		estimate, err := EstimateSegmentSize(rows, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := writeEstimateSegment(t, rows, opts)
+		if estimate != actual {
+			t.Fatal("expected an exact estimate for", name, "got", estimate, "actual", actual)
+		}
+	}
+
+	blockCompression := DefaultSegmentWriterOptions()
+	blockCompression.ZSTDCompressionLevel = 3
+	valueCompression := DefaultSegmentWriterOptions()
+	valueCompression.ValueCompressionThreshold = 64
+	for name, opts := range map[string]SegmentWriterOptions{
+		"block compression": blockCompression,
+		"value compression": valueCompression,
+	} {
+		estimate, err := EstimateSegmentSize(rows, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := writeEstimateSegment(t, rows, opts)
+		if math.Abs(float64(estimate-actual))/float64(actual) > 0.3 {
+			t.Fatal("expected an estimate within 30% for", name, "got", estimate, "actual", actual)
+		}
+	}
+
+	_, err := EstimateSegmentSize(nil, DefaultSegmentWriterOptions())
+	if !errors.Is(err, ErrNoRowsWritten) {
+		t.Fatal("expected ErrNoRowsWritten, got", err)
+	}
+}
@@ -0,0 +1,118 @@
+package sst
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// mergeCursor is the current row of an input segment of MergeSegments
+	mergeCursor struct {
+		row   KVPair
+		iter  *RowIter
+		index int
+	}
+
+	// mergeHeap orders cursors by key, with the latest reader first for the same key
+	mergeHeap []*mergeCursor
+)
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	if cmp := bytes.Compare(h[i].row.Key, h[j].row.Key); cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].index > h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	*h = append(*h, x.(*mergeCursor))
+}
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	cursor := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// MergeSegments merges the rows of the segments into a single segment written to out, returning the results of
+// SegmentWriter.Close. When multiple segments have the same key, the row from the later reader wins.
+//
+// Tombstones are kept, as older segments outside the merge may still hold the key. Row sequence numbers are kept if
+// opts.RowSequence is enabled.
+//
+// The inputs are merged with a heap, so each output row costs O(log n) for n readers.
+func MergeSegments(readers []*SegmentReader, out io.Writer, opts SegmentWriterOptions) (uint64, []byte, error) {
+	cursors := make(mergeHeap, 0, len(readers))
+	// advance moves the cursor to its next row, returning false if the reader is exhausted
+	advance := func(cursor *mergeCursor) (bool, error) {
+		row, err := cursor.iter.Next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error in RowIter.Next for reader %d: %w", cursor.index, err)
+		}
+		cursor.row = row
+		return true, nil
+	}
+
+	for i, reader := range readers {
+		iter, err := reader.RowIter(DirectionAscending)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in RowIter for reader %d: %w", i, err)
+		}
+		cursor := &mergeCursor{iter: iter, index: i}
+		ok, err := advance(cursor)
+		if err != nil {
+			return 0, nil, err
+		}
+		if ok {
+			cursors = append(cursors, cursor)
+		}
+	}
+	heap.Init(&cursors)
+
+	w := NewSegmentWriter(nopWriteCloser{out}, opts)
+	for cursors.Len() > 0 {
+		// the lowest key, with the latest reader winning ties
+		row := cursors[0].row
+		var err error
+		err = w.WriteKVPair(row)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error writing row %x: %w", row.Key, err)
+		}
+
+		// roll forward every reader on this key
+		for cursors.Len() > 0 && bytes.Equal(cursors[0].row.Key, row.Key) {
+			ok, err := advance(cursors[0])
+			if err != nil {
+				return 0, nil, err
+			}
+			if ok {
+				heap.Fix(&cursors, 0)
+			} else {
+				heap.Pop(&cursors)
+			}
+		}
+	}
+
+	length, metaBytes, err := w.Close()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in SegmentWriter.Close: %w", err)
+	}
+
+	return length, metaBytes, nil
+}
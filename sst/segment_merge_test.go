@@ -0,0 +1,234 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// writeTestSegment writes every other key below key200 from start, like the odd/even snapshot reader test segments
+func writeTestSegment(t *testing.T, start int, valuePrefix string) *SegmentReader {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := start; i < 200; i += 2 {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("%s%03d", valuePrefix, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	return &r
+}
+
+func TestMergeSegments(t *testing.T) {
+	even := writeTestSegment(t, 0, "value")
+	odd := writeTestSegment(t, 1, "value")
+
+	out := &bytes.Buffer{}
+	length, _, err := MergeSegments([]*SegmentReader{even, odd}, out, DefaultSegmentWriterOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(length) != out.Len() {
+		t.Fatal("expected length", out.Len(), "got", length)
+	}
+
+	rows := readAllRows(t, out.Bytes())
+	if len(rows) != 200 {
+		t.Fatal("expected 200 rows, got", len(rows))
+	}
+	for i, row := range rows {
+		if string(row.Key) != fmt.Sprintf("key%03d", i) || string(row.Value) != fmt.Sprintf("value%03d", i) {
+			t.Fatal("unexpected row", string(row.Key), string(row.Value), "at", i)
+		}
+	}
+}
+
+func TestMergeSegmentsLaterWins(t *testing.T) {
+	old := writeTestSegment(t, 0, "old")
+	odd := writeTestSegment(t, 1, "value")
+	newer := writeTestSegment(t, 0, "value")
+
+	out := &bytes.Buffer{}
+	_, _, err := MergeSegments([]*SegmentReader{old, odd, newer}, out, DefaultSegmentWriterOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readAllRows(t, out.Bytes())
+	if len(rows) != 200 {
+		t.Fatal("expected 200 rows, got", len(rows))
+	}
+	for i, row := range rows {
+		if string(row.Value) != fmt.Sprintf("value%03d", i) {
+			t.Fatal("expected the later reader to win, got", string(row.Value), "for", string(row.Key))
+		}
+	}
+}
+
+// mergeSegmentsLinear is MergeSegments scanning every cursor for each output row, as a reference for the heap merge
+func mergeSegmentsLinear(readers []*SegmentReader, out io.Writer, opts SegmentWriterOptions) (uint64, []byte, error) {
+	iters := make([]*RowIter, len(readers))
+	cursors := make([]KVPair, len(readers))
+	exhausted := make([]bool, len(readers))
+	advance := func(i int) error {
+		row, err := iters[i].Next()
+		if errors.Is(err, io.EOF) {
+			exhausted[i] = true
+			return nil
+		}
+		cursors[i] = row
+		return err
+	}
+
+	for i, reader := range readers {
+		iter, err := reader.RowIter(DirectionAscending)
+		if err != nil {
+			return 0, nil, err
+		}
+		iters[i] = iter
+		err = advance(i)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	w := NewSegmentWriter(nopWriteCloser{out}, opts)
+	for {
+		winner := -1
+		for i := range cursors {
+			if exhausted[i] {
+				continue
+			}
+			if winner == -1 || bytes.Compare(cursors[i].Key, cursors[winner].Key) <= 0 {
+				winner = i
+			}
+		}
+		if winner == -1 {
+			break
+		}
+
+		row := cursors[winner]
+		err := w.WriteRow(row.Key, row.Value)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := range cursors {
+			if exhausted[i] || !bytes.Equal(cursors[i].Key, row.Key) {
+				continue
+			}
+			err = advance(i)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	return w.Close()
+}
+
+// writeFanInSegments writes n segments of overlapping keys, where segment s holds the keys below rows where
+// key%(n/2) == s%(n/2), so each key is in two segments. Every 10th key of the later segment is a tombstone.
+func writeFanInSegments(tb testing.TB, n, rows int) [][]byte {
+	segments := make([][]byte, n)
+	for s := 0; s < n; s++ {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := s % (n / 2); i < rows; i += n / 2 {
+			val := []byte(fmt.Sprintf("value%d-%08d", s, i))
+			if s >= n/2 && i%10 == 0 {
+				val = nil
+			}
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), val)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+		_, _, err := w.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		segments[s] = b.Bytes()
+	}
+	return segments
+}
+
+func fanInReaders(segments [][]byte) []*SegmentReader {
+	readers := make([]*SegmentReader, len(segments))
+	for i, segment := range segments {
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+		readers[i] = &r
+	}
+	return readers
+}
+
+func TestMergeSegmentsFanIn(t *testing.T) {
+	segments := writeFanInSegments(t, 64, 20_000)
+
+	opts := DefaultSegmentWriterOptions()
+	opts.CreatedAt = time.Unix(1_700_000_000, 0)
+	linearOpts := opts
+	linearOpts.BloomFilter = opts.BloomFilter.Copy()
+	heapOut, linearOut := &bytes.Buffer{}, &bytes.Buffer{}
+	_, _, err := MergeSegments(fanInReaders(segments), heapOut, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mergeSegmentsLinear(fanInReaders(segments), linearOut, linearOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(heapOut.Bytes(), linearOut.Bytes()) {
+		t.Fatal("expected the heap merge to match the linear merge")
+	}
+
+	rows := readAllRows(t, heapOut.Bytes())
+	if len(rows) != 20_000 {
+		t.Fatal("expected 20000 rows, got", len(rows))
+	}
+	for i, row := range rows {
+		// the later of the two segments holding the key wins, keeping its tombstones
+		s := i%32 + 32
+		expected := fmt.Sprintf("value%d-%08d", s, i)
+		if i%10 == 0 {
+			expected = ""
+		}
+		if string(row.Key) != fmt.Sprintf("key%08d", i) || string(row.Value) != expected {
+			t.Fatal("unexpected row", string(row.Key), string(row.Value), "at", i)
+		}
+	}
+}
+
+func BenchmarkMergeSegmentsFanIn(b *testing.B) {
+	for _, n := range []int{4, 64} {
+		segments := writeFanInSegments(b, n, 20_000)
+		for name, merge := range map[string]func([]*SegmentReader, io.Writer, SegmentWriterOptions) (uint64, []byte, error){
+			"heap":   MergeSegments,
+			"linear": mergeSegmentsLinear,
+		} {
+			b.Run(fmt.Sprintf("%s-%d", name, n), func(b *testing.B) {
+				opts := DefaultSegmentWriterOptions()
+				opts.BloomFilter = nil
+				out := &bytes.Buffer{}
+				for i := 0; i < b.N; i++ {
+					out.Reset()
+					_, _, err := merge(fanInReaders(segments), out, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
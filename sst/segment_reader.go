@@ -10,6 +10,11 @@ import (
 	"github.com/google/btree"
 	"github.com/klauspost/compress/zstd"
 	"io"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // BytesReadSeekCloser is a wrapper around bytes.Reader that implements io.ReadSeekCloser
@@ -32,23 +37,108 @@ type (
 		reader    io.ReadSeekCloser
 		fileBytes int
 		closed    bool
+
+		options SegmentReaderOptions
 	}
 
 	SegmentMetadata struct {
+		// Version is the segment version of the meta block, see SEGMENT.md. Segments of version 1 have no row
+		// format, block size, or row stats.
+		Version byte
+
+		// BloomFilter is nil if there is no bloom filter, or it is lazily loaded
 		BloomFilter *bloom.BloomFilter
+		// BloomFilterLength is the stored (possibly compressed) byte length of the bloom filter, 0 if there is no
+		// bloom filter
+		BloomFilterLength uint64
+		// BloomFilterEndOffset is how many bytes from the end of the segment file the bloom filter starts,
+		// used to lazily load the bloom filter
+		BloomFilterEndOffset uint64
+		bloomFilterKey       *bloomFilterKey
+		// bloomFilterType is the type of the stored filter, to decode a lazily loaded filter
+		bloomFilterType byte
+		// bloomFilterCompressed is whether the stored bloom filter is zstd compressed
+		bloomFilterCompressed bool
+		// BlockedBloomFilter is set if the segment was written with SegmentWriterOptions.BlockedBloomFilter, in
+		// place of BloomFilter. It is always loaded with the metadata, even with LazyBloomFilter.
+		BlockedBloomFilter *BlockedBloomFilter
+		// KeyFilter is the XorFilter or RibbonFilter if the segment was written with SegmentWriterOptions.KeyFilter,
+		// in place of BloomFilter. Like BloomFilter, it is nil if lazily loaded.
+		KeyFilter Filter
 
 		// ZSTDCompression is the highest priority compression check
 		ZSTDCompression bool
 		// ZSTDCompression takes priority
 		LZ4Compression bool
+		// Codec compresses data blocks if not nil, resolved from the stored codec ID (see RegisterCodec). Set with
+		// LZ4Compression.
+		Codec Codec
+
+		// RowSequence indicates that each row header has a sequence number
+		RowSequence bool
+		// ValueCompression indicates that each row header has a value flags byte, and values may be individually
+		// compressed
+		ValueCompression bool
+		// Tombstones indicates that tombstones are marked in the row header (see SegmentWriter.WriteTombstone), so
+		// rows with an empty value are live. Only version 1 segments don't, and their rows with an empty value are
+		// read as tombstones.
+		Tombstones bool
+
+		// Epoch is the write epoch of the segment, 0 if not set, see SegmentWriterOptions.Epoch
+		Epoch uint64
+
+		// UserMetadata is the opaque blob from SegmentWriterOptions.UserMetadata, nil if not set
+		UserMetadata []byte
+
+		// DataBlockSize and DataBlockThresholdBytes are the SegmentWriterOptions the segment was written with, and
+		// DataBlockPadding is whether blocks were padded to a multiple of DataBlockSize (not
+		// SegmentWriterOptions.DisableBlockPadding). All are zero for segments written before they were recorded.
+		DataBlockSize           uint64
+		DataBlockThresholdBytes uint64
+		DataBlockPadding        bool
+
+		// CreatedAt is SegmentWriterOptions.CreatedAt, zero if not stored
+		CreatedAt time.Time
+
+		// ZSTDDictionary is the zstd dictionary the data blocks are compressed with, nil if none, see
+		// SegmentWriterOptions.ZSTDDictionarySampleBytes
+		ZSTDDictionary []byte
+		// zstdDictionaryDecoder decompresses the data blocks with ZSTDDictionary
+		zstdDictionaryDecoder *zstd.Decoder
 
 		FirstKey []byte
 		LastKey  []byte
 
 		BlockIndex *btree.BTreeG[BlockStat]
+		// IndexPartitions is the top level index of a partitioned block index, nil if the block index is not
+		// partitioned (see SegmentWriterOptions.BlockIndexPartitionEntries). Each entry is a partition, with the
+		// stats of its blocks totalled. BlockIndex only holds the blocks of the loaded partitions, which is all of
+		// them unless SegmentReaderOptions.LazyBlockIndex.
+		IndexPartitions *btree.BTreeG[BlockStat]
+		// loadedIndexPartitions tracks the partitions loaded into BlockIndex, nil if the block index is not
+		// partitioned
+		loadedIndexPartitions *loadedIndexPartitions
+
+		// RowCount is the total number of rows in the segment, including tombstones. The row stats are 0 for
+		// version 1 segments, as their block index doesn't hold them, see SEGMENT.md.
+		RowCount uint64
+		// TombstoneCount is the number of rows in the segment that are tombstones, see KVPair.Tombstone
+		TombstoneCount uint64
+		// MinValueLength and MaxValueLength are the smallest and largest value lengths in the segment,
+		// excluding tombstones. Both are 0 if there are only tombstones.
+		MinValueLength uint32
+		MaxValueLength uint32
 	}
 )
 
+// loadedIndexPartitions are the offsets of the partitions loaded into a SegmentMetadata.BlockIndex. It is held by
+// pointer so that copies of the metadata, and readers sharing it with LoadCachedMetadata, load each partition once
+// and don't race on the BlockIndex. Once every partition is loaded the BlockIndex no longer changes.
+type loadedIndexPartitions struct {
+	mu      sync.RWMutex
+	offsets map[uint64]bool
+}
+
 var (
 	// UnboundStart indicates that the range should go all the way to the first key
 	UnboundStart []byte
@@ -56,15 +146,44 @@ var (
 	UnboundEnd = []byte{0xff}
 )
 
-func NewSegmentReader(reader io.ReadSeekCloser, fileBytes int) SegmentReader {
+// NewSegmentReader creates a reader for a segment of fileBytes length. The options are optional, using
+// DefaultSegmentReaderOptions if omitted, and only the first is used.
+func NewSegmentReader(reader io.ReadSeekCloser, fileBytes int, opts ...SegmentReaderOptions) SegmentReader {
+	if len(opts) > 0 {
+		return NewSegmentReaderWithOptions(reader, fileBytes, opts[0])
+	}
+	return NewSegmentReaderWithOptions(reader, fileBytes, DefaultSegmentReaderOptions())
+}
+
+// NewSegmentReaderWithOptions creates a reader for a segment of fileBytes length. Unset options behave as their
+// defaults, so a zero value SegmentReaderOptions is safe to use.
+func NewSegmentReaderWithOptions(reader io.ReadSeekCloser, fileBytes int, opts SegmentReaderOptions) SegmentReader {
 	sr := SegmentReader{
 		reader:    reader,
 		fileBytes: fileBytes,
+		options:   opts,
 	}
 
 	return sr
 }
 
+// NewMetadataSegmentReader creates a reader from just the meta block bytes (such as those returned by
+// SegmentWriter.Close, or cached), for planning without access to the segment file. Methods that only need the
+// metadata work, such as FetchAndLoadMetadata, BlockRanges, and MayContain, while methods that read data blocks
+// return ErrNoDataReader. The bloom filter is loaded with the metadata.
+func NewMetadataSegmentReader(metaBlockBytes []byte) (SegmentReader, error) {
+	sr := SegmentReader{
+		options: DefaultSegmentReaderOptions(),
+	}
+	metadata, err := sr.tryBytesToMetadata(metaBlockBytes, false, currentSegmentVersion)
+	if err != nil {
+		return SegmentReader{}, fmt.Errorf("error in tryBytesToMetadata: %w", err)
+	}
+	sr.metadata = metadata
+
+	return sr, nil
+}
+
 // LoadCachedMetadata loads in cached metadata
 func (s *SegmentReader) LoadCachedMetadata(metadata *SegmentMetadata) {
 	s.metadata = metadata
@@ -72,60 +191,225 @@ func (s *SegmentReader) LoadCachedMetadata(metadata *SegmentMetadata) {
 
 var (
 	FatalError                 = errors.New("fatal error (crash node!)")
-	ErrUnknownSegmentVersion   = fmt.Errorf("%w: unknown segment version", FatalError)
-	ErrMismatchedMetaBlockHash = fmt.Errorf("%w: mismatched meta block hash", FatalError)
-	ErrInvalidMetaBlock        = fmt.Errorf("%w: invalid meta block", FatalError)
-	ErrInvalidMagicNumber      = fmt.Errorf("%w: sst file did not have magic number as final bytes", FatalError)
+	ErrUnknownSegmentVersion   = fmt.Errorf("%w: unknown segment version", ErrCorrupt)
+	ErrMismatchedMetaBlockHash = fmt.Errorf("%w: mismatched meta block hash", ErrCorrupt)
+	ErrInvalidMetaBlock        = fmt.Errorf("%w: invalid meta block", ErrCorrupt)
+	ErrInvalidMagicNumber      = fmt.Errorf("%w: sst file did not have magic number as final bytes", ErrCorrupt)
+	ErrMismatchedBlockHash     = fmt.Errorf("%w: mismatched block hash", ErrCorrupt)
+	ErrCorruptBlockIndexEntry  = fmt.Errorf("%w: corrupt block index entry", ErrCorrupt)
+	ErrBlockOutOfBounds        = fmt.Errorf("%w: block is beyond the end of the segment file", ErrCorrupt)
+	ErrInconsistentMetadata    = fmt.Errorf("%w: first and last key do not match the block index", ErrCorrupt)
+	ErrInvalidValueFlags       = fmt.Errorf("%w: invalid value flags", ErrCorrupt)
+	ErrCorruptCompressedData   = fmt.Errorf("%w: corrupt compressed data", ErrCorrupt)
+	ErrNoDataReader            = errors.New("no data reader, the segment reader only has metadata")
+
+	// ErrDecompressorUnavailable indicates that a decompressor couldn't be created, such as from resource
+	// exhaustion. Unlike ErrCorrupt it is transient, so the read can be retried.
+	ErrDecompressorUnavailable = errors.New("decompressor unavailable")
 )
 
+var (
+	// zstdDecoder decompresses blocks and individually compressed values, DecodeAll is safe for concurrent use.
+	// It is created on first use by getZSTDDecoder, and again on the next use if that fails.
+	zstdDecoder atomic.Pointer[zstd.Decoder]
+	// newZSTDDecoder creates zstdDecoder, replaced in tests
+	newZSTDDecoder = func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil)
+	}
+)
+
+// getZSTDDecoder returns the shared zstd decoder, creating it if needed
+func getZSTDDecoder() (*zstd.Decoder, error) {
+	if decoder := zstdDecoder.Load(); decoder != nil {
+		return decoder, nil
+	}
+
+	decoder, err := newZSTDDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("%w: error in zstd.NewReader: %w", ErrDecompressorUnavailable, err)
+	}
+	if !zstdDecoder.CompareAndSwap(nil, decoder) {
+		// created concurrently
+		decoder.Close()
+		return zstdDecoder.Load(), nil
+	}
+	return decoder, nil
+}
+
+// zstdDecodeAll decompresses src with the shared zstd decoder, appending to dst. Errors wrap
+// ErrDecompressorUnavailable if the decoder couldn't be created, or ErrCorruptCompressedData if src is invalid.
+func zstdDecodeAll(src, dst []byte) ([]byte, error) {
+	decoder, err := getZSTDDecoder()
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptCompressedData, err)
+	}
+	return decoded, nil
+}
+
+// TombstoneRatio returns the fraction of rows in the segment that are tombstones, useful for finding segments
+// with a lot of garbage that should be compacted. Returns 0 if there are no rows, or the segment is version 1 and has no
+// row stats.
+func (m *SegmentMetadata) TombstoneRatio() float64 {
+	if m.RowCount == 0 {
+		return 0
+	}
+	return float64(m.TombstoneCount) / float64(m.RowCount)
+}
+
+// zstdDecodeBlock is zstdDecodeAll for a zstd compressed data block, using the dictionary if the segment has one
+func (m *SegmentMetadata) zstdDecodeBlock(src, dst []byte) ([]byte, error) {
+	if m.zstdDictionaryDecoder == nil {
+		return zstdDecodeAll(src, dst)
+	}
+	decoded, err := m.zstdDictionaryDecoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptCompressedData, err)
+	}
+	return decoded, nil
+}
+
+// blockCodec returns the codec data blocks are compressed with, nil if none or zstd
+func (m *SegmentMetadata) blockCodec() Codec {
+	if m.Codec == nil && m.LZ4Compression {
+		return lz4Codec{}
+	}
+	return m.Codec
+}
+
 // FetchAndLoadMetadata will load the metadata from the file it not already held in the reader, then returns it (for caching).
 //
 // While a bytes.Reader might be less memory and allocation efficient than inspecting the byte array directly, it is well
 // worth it to simplify the code and ensure correctness. This likely only happens once per file anyway with metadata caching.
+//
+// See SegmentReaderOptions.MetadataRetries for retrying a mismatched meta block hash, and
+// SegmentReaderOptions.RecoverTrailer for reading segments with a damaged trailer. A reader from
+// NewMetadataSegmentReader returns its metadata.
 func (s *SegmentReader) FetchAndLoadMetadata() (*SegmentMetadata, error) {
+	if s.reader == nil && s.metadata != nil {
+		return s.metadata, nil
+	}
+	metadata, err := s.fetchAndLoadMetadataWithRetries()
+	if err != nil || s.options.LazyBlockIndex {
+		return metadata, err
+	}
+	err = s.loadBlockIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error in loadBlockIndex: %w", err)
+	}
+	return metadata, nil
+}
+
+// fetchAndLoadMetadataWithRetries is FetchAndLoadMetadata without loading the partitions of the block index
+func (s *SegmentReader) fetchAndLoadMetadataWithRetries() (*SegmentMetadata, error) {
+	for attempt := 0; ; attempt++ {
+		metadata, err := s.fetchAndLoadMetadata()
+		if errors.Is(err, ErrMismatchedMetaBlockHash) && attempt < s.options.MetadataRetries {
+			// may be a transient bad read from a remote store, read the trailer and meta block again
+			continue
+		}
+		if errors.Is(err, ErrCorrupt) && s.options.RecoverTrailer {
+			metadata, recoverErr := s.recoverMetadata()
+			if recoverErr != nil {
+				return nil, fmt.Errorf("error in recoverMetadata: %w (after %w)", recoverErr, err)
+			}
+			return metadata, nil
+		}
+		return metadata, err
+	}
+}
+
+// segmentTrailer is the final bytes of a segment, see SEGMENT.md
+type segmentTrailer struct {
+	metaBlockOffset uint64
+	metaBlockHash   uint64
+	version         byte
+	flags           byte
+}
+
+// readTrailer reads and validates the trailer from the metadata source. The meta block offset is 0 for a separate
+// MetadataReader, as the meta block is at the start of it.
+func (s *SegmentReader) readTrailer() (segmentTrailer, error) {
+	reader, fileBytes := s.metadataSource()
+
 	// get final bytes of file
-	_, err := s.reader.Seek(-25, io.SeekEnd)
+	_, err := reader.Seek(-25, io.SeekEnd)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Seek to last 25 bytes: %w", err)
+		return segmentTrailer{}, fmt.Errorf("error in reader.Seek to last 25 bytes: %w", ioError(err))
 	}
 
 	// read the bytes
 	finalSegmentBytes := make([]byte, 25)
-	_, err = s.reader.Read(finalSegmentBytes)
+	_, err = io.ReadFull(reader, finalSegmentBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error reading final segment bytes: %w", err)
+		return segmentTrailer{}, fmt.Errorf("error reading final segment bytes: %w", ioError(err))
 	}
 
 	magicNumber := binary.LittleEndian.Uint64(finalSegmentBytes[17:])
 	if magicNumber != MagicNumber {
-		return nil, ErrInvalidMagicNumber
+		return segmentTrailer{}, ErrInvalidMagicNumber
 	}
 
-	segmentVersion := finalSegmentBytes[16]
-	if segmentVersion != 1 {
-		return nil, fmt.Errorf("%w: expected=%d got=%d", ErrUnknownSegmentVersion, 1, segmentVersion)
+	segmentVersion := finalSegmentBytes[16] &^ trailerFlagsMask
+	if segmentVersion != segmentVersion1 && segmentVersion != segmentVersion2 {
+		return segmentTrailer{}, fmt.Errorf("%w: expected<=%d got=%d", ErrUnknownSegmentVersion, currentSegmentVersion, segmentVersion)
 	}
 
-	metaBlockOffset := binary.LittleEndian.Uint64(finalSegmentBytes[0:8])
-	metaBlockHash := binary.LittleEndian.Uint64(finalSegmentBytes[8:16])
+	trailer := segmentTrailer{
+		metaBlockOffset: binary.LittleEndian.Uint64(finalSegmentBytes[0:8]),
+		metaBlockHash:   binary.LittleEndian.Uint64(finalSegmentBytes[8:16]),
+		version:         segmentVersion,
+		flags:           finalSegmentBytes[16] & trailerFlagsMask,
+	}
+	if s.options.MetadataReader != nil {
+		// the meta block is at the start of the separate source
+		trailer.metaBlockOffset = 0
+	}
+	if trailer.metaBlockOffset > uint64(fileBytes-25) {
+		return segmentTrailer{}, fmt.Errorf("%w: meta block offset %d is beyond the trailer at %d", ErrInvalidMetaBlock, trailer.metaBlockOffset, fileBytes-25)
+	}
+
+	return trailer, nil
+}
+
+// fetchAndLoadMetadata is a single attempt of FetchAndLoadMetadata
+func (s *SegmentReader) fetchAndLoadMetadata() (*SegmentMetadata, error) {
+	reader, fileBytes := s.metadataSource()
+	trailer, err := s.readTrailer()
+	if err != nil {
+		return nil, err
+	}
 
 	// Verify the meta block hash
-	_, err = s.reader.Seek(int64(metaBlockOffset), io.SeekStart)
+	_, err = reader.Seek(int64(trailer.metaBlockOffset), io.SeekStart)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Seek to meta block offset: %w", err)
+		return nil, fmt.Errorf("error in reader.Seek to meta block offset: %w", ioError(err))
 	}
 
-	metaBlockBytes := make([]byte, s.fileBytes-int(metaBlockOffset)-25)
-	_, err = s.reader.Read(metaBlockBytes)
+	metaBlockBytes := make([]byte, fileBytes-int(trailer.metaBlockOffset)-25)
+	_, err = io.ReadFull(reader, metaBlockBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Read for meta block bytes: %w", err)
+		return nil, fmt.Errorf("error in io.ReadFull for meta block bytes: %w", ioError(err))
 	}
 
-	if calculatedHash := xxhash.Sum64(metaBlockBytes); calculatedHash != metaBlockHash {
-		return nil, fmt.Errorf("%w: expected=%d got=%d", ErrMismatchedMetaBlockHash, metaBlockHash, calculatedHash)
+	if calculatedHash := xxhash.Sum64(metaBlockBytes); calculatedHash != trailer.metaBlockHash {
+		return nil, fmt.Errorf("%w: expected=%d got=%d", ErrMismatchedMetaBlockHash, trailer.metaBlockHash, calculatedHash)
 	}
 
-	metadata, err := s.BytesToMetadata(metaBlockBytes)
+	lazyBloomFilter := s.options.LazyBloomFilter
+	if trailer.flags&trailerFlagMetaBlockZSTD != 0 {
+		metaBlockBytes, err = zstdDecodeAll(metaBlockBytes, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error in zstd DecodeAll for meta block: %w", err)
+		}
+		// the bloom filter can't be read from the file on its own
+		lazyBloomFilter = false
+	}
+
+	metadata, err := s.bytesToMetadata(metaBlockBytes, lazyBloomFilter, trailer.version)
 	if err != nil {
 		return nil, fmt.Errorf("error in BytesToMetadata: %w", err)
 	}
@@ -134,12 +418,103 @@ func (s *SegmentReader) FetchAndLoadMetadata() (*SegmentMetadata, error) {
 	return metadata, nil
 }
 
+// zstdFrameMagic starts every zstd frame, used to find a compressed meta block when recovering the trailer
+var zstdFrameMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// recoverMetadata finds the meta block without using the trailer, see SegmentReaderOptions.RecoverTrailer.
+//
+// Every offset is tried from the end of the segment, as the meta block ends at the trailer. A candidate must parse,
+// and its block index must start at the beginning of the segment and end exactly at the candidate. As the version
+// is in the trailer, each candidate is parsed as the current version, then as version 1.
+func (s *SegmentReader) recoverMetadata() (*SegmentMetadata, error) {
+	if s.options.MetadataReader != nil {
+		return nil, fmt.Errorf("%w: can't recover the trailer of a separate metadata source", ErrInvalidMetaBlock)
+	}
+	if s.fileBytes < 25 {
+		return nil, fmt.Errorf("%w: segment file is shorter than the trailer", ErrInvalidMetaBlock)
+	}
+
+	_, err := s.reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("error in reader.Seek to start: %w", ioError(err))
+	}
+	segmentBytes := make([]byte, s.fileBytes-25)
+	_, err = io.ReadFull(s.reader, segmentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in io.ReadFull for segment bytes: %w", ioError(err))
+	}
+
+	for offset := len(segmentBytes) - 1; offset > 0; offset-- {
+		metaBlockBytes := segmentBytes[offset:]
+		lazyBloomFilter := s.options.LazyBloomFilter
+		if bytes.HasPrefix(metaBlockBytes, zstdFrameMagic) {
+			decoded, err := zstdDecodeAll(metaBlockBytes, nil)
+			if errors.Is(err, ErrDecompressorUnavailable) {
+				return nil, err
+			}
+			if err != nil {
+				continue
+			}
+			metaBlockBytes = decoded
+			lazyBloomFilter = false
+		}
+
+		for _, version := range []byte{currentSegmentVersion, segmentVersion1} {
+			// skip over the bloom filter while checking the candidate, so a garbage length isn't allocated
+			metadata, err := s.tryBytesToMetadata(metaBlockBytes, true, version)
+			if err != nil {
+				continue
+			}
+			// index partitions are after the data blocks, so only the end can be checked
+			firstBlock, _ := metadata.topLevelIndex().Min()
+			lastBlock, _ := metadata.topLevelIndex().Max()
+			if (metadata.IndexPartitions == nil && firstBlock.Offset != 0) || lastBlock.Offset+lastBlock.BlockSize != uint64(offset) {
+				continue
+			}
+
+			metadata, err = s.tryBytesToMetadata(metaBlockBytes, lazyBloomFilter, version)
+			if err != nil {
+				return nil, fmt.Errorf("error in BytesToMetadata for recovered meta block at offset %d: %w", offset, err)
+			}
+			s.metadata = metadata
+			return metadata, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no meta block found", ErrInvalidMetaBlock)
+}
+
+// tryBytesToMetadata is bytesToMetadata, returning ErrInvalidMetaBlock rather than panicking on truncated bytes
+func (s *SegmentReader) tryBytesToMetadata(metaBlockBytes []byte, lazyBloomFilter bool, version byte) (metadata *SegmentMetadata, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metadata, err = nil, fmt.Errorf("%w: %v", ErrInvalidMetaBlock, r)
+		}
+	}()
+	return s.bytesToMetadata(metaBlockBytes, lazyBloomFilter, version)
+}
+
+// metadataSource returns the reader and length of the source holding the meta block and trailer
+func (s *SegmentReader) metadataSource() (io.ReadSeeker, int) {
+	if s.options.MetadataReader != nil {
+		return s.options.MetadataReader, s.options.MetadataBytes
+	}
+	return s.reader, s.fileBytes
+}
+
 // BytesToMetadata turns a metadata byte array into its respective struct.
 //
 // This is useful if you want to preemptively cache metadata from a recent segment write without providing a reader to
-// the entire segment, as the SegmentWriter.Close returns the metadata bytes.
+// the entire segment, as the SegmentWriter.Close returns the metadata bytes. The bytes must be of the current
+// segment version, as written by SegmentWriter.Close.
 func (s *SegmentReader) BytesToMetadata(metaBlockBytes []byte) (*SegmentMetadata, error) {
-	metadata := &SegmentMetadata{}
+	return s.bytesToMetadata(metaBlockBytes, s.options.LazyBloomFilter, currentSegmentVersion)
+}
+
+// bytesToMetadata is BytesToMetadata for a meta block of the segment version, only storing the location of the
+// bloom filter if lazyBloomFilter
+func (s *SegmentReader) bytesToMetadata(metaBlockBytes []byte, lazyBloomFilter bool, version byte) (*SegmentMetadata, error) {
+	metadata := &SegmentMetadata{Version: version}
 	metaReader := bytes.NewReader(metaBlockBytes)
 
 	// read the first and last key
@@ -151,7 +526,7 @@ func (s *SegmentReader) BytesToMetadata(metaBlockBytes []byte) (*SegmentMetadata
 	var err error
 
 	// read bloom filter block
-	metadata.BloomFilter, err = s.parseBloomFilterBlock(metaReader)
+	err = parseBloomFilterBlock(metaReader, metadata, lazyBloomFilter)
 	if err != nil {
 		return nil, fmt.Errorf("error in parseBloomFilterBlock: %w", err)
 	}
@@ -159,76 +534,589 @@ func (s *SegmentReader) BytesToMetadata(metaBlockBytes []byte) (*SegmentMetadata
 	// read compression
 	compressionByte := mustReadBytes(metaReader, 1)[0]
 	switch compressionByte {
-	case 1:
+	case CodecIDNone:
+	case CodecIDZSTD:
 		metadata.ZSTDCompression = true
-	case 2:
-		metadata.LZ4Compression = true
+	default:
+		codec, found := lookupCodec(compressionByte)
+		if !found {
+			return nil, fmt.Errorf("%w: codec ID %02x", ErrUnknownCodec, compressionByte)
+		}
+		metadata.Codec = codec
+		metadata.LZ4Compression = compressionByte == CodecIDLZ4
+	}
+
+	if version == segmentVersion1 {
+		metadata.BlockIndex, err = s.parseBlockIndexV1(metaReader)
+		if err != nil {
+			return nil, fmt.Errorf("error in parseBlockIndexV1: %w", err)
+		}
+		return metadata, verifyKeyBounds(metadata)
+	}
+
+	// read row format
+	rowFormat := mustReadBytes(metaReader, 1)[0]
+	metadata.RowSequence = rowFormat&rowFormatSequence != 0
+	metadata.ValueCompression = rowFormat&rowFormatValueFlags != 0
+	metadata.Tombstones = true
+	if rowFormat&rowFormatEpoch != 0 {
+		metadata.Epoch = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
 	}
 
-	// read the block index according to spec
-	metadata.BlockIndex, err = s.parseBlockIndex(metaReader)
-	if err != nil {
-		return nil, fmt.Errorf("error in parseBlockIndex: %w", err)
+	// read the block index according to spec
+	metadata.BlockIndex, metadata.IndexPartitions, err = s.parseBlockIndex(metaReader)
+	if err != nil {
+		return nil, fmt.Errorf("error in parseBlockIndex: %w", err)
+	}
+	if metadata.IndexPartitions != nil {
+		metadata.loadedIndexPartitions = &loadedIndexPartitions{offsets: map[uint64]bool{}}
+	}
+
+	if rowFormat&rowFormatUserMetadata != 0 {
+		userMetadataLength := binary.LittleEndian.Uint32(mustReadBytes(metaReader, 4))
+		metadata.UserMetadata = mustReadBytes(metaReader, int(userMetadataLength))
+	}
+
+	if rowFormat&rowFormatBlockSize != 0 {
+		metadata.DataBlockSize = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
+		metadata.DataBlockThresholdBytes = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
+		metadata.DataBlockPadding = mustReadBytes(metaReader, 1)[0] == 1
+	}
+
+	if rowFormat&rowFormatCreatedAt != 0 {
+		metadata.CreatedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))))
+	}
+
+	if rowFormat&rowFormatDictionary != 0 {
+		dictionaryLength := binary.LittleEndian.Uint32(mustReadBytes(metaReader, 4))
+		metadata.ZSTDDictionary, err = readBytes(metaReader, int(dictionaryLength))
+		if err != nil {
+			return nil, fmt.Errorf("error reading zstd dictionary: %w", err)
+		}
+		// DecodeAll only needs one block decoder per call, and more would hold memory for every loaded segment
+		metadata.zstdDictionaryDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(metadata.ZSTDDictionary))
+		if err != nil {
+			return nil, fmt.Errorf("%w: error in zstd.NewReader with dictionary: %w", ErrDecompressorUnavailable, err)
+		}
+		// metadata is shared between readers with LoadCachedMetadata and copied by value, so no reader can close
+		// the decoder. It is closed once no copy of the metadata references it.
+		runtime.SetFinalizer(metadata.zstdDictionaryDecoder, (*zstd.Decoder).Close)
+	}
+
+	// total the row stats from the blocks
+	metadata.topLevelIndex().Ascend(func(item BlockStat) bool {
+		metadata.RowCount += item.RowCount
+		metadata.TombstoneCount += item.TombstoneCount
+		if item.RowCount == item.TombstoneCount {
+			// no values
+			return true
+		}
+		if metadata.RowCount-metadata.TombstoneCount == item.RowCount-item.TombstoneCount || item.MinValueLength < metadata.MinValueLength {
+			// first block with values, or smaller
+			metadata.MinValueLength = item.MinValueLength
+		}
+		metadata.MaxValueLength = max(metadata.MaxValueLength, item.MaxValueLength)
+		return true
+	})
+
+	err = verifyKeyBounds(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// verifyKeyBounds checks that the first and last key bracket the block index, as the snapshot reader relies on
+// them for selecting segments
+func verifyKeyBounds(metadata *SegmentMetadata) error {
+	firstBlock, found := metadata.topLevelIndex().Min()
+	if !found {
+		return fmt.Errorf("%w: empty block index", ErrInconsistentMetadata)
+	}
+	lastBlock, _ := metadata.topLevelIndex().Max()
+
+	if !bytes.Equal(metadata.FirstKey, firstBlock.FirstKey) {
+		return fmt.Errorf("%w: first key %x does not match first block key %x", ErrInconsistentMetadata, metadata.FirstKey, firstBlock.FirstKey)
+	}
+	if bytes.Compare(metadata.LastKey, lastBlock.FirstKey) < 0 {
+		return fmt.Errorf("%w: last key %x is before last block first key %x", ErrInconsistentMetadata, metadata.LastKey, lastBlock.FirstKey)
+	}
+
+	return nil
+}
+
+// parseBloomFilterBlock reads the bloom filter block into the metadata. If lazyBloomFilter (see
+// SegmentReaderOptions.LazyBloomFilter), then only the location of the bloom filter is stored.
+func parseBloomFilterBlock(metaReader *bytes.Reader, metadata *SegmentMetadata, lazyBloomFilter bool) error {
+	filterType := mustReadBytes(metaReader, 1)[0]
+	metadata.bloomFilterCompressed = filterType&bloomFilterFlagZSTD != 0
+	filterType &^= bloomFilterFlagZSTD
+
+	switch filterType {
+	case bloomFilterTypeNone:
+		return nil
+	case bloomFilterTypeSingle, bloomFilterTypeBlocked, bloomFilterTypeXor, bloomFilterTypeRibbon:
+	default:
+		return fmt.Errorf("%w: unknown bloom filter type %d", ErrInvalidMetaBlock, filterType)
+	}
+
+	// read the length of the filter
+	metadata.BloomFilterLength = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
+	if metadata.BloomFilterLength > uint64(metaReader.Len()) {
+		return fmt.Errorf("%w: bloom filter length %d is beyond the meta block", ErrInvalidMetaBlock, metadata.BloomFilterLength)
+	}
+	// bytes remaining in the meta block, plus the final segment bytes
+	metadata.BloomFilterEndOffset = uint64(metaReader.Len()) + 25
+
+	if filterType == bloomFilterTypeBlocked {
+		bloomBytes, err := decompressBloomFilter(mustReadBytes(metaReader, int(metadata.BloomFilterLength)), metadata.bloomFilterCompressed)
+		if err != nil {
+			return err
+		}
+		var blockedBloomFilter BlockedBloomFilter
+		_, err = blockedBloomFilter.ReadFrom(bytes.NewReader(bloomBytes))
+		if err != nil {
+			return fmt.Errorf("error in BlockedBloomFilter.ReadFrom: %w", err)
+		}
+		metadata.BlockedBloomFilter = &blockedBloomFilter
+		return nil
+	}
+
+	metadata.bloomFilterType = filterType
+	if lazyBloomFilter {
+		_, err := metaReader.Seek(int64(metadata.BloomFilterLength), io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("error in metaReader.Seek past bloom filter: %w", err)
+		}
+		metadata.bloomFilterKey = &bloomFilterKey{}
+		return nil
+	}
+
+	bloomBytes, err := decompressBloomFilter(mustReadBytes(metaReader, int(metadata.BloomFilterLength)), metadata.bloomFilterCompressed)
+	if err != nil {
+		return err
+	}
+	filter, err := decodeFilter(filterType, bloomBytes)
+	if err != nil {
+		return err
+	}
+	if bloomFilter, ok := filter.(*bloom.BloomFilter); ok {
+		metadata.BloomFilter = bloomFilter
+	} else {
+		metadata.KeyFilter = filter
+	}
+	return nil
+}
+
+// decodeFilter decodes the stored bytes of a single bloom filter, XorFilter, or RibbonFilter
+func decodeFilter(filterType byte, filterBytes []byte) (Filter, error) {
+	var filter interface {
+		Filter
+		io.ReaderFrom
+	}
+	switch filterType {
+	case bloomFilterTypeXor:
+		filter = &XorFilter{}
+	case bloomFilterTypeRibbon:
+		filter = &RibbonFilter{}
+	default:
+		filter = &bloom.BloomFilter{}
+	}
+	_, err := filter.ReadFrom(bytes.NewReader(filterBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error in ReadFrom for filter type %d: %w", filterType, err)
+	}
+	return filter, nil
+}
+
+// loadBloomFilter is loadFilter for segments with a single bloom filter, returning ErrNoBloomFilter for other
+// filter types.
+func (s *SegmentReader) loadBloomFilter() (*bloom.BloomFilter, error) {
+	filter, err := s.loadFilter()
+	if err != nil {
+		return nil, err
+	}
+	bloomFilter, ok := filter.(*bloom.BloomFilter)
+	if !ok {
+		return nil, ErrNoBloomFilter
+	}
+	return bloomFilter, nil
+}
+
+// loadFilter reads a lazily loaded filter from the segment file, using the cache if provided.
+func (s *SegmentReader) loadFilter() (Filter, error) {
+	if s.options.BloomFilterCache != nil {
+		if filter, found := s.options.BloomFilterCache.get(s.bloomFilterCacheKey()); found {
+			return filter, nil
+		}
+	}
+
+	reader, _ := s.metadataSource()
+	_, err := reader.Seek(-int64(s.metadata.BloomFilterEndOffset), io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("error in reader.Seek to bloom filter: %w", ioError(err))
+	}
+
+	bloomBytes, err := readBytes(reader, int(s.metadata.BloomFilterLength))
+	if err != nil {
+		return nil, fmt.Errorf("error in readBytes for bloom filter: %w", err)
+	}
+	bloomBytes, err = decompressBloomFilter(bloomBytes, s.metadata.bloomFilterCompressed)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := decodeFilter(s.metadata.bloomFilterType, bloomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.options.BloomFilterCache != nil {
+		s.options.BloomFilterCache.put(s.bloomFilterCacheKey(), filter)
+	}
+
+	return filter, nil
+}
+
+// bloomFilterCacheKey returns the key of the lazily loaded filter in the BloomFilterCache
+func (s *SegmentReader) bloomFilterCacheKey() bloomFilterCacheKey {
+	if s.options.SegmentID == "" {
+		return bloomFilterCacheKey{parse: s.metadata.bloomFilterKey}
+	}
+	_, fileBytes := s.metadataSource()
+	return bloomFilterCacheKey{
+		segmentID: s.options.SegmentID,
+		offset:    int64(fileBytes) - int64(s.metadata.BloomFilterEndOffset),
+	}
+}
+
+// decompressBloomFilter decompresses the stored bloom filter bytes if compressed, see
+// SegmentWriterOptions.BloomFilterZSTDCompression
+func decompressBloomFilter(bloomBytes []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return bloomBytes, nil
+	}
+	decompressed, err := zstdDecodeAll(bloomBytes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in zstd DecodeAll for bloom filter: %w", err)
+	}
+	return decompressed, nil
+}
+
+// ErrNoBloomFilter is returned from ReadBloomFilter when the segment was written without a bloom filter
+var ErrNoBloomFilter = errors.New("segment has no bloom filter")
+
+// ReadBloomFilter reads only the bloom filter block from the meta block, without parsing the block index, such as
+// for building a filter over many segments. If the metadata is already loaded, its bloom filter is used.
+//
+// The meta block hash is only verified when the meta block is compressed, as otherwise only the start of the meta
+// block is read. Segments written with a BlockedBloomFilter or KeyFilter return ErrNoBloomFilter, see
+// SegmentMetadata.BlockedBloomFilter and SegmentMetadata.KeyFilter.
+func (s *SegmentReader) ReadBloomFilter() (*bloom.BloomFilter, error) {
+	if s.metadata != nil {
+		if s.metadata.bloomFilterKey != nil {
+			return s.loadBloomFilter()
+		}
+		if s.metadata.BloomFilter == nil {
+			return nil, ErrNoBloomFilter
+		}
+		return s.metadata.BloomFilter, nil
+	}
+
+	trailer, err := s.readTrailer()
+	if err != nil {
+		return nil, fmt.Errorf("error in readTrailer: %w", err)
+	}
+
+	reader, fileBytes := s.metadataSource()
+	_, err = reader.Seek(int64(trailer.metaBlockOffset), io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("error in reader.Seek to meta block offset: %w", ioError(err))
+	}
+
+	var metaReader io.Reader = reader
+	compressed := trailer.flags&trailerFlagMetaBlockZSTD != 0
+	if compressed {
+		// the whole meta block is needed to decompress it
+		metaBlockBytes := make([]byte, fileBytes-int(trailer.metaBlockOffset)-25)
+		_, err = io.ReadFull(reader, metaBlockBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error in io.ReadFull for meta block bytes: %w", ioError(err))
+		}
+		if calculatedHash := xxhash.Sum64(metaBlockBytes); calculatedHash != trailer.metaBlockHash {
+			return nil, fmt.Errorf("%w: expected=%d got=%d", ErrMismatchedMetaBlockHash, trailer.metaBlockHash, calculatedHash)
+		}
+		metaBlockBytes, err = zstdDecodeAll(metaBlockBytes, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error in zstd DecodeAll for meta block: %w", err)
+		}
+		metaReader = bytes.NewReader(metaBlockBytes)
+	}
+
+	// skip the first and last key
+	for i := 0; i < 2; i++ {
+		keyLength, err := readBytes(metaReader, 2)
+		if err != nil {
+			return nil, fmt.Errorf("error in readBytes for key length: %w", err)
+		}
+		_, err = readBytes(metaReader, int(binary.LittleEndian.Uint16(keyLength)))
+		if err != nil {
+			return nil, fmt.Errorf("error in readBytes for key: %w", err)
+		}
+	}
+
+	filterType, err := readBytes(metaReader, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error in readBytes for bloom filter type: %w", err)
+	}
+	if filterType[0]&^bloomFilterFlagZSTD != bloomFilterTypeSingle {
+		return nil, ErrNoBloomFilter
+	}
+
+	lengthBytes, err := readBytes(metaReader, 8)
+	if err != nil {
+		return nil, fmt.Errorf("error in readBytes for bloom filter length: %w", err)
+	}
+	bloomFilterLength := binary.LittleEndian.Uint64(lengthBytes)
+	// a decompressed meta block bounds its own reads, see readBytes
+	if !compressed && bloomFilterLength > uint64(fileBytes) {
+		return nil, fmt.Errorf("%w: bloom filter length %d is beyond the segment", ErrInvalidMetaBlock, bloomFilterLength)
+	}
+
+	bloomBytes, err := readBytes(metaReader, int(bloomFilterLength))
+	if err != nil {
+		return nil, fmt.Errorf("error in readBytes for bloom filter: %w", err)
+	}
+	bloomBytes, err = decompressBloomFilter(bloomBytes, filterType[0]&bloomFilterFlagZSTD != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var bloomFilter bloom.BloomFilter
+	_, err = bloomFilter.ReadFrom(bytes.NewReader(bloomBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error in bloomFilter.ReadFrom: %w", err)
+	}
+
+	return &bloomFilter, nil
+}
+
+// parseBlockIndex loads the block index into the SegmentReader's SegmentMetadata using the provided metaReader,
+// returning the block index, and the top level index if the block index is partitioned. The blocks of a
+// partitioned block index are loaded later by loadIndexPartition.
+//
+// It is assumed that the metaReader is Seeked to the start of the data block index
+func (s *SegmentReader) parseBlockIndex(metaReader *bytes.Reader) (*btree.BTreeG[BlockStat], *btree.BTreeG[BlockStat], error) {
+	indexType := mustReadBytes(metaReader, 1)[0]
+	if indexType != blockIndexTypeSimple && indexType != blockIndexTypePartitioned {
+		return nil, nil, fmt.Errorf("%w: unknown block index type %d", ErrInvalidMetaBlock, indexType)
+	}
+
+	t := s.newBlockIndexTree()
+	err := parseBlockIndexEntries(metaReader, t, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Len() == 0 {
+		return nil, nil, fmt.Errorf("%w: had no data block entries", ErrInvalidMetaBlock)
+	}
+
+	if indexType == blockIndexTypePartitioned {
+		return s.newBlockIndexTree(), t, nil
+	}
+	return t, nil, nil
+}
+
+// parseBlockIndexV1 reads the block index of a segmentVersion1 meta block, which is always simple, and has entries
+// without row stats or checksums. See SEGMENT.md.
+func (s *SegmentReader) parseBlockIndexV1(metaReader *bytes.Reader) (*btree.BTreeG[BlockStat], error) {
+	indexType := mustReadBytes(metaReader, 1)[0]
+	if indexType != blockIndexTypeSimple {
+		return nil, fmt.Errorf("%w: unknown version 1 block index type %d", ErrInvalidMetaBlock, indexType)
+	}
+
+	t := s.newBlockIndexTree()
+	err := parseBlockIndexEntries(metaReader, t, false)
+	if err != nil {
+		return nil, err
+	}
+	if t.Len() == 0 {
+		return nil, fmt.Errorf("%w: had no data block entries", ErrInvalidMetaBlock)
+	}
+
+	return t, nil
+}
+
+// newBlockIndexTree creates an empty block index with the BlockIndexDegree
+func (s *SegmentReader) newBlockIndexTree() *btree.BTreeG[BlockStat] {
+	degree := s.options.BlockIndexDegree
+	if degree == 0 {
+		degree = DefaultBlockIndexDegree
+	}
+	return btree.NewG[BlockStat](degree, func(a, b BlockStat) bool {
+		return bytes.Compare(a.FirstKey, b.FirstKey) == -1
+	})
+}
+
+// parseBlockIndexEntries reads the number of entries, then each entry into t, see SEGMENT.md. Without entryStats
+// the entries are in the version 1 layout, without the row stats and checksum, which are left zero and not
+// checked.
+func parseBlockIndexEntries(reader *bytes.Reader, t *btree.BTreeG[BlockStat], entryStats bool) error {
+	numEntriesBytes, err := readBytes(reader, 8)
+	if err != nil {
+		return fmt.Errorf("%w: error reading number of entries: %w", ErrCorruptBlockIndexEntry, err)
+	}
+	numEntries := binary.LittleEndian.Uint64(numEntriesBytes)
+	minEntryLength := uint64(2 + 40)
+	if entryStats {
+		minEntryLength = 2 + 64 + 8
+	}
+	if numEntries > uint64(reader.Len())/minEntryLength {
+		// don't parse a corrupt count, such as while recovering a trailer
+		return fmt.Errorf("%w: %d entries can't fit in %d bytes", ErrCorruptBlockIndexEntry, numEntries, reader.Len())
+	}
+
+	for i := uint64(0); i < numEntries; i++ {
+		// read first key length
+		keyLengthBytes, err := readBytes(reader, 2)
+		if err != nil {
+			return fmt.Errorf("%w: entry %d: error reading first key length: %w", ErrCorruptBlockIndexEntry, i, err)
+		}
+		keyLength := int(binary.LittleEndian.Uint16(keyLengthBytes))
+
+		// read the rest of the entry, and its checksum
+		entryLength := keyLength + 40
+		if entryStats {
+			entryLength = keyLength + 64
+		}
+		entryBytes, err := readBytes(reader, entryLength)
+		if err != nil {
+			return fmt.Errorf("%w: entry %d: error reading entry: %w", ErrCorruptBlockIndexEntry, i, err)
+		}
+		if entryStats {
+			checksumBytes, err := readBytes(reader, 8)
+			if err != nil {
+				return fmt.Errorf("%w: entry %d: error reading checksum: %w", ErrCorruptBlockIndexEntry, i, err)
+			}
+			checksum := binary.LittleEndian.Uint64(checksumBytes)
+			if calculated := xxhash.Sum64(append(keyLengthBytes, entryBytes...)); calculated != checksum {
+				return fmt.Errorf("%w: entry %d: expected checksum=%d got=%d", ErrCorruptBlockIndexEntry, i, checksum, calculated)
+			}
+		}
+
+		// read all the data
+		stat := BlockStat{}
+		stat.FirstKey = entryBytes[:keyLength]
+		stat.Offset = binary.LittleEndian.Uint64(entryBytes[keyLength : keyLength+8])
+		stat.BlockSize = binary.LittleEndian.Uint64(entryBytes[keyLength+8 : keyLength+16])
+		stat.OriginalSize = binary.LittleEndian.Uint64(entryBytes[keyLength+16 : keyLength+24])
+		stat.CompressedSize = binary.LittleEndian.Uint64(entryBytes[keyLength+24 : keyLength+32])
+		stat.Hash = binary.LittleEndian.Uint64(entryBytes[keyLength+32 : keyLength+40])
+		if !entryStats {
+			t.ReplaceOrInsert(stat)
+			continue
+		}
+		stat.RowCount = binary.LittleEndian.Uint64(entryBytes[keyLength+40 : keyLength+48])
+		stat.TombstoneCount = binary.LittleEndian.Uint64(entryBytes[keyLength+48 : keyLength+56])
+		stat.MinValueLength = binary.LittleEndian.Uint32(entryBytes[keyLength+56 : keyLength+60])
+		stat.MaxValueLength = binary.LittleEndian.Uint32(entryBytes[keyLength+60 : keyLength+64])
+		t.ReplaceOrInsert(stat)
 	}
 
-	return metadata, nil
+	return nil
 }
 
-func (s *SegmentReader) parseBloomFilterBlock(metaReader *bytes.Reader) (*bloom.BloomFilter, error) {
-	enabled := mustReadBytes(metaReader, 1)[0] == 1
-
-	if !enabled {
-		return nil, nil
+// topLevelIndex returns IndexPartitions if the block index is partitioned, otherwise BlockIndex. Both cover the
+// whole segment with first keys and totalled stats.
+func (m *SegmentMetadata) topLevelIndex() *btree.BTreeG[BlockStat] {
+	if m.IndexPartitions != nil {
+		return m.IndexPartitions
 	}
+	return m.BlockIndex
+}
 
-	// read the length of the filter
-	bloomLength := binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-	bloomBytes := mustReadBytes(metaReader, int(bloomLength))
+// blockFor returns the stat of the loaded block that would hold key, nil if key is before the first block
+func (m *SegmentMetadata) blockFor(key []byte) *BlockStat {
+	if m.loadedIndexPartitions != nil {
+		m.loadedIndexPartitions.mu.RLock()
+		defer m.loadedIndexPartitions.mu.RUnlock()
+	}
+	var stat *BlockStat
+	m.BlockIndex.DescendLessOrEqual(BlockStat{FirstKey: key}, func(item BlockStat) bool {
+		stat = &item
+		return false
+	})
+	return stat
+}
 
-	var bloomFilter bloom.BloomFilter
-	_, err := bloomFilter.ReadFrom(bytes.NewReader(bloomBytes))
-	if err != nil {
-		return nil, fmt.Errorf("error in mustReadBytes(metaReader, 8): %w", err)
+// loadBlockIndex loads every partition of a partitioned block index that isn't loaded yet
+func (s *SegmentReader) loadBlockIndex() error {
+	if s.metadata.IndexPartitions == nil {
+		return nil
+	}
+	s.metadata.loadedIndexPartitions.mu.RLock()
+	loaded := len(s.metadata.loadedIndexPartitions.offsets) == s.metadata.IndexPartitions.Len()
+	s.metadata.loadedIndexPartitions.mu.RUnlock()
+	if loaded {
+		return nil
 	}
 
-	return &bloomFilter, nil
+	var err error
+	s.metadata.IndexPartitions.Ascend(func(partition BlockStat) bool {
+		err = s.loadIndexPartition(partition)
+		return err == nil
+	})
+	return err
 }
 
-// parseBlockIndex loads the block index into the SegmentReader's SegmentMetadata using the provided metaReader.
-//
-// It is assumed that the metaReader is Seeked to the start of the data block index
-func (s *SegmentReader) parseBlockIndex(metaReader *bytes.Reader) (*btree.BTreeG[BlockStat], error) {
-	// we only support simple block index now so can skip first byte
-	// metaReader.Seek(1, io.SeekCurrent)
-	mustReadBytes(metaReader, 1)
-
-	// read the number of data block index entries
-	numEntries := int(binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8)))
-	if numEntries == 0 {
-		return nil, fmt.Errorf("%w: had no data block entries", ErrInvalidMetaBlock)
+// loadIndexPartitionFor loads the partition of a partitioned block index that would hold the block for key, if it
+// isn't loaded yet
+func (s *SegmentReader) loadIndexPartitionFor(key []byte) error {
+	if s.metadata.IndexPartitions == nil {
+		return nil
 	}
 
-	t := btree.NewG[BlockStat](2, func(a, b BlockStat) bool {
-		return bytes.Compare(a.FirstKey, b.FirstKey) == -1
+	var partition *BlockStat
+	s.metadata.IndexPartitions.DescendLessOrEqual(BlockStat{FirstKey: key}, func(item BlockStat) bool {
+		partition = &item
+		return false
 	})
+	if partition == nil {
+		// before the first block
+		return nil
+	}
+	return s.loadIndexPartition(*partition)
+}
 
-	for i := 0; i < numEntries; i++ {
-		stat := BlockStat{}
+// loadIndexPartition reads the blocks of the partition into the BlockIndex, if it isn't loaded yet
+func (s *SegmentReader) loadIndexPartition(partition BlockStat) error {
+	loadedPartitions := s.metadata.loadedIndexPartitions
+	loadedPartitions.mu.RLock()
+	loaded := loadedPartitions.offsets[partition.Offset]
+	loadedPartitions.mu.RUnlock()
+	if loaded {
+		return nil
+	}
 
-		// read first key length
-		keyLength := int(binary.LittleEndian.Uint16(mustReadBytes(metaReader, 2)))
+	raw, err := s.readRawBlock(partition, true)
+	if err != nil {
+		return fmt.Errorf("error in readRawBlock for index partition at offset %d: %w", partition.Offset, err)
+	}
 
-		// read all the data
-		stat.FirstKey = mustReadBytes(metaReader, keyLength)
-		stat.Offset = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-		stat.BlockSize = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-		stat.OriginalSize = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-		stat.CompressedSize = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-		stat.Hash = binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))
-		t.ReplaceOrInsert(stat)
+	loadedPartitions.mu.Lock()
+	defer loadedPartitions.mu.Unlock()
+	if loadedPartitions.offsets[partition.Offset] {
+		// loaded concurrently by another reader
+		return nil
+	}
+	err = parseBlockIndexEntries(bytes.NewReader(raw), s.metadata.BlockIndex, true)
+	if err != nil {
+		return fmt.Errorf("error in parseBlockIndexEntries for index partition at offset %d: %w", partition.Offset, err)
 	}
 
-	return t, nil
+	loadedPartitions.offsets[partition.Offset] = true
+	return nil
 }
 
 // probeBloomFilter probes a bloom filter for whether they key might exist within a block in the file.
@@ -244,11 +1132,58 @@ func (s *SegmentReader) probeBloomFilter(key []byte) (bool, error) {
 		}
 	}
 
-	if s.metadata.BloomFilter == nil {
-		return false, nil
+	if s.metadata.KeyFilter != nil {
+		return s.metadata.KeyFilter.Test(key), nil
+	}
+	if s.metadata.BlockedBloomFilter != nil {
+		return s.metadata.BlockedBloomFilter.Test(key), nil
+	}
+	if s.metadata.BloomFilter != nil {
+		return s.metadata.BloomFilter.Test(key), nil
+	}
+
+	if s.metadata.bloomFilterKey == nil {
+		// no bloom filter
+		return true, nil
+	}
+
+	filter, err := s.loadFilter()
+	if err != nil {
+		return false, fmt.Errorf("error in loadFilter: %w", err)
+	}
+
+	return filter.Test(key), nil
+}
+
+// MayContain is a fast check of whether the segment definitely does not contain the key, without reading any data
+// blocks. It returns true only when the segment has a bloom filter that excludes the key, and false (unknown, the
+// block must be read) otherwise, including when the segment has no bloom filter.
+//
+// Fetches the metadata (and a lazily loaded bloom filter) if not already loaded. Errors are treated as unknown, as
+// the subsequent read will surface them.
+func (s *SegmentReader) MayContain(key []byte) (definitelyNot bool) {
+	mayContain, err := s.probeBloomFilter(key)
+	if err != nil {
+		return false
 	}
+	return !mayContain
+}
 
-	return s.metadata.BloomFilter.Test(key), nil
+// FilterKeys returns the keys that the bloom filter of the segment doesn't exclude, in order, such as to prune a
+// batch of lookups before reading any data blocks. All keys are returned if the segment has no bloom filter, or if
+// the bloom filter can't be loaded.
+func (s *SegmentReader) FilterKeys(keys [][]byte) [][]byte {
+	var filtered [][]byte
+	for _, key := range keys {
+		mayContain, err := s.probeBloomFilter(key)
+		if err != nil {
+			return keys
+		}
+		if mayContain {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
 }
 
 // RowIter creates a new row iterator. This should only really be used for compaction and higher-level range reading,
@@ -256,19 +1191,19 @@ func (s *SegmentReader) probeBloomFilter(key []byte) (bool, error) {
 //
 // Fetches the metadata if not already loaded.
 func (s *SegmentReader) RowIter(direction int) (*RowIter, error) {
+	if s.reader == nil {
+		return nil, ErrNoDataReader
+	}
 	if s.metadata == nil {
 		_, err := s.FetchAndLoadMetadata()
 		if err != nil {
 			return nil, fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
 		}
 	}
-
-	// collect necessary blocks
-	var stats []BlockStat
-	s.metadata.BlockIndex.Ascend(func(item BlockStat) bool {
-		stats = append(stats, item)
-		return true
-	})
+	err := s.loadBlockIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error in loadBlockIndex: %w", err)
+	}
 
 	return &RowIter{
 		s:         s,
@@ -279,14 +1214,59 @@ func (s *SegmentReader) RowIter(direction int) (*RowIter, error) {
 type KVPair struct {
 	Key   []byte
 	Value []byte
+	// Seq is the sequence number of the row, 0 if not written with SegmentWriter.WriteRowWithSeq
+	Seq uint64
+	// Tombstone is whether the row deletes its key, in which case Value is nil. Written with
+	// SegmentWriter.WriteTombstone, and set for rows with an empty value in segments without
+	// SegmentMetadata.Tombstones.
+	Tombstone bool
+}
+
+// NewTombstone creates a row that deletes the key
+func NewTombstone(key []byte) KVPair {
+	return KVPair{Key: key, Tombstone: true}
+}
+
+// IsTombstone returns whether the row deletes its key, see KVPair.Tombstone
+func (p KVPair) IsTombstone() bool {
+	return p.Tombstone
 }
 
 // ReadBlockWithStat will read a data block at an offset, decompress and deserialize it.
 //
-// Will error if the offset is not a valid block starting point.
+// Will error if the offset is not a valid block starting point, or with ErrUnsortedRows if the rows of the block
+// are not in ascending key order.
 //
 // Fetches the metadata if not already loaded.
 func (s *SegmentReader) ReadBlockWithStat(stat BlockStat) ([]KVPair, error) {
+	rows, err := s.readBlock(stat, nil, true, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(rows); i++ {
+		if bytes.Compare(rows[i].Key, rows[i-1].Key) <= 0 {
+			return nil, fmt.Errorf("%w: block at offset %d row %d key %x is not greater than previous key %x", ErrUnsortedRows, stat.Offset, i, rows[i].Key, rows[i-1].Key)
+		}
+	}
+	return rows, nil
+}
+
+// ReadBlockRaw reads the rows of a data block exactly in their stored order, without any reversal, sorting, or
+// validation of the key order, such as for a debugger to inspect a block that ReadBlockWithStat rejects with
+// ErrUnsortedRows. The block hash is not verified either, so the rows of a corrupted block can still be inspected,
+// see ReadRawBlock for the undecoded bytes.
+//
+// Fetches the metadata if not already loaded.
+func (s *SegmentReader) ReadBlockRaw(stat BlockStat) ([]KVPair, error) {
+	return s.readBlock(stat, nil, true, false)
+}
+
+// readBlock is ReadBlockWithStat, decoding into the scratch memory if not nil. See decodeBlockRowsInto for
+// decodeValues.
+func (s *SegmentReader) readBlock(stat BlockStat, scratch *blockScratch, decodeValues, verifyHash bool) ([]KVPair, error) {
+	if s.reader == nil {
+		return nil, ErrNoDataReader
+	}
 	if s.metadata == nil {
 		_, err := s.FetchAndLoadMetadata()
 		if err != nil {
@@ -294,56 +1274,225 @@ func (s *SegmentReader) ReadBlockWithStat(stat BlockStat) ([]KVPair, error) {
 		}
 	}
 
-	_, err := s.reader.Seek(int64(stat.Offset), io.SeekStart)
+	err := s.checkBlockBounds(stat)
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitForBytes(s.options.RateLimiter, int(stat.BlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("error in waitForBytes: %w", err)
+	}
+
+	_, err = s.reader.Seek(int64(stat.Offset), io.SeekStart)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Seek: %w", err)
+		return nil, fmt.Errorf("error in reader.Seek: %w", ioError(err))
 	}
 
 	// read the block into a reader
+	var rawBlockBytes []byte
+	if scratch != nil {
+		scratch.raw = grow(scratch.raw, int(stat.BlockSize))
+		rawBlockBytes = scratch.raw
+	} else {
+		rawBlockBytes = make([]byte, stat.BlockSize)
+	}
+	bytesRead, err := s.reader.Read(rawBlockBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in reader.Read: %w", ioError(err))
+	}
+	if bytesRead != int(stat.BlockSize) {
+		return nil, fmt.Errorf("%w when reading raw block bytes", ErrUnexpectedBytesRead)
+	}
+
+	if verifyHash {
+		if calculatedHash := xxhash.Sum64(rawBlockBytes); calculatedHash != stat.Hash {
+			return nil, fmt.Errorf("%w: block at offset %d with first key %x expected=%d got=%d", ErrMismatchedBlockHash, stat.Offset, stat.FirstKey, stat.Hash, calculatedHash)
+		}
+	}
+
+	return decodeBlockRowsInto(rawBlockBytes, stat, s.metadata, scratch, decodeValues)
+}
+
+// ReadRawBlock will read the final (padded, possibly compressed) bytes of a data block, without decompressing or
+// deserializing it. The returned bytes can be handed to SegmentWriter.WriteRawBlock to copy the block verbatim.
+//
+// Will error if the block hash does not match the bytes read.
+func (s *SegmentReader) ReadRawBlock(stat BlockStat) ([]byte, error) {
+	return s.readRawBlock(stat, true)
+}
+
+// readRawBlock is ReadRawBlock, only verifying the block hash if verifyHash
+func (s *SegmentReader) readRawBlock(stat BlockStat, verifyHash bool) ([]byte, error) {
+	if s.reader == nil {
+		return nil, ErrNoDataReader
+	}
+	err := s.checkBlockBounds(stat)
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitForBytes(s.options.RateLimiter, int(stat.BlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("error in waitForBytes: %w", err)
+	}
+
+	_, err = s.reader.Seek(int64(stat.Offset), io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("error in reader.Seek: %w", ioError(err))
+	}
+
 	rawBlockBytes := make([]byte, stat.BlockSize)
 	bytesRead, err := s.reader.Read(rawBlockBytes)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Read: %w", err)
+		return nil, fmt.Errorf("error in reader.Read: %w", ioError(err))
 	}
 	if bytesRead != int(stat.BlockSize) {
 		return nil, fmt.Errorf("%w when reading raw block bytes", ErrUnexpectedBytesRead)
 	}
 
-	decompressedBlockBytes := &bytes.Buffer{}
+	if !verifyHash {
+		return rawBlockBytes, nil
+	}
+	if calculatedHash := xxhash.Sum64(rawBlockBytes); calculatedHash != stat.Hash {
+		return nil, fmt.Errorf("%w: expected=%d got=%d", ErrMismatchedBlockHash, stat.Hash, calculatedHash)
+	}
+
+	return rawBlockBytes, nil
+}
+
+// checkBlockBounds verifies that the block lies within the segment file, if the file size is known
+func (s *SegmentReader) checkBlockBounds(stat BlockStat) error {
+	if s.fileBytes <= 0 {
+		return nil
+	}
+	if stat.Offset > uint64(s.fileBytes) || stat.BlockSize > uint64(s.fileBytes)-stat.Offset {
+		return fmt.Errorf("%w: offset=%d size=%d file bytes=%d", ErrBlockOutOfBounds, stat.Offset, stat.BlockSize, s.fileBytes)
+	}
+	return nil
+}
+
+// blockScratch is memory reused between decoding blocks, see RowIter.ReuseBlockMemory
+type blockScratch struct {
+	raw          []byte
+	decompressed []byte
+	values       []byte
+	rows         []KVPair
+}
+
+// grow returns b resized to n bytes, only allocating if the capacity is too small
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// decodeBlockRows decompresses (if needed) and deserializes the final bytes of a data block into rows. The keys and
+// values of the rows may reference rawBlockBytes.
+func decodeBlockRows(rawBlockBytes []byte, stat BlockStat, metadata *SegmentMetadata) ([]KVPair, error) {
+	return decodeBlockRowsInto(rawBlockBytes, stat, metadata, nil, true)
+}
+
+// decodeBlockRowsInto is decodeBlockRows, reusing the scratch memory if not nil. The rows are then only valid until
+// the scratch is used again.
+//
+// If not decodeValues, individually compressed values are left compressed, which is enough to tell tombstones apart.
+func decodeBlockRowsInto(rawBlockBytes []byte, stat BlockStat, metadata *SegmentMetadata, scratch *blockScratch, decodeValues bool) ([]KVPair, error) {
+	if scratch == nil {
+		scratch = &blockScratch{}
+	}
+
+	block := rawBlockBytes
 	// if compressed, decompress it
-	if s.metadata.ZSTDCompression {
-		dec, err := zstd.NewReader(bytes.NewReader(rawBlockBytes[:stat.CompressedSize]))
+	if metadata.ZSTDCompression {
+		if stat.CompressedSize > uint64(len(rawBlockBytes)) {
+			return nil, fmt.Errorf("%w: compressed size %d is larger than the block", ErrUnexpectedBytesRead, stat.CompressedSize)
+		}
+		decompressed, err := metadata.zstdDecodeBlock(rawBlockBytes[:stat.CompressedSize], scratch.decompressed[:0])
 		if err != nil {
-			return nil, fmt.Errorf("error in zstd.NewReader: %w", err)
+			return nil, fmt.Errorf("error in zstd DecodeAll: %w", err)
 		}
-		defer dec.Close()
-
-		_, err = io.Copy(decompressedBlockBytes, dec)
+		scratch.decompressed = decompressed
+		block = decompressed
+	} else if codec := metadata.blockCodec(); codec != nil && stat.CompressedSize != stat.OriginalSize {
+		// blocks that didn't compress are stored as is
+		if stat.CompressedSize > uint64(len(rawBlockBytes)) {
+			return nil, fmt.Errorf("%w: compressed size %d is larger than the block", ErrUnexpectedBytesRead, stat.CompressedSize)
+		}
+		decompressed, err := codec.Decompress(rawBlockBytes[:stat.CompressedSize], scratch.decompressed[:0], int(stat.OriginalSize))
 		if err != nil {
-			return nil, fmt.Errorf("error in io.Copy from zstd decoder to byte buffer: %w", err)
+			return nil, fmt.Errorf("error in Codec.Decompress (codec ID %02x): %w", codec.ID(), err)
 		}
-	} else if s.metadata.LZ4Compression {
-		// todo decompress lz4
-	} else {
-		decompressedBlockBytes = bytes.NewBuffer(rawBlockBytes)
+		scratch.decompressed = decompressed
+		block = decompressed
 	}
 
 	// read the rows
-	var rows []KVPair
-	totalReadBytes := 0
-	for totalReadBytes < int(stat.OriginalSize) {
+	rows := scratch.rows[:0]
+	scratch.values = scratch.values[:0]
+	offset := 0
+	for offset < int(stat.OriginalSize) {
 		pair := KVPair{}
-		keyLen := binary.LittleEndian.Uint16(mustReadBytes(decompressedBlockBytes, 2))
-		totalReadBytes += 2
-		valueLen := binary.LittleEndian.Uint32(mustReadBytes(decompressedBlockBytes, 4))
-		totalReadBytes += 4
-		pair.Key = mustReadBytes(decompressedBlockBytes, int(keyLen))
-		totalReadBytes += int(keyLen)
-		pair.Value = mustReadBytes(decompressedBlockBytes, int(valueLen))
-		totalReadBytes += int(valueLen)
+		headerLen := 6
+		if metadata.RowSequence {
+			headerLen += 8
+		}
+		if metadata.ValueCompression {
+			headerLen++
+		}
+		if offset+headerLen > len(block) {
+			return nil, fmt.Errorf("%w: row header at offset %d extends past the end of the block", ErrUnexpectedBytesRead, offset)
+		}
+
+		keyLen := int(binary.LittleEndian.Uint16(block[offset : offset+2]))
+		storedValueLen := binary.LittleEndian.Uint32(block[offset+2 : offset+6])
+		valueLen := int(storedValueLen)
+		if metadata.Tombstones && storedValueLen == tombstoneValueLength {
+			pair.Tombstone = true
+			valueLen = 0
+		} else if !metadata.Tombstones && storedValueLen == 0 {
+			pair.Tombstone = true
+		}
+		if metadata.RowSequence {
+			pair.Seq = binary.LittleEndian.Uint64(block[offset+6 : offset+14])
+		}
+		valueFlags := byte(valueFlagNone)
+		if metadata.ValueCompression {
+			valueFlags = block[offset+headerLen-1]
+		}
+		offset += headerLen
+
+		if offset+keyLen+valueLen > len(block) {
+			return nil, fmt.Errorf("%w: row at offset %d extends past the end of the block", ErrUnexpectedBytesRead, offset-headerLen)
+		}
+		pair.Key = block[offset : offset+keyLen : offset+keyLen]
+		offset += keyLen
+		if valueLen > 0 {
+			pair.Value = block[offset : offset+valueLen : offset+valueLen]
+		}
+		offset += valueLen
+
+		switch valueFlags {
+		case valueFlagNone:
+		case valueFlagZSTD:
+			if !decodeValues {
+				break
+			}
+			valueStart := len(scratch.values)
+			values, err := zstdDecodeAll(pair.Value, scratch.values)
+			if err != nil {
+				return nil, fmt.Errorf("error in DecodeAll for value of key %x: %w", pair.Key, err)
+			}
+			scratch.values = values
+			pair.Value = values[valueStart:len(values):len(values)]
+		default:
+			return nil, fmt.Errorf("%w: unknown value flags %d for key %x", ErrInvalidValueFlags, valueFlags, pair.Key)
+		}
 
 		rows = append(rows, pair)
 	}
+	scratch.rows = rows
 
 	return rows, nil
 }
@@ -362,22 +1511,20 @@ func (s *SegmentReader) GetRow(key []byte) (KVPair, error) {
 	}
 
 	// first test the bloom filter if we have it
-	if s.metadata.BloomFilter != nil {
-		maybeExists, err := s.probeBloomFilter(key)
-		if err != nil {
-			return KVPair{}, fmt.Errorf("error probing bloom filter: %w", err)
-		} else if !maybeExists {
-			return KVPair{}, fmt.Errorf("did not find row in bloom filter: %w", ErrNoRows)
-		}
+	maybeExists, err := s.probeBloomFilter(key)
+	if err != nil {
+		return KVPair{}, fmt.Errorf("error probing bloom filter: %w", err)
+	} else if !maybeExists {
+		return KVPair{}, fmt.Errorf("did not find row in bloom filter: %w", ErrNoRows)
 	}
 
-	// find the last block first key before this
-	var stat *BlockStat
-	s.metadata.BlockIndex.DescendLessOrEqual(BlockStat{FirstKey: key}, func(item BlockStat) bool {
-		stat = &item
-		return false
-	})
+	err = s.loadIndexPartitionFor(key)
+	if err != nil {
+		return KVPair{}, fmt.Errorf("error in loadIndexPartitionFor: %w", err)
+	}
 
+	// find the last block first key before this
+	stat := s.metadata.blockFor(key)
 	if stat == nil {
 		return KVPair{}, fmt.Errorf("did not find potential block: %w", ErrNoRows)
 	}
@@ -397,6 +1544,102 @@ func (s *SegmentReader) GetRow(key []byte) (KVPair, error) {
 	return KVPair{}, fmt.Errorf("did not find row in block: %w", ErrNoRows)
 }
 
+var ErrBufferTooSmall = errors.New("buffer too small")
+
+// GetRowInto copies the value of a row into dst, returning the length of the value. Returns found=false if the row
+// does not exist, rather than ErrNoRows.
+//
+// If dst is too small, returns the length of the value with ErrBufferTooSmall, so the caller can grow dst and retry.
+func (s *SegmentReader) GetRowInto(key, dst []byte) (n int, found bool, err error) {
+	row, err := s.GetRow(key)
+	if errors.Is(err, ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(row.Value) > len(dst) {
+		return len(row.Value), true, fmt.Errorf("%w: need %d bytes, got %d", ErrBufferTooSmall, len(row.Value), len(dst))
+	}
+
+	return copy(dst, row.Value), true, nil
+}
+
+// GetRows fetches multiple rows from the segment, reading each block that may contain a key only once. Keys that
+// are not found are not in the returned map, which is keyed by string(key).
+func (s *SegmentReader) GetRows(keys [][]byte) (map[string]KVPair, error) {
+	if s.metadata == nil {
+		_, err := s.FetchAndLoadMetadata()
+		if err != nil {
+			return nil, fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
+		}
+	}
+
+	sortedKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		maybeExists, err := s.probeBloomFilter(key)
+		if err != nil {
+			return nil, fmt.Errorf("error probing bloom filter: %w", err)
+		}
+		if maybeExists {
+			sortedKeys = append(sortedKeys, key)
+		}
+	}
+	slices.SortFunc(sortedKeys, bytes.Compare)
+
+	// group the keys by the block they would be in
+	type blockKeys struct {
+		stat BlockStat
+		keys [][]byte
+	}
+	var blocks []blockKeys
+	for _, key := range sortedKeys {
+		if bytes.Compare(key, s.metadata.LastKey) > 0 {
+			// past the end of the segment, and so are the rest
+			break
+		}
+
+		err := s.loadIndexPartitionFor(key)
+		if err != nil {
+			return nil, fmt.Errorf("error in loadIndexPartitionFor: %w", err)
+		}
+
+		stat := s.metadata.blockFor(key)
+		if stat == nil {
+			// before the first block
+			continue
+		}
+
+		if len(blocks) > 0 && bytes.Equal(blocks[len(blocks)-1].stat.FirstKey, stat.FirstKey) {
+			blocks[len(blocks)-1].keys = append(blocks[len(blocks)-1].keys, key)
+		} else {
+			blocks = append(blocks, blockKeys{stat: *stat, keys: [][]byte{key}})
+		}
+	}
+
+	rows := make(map[string]KVPair, len(sortedKeys))
+	for _, block := range blocks {
+		blockRows, err := s.ReadBlockWithStat(block.stat)
+		if err != nil {
+			return nil, fmt.Errorf("error in ReadBlockWithStat for offset %d: %w", block.stat.Offset, err)
+		}
+
+		// both are sorted, so walk them together
+		rowIdx := 0
+		for _, key := range block.keys {
+			for rowIdx < len(blockRows) && bytes.Compare(blockRows[rowIdx].Key, key) < 0 {
+				rowIdx++
+			}
+			if rowIdx < len(blockRows) && bytes.Equal(blockRows[rowIdx].Key, key) {
+				rows[string(key)] = blockRows[rowIdx]
+			}
+		}
+	}
+
+	return rows, nil
+}
+
 // GetRange will get the range of keys [start, end) from the segment.
 // todo delete this method - this should be higher level - or we should
 //
@@ -409,6 +1652,11 @@ func (s *SegmentReader) GetRange(start, end []byte) ([]KVPair, error) {
 		}
 	}
 
+	err := s.loadBlockIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error in loadBlockIndex: %w", err)
+	}
+
 	isUnboundStart := bytes.Equal(start, UnboundStart)
 	isUnboundEnd := bytes.Equal(end, UnboundEnd)
 
@@ -468,7 +1716,68 @@ func (s *SegmentReader) GetRange(start, end []byte) ([]KVPair, error) {
 	return inclRows, nil
 }
 
-var ErrUnexpectedBytesRead = errors.New("unexpected bytes read")
+// BlockRanges returns the key range of every block in ascending order, from the block index alone without reading
+// any data blocks, such as for choosing range partitions during compaction. Each block covers [FirstKey, EndKey),
+// except the last block, which covers [FirstKey, LastKey].
+//
+// Fetches the metadata if not already loaded.
+func (s *SegmentReader) BlockRanges() ([]BlockRange, error) {
+	if s.metadata == nil {
+		_, err := s.FetchAndLoadMetadata()
+		if err != nil {
+			return nil, fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
+		}
+	}
+
+	err := s.loadBlockIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error in loadBlockIndex: %w", err)
+	}
+
+	ranges := make([]BlockRange, 0, s.metadata.BlockIndex.Len())
+	s.metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if len(ranges) > 0 {
+			ranges[len(ranges)-1].EndKey = stat.FirstKey
+		}
+		ranges = append(ranges, BlockRange{Stat: stat})
+		return true
+	})
+	ranges[len(ranges)-1].EndKey = s.metadata.LastKey
+	ranges[len(ranges)-1].Last = true
+
+	return ranges, nil
+}
+
+// ErrUnsortedRows is returned by VerifyOrder when a row's key is not greater than the key before it
+var ErrUnsortedRows = fmt.Errorf("%w: rows are not sorted", ErrCorrupt)
+
+// VerifyOrder reads every row of the segment, checking that each key is greater than the key before it, including
+// across block boundaries. Returns ErrUnsortedRows with the keys of the first violation. Values are not
+// decompressed. This is a debugging aid for catching writer bugs, as it reads the whole segment.
+func (s *SegmentReader) VerifyOrder() error {
+	iter, err := s.RowIter(DirectionAscending)
+	if err != nil {
+		return fmt.Errorf("error in RowIter: %w", err)
+	}
+	iter.KeysOnly()
+
+	var prevKey []byte
+	for i := 0; ; i++ {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error in RowIter.Next: %w", err)
+		}
+		if prevKey != nil && bytes.Compare(row.Key, prevKey) <= 0 {
+			return fmt.Errorf("%w: row %d key %x is not greater than previous key %x", ErrUnsortedRows, i, row.Key, prevKey)
+		}
+		prevKey = row.Key
+	}
+}
+
+var ErrUnexpectedBytesRead = fmt.Errorf("%w: unexpected bytes read", ErrCorrupt)
 var ErrAlreadyClosed = errors.New("already closed")
 
 // Close closes the reader. If already closed, will return ErrAlreadyClosed
@@ -477,6 +1786,13 @@ func (s *SegmentReader) Close() error {
 		return ErrAlreadyClosed
 	}
 	s.closed = true
+	if s.reader == nil {
+		// metadata only
+		return nil
+	}
+	if s.options.MetadataReader != nil {
+		return errors.Join(s.reader.Close(), s.options.MetadataReader.Close())
+	}
 	return s.reader.Close()
 }
 
@@ -485,10 +1801,14 @@ func readBytes(reader io.Reader, bytes int) ([]byte, error) {
 		// nothing to read
 		return nil, nil
 	}
+	if lenReader, ok := reader.(interface{ Len() int }); ok && bytes > lenReader.Len() {
+		// don't allocate a corrupt length, such as while recovering a trailer
+		return nil, fmt.Errorf("%w: expected=%d remaining=%d", ErrUnexpectedBytesRead, bytes, lenReader.Len())
+	}
 	buf := make([]byte, bytes)
 	n, err := reader.Read(buf)
 	if err != nil {
-		return nil, fmt.Errorf("error in reader.Read: %w", err)
+		return nil, fmt.Errorf("error in reader.Read: %w", ioError(err))
 	}
 	if n != bytes {
 		return nil, fmt.Errorf("%w: expected=%d read=%d", ErrUnexpectedBytesRead, bytes, n)
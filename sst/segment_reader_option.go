@@ -0,0 +1,65 @@
+package sst
+
+import (
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+type SegmentReaderOptions struct {
+	// LazyBloomFilter will keep the bloom filter out of the SegmentMetadata, only storing where it lives in the file.
+	// The bloom filter is then read from the segment file when probed. This trades a read for memory.
+	LazyBloomFilter bool
+	// BloomFilterCache is an optional cache of lazily loaded bloom filters, which should be shared between readers.
+	BloomFilterCache *BloomFilterCache
+	// SegmentID identifies the segment in the BloomFilterCache, such as its ID or path, so readers of the same
+	// segment share its cached bloom filter even when they parse the metadata separately. If empty, only readers
+	// sharing the same SegmentMetadata (see LoadCachedMetadata) share it.
+	SegmentID string
+	// MetadataReader is an optional separate source for the meta block and trailer, for when they are stored apart
+	// from the data blocks (everything from the meta block offset to the end of the segment file). The metadata and
+	// lazily loaded bloom filters are read from it, while data blocks are read from the segment reader.
+	// BlockStat offsets are relative to the start of the data.
+	//
+	// It is closed when the SegmentReader is closed.
+	MetadataReader io.ReadSeekCloser
+	// MetadataBytes is the length of the MetadataReader source
+	MetadataBytes int
+	// BlockIndexDegree is the degree of the block index btree, larger degrees reduce allocations and improve lookup
+	// locality for segments with many blocks. Uses DefaultBlockIndexDegree if 0.
+	BlockIndexDegree int
+	// LazyBlockIndex only loads the partitions of a partitioned block index (see
+	// SegmentWriterOptions.BlockIndexPartitionEntries) when they are needed, rather than with the metadata. Point
+	// reads load the one partition holding the key, while iterators and ranges load them all. This trades a read for
+	// memory with very large segments. Segments without a partitioned block index are unaffected.
+	LazyBlockIndex bool
+	// RateLimiter paces data block reads in bytes per second, waiting before each block is read, such as to keep
+	// compaction from starving foreground reads. Disabled if nil.
+	RateLimiter *rate.Limiter
+	// MetadataRetries is how many times FetchAndLoadMetadata reads the trailer and meta block again when the meta
+	// block hash doesn't match, as a partial or bad read from a remote store may be transient. Returns
+	// ErrMismatchedMetaBlockHash once the retries are exhausted. Short reads are always read in full, so they aren't
+	// mistaken for a mismatch. Disabled if 0.
+	MetadataRetries int
+	// RecoverTrailer finds the meta block by scanning the segment when the trailer is damaged (e.g. a bad magic
+	// number, offset, or hash), for reading partially damaged segments in disaster recovery. This is best-effort, and
+	// reads the whole segment file into memory. Not supported with MetadataReader.
+	RecoverTrailer bool
+}
+
+const DefaultBlockIndexDegree = 32
+
+func DefaultSegmentReaderOptions() SegmentReaderOptions {
+	return SegmentReaderOptions{
+		LazyBloomFilter:  false,
+		BloomFilterCache: nil,
+		SegmentID:        "",
+		MetadataReader:   nil,
+		MetadataBytes:    0,
+		BlockIndexDegree: DefaultBlockIndexDegree,
+		LazyBlockIndex:   false,
+		RateLimiter:      nil,
+		MetadataRetries:  0,
+		RecoverTrailer:   false,
+	}
+}
@@ -3,10 +3,21 @@ package sst
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestReadUncompressed(t *testing.T) {
@@ -828,3 +839,1741 @@ func TestReadCorruptFileMiddle(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// countingReadSeekCloser counts the bytes read from the underlying reader
+type countingReadSeekCloser struct {
+	BytesReadSeekCloser
+	bytesRead int
+}
+
+func (c *countingReadSeekCloser) Read(p []byte) (int, error) {
+	n, err := c.BytesReadSeekCloser.Read(p)
+	c.bytesRead += n
+	return n, err
+}
+
+func TestReadLazyBloomFilter(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := []byte(fmt.Sprintf("value%03d", i))
+		err := w.WriteRow(key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eagerMetadata, err := (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eagerMetadata.BloomFilter == nil {
+		t.Fatal("expected bloom filter to be resident")
+	}
+
+	cache := NewBloomFilterCache(1)
+	readerOpts := DefaultSegmentReaderOptions()
+	readerOpts.LazyBloomFilter = true
+	readerOpts.BloomFilterCache = cache
+	countingReader := &countingReadSeekCloser{
+		BytesReadSeekCloser: BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		},
+	}
+	r := NewSegmentReaderWithOptions(countingReader, int(segmentLength), readerOpts)
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.BloomFilter != nil {
+		t.Fatal("expected bloom filter to not be resident")
+	}
+	if metadata.BloomFilterLength != eagerMetadata.BloomFilterLength || metadata.BloomFilterLength == 0 {
+		t.Fatal("unexpected bloom filter length", metadata.BloomFilterLength)
+	}
+	if cache.Len() != 0 {
+		t.Fatal("expected empty cache")
+	}
+
+	// a missing key should only read the bloom filter, and never a data block
+	countingReader.bytesRead = 0
+	_, err = r.GetRow([]byte("key999"))
+	if !errors.Is(err, ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	if countingReader.bytesRead != int(metadata.BloomFilterLength) {
+		t.Fatal("expected to only read the bloom filter, read bytes", countingReader.bytesRead)
+	}
+	if cache.Len() != 1 {
+		t.Fatal("expected bloom filter to be cached")
+	}
+
+	// the cached bloom filter should not be read again
+	countingReader.bytesRead = 0
+	_, err = r.GetRow([]byte("key998"))
+	if !errors.Is(err, ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	if countingReader.bytesRead != 0 {
+		t.Fatal("expected cached bloom filter, read bytes", countingReader.bytesRead)
+	}
+
+	row, err := r.GetRow([]byte("key100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(row.Value, []byte("value100")) {
+		t.Fatal("unexpected value", string(row.Value))
+	}
+
+	// another segment's bloom filter should evict the first
+	v1Reader := NewSegmentReaderWithOptions(BytesReadSeekCloser{
+		Reader: bytes.NewReader(b.Bytes()),
+	}, int(segmentLength), readerOpts)
+	_, err = v1Reader.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v1Reader.GetRow([]byte("key999"))
+	if !errors.Is(err, ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	if cache.Len() != 1 {
+		t.Fatal("expected cache to evict, got length", cache.Len())
+	}
+	countingReader.bytesRead = 0
+	_, err = r.GetRow([]byte("key999"))
+	if !errors.Is(err, ErrNoRows) {
+		t.Fatal("expected no rows, got", err)
+	}
+	if countingReader.bytesRead != int(metadata.BloomFilterLength) {
+		t.Fatal("expected evicted bloom filter to be read again, read bytes", countingReader.bytesRead)
+	}
+
+	// readers with the same segment ID share the bloom filter, even when they parse the metadata separately
+	readerOpts.SegmentID = "segment"
+	for i := 0; i < 2; i++ {
+		countingReader := &countingReadSeekCloser{
+			BytesReadSeekCloser: BytesReadSeekCloser{
+				Reader: bytes.NewReader(b.Bytes()),
+			},
+		}
+		r := NewSegmentReaderWithOptions(countingReader, int(segmentLength), readerOpts)
+		_, err = r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		countingReader.bytesRead = 0
+		_, err = r.GetRow([]byte("key999"))
+		if !errors.Is(err, ErrNoRows) {
+			t.Fatal("expected no rows, got", err)
+		}
+		if i == 0 && countingReader.bytesRead != int(metadata.BloomFilterLength) {
+			t.Fatal("expected the first reader to read the bloom filter, read bytes", countingReader.bytesRead)
+		}
+		if i == 1 && countingReader.bytesRead != 0 {
+			t.Fatal("expected the second reader to use the cached bloom filter, read bytes", countingReader.bytesRead)
+		}
+	}
+}
+
+func TestReadCorruptBlockIndexEntry(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := []byte(fmt.Sprintf("value%03d", i))
+		err := w.WriteRow(key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the offset of the second block index entry
+	secondBlockFirstKey := []byte("key180")
+	keyIndex := bytes.LastIndex(metadataBytes, secondBlockFirstKey)
+	if keyIndex == -1 {
+		t.Fatal("did not find second block first key in metadata")
+	}
+	corrupted := bytes.Clone(metadataBytes)
+	corrupted[keyIndex+len(secondBlockFirstKey)]++
+
+	_, err = (&SegmentReader{}).BytesToMetadata(corrupted)
+	if !errors.Is(err, ErrCorruptBlockIndexEntry) {
+		t.Fatal("did not get corrupt block index entry error, got:", err)
+	}
+	if !strings.Contains(err.Error(), "entry 1:") {
+		t.Fatal("error did not localize the corrupt entry:", err)
+	}
+}
+
+func TestReadVersion1BlockIndexEntries(t *testing.T) {
+	// version 1 segments have entries without the row stats and checksum
+	stats := []BlockStat{
+		{FirstKey: []byte("a"), Offset: 0, BlockSize: 100, OriginalSize: 100, Hash: 1},
+		{FirstKey: []byte("m"), Offset: 100, BlockSize: 50, OriginalSize: 80, CompressedSize: 50, Hash: 2},
+	}
+	legacy := []byte{blockIndexTypeSimple}
+	legacy = binary.LittleEndian.AppendUint64(legacy, uint64(len(stats)))
+	for _, stat := range stats {
+		legacy = binary.LittleEndian.AppendUint16(legacy, uint16(len(stat.FirstKey)))
+		legacy = append(legacy, stat.FirstKey...)
+		for _, field := range []uint64{stat.Offset, stat.BlockSize, stat.OriginalSize, stat.CompressedSize, stat.Hash} {
+			legacy = binary.LittleEndian.AppendUint64(legacy, field)
+		}
+	}
+
+	r := &SegmentReader{}
+	index, err := r.parseBlockIndexV1(bytes.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != len(stats) {
+		t.Fatal("expected", len(stats), "blocks, got", index.Len())
+	}
+	for _, stat := range stats {
+		parsed, found := index.Get(stat)
+		if !found || !reflect.DeepEqual(parsed, stat) {
+			t.Fatal("expected", stat, "got", parsed)
+		}
+	}
+
+	// version 2 entries are read with their stats and checksums, so the version 1 layout is corrupt
+	_, _, err = r.parseBlockIndex(bytes.NewReader(legacy))
+	if !errors.Is(err, ErrCorruptBlockIndexEntry) {
+		t.Fatal("expected ErrCorruptBlockIndexEntry, got", err)
+	}
+	current := appendBlockIndexEntries([]byte{blockIndexTypeSimple}, stats)
+	index, _, err = r.parseBlockIndex(bytes.NewReader(current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != len(stats) {
+		t.Fatal("expected", len(stats), "blocks, got", index.Len())
+	}
+
+	// version 1 block indexes are never partitioned
+	legacy[0] = blockIndexTypePartitioned
+	_, err = r.parseBlockIndexV1(bytes.NewReader(legacy))
+	if !errors.Is(err, ErrInvalidMetaBlock) {
+		t.Fatal("expected ErrInvalidMetaBlock, got", err)
+	}
+
+	// the entries of a segment written by version 1 locate its blocks
+	segment, err := os.ReadFile(filepath.Join("testdata", "v1.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Reader := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	metadata, err := v1Reader.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.BlockIndex.Len() < 2 {
+		t.Fatal("expected multiple blocks, got", metadata.BlockIndex.Len())
+	}
+	var offset uint64
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if stat.Offset != offset || stat.RowCount != 0 {
+			t.Fatal("unexpected block", stat, "at offset", offset)
+		}
+		_, err = v1Reader.ReadRawBlock(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset += stat.BlockSize
+		return true
+	})
+}
+
+func TestReadSegmentVersion1(t *testing.T) {
+	// the fixtures were written by the first release of the SegmentWriter, without a bloom filter, in blocks of 256
+	// bytes: key-000 through key-049, with value-NNN values, except keys ending in 5 have an empty value
+	for _, name := range []string{"v1.sst", "v1_zstd.sst"} {
+		segment, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if metadata.Version != segmentVersion1 || metadata.Tombstones || metadata.RowCount != 0 {
+			t.Fatal("unexpected metadata", metadata.Version, metadata.Tombstones, metadata.RowCount, "for", name)
+		}
+		if string(metadata.FirstKey) != "key-000" || string(metadata.LastKey) != "key-049" {
+			t.Fatal("unexpected key bounds", string(metadata.FirstKey), string(metadata.LastKey), "for", name)
+		}
+		if metadata.ZSTDCompression != (name == "v1_zstd.sst") {
+			t.Fatal("unexpected compression for", name)
+		}
+
+		row, err := r.GetRow([]byte("key-012"))
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if string(row.Value) != "value-012" || row.Tombstone {
+			t.Fatal("unexpected row", row, "for", name)
+		}
+		// empty values are tombstones in version 1
+		row, err = r.GetRow([]byte("key-015"))
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if !row.Tombstone {
+			t.Fatal("expected a tombstone, got", row, "for", name)
+		}
+
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				if i != 50 {
+					t.Fatal("expected 50 rows, got", i, "for", name)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err, "for", name)
+			}
+			expected := KVPair{Key: []byte(fmt.Sprintf("key-%03d", i)), Value: []byte(fmt.Sprintf("value-%03d", i))}
+			if i%10 == 5 {
+				expected = NewTombstone(expected.Key)
+			}
+			if !bytes.Equal(row.Key, expected.Key) || !bytes.Equal(row.Value, expected.Value) || row.Tombstone != expected.Tombstone {
+				t.Fatal("expected", expected, "got", row, "for", name)
+			}
+		}
+
+		// the trailer can be recovered
+		damaged := bytes.Clone(segment)
+		clear(damaged[len(damaged)-25:])
+		opts := DefaultSegmentReaderOptions()
+		opts.RecoverTrailer = true
+		r = NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(damaged)}, len(damaged), opts)
+		metadata, err = r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if metadata.Version != segmentVersion1 || metadata.BlockIndex.Len() == 0 {
+			t.Fatal("unexpected recovered metadata for", name)
+		}
+	}
+
+	// newer segments are version 2
+	b := &bytes.Buffer{}
+	w := NewSegmentWriter(BytesWriteCloser{b}, DefaultSegmentWriterOptions())
+	err := w.WriteRow([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := b.Bytes()[b.Len()-9]; version != segmentVersion2 {
+		t.Fatal("expected version 2, got", version)
+	}
+}
+
+func TestReadSeparateMetadata(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := []byte(fmt.Sprintf("value%03d", i))
+		err := w.WriteRow(key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// split the data blocks from the meta block and trailer
+	dataLength := int(segmentLength) - len(metadataBytes) - 25
+	dataBytes := bytes.Clone(b.Bytes()[:dataLength])
+	metaBytes := bytes.Clone(b.Bytes()[dataLength:])
+
+	checkReader := func(t *testing.T, r *SegmentReader) {
+		row, err := r.GetRow([]byte("key100"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(row.Value, []byte("value100")) {
+			t.Fatal("unexpected value", string(row.Value))
+		}
+		_, err = r.GetRow([]byte("key999"))
+		if !errors.Is(err, ErrNoRows) {
+			t.Fatal("expected no rows, got", err)
+		}
+
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			row, err := iter.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(row.Key, []byte(fmt.Sprintf("key%03d", i))) {
+				t.Fatal("unexpected key", string(row.Key))
+			}
+		}
+		_, err = iter.Next()
+		if !errors.Is(err, io.EOF) {
+			t.Fatal("expected EOF, got", err)
+		}
+	}
+
+	t.Run("cached metadata", func(t *testing.T) {
+		metadata, err := (&SegmentReader{}).BytesToMetadata(metadataBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(dataBytes),
+		}, len(dataBytes))
+		r.LoadCachedMetadata(metadata)
+		checkReader(t, &r)
+	})
+
+	t.Run("metadata reader", func(t *testing.T) {
+		readerOpts := DefaultSegmentReaderOptions()
+		readerOpts.LazyBloomFilter = true
+		readerOpts.MetadataReader = BytesReadSeekCloser{
+			Reader: bytes.NewReader(metaBytes),
+		}
+		readerOpts.MetadataBytes = len(metaBytes)
+		r := NewSegmentReaderWithOptions(BytesReadSeekCloser{
+			Reader: bytes.NewReader(dataBytes),
+		}, len(dataBytes), readerOpts)
+		_, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkReader(t, &r)
+	})
+}
+
+func TestReadBlockOutOfBounds(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{
+		Reader: bytes.NewReader(b.Bytes()),
+	}, int(segmentLength))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := metadata.BlockIndex.Max()
+
+	for _, corrupt := range []BlockStat{
+		{Offset: segmentLength + 4096, BlockSize: stat.BlockSize, OriginalSize: stat.OriginalSize, Hash: stat.Hash},
+		{Offset: stat.Offset, BlockSize: segmentLength, OriginalSize: stat.OriginalSize, Hash: stat.Hash},
+		{Offset: math.MaxUint64, BlockSize: stat.BlockSize, OriginalSize: stat.OriginalSize, Hash: stat.Hash},
+	} {
+		_, err = r.ReadBlockWithStat(corrupt)
+		if !errors.Is(err, ErrBlockOutOfBounds) {
+			t.Fatal("expected out of bounds error, got", err)
+		}
+		_, err = r.ReadRawBlock(corrupt)
+		if !errors.Is(err, ErrBlockOutOfBounds) {
+			t.Fatal("expected out of bounds error, got", err)
+		}
+	}
+
+	// the real stat is still fine
+	_, err = r.ReadBlockWithStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkGetRowBlockIndexDegree(b *testing.B) {
+	// small blocks for a large block index
+	buf := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.DataBlockThresholdBytes = 64
+	opts.DataBlockSize = 128
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: buf,
+		}, opts)
+
+	const rows = 100_000
+	for i := 0; i < rows; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, degree := range []int{2, 32} {
+		b.Run(fmt.Sprintf("degree-%d", degree), func(b *testing.B) {
+			readerOpts := DefaultSegmentReaderOptions()
+			readerOpts.BlockIndexDegree = degree
+			r := NewSegmentReaderWithOptions(BytesReadSeekCloser{
+				Reader: bytes.NewReader(buf.Bytes()),
+			}, int(segmentLength), readerOpts)
+			_, err := r.FetchAndLoadMetadata()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_, err := r.GetRow([]byte(fmt.Sprintf("key%08d", (n*7919)%rows)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRows(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 1000; i += 2 {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countingReader := &countingReadSeekCloser{
+		BytesReadSeekCloser: BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		},
+	}
+	r := NewSegmentReader(countingReader, int(segmentLength))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstBlock, _ := metadata.BlockIndex.Min()
+
+	// many keys in the first block, unsorted, with duplicates, missing keys, and keys outside the segment
+	var keys [][]byte
+	for _, i := range []int{100, 0, 2, 50, 51, 3, 100} {
+		keys = append(keys, []byte(fmt.Sprintf("key%04d", i)))
+	}
+	keys = append(keys, []byte("a"), []byte("zzz"))
+
+	countingReader.bytesRead = 0
+	rows, err := r.GetRows(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countingReader.bytesRead != int(firstBlock.BlockSize) {
+		t.Fatal("expected to read the first block once, read bytes", countingReader.bytesRead)
+	}
+
+	// keys spread across blocks
+	for i := 0; i < 1000; i += 37 {
+		keys = append(keys, []byte(fmt.Sprintf("key%04d", i)))
+	}
+	rows, err = r.GetRows(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for _, key := range keys {
+		row, err := r.GetRow(key)
+		if errors.Is(err, ErrNoRows) {
+			if _, exists := rows[string(key)]; exists {
+				t.Fatal("unexpected row for", string(key))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		found++
+		if batchRow, exists := rows[string(key)]; !exists || !bytes.Equal(batchRow.Value, row.Value) {
+			t.Fatal("batch row did not match GetRow for", string(key))
+		}
+	}
+	if found == 0 || len(rows) > found {
+		t.Fatal("unexpected number of rows", len(rows), "found", found)
+	}
+}
+
+func TestReadInconsistentKeyBounds(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the meta block starts with the first key (key000) then last key (key199), both 6 bytes with a 2 byte length
+	firstKeyMismatch := bytes.Clone(metadataBytes)
+	copy(firstKeyMismatch[2:8], "key001")
+	_, err = (&SegmentReader{}).BytesToMetadata(firstKeyMismatch)
+	if !errors.Is(err, ErrInconsistentMetadata) {
+		t.Fatal("expected inconsistent metadata, got", err)
+	}
+
+	// before the last block's first key (key180)
+	lastKeyBeforeLastBlock := bytes.Clone(metadataBytes)
+	copy(lastKeyBeforeLastBlock[10:16], "key100")
+	_, err = (&SegmentReader{}).BytesToMetadata(lastKeyBeforeLastBlock)
+	if !errors.Is(err, ErrInconsistentMetadata) {
+		t.Fatal("expected inconsistent metadata, got", err)
+	}
+
+	_, err = (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetRowInto(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			Buffer: b,
+		}, opts)
+
+	for i := 0; i < 200; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{
+		Reader: bytes.NewReader(b.Bytes()),
+	}, int(segmentLength))
+
+	// exact fit
+	dst := make([]byte, len("value100"))
+	n, found, err := r.GetRowInto([]byte("key100"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || n != len(dst) || string(dst) != "value100" {
+		t.Fatal("unexpected result", n, found, string(dst))
+	}
+
+	// larger buffer
+	dst = make([]byte, 100)
+	n, found, err = r.GetRowInto([]byte("key101"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || string(dst[:n]) != "value101" {
+		t.Fatal("unexpected result", n, found, string(dst[:n]))
+	}
+
+	// too small
+	dst = make([]byte, 3)
+	n, found, err = r.GetRowInto([]byte("key102"), dst)
+	if !errors.Is(err, ErrBufferTooSmall) {
+		t.Fatal("expected buffer too small, got", err)
+	}
+	if !found || n != len("value102") {
+		t.Fatal("expected the needed size, got", n, found)
+	}
+
+	// not found
+	n, found, err = r.GetRowInto([]byte("key999"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found || n != 0 {
+		t.Fatal("expected not found, got", n, found)
+	}
+}
+
+func TestNewSegmentReaderOptions(t *testing.T) {
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	readers := map[string]SegmentReader{
+		"omitted":  NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length)),
+		"explicit": NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length), DefaultSegmentReaderOptions()),
+		"zero":     NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length), SegmentReaderOptions{}),
+	}
+
+	for name, r := range readers {
+		row, err := r.GetRow([]byte("key00001234"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if string(row.Value) != "value00001234" {
+			t.Fatal(name, "unexpected value", string(row.Value))
+		}
+
+		iter, err := r.RowIter(DirectionDescending)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		count := 0
+		for {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if string(row.Key) != fmt.Sprintf("key%08d", 2_000-1-count) {
+				t.Fatal(name, "unexpected key", string(row.Key), "at", count)
+			}
+			count++
+		}
+		if count != 2_000 {
+			t.Fatal(name, "unexpected row count", count)
+		}
+	}
+
+	explicit := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length), SegmentReaderOptions{LazyBloomFilter: true})
+	if !explicit.options.LazyBloomFilter {
+		t.Fatal("expected the explicit options to be used")
+	}
+}
+
+func TestKVPairIsTombstone(t *testing.T) {
+	if !NewTombstone([]byte("key")).IsTombstone() {
+		t.Fatal("expected a tombstone")
+	}
+	if (KVPair{Key: []byte("key"), Value: []byte("v")}).IsTombstone() || (KVPair{Key: []byte("key"), Value: []byte{}}).IsTombstone() {
+		t.Fatal("expected values not to be tombstones")
+	}
+
+	// the predicate agrees with the tombstone count of the writer, and empty values are live
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 300; i++ {
+		row := KVPair{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value")}
+		switch i % 3 {
+		case 0:
+			row = NewTombstone(row.Key)
+		case 1:
+			row.Value = []byte{}
+		}
+		err := w.WriteKVPair(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tombstones, emptyValues uint64
+	for {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.IsTombstone() {
+			if row.Value != nil {
+				t.Fatal("expected a tombstone to have no value, got", row.Value)
+			}
+			tombstones++
+		} else if len(row.Value) == 0 {
+			emptyValues++
+		}
+	}
+	if tombstones != 100 || tombstones != r.metadata.TombstoneCount {
+		t.Fatal("expected 100 tombstones, got", tombstones, "metadata", r.metadata.TombstoneCount)
+	}
+	if emptyValues != 100 {
+		t.Fatal("expected 100 empty values, got", emptyValues)
+	}
+	if !r.metadata.Tombstones {
+		t.Fatal("expected the segment to mark tombstones")
+	}
+
+	// version 1 segments read empty values as tombstones
+	segment, err := os.ReadFile(filepath.Join("testdata", "v1.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Tombstones {
+		t.Fatal("expected a version 1 segment not to mark tombstones")
+	}
+	stat, _ := metadata.BlockIndex.Min()
+	rows, err := r.ReadBlockWithStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if row.IsTombstone() != (i%10 == 5) || (row.IsTombstone() && row.Value != nil) {
+			t.Fatal("unexpected tombstone", row.IsTombstone(), "for", string(row.Key))
+		}
+	}
+}
+
+// flakyMetaReadSeekCloser corrupts the first reads of the meta block, and returns short reads
+type flakyMetaReadSeekCloser struct {
+	BytesReadSeekCloser
+	metaBlockLength int
+	corruptReads    int
+	maxRead         int
+}
+
+func (f *flakyMetaReadSeekCloser) Read(p []byte) (int, error) {
+	if f.maxRead > 0 && len(p) > f.maxRead {
+		p = p[:f.maxRead]
+	}
+	n, err := f.BytesReadSeekCloser.Read(p)
+	if len(p) == f.metaBlockLength && f.corruptReads > 0 {
+		f.corruptReads--
+		p[0] ^= 0xff
+	}
+	return n, err
+}
+
+func TestFetchAndLoadMetadataRetries(t *testing.T) {
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	metaBlockLength := int(length) - int(binary.LittleEndian.Uint64(buf.Bytes()[length-25:])) - 25
+
+	for _, tc := range []struct {
+		retries      int
+		corruptReads int
+		expectErr    bool
+	}{
+		{retries: 0, corruptReads: 0},
+		{retries: 0, corruptReads: 1, expectErr: true},
+		{retries: 1, corruptReads: 1},
+		{retries: 3, corruptReads: 3},
+		{retries: 2, corruptReads: 3, expectErr: true},
+	} {
+		opts := DefaultSegmentReaderOptions()
+		opts.MetadataRetries = tc.retries
+		r := NewSegmentReaderWithOptions(&flakyMetaReadSeekCloser{
+			BytesReadSeekCloser: BytesReadSeekCloser{bytes.NewReader(buf.Bytes())},
+			metaBlockLength:     metaBlockLength,
+			corruptReads:        tc.corruptReads,
+		}, int(length), opts)
+		metadata, err := r.FetchAndLoadMetadata()
+		if tc.expectErr {
+			if !errors.Is(err, ErrMismatchedMetaBlockHash) {
+				t.Fatal("expected ErrMismatchedMetaBlockHash, got", err, "for", tc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err, "for", tc)
+		}
+		if metadata.RowCount != 2_000 {
+			t.Fatal("unexpected row count", metadata.RowCount)
+		}
+	}
+
+	// short reads are read in full rather than mismatching
+	r := NewSegmentReader(&flakyMetaReadSeekCloser{
+		BytesReadSeekCloser: BytesReadSeekCloser{bytes.NewReader(buf.Bytes())},
+		maxRead:             100,
+	}, int(length))
+	_, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverTrailer(t *testing.T) {
+	for _, tc := range []struct {
+		zstdLevel         int
+		compressMetaBlock bool
+	}{
+		{},
+		{zstdLevel: 1},
+		{compressMetaBlock: true},
+	} {
+		b := &bytes.Buffer{}
+		writerOpts := DefaultSegmentWriterOptions()
+		writerOpts.ZSTDCompressionLevel = tc.zstdLevel
+		writerOpts.MetaBlockZSTDCompression = tc.compressMetaBlock
+		w := NewSegmentWriter(BytesWriteCloser{b}, writerOpts)
+		for i := 0; i < 2_000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// zero the trailer
+		segment := bytes.Clone(b.Bytes())
+		clear(segment[len(segment)-25:])
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, int(length))
+		_, err = r.FetchAndLoadMetadata()
+		if !errors.Is(err, ErrInvalidMagicNumber) {
+			t.Fatal("expected ErrInvalidMagicNumber without recovery, got", err, "for", tc)
+		}
+
+		opts := DefaultSegmentReaderOptions()
+		opts.RecoverTrailer = true
+		r = NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(segment)}, int(length), opts)
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err, "for", tc)
+		}
+		if metadata.RowCount != 2_000 || string(metadata.FirstKey) != "key00000000" || string(metadata.LastKey) != "key00001999" {
+			t.Fatal("unexpected metadata", metadata.RowCount, string(metadata.FirstKey), string(metadata.LastKey), "for", tc)
+		}
+		if metadata.BloomFilter == nil || !metadata.BloomFilter.Test([]byte("key00001234")) {
+			t.Fatal("expected the bloom filter to be recovered for", tc)
+		}
+
+		row, err := r.GetRow([]byte("key00001234"))
+		if err != nil {
+			t.Fatal(err, "for", tc)
+		}
+		if string(row.Value) != "value00001234" {
+			t.Fatal("unexpected value", string(row.Value), "for", tc)
+		}
+	}
+
+	// a damaged meta block can't be recovered, the block index is before the block size and created at fields
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	segment := bytes.Clone(buf.Bytes())
+	clear(segment[int(length)-25-8-17-1:])
+	opts := DefaultSegmentReaderOptions()
+	opts.RecoverTrailer = true
+	r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(segment)}, int(length), opts)
+	_, err := r.FetchAndLoadMetadata()
+	if !errors.Is(err, ErrInvalidMetaBlock) {
+		t.Fatal("expected ErrInvalidMetaBlock, got", err)
+	}
+}
+
+func TestVerifyOrder(t *testing.T) {
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	err := r.VerifyOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer doesn't check order, so a smaller or duplicate key can be written mid segment
+	for _, outOfOrder := range []string{"key00000010", "key00000999"} {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 2_000; i++ {
+			key := fmt.Sprintf("key%08d", i)
+			if i == 1_000 {
+				key = outOfOrder
+			}
+			err := w.WriteRow([]byte(key), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		err = r.VerifyOrder()
+		if !errors.Is(err, ErrUnsortedRows) {
+			t.Fatal("expected ErrUnsortedRows for", outOfOrder, "got", err)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%x", outOfOrder)) {
+			t.Fatal("expected the error to include the out of order key, got", err)
+		}
+	}
+}
+
+func TestReadBloomFilter(t *testing.T) {
+	for _, compressMetaBlock := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		writerOpts := DefaultSegmentWriterOptions()
+		writerOpts.MetaBlockZSTDCompression = compressMetaBlock
+		w := NewSegmentWriter(BytesWriteCloser{b}, writerOpts)
+		for i := 0; i < 2_000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		filter, err := r.ReadBloomFilter()
+		if err != nil {
+			t.Fatal(err, "for compressMetaBlock", compressMetaBlock)
+		}
+		for i := 0; i < 2_000; i++ {
+			if !filter.Test([]byte(fmt.Sprintf("key%08d", i))) {
+				t.Fatal("expected the bloom filter to contain key", i, "for compressMetaBlock", compressMetaBlock)
+			}
+		}
+
+		// matches the filter from the full metadata
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !filter.Equal(metadata.BloomFilter) {
+			t.Fatal("expected the bloom filter to match the metadata for compressMetaBlock", compressMetaBlock)
+		}
+	}
+
+	buf, length := writeLargeSegment(t, 100, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	_, err := r.ReadBloomFilter()
+	if !errors.Is(err, ErrNoBloomFilter) {
+		t.Fatal("expected ErrNoBloomFilter, got", err)
+	}
+}
+
+func TestBlockRanges(t *testing.T) {
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	ranges, err := r.BlockRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != metadata.BlockIndex.Len() || len(ranges) < 2 {
+		t.Fatal("expected a range per block, got", len(ranges), "for", metadata.BlockIndex.Len(), "blocks")
+	}
+
+	// the ranges tile the segment with no gaps or overlaps
+	if !bytes.Equal(ranges[0].Stat.FirstKey, metadata.FirstKey) {
+		t.Fatal("expected the first range to start at the first key, got", string(ranges[0].Stat.FirstKey))
+	}
+	for i, blockRange := range ranges {
+		last := i == len(ranges)-1
+		if blockRange.Last != last {
+			t.Fatal("unexpected Last", blockRange.Last, "for range", i)
+		}
+		if !last && !bytes.Equal(blockRange.EndKey, ranges[i+1].Stat.FirstKey) {
+			t.Fatal("expected range", i, "to end at the next first key, got", string(blockRange.EndKey))
+		}
+		if last && !bytes.Equal(blockRange.EndKey, metadata.LastKey) {
+			t.Fatal("expected the last range to end at the last key, got", string(blockRange.EndKey))
+		}
+
+		// every row of the block is within its range
+		rows, err := r.ReadBlockWithStat(blockRange.Stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			cmp := bytes.Compare(row.Key, blockRange.EndKey)
+			if bytes.Compare(row.Key, blockRange.Stat.FirstKey) < 0 || cmp > 0 || (cmp == 0 && !last) {
+				t.Fatal("row", string(row.Key), "outside of range", i)
+			}
+		}
+	}
+}
+
+func TestReadCompressionLZ4(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.LZ4Compression = true
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 5_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.LZ4Compression || metadata.ZSTDCompression {
+		t.Fatal("expected lz4 compression in the metadata")
+	}
+	var originalSize, compressedSize uint64
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if stat.CompressedSize == 0 || stat.CompressedSize >= stat.OriginalSize || stat.CompressedSize > stat.BlockSize {
+			t.Fatal("unexpected block sizes", stat.CompressedSize, stat.OriginalSize, stat.BlockSize)
+		}
+		originalSize += stat.OriginalSize
+		compressedSize += stat.CompressedSize
+		return true
+	})
+	t.Log("lz4 compressed", originalSize, "to", compressedSize)
+	if compressedSize > originalSize/2 {
+		t.Fatal("expected the rows to compress, got", compressedSize, "from", originalSize)
+	}
+
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(row.Key) != fmt.Sprintf("key%08d", count) || string(row.Value) != fmt.Sprintf("value%08d", count) {
+			t.Fatal("unexpected row", string(row.Key), string(row.Value), "at", count)
+		}
+		count++
+	}
+	if count != 5_000 {
+		t.Fatal("unexpected row count", count)
+	}
+
+	row, err := r.GetRow([]byte("key00001234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(row.Value) != "value00001234" {
+		t.Fatal("unexpected value", string(row.Value))
+	}
+}
+
+func TestBloomFilterZSTDCompression(t *testing.T) {
+	writeSegment := func(blocked, compress bool) ([]byte, uint64) {
+		b := &bytes.Buffer{}
+		writerOpts := DefaultSegmentWriterOptions()
+		if blocked {
+			writerOpts.BloomFilter = nil
+			writerOpts.BlockedBloomFilter = NewBlockedBloomFilterWithEstimates(100_000, DefaultBloomFilterFalsePositiveRate)
+		}
+		writerOpts.BloomFilterZSTDCompression = compress
+		w := NewSegmentWriter(BytesWriteCloser{b}, writerOpts)
+		for i := 0; i < 500; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes(), length
+	}
+
+	for _, blocked := range []bool{false, true} {
+		uncompressedBytes, uncompressedLength := writeSegment(blocked, false)
+		compressedBytes, compressedLength := writeSegment(blocked, true)
+		if compressedLength >= uncompressedLength {
+			t.Fatal("expected the compressed bloom filter segment to be smaller, got", compressedLength, "vs", uncompressedLength, "for blocked", blocked)
+		}
+
+		uncompressedReader := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(uncompressedBytes)}, int(uncompressedLength))
+		uncompressed, err := uncompressedReader.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// without metadata, eager, and lazy
+		for _, lazy := range []bool{false, true} {
+			readerOpts := DefaultSegmentReaderOptions()
+			readerOpts.LazyBloomFilter = lazy
+			r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(compressedBytes)}, int(compressedLength), readerOpts)
+			if blocked {
+				metadata, err := r.FetchAndLoadMetadata()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !metadata.BlockedBloomFilter.Equal(uncompressed.BlockedBloomFilter) {
+					t.Fatal("expected an equivalent blocked bloom filter for lazy", lazy)
+				}
+				continue
+			}
+
+			filter, err := r.ReadBloomFilter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !filter.Equal(uncompressed.BloomFilter) {
+				t.Fatal("expected ReadBloomFilter to decompress to an equivalent filter for lazy", lazy)
+			}
+
+			_, err = r.FetchAndLoadMetadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter, err = r.ReadBloomFilter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !filter.Equal(uncompressed.BloomFilter) {
+				t.Fatal("expected the metadata to decompress to an equivalent filter for lazy", lazy)
+			}
+			_, err = r.GetRow([]byte("key00000001"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestMayContain(t *testing.T) {
+	for _, withBloomFilter := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		writerOpts := DefaultSegmentWriterOptions()
+		if !withBloomFilter {
+			writerOpts.BloomFilter = nil
+		}
+		w := NewSegmentWriter(BytesWriteCloser{b}, writerOpts)
+		for i := 0; i < 1_000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		for i := 0; i < 1_000; i++ {
+			if r.MayContain([]byte(fmt.Sprintf("key%08d", i))) {
+				t.Fatal("expected written key", i, "to not be excluded for withBloomFilter", withBloomFilter)
+			}
+		}
+
+		excluded := 0
+		for i := 1_000; i < 2_000; i++ {
+			if r.MayContain([]byte(fmt.Sprintf("key%08d", i))) {
+				excluded++
+			}
+		}
+		if withBloomFilter && excluded < 990 {
+			t.Fatal("expected the bloom filter to exclude missing keys, excluded", excluded)
+		}
+		if !withBloomFilter && excluded != 0 {
+			t.Fatal("expected unknown for every key without a bloom filter, excluded", excluded)
+		}
+	}
+
+	// unreadable segments are unknown
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader([]byte("not a segment"))}, 13)
+	if r.MayContain([]byte("key")) {
+		t.Fatal("expected unknown for an unreadable segment")
+	}
+}
+
+func TestFilterKeys(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 2_000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%08d", i)))
+	}
+
+	for _, withBloomFilter := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		writerOpts := DefaultSegmentWriterOptions()
+		if !withBloomFilter {
+			writerOpts.BloomFilter = nil
+		}
+		w := NewSegmentWriter(BytesWriteCloser{b}, writerOpts)
+		// only the even keys are present
+		for i := 0; i < len(keys); i += 2 {
+			err := w.WriteRow(keys[i], []byte("value"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		filtered := r.FilterKeys(keys)
+		if !withBloomFilter {
+			if len(filtered) != len(keys) {
+				t.Fatal("expected every key without a bloom filter, got", len(filtered))
+			}
+			continue
+		}
+
+		present := 0
+		for i, key := range filtered {
+			if i > 0 && bytes.Compare(filtered[i-1], key) >= 0 {
+				t.Fatal("expected the keys to stay in order")
+			}
+			var n int
+			_, err := fmt.Sscanf(string(key), "key%08d", &n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n%2 == 0 {
+				present++
+			}
+		}
+		if present != len(keys)/2 {
+			t.Fatal("expected every present key to be retained, got", present)
+		}
+		if len(filtered)-present > 10 {
+			t.Fatal("expected the bloom filter to filter out absent keys, retained", len(filtered)-present)
+		}
+	}
+
+	// unreadable segments keep every key
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader([]byte("not a segment"))}, 13)
+	if len(r.FilterKeys(keys)) != len(keys) {
+		t.Fatal("expected every key for an unreadable segment")
+	}
+}
+
+func TestReadBlockRaw(t *testing.T) {
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := metadata.BlockIndex.Min()
+	last, _ := metadata.BlockIndex.Max()
+	for _, stat := range []BlockStat{first, last} {
+		raw, err := r.ReadBlockRaw(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := r.ReadBlockWithStat(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) != len(rows) || len(raw) == 0 {
+			t.Fatal("expected", len(rows), "rows, got", len(raw))
+		}
+		for i := range rows {
+			if !bytes.Equal(raw[i].Key, rows[i].Key) || !bytes.Equal(raw[i].Value, rows[i].Value) {
+				t.Fatal("unexpected row", i, string(raw[i].Key))
+			}
+			if i > 0 && bytes.Compare(raw[i-1].Key, raw[i].Key) >= 0 {
+				t.Fatal("expected the stored order of a normal block to be ascending at row", i)
+			}
+		}
+	}
+
+	// a misordered block, copied verbatim with WriteRawBlock
+	var block []byte
+	keys := []string{"key2", "key1", "key3"}
+	for _, key := range keys {
+		block = binary.LittleEndian.AppendUint16(block, uint16(len(key)))
+		block = binary.LittleEndian.AppendUint32(block, uint32(len("value")))
+		block = append(append(block, key...), "value"...)
+	}
+	stat := BlockStat{
+		FirstKey:     []byte("key2"),
+		BlockSize:    uint64(len(block)),
+		OriginalSize: uint64(len(block)),
+		Hash:         xxhash.Sum64(block),
+	}
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	err = w.WriteRawBlock(&SegmentMetadata{Tombstones: true}, stat, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, _, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err = r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = metadata.BlockIndex.Min()
+	_, err = r.ReadBlockWithStat(stat)
+	if !errors.Is(err, ErrUnsortedRows) {
+		t.Fatal("expected ErrUnsortedRows, got", err)
+	}
+	raw, err := r.ReadBlockRaw(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != len(keys) {
+		t.Fatal("expected", len(keys), "rows, got", len(raw))
+	}
+	for i, key := range keys {
+		if string(raw[i].Key) != key {
+			t.Fatal("expected the stored order", keys, "got", string(raw[i].Key), "at row", i)
+		}
+	}
+}
+
+func TestDecompressorUnavailable(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.ZSTDCompressionLevel = 1
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 1_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := metadata.BlockIndex.Min()
+
+	// simulate failing to create the decoder
+	decoder, originalNewZSTDDecoder := zstdDecoder.Swap(nil), newZSTDDecoder
+	newZSTDDecoder = func() (*zstd.Decoder, error) {
+		return nil, errors.New("out of memory")
+	}
+	_, err = r.ReadBlockWithStat(stat)
+	newZSTDDecoder = originalNewZSTDDecoder
+	zstdDecoder.Store(decoder)
+	if !errors.Is(err, ErrDecompressorUnavailable) || errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrDecompressorUnavailable, got", err)
+	}
+
+	// the read can be retried
+	rows, err := r.ReadBlockWithStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Fatal("expected rows")
+	}
+
+	// corrupt the compressed block, skipping the hash verification to reach the decoder
+	segment := bytes.Clone(b.Bytes())
+	for i := stat.Offset + 4; i < stat.Offset+stat.CompressedSize; i++ {
+		segment[i] ^= 0xff
+	}
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, int(length))
+	_, err = r.ReadBlockRaw(stat)
+	if !errors.Is(err, ErrCorruptCompressedData) || !errors.Is(err, ErrCorrupt) || errors.Is(err, ErrDecompressorUnavailable) {
+		t.Fatal("expected ErrCorruptCompressedData, got", err)
+	}
+}
+
+func TestMetadataSegmentReader(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := NewSegmentWriter(BytesWriteCloser{b}, DefaultSegmentWriterOptions())
+	for i := 0; i < 1_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, metaBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	expectedRanges, err := full.BlockRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewMetadataSegmentReader(metaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// planning works from the metadata
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(metadata.FirstKey) != "key00000000" || string(metadata.LastKey) != "key00000999" || metadata.RowCount != 1_000 {
+		t.Fatal("unexpected metadata", string(metadata.FirstKey), string(metadata.LastKey), metadata.RowCount)
+	}
+	ranges, err := r.BlockRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != len(expectedRanges) || ranges[0].Stat.Offset != expectedRanges[0].Stat.Offset || !bytes.Equal(ranges[len(ranges)-1].EndKey, expectedRanges[len(expectedRanges)-1].EndKey) {
+		t.Fatal("unexpected block ranges", ranges)
+	}
+	if r.MayContain([]byte("key00000123")) {
+		t.Fatal("expected a written key to not be excluded")
+	}
+	if !r.MayContain([]byte("missing")) {
+		t.Fatal("expected the bloom filter to exclude a missing key")
+	}
+
+	// reading data errors
+	_, err = r.GetRow([]byte("key00000123"))
+	if !errors.Is(err, ErrNoDataReader) {
+		t.Fatal("expected ErrNoDataReader from GetRow, got", err)
+	}
+	_, err = r.RowIter(DirectionAscending)
+	if !errors.Is(err, ErrNoDataReader) {
+		t.Fatal("expected ErrNoDataReader from RowIter, got", err)
+	}
+	_, err = r.ReadRawBlock(ranges[0].Stat)
+	if !errors.Is(err, ErrNoDataReader) {
+		t.Fatal("expected ErrNoDataReader from ReadRawBlock, got", err)
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewMetadataSegmentReader([]byte("not a meta block"))
+	if !errors.Is(err, ErrInvalidMetaBlock) {
+		t.Fatal("expected ErrInvalidMetaBlock, got", err)
+	}
+}
+
+func TestPartitionedBlockIndex(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BlockIndexPartitionEntries = 4
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 2_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := metadata.BlockIndex.Len()
+	if metadata.IndexPartitions == nil || metadata.IndexPartitions.Len() != (blocks+3)/4 || blocks <= 4 {
+		t.Fatal("expected the block index to be partitioned, got blocks", blocks)
+	}
+	if metadata.RowCount != 2_000 {
+		t.Fatal("expected the row count totalled from the partitions, got", metadata.RowCount)
+	}
+
+	// lazily loaded partitions
+	lazy := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length), SegmentReaderOptions{LazyBlockIndex: true})
+	lazyMetadata, err := lazy.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lazyMetadata.BlockIndex.Len() != 0 || lazyMetadata.RowCount != 2_000 {
+		t.Fatal("expected no blocks loaded with the metadata, got", lazyMetadata.BlockIndex.Len(), lazyMetadata.RowCount)
+	}
+	row, err := lazy.GetRow([]byte("key00001000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(row.Value) != "value00001000" {
+		t.Fatal("unexpected value", string(row.Value))
+	}
+	if lazyMetadata.BlockIndex.Len() != 4 {
+		t.Fatal("expected only the partition holding the key to be loaded, got blocks", lazyMetadata.BlockIndex.Len())
+	}
+	_, err = lazy.GetRow([]byte("a"))
+	if !errors.Is(err, ErrNoRows) {
+		t.Fatal("expected ErrNoRows before the first block, got", err)
+	}
+
+	// readers sharing the metadata load partitions concurrently
+	sharedReader := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length), SegmentReaderOptions{LazyBlockIndex: true})
+	shared, err := sharedReader.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			reader := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+			reader.LoadCachedMetadata(shared)
+			for i := g; i < 2_000; i += 8 {
+				row, err := reader.GetRow([]byte(fmt.Sprintf("key%08d", i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(row.Value) != fmt.Sprintf("value%08d", i) {
+					errs <- fmt.Errorf("unexpected value %s for %d", row.Value, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if shared.BlockIndex.Len() != blocks {
+		t.Fatal("expected every partition to be loaded, got blocks", shared.BlockIndex.Len())
+	}
+
+	// iterators load every partition
+	iter, err := lazy.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			if i != 2_000 {
+				t.Fatal("expected 2000 rows, got", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(row.Key) != fmt.Sprintf("key%08d", i) {
+			t.Fatal("unexpected key", string(row.Key))
+		}
+	}
+	if lazyMetadata.BlockIndex.Len() != blocks {
+		t.Fatal("expected every partition to be loaded, got blocks", lazyMetadata.BlockIndex.Len())
+	}
+
+	// copies include the partitions
+	copied := &bytes.Buffer{}
+	_, err = CopySegment(&r, copied, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied.Bytes(), b.Bytes()) {
+		t.Fatal("expected a byte identical copy")
+	}
+
+	// a corrupt partition is detected when loaded
+	corrupt := bytes.Clone(b.Bytes())
+	partition, _ := metadata.IndexPartitions.Min()
+	corrupt[partition.Offset+10] ^= 0xff
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(corrupt)}, int(length))
+	_, err = r.FetchAndLoadMetadata()
+	if !errors.Is(err, ErrMismatchedBlockHash) {
+		t.Fatal("expected ErrMismatchedBlockHash, got", err)
+	}
+}
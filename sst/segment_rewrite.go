@@ -0,0 +1,28 @@
+package sst
+
+import (
+	"fmt"
+	"io"
+)
+
+// RewriteSegment writes the rows of the segment to out with new options, such as to change the compression, block
+// size, or bloom filter sizing of existing data, returning the results of SegmentWriter.Close.
+//
+// This is a single input MergeSegments, so tombstones are kept, and row sequence numbers are kept if
+// newOpts.RowSequence is enabled. The creation time of the segment is kept if newOpts.CreatedAt is zero.
+func RewriteSegment(r *SegmentReader, out io.Writer, newOpts SegmentWriterOptions) (uint64, []byte, error) {
+	if newOpts.CreatedAt.IsZero() {
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
+		}
+		newOpts.CreatedAt = metadata.CreatedAt
+	}
+
+	length, metaBytes, err := MergeSegments([]*SegmentReader{r}, out, newOpts)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in MergeSegments: %w", err)
+	}
+
+	return length, metaBytes, nil
+}
@@ -0,0 +1,90 @@
+package sst
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRewriteSegment(t *testing.T) {
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	input := readAllRows(t, buf.Bytes())
+
+	zstdOpts := DefaultSegmentWriterOptions()
+	zstdOpts.ZSTDCompressionLevel = 1
+	largeBlockOpts := DefaultSegmentWriterOptions()
+	largeBlockOpts.DataBlockThresholdBytes = 14_336
+	largeBlockOpts.DataBlockSize = 16_384
+	noBloomOpts := DefaultSegmentWriterOptions()
+	noBloomOpts.BloomFilter = nil
+
+	for name, opts := range map[string]SegmentWriterOptions{
+		"zstd":        zstdOpts,
+		"large block": largeBlockOpts,
+		"no bloom":    noBloomOpts,
+	} {
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+		out := &bytes.Buffer{}
+		outLength, _, err := RewriteSegment(&r, out, opts)
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if int(outLength) != out.Len() {
+			t.Fatal("expected length", out.Len(), "got", outLength, "for", name)
+		}
+
+		rewritten := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(out.Bytes())}, out.Len())
+		metadata, err := rewritten.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err, "for", name)
+		}
+		if metadata.ZSTDCompression != (opts.ZSTDCompressionLevel > 0) {
+			t.Fatal("unexpected compression for", name)
+		}
+		if (metadata.BloomFilter != nil) != (opts.BloomFilter != nil) {
+			t.Fatal("unexpected bloom filter for", name)
+		}
+		first, _ := metadata.BlockIndex.Min()
+		if first.BlockSize%opts.DataBlockSize != 0 {
+			t.Fatal("expected blocks padded to", opts.DataBlockSize, "got", first.BlockSize, "for", name)
+		}
+
+		rows := readAllRows(t, out.Bytes())
+		if len(rows) != len(input) {
+			t.Fatal("expected", len(input), "rows, got", len(rows), "for", name)
+		}
+		for i := range input {
+			if !bytes.Equal(rows[i].Key, input[i].Key) || !bytes.Equal(rows[i].Value, input[i].Value) {
+				t.Fatal("mismatched row", i, string(rows[i].Key), string(input[i].Key), "for", name)
+			}
+		}
+	}
+}
+
+func TestRewriteSegmentRoundTrip(t *testing.T) {
+	// uncompressed -> zstd -> uncompressed is byte-identical
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	zstdOpts := DefaultSegmentWriterOptions()
+	zstdOpts.BloomFilter = nil
+	zstdOpts.ZSTDCompressionLevel = 1
+	compressed := &bytes.Buffer{}
+	_, _, err := RewriteSegment(&r, compressed, zstdOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= buf.Len() {
+		t.Fatal("expected the compressed segment to be smaller, got", compressed.Len(), "from", buf.Len())
+	}
+
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(compressed.Bytes())}, compressed.Len())
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	uncompressed := &bytes.Buffer{}
+	_, _, err = RewriteSegment(&r, uncompressed, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uncompressed.Bytes(), buf.Bytes()) {
+		t.Fatal("expected the round trip to be byte-identical")
+	}
+}
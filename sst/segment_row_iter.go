@@ -16,6 +16,21 @@ type (
 		s           *SegmentReader
 		direction   int
 		initialized bool
+		// lastKey is the key of the last row returned by Next, see Position
+		lastKey []byte
+		// scratch is reused for decoding blocks if not nil, see ReuseBlockMemory
+		scratch *blockScratch
+		// batch is reused for NextBatch along with scratch
+		batch []KVPair
+		// keysOnly skips decompressing values, see KeysOnly
+		keysOnly bool
+		// verifyBlockHashes checks each block against its hash as it is loaded, see VerifyBlockHashes
+		verifyBlockHashes bool
+		// nextStat is set by visitNextBlock, kept on the iter (along with the visitNext method value) so finding
+		// the next block doesn't allocate
+		nextStat  BlockStat
+		foundNext bool
+		visitNext func(item BlockStat) bool
 	}
 )
 
@@ -24,7 +39,12 @@ const (
 	DirectionDescending
 )
 
-var ErrClosed = errors.New("closed")
+var (
+	ErrClosed           = errors.New("closed")
+	ErrNoPosition       = errors.New("no position, Next has not returned a row since the last seek")
+	ErrInvalidPosition  = errors.New("invalid position")
+	ErrInvalidBatchSize = errors.New("batch size must be positive")
+)
 
 // Next returns io.EOF when there are no more rows. Can safely call Next after an io.EOF error, as that will be
 // cached in the RowIter instance, so there is zero cost to blindly calling it (e.g. cursor logic in SnapshotReader).
@@ -38,51 +58,34 @@ func (r *RowIter) Next() (KVPair, error) {
 		// return the row if we have them, and have not reached the end
 		pair := r.blockRows[r.blockRowIdx]
 		r.blockRowIdx++
+		r.lastKey = pair.Key
 		return pair, nil
 	}
 	// otherwise we need to load the next block's rows
-	var stat *BlockStat
+	if r.visitNext == nil {
+		r.visitNext = r.visitNextBlock
+	}
+	r.foundNext = false
 	if r.direction == DirectionDescending {
 		// special check to make sure this is a new iter and not a Seek(UnboundStart) while DirectionDescending
 		if r.statLastKey == nil && r.blockRowIdx > -1 {
 			// we grab the top key
 			r.statLastKey = r.s.metadata.LastKey
 		}
-		r.s.metadata.BlockIndex.DescendLessOrEqual(BlockStat{FirstKey: r.statLastKey}, func(item BlockStat) bool {
-			if bytes.Equal(r.statLastKey, item.FirstKey) {
-				// keep going, this is the same key
-				return true
-			}
-
-			// Otherwise we take it and exit (next stat)
-			r.statLastKey = item.FirstKey
-			stat = &item
-			return false
-		})
+		r.s.metadata.BlockIndex.DescendLessOrEqual(BlockStat{FirstKey: r.statLastKey}, r.visitNext)
 	} else {
 		// ascending by default
-		r.s.metadata.BlockIndex.AscendGreaterOrEqual(BlockStat{FirstKey: r.statLastKey}, func(item BlockStat) bool {
-			if bytes.Equal(r.statLastKey, item.FirstKey) {
-				// keep going, this is the same key
-				return true
-			}
-
-			// Otherwise we take it and exit (next stat)
-			r.statLastKey = item.FirstKey
-			stat = &item
-			return false
-		})
-
+		r.s.metadata.BlockIndex.AscendGreaterOrEqual(BlockStat{FirstKey: r.statLastKey}, r.visitNext)
 	}
 
-	if stat == nil {
+	if !r.foundNext {
 		// there are no more blocks
 		return KVPair{}, io.EOF
 	}
 
-	rows, err := r.s.ReadBlockWithStat(*stat)
+	rows, err := r.s.readBlock(r.nextStat, r.scratch, !r.keysOnly, r.verifyBlockHashes)
 	if err != nil {
-		return KVPair{}, fmt.Errorf("error in SegmentReader.ReadBlockWithStat: %w", err)
+		return KVPair{}, fmt.Errorf("error in SegmentReader.readBlock: %w", err)
 	}
 
 	r.blockRows = rows
@@ -92,14 +95,81 @@ func (r *RowIter) Next() (KVPair, error) {
 	}
 
 	r.blockRowIdx = 1
+	r.lastKey = r.blockRows[0].Key
 	return r.blockRows[0], nil
 }
 
+// NextBatch returns up to max rows in one call, continuing into subsequent blocks as needed, for scans that process
+// rows in chunks. Returns io.EOF when there are no more rows, and any rows read before an error along with it.
+//
+// With ReuseBlockMemory, a batch stops at the end of a block (as loading the next block would overwrite the rows
+// of the batch), and the batch itself is reused, so it is only valid until the next call to NextBatch.
+func (r *RowIter) NextBatch(max int) ([]KVPair, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidBatchSize, max)
+	}
+	if r.s.closed {
+		return nil, ErrClosed
+	}
+
+	var batch []KVPair
+	if r.scratch != nil {
+		batch = r.batch[:0]
+	}
+	for len(batch) < max {
+		if r.blockRows != nil && r.blockRowIdx < len(r.blockRows) && r.blockRowIdx >= 0 {
+			// take as many rows of the current block as we can
+			n := min(max-len(batch), len(r.blockRows)-r.blockRowIdx)
+			batch = append(batch, r.blockRows[r.blockRowIdx:r.blockRowIdx+n]...)
+			r.blockRowIdx += n
+			r.lastKey = batch[len(batch)-1].Key
+			continue
+		}
+		if r.scratch != nil && len(batch) > 0 {
+			break
+		}
+
+		// load the next block
+		row, err := r.Next()
+		if errors.Is(err, io.EOF) && len(batch) > 0 {
+			break
+		}
+		if err != nil {
+			return batch, err
+		}
+		batch = append(batch, row)
+	}
+
+	if r.scratch != nil {
+		r.batch = batch
+	}
+	return batch, nil
+}
+
+// visitNextBlock finds the next block stat after statLastKey in the direction of iteration
+func (r *RowIter) visitNextBlock(item BlockStat) bool {
+	if bytes.Equal(r.statLastKey, item.FirstKey) {
+		// keep going, this is the same key
+		return true
+	}
+
+	// Otherwise we take it and exit (next stat)
+	r.statLastKey = item.FirstKey
+	r.nextStat = item
+	r.foundNext = true
+	return false
+}
+
 // Seek will seek up to the given key, such that any subsequent Next
 // call will return greater than or equal to key (or io.EOF).
 //
 // Can use UnboundStart and UnboundEnd to seek to the start and end
 func (r *RowIter) Seek(key []byte) error {
+	// rows read while seeking were not returned
+	defer func() {
+		r.lastKey = nil
+	}()
+
 	// find the last block first key before this
 	var stat *BlockStat
 	isUnboundStart := bytes.Equal(key, UnboundStart)
@@ -111,9 +181,11 @@ func (r *RowIter) Seek(key []byte) error {
 		last, _ := r.s.metadata.BlockIndex.Max()
 		stat = &last
 	} else {
+		// the block the key would be in, going further back when the key is a block first key would read an
+		// extra block (and skip the key when descending)
 		r.s.metadata.BlockIndex.DescendLessOrEqual(BlockStat{FirstKey: key}, func(item BlockStat) bool {
 			stat = &item
-			return bytes.Compare(key, item.FirstKey) <= 0
+			return false
 		})
 	}
 
@@ -138,21 +210,10 @@ func (r *RowIter) Seek(key []byte) error {
 			}
 
 		case DirectionDescending:
-			// check if we are greater than the last key
-			lastBlock, _ := r.s.metadata.BlockIndex.Max()
-			rows, err = r.s.ReadBlockWithStat(lastBlock)
-			if err != nil {
-				return fmt.Errorf("error in ReadBlockWithState to inspect end of last block: %w", err)
-			}
-			if bytes.Compare(key, rows[len(rows)-1].Key) > 0 {
-				// We are at the beginning, set to end
-				stat = &lastBlock
-			} else {
-				// We are past the entire segment, go to the end
-				firstBlock, _ := r.s.metadata.BlockIndex.Min()
-				stat = &firstBlock
-				r.blockRowIdx = len(rows) - 1
-			}
+			// We are before the entire segment, so there is nothing to descend to. Go to the first block without
+			// reading the last block, so the iterator is exhausted below.
+			firstBlock, _ := r.s.metadata.BlockIndex.Min()
+			stat = &firstBlock
 		}
 	} else {
 		r.blockRowIdx = 0
@@ -162,9 +223,9 @@ func (r *RowIter) Seek(key []byte) error {
 	r.statLastKey = stat.FirstKey
 
 	// clear out the loaded block (this could be more efficient)
-	rows, err = r.s.ReadBlockWithStat(*stat)
+	rows, err = r.s.readBlock(*stat, r.scratch, !r.keysOnly, r.verifyBlockHashes)
 	if err != nil {
-		fmt.Errorf("error in SegmentReader.ReadBlockWithStat: %w", err)
+		return fmt.Errorf("error in SegmentReader.readBlock: %w", err)
 	}
 	r.blockRows = rows
 	if r.direction == DirectionDescending {
@@ -173,6 +234,9 @@ func (r *RowIter) Seek(key []byte) error {
 
 	if (r.direction == DirectionAscending && isUnboundEnd) || (r.direction == DirectionDescending && isUnboundStart) {
 		r.blockRowIdx = len(rows)
+	} else if r.direction == DirectionDescending && isUnboundEnd {
+		// start from the top, as keys can sort after the UnboundEnd sentinel (e.g. 0xff01)
+		r.blockRowIdx = 0
 	} else {
 		// Call .Next() until we hit the key or go past it
 		for {
@@ -206,6 +270,81 @@ func (r *RowIter) Seek(key []byte) error {
 	return nil
 }
 
+// Position returns a resume token for the last row returned by Next, which can be persisted and passed to Resume
+// to continue the scan (e.g. after a restart) without gaps or repeats. Returns ErrNoPosition if no row has been
+// returned since the iterator was created or seeked.
+func (r *RowIter) Position() ([]byte, error) {
+	if r.lastKey == nil {
+		return nil, ErrNoPosition
+	}
+
+	// direction byte followed by the key
+	token := make([]byte, 1+len(r.lastKey))
+	token[0] = byte(r.direction)
+	copy(token[1:], r.lastKey)
+	return token, nil
+}
+
+// Resume seeks strictly past the row of a token from Position, such that any subsequent Next call will return the
+// row after it (or io.EOF). The token must be from an iterator with the same direction.
+func (r *RowIter) Resume(token []byte) error {
+	if len(token) < 2 {
+		return fmt.Errorf("%w: token too short", ErrInvalidPosition)
+	}
+	if int(token[0]) != r.direction {
+		return fmt.Errorf("%w: token direction %d does not match iterator direction %d", ErrInvalidPosition, token[0], r.direction)
+	}
+
+	return r.SeekPast(token[1:])
+}
+
+// SeekPast is like Seek, but skips the key itself if it exists, so any subsequent Next call will return strictly
+// greater than key when DirectionAscending, or strictly less than key when DirectionDescending (or io.EOF).
+func (r *RowIter) SeekPast(key []byte) error {
+	err := r.Seek(key)
+	if err != nil {
+		return fmt.Errorf("error in Seek: %w", err)
+	}
+
+	row, err := r.Next()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error in Next: %w", err)
+	}
+	if !bytes.Equal(row.Key, key) {
+		// not the key, so it still needs to be returned
+		r.blockRowIdx--
+	}
+	r.lastKey = nil
+
+	return nil
+}
+
+// ReuseBlockMemory makes the RowIter decode every block into the same memory, so iterating a segment doesn't
+// allocate per block.
+//
+// Rows returned by Next, including their Key and Value, are only valid until the next call to Next that loads a
+// new block (or a Seek), so they must be copied to be kept.
+func (r *RowIter) ReuseBlockMemory() {
+	r.scratch = &blockScratch{}
+}
+
+// KeysOnly makes the RowIter skip decompressing individually compressed values (see
+// SegmentWriterOptions.ValueCompressionThreshold), for when only the keys are needed, such as counting. Values are
+// returned as stored, so they are only meaningful for KVPair.IsTombstone.
+func (r *RowIter) KeysOnly() {
+	r.keysOnly = true
+}
+
+// VerifyBlockHashes makes the RowIter check each block against BlockStat.Hash as it is loaded, such as to scrub a
+// segment while scanning it for a backup. A mismatch is returned from Next (or Seek) as ErrMismatchedBlockHash,
+// identifying the block.
+func (r *RowIter) VerifyBlockHashes() {
+	r.verifyBlockHashes = true
+}
+
 // CloseReader proxies to SegmentReader.Close
 func (r *RowIter) CloseReader() error {
 	return r.s.Close()
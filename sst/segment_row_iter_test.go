@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -448,3 +450,468 @@ func TestRollover(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRowIterResume(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			b,
+		}, opts)
+
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		err := w.WriteRow([]byte(key), []byte(fmt.Sprintf("value%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	segmentLen, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newIter := func(direction int) *RowIter {
+		r := NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		}, int(segmentLen))
+		iter, err := r.RowIter(direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return iter
+	}
+
+	for _, direction := range []int{DirectionAscending, DirectionDescending} {
+		expected := slices.Clone(keys)
+		if direction == DirectionDescending {
+			slices.Reverse(expected)
+		}
+
+		// checkpoint mid-block, at block boundaries (163 rows per block, 22 in the last), and at the last row
+		for _, checkpoint := range []int{1, 21, 22, 23, 100, 162, 163, 164, 999, 1000} {
+			iter := newIter(direction)
+			_, err := iter.Position()
+			if !errors.Is(err, ErrNoPosition) {
+				t.Fatal("expected no position, got", err)
+			}
+
+			var got []string
+			for i := 0; i < checkpoint; i++ {
+				row, err := iter.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(row.Key))
+			}
+			token, err := iter.Position()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// resume in a new iterator, as if after a restart
+			resumed := newIter(direction)
+			err = resumed.Resume(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				row, err := resumed.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(row.Key))
+			}
+
+			if !slices.Equal(got, expected) {
+				t.Fatal("gaps or repeats resuming at", checkpoint, "direction", direction, "got", len(got), "rows")
+			}
+		}
+	}
+
+	token, err := newIter(DirectionAscending).Position()
+	if !errors.Is(err, ErrNoPosition) {
+		t.Fatal("expected no position, got", err, token)
+	}
+	ascIter := newIter(DirectionAscending)
+	_, err = ascIter.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = ascIter.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newIter(DirectionDescending).Resume(token)
+	if !errors.Is(err, ErrInvalidPosition) {
+		t.Fatal("expected invalid position for mismatched direction, got", err)
+	}
+}
+
+// writeLargeSegment writes a segment with many blocks for iteration tests and benchmarks
+func writeLargeSegment(tb testing.TB, rows int, zstdLevel int) (*bytes.Buffer, uint64) {
+	buf := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.ZSTDCompressionLevel = zstdLevel
+	w := NewSegmentWriter(BytesWriteCloser{buf}, opts)
+	for i := 0; i < rows; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf, length
+}
+
+func TestRowIterReuseBlockMemory(t *testing.T) {
+	for _, zstdLevel := range []int{0, 1} {
+		buf, length := writeLargeSegment(t, 20_000, zstdLevel)
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, direction := range []int{DirectionAscending, DirectionDescending} {
+			iter, err := r.RowIter(direction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter.ReuseBlockMemory()
+			count := 0
+			for {
+				row, err := iter.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				i := count
+				if direction == DirectionDescending {
+					i = 20_000 - 1 - count
+				}
+				if string(row.Key) != fmt.Sprintf("key%08d", i) || string(row.Value) != fmt.Sprintf("value%08d", i) {
+					t.Fatal("unexpected row", string(row.Key), string(row.Value), "at", count)
+				}
+				count++
+			}
+			if count != 20_000 {
+				t.Fatal("unexpected row count", count)
+			}
+		}
+
+		// after the first block, iterating doesn't allocate per block
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter.ReuseBlockMemory()
+		_, err = iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		allocs := testing.AllocsPerRun(1, func() {
+			for {
+				_, err := iter.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		t.Log("zstd level", zstdLevel, "blocks", metadata.BlockIndex.Len(), "allocs", allocs)
+		if allocs > 4 {
+			t.Fatal("too many allocations", allocs, "for", metadata.BlockIndex.Len(), "blocks")
+		}
+	}
+}
+
+func BenchmarkRowIter(b *testing.B) {
+	buf, length := writeLargeSegment(b, 100_000, 0)
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse-%t", reuse), func(b *testing.B) {
+			r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+			_, err := r.FetchAndLoadMetadata()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				iter, err := r.RowIter(DirectionAscending)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if reuse {
+					iter.ReuseBlockMemory()
+				}
+				for {
+					_, err := iter.Next()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRowIterNextBatch(t *testing.T) {
+	buf, length := writeLargeSegment(t, 5_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var maxBlockRows uint64
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		maxBlockRows = max(maxBlockRows, stat.RowCount)
+		return true
+	})
+
+	for _, direction := range []int{DirectionAscending, DirectionDescending} {
+		iter, err := r.RowIter(direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []KVPair
+		for {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, row)
+		}
+
+		for _, reuse := range []bool{false, true} {
+			for _, max := range []int{1, 7, 1_000, 10_000} {
+				iter, err := r.RowIter(direction)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reuse {
+					iter.ReuseBlockMemory()
+				}
+				var rows []KVPair
+				for {
+					batch, err := iter.NextBatch(max)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(batch) == 0 || len(batch) > max {
+						t.Fatal("unexpected batch size", len(batch), "for max", max)
+					}
+					if reuse && uint64(len(batch)) > maxBlockRows {
+						t.Fatal("expected the batch to stop at the end of the block, got", len(batch))
+					}
+					for _, row := range batch {
+						// copied, as the rows are only valid until the next call with ReuseBlockMemory
+						rows = append(rows, KVPair{Key: bytes.Clone(row.Key), Value: bytes.Clone(row.Value)})
+					}
+				}
+				if len(rows) != len(expected) {
+					t.Fatal("expected", len(expected), "rows, got", len(rows), "for max", max, "reuse", reuse)
+				}
+				for i := range rows {
+					if !bytes.Equal(rows[i].Key, expected[i].Key) || !bytes.Equal(rows[i].Value, expected[i].Value) {
+						t.Fatal("unexpected row", string(rows[i].Key), "at", i, "for max", max, "reuse", reuse)
+					}
+				}
+
+				// EOF is cached
+				_, err = iter.NextBatch(max)
+				if !errors.Is(err, io.EOF) {
+					t.Fatal("expected io.EOF, got", err)
+				}
+			}
+		}
+
+		// mixing Next and NextBatch
+		iter, err = r.RowIter(direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, err := iter.NextBatch(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(row.Key, expected[0].Key) || len(batch) != 3 || !bytes.Equal(batch[0].Key, expected[1].Key) || !bytes.Equal(next.Key, expected[4].Key) {
+			t.Fatal("unexpected rows when mixing Next and NextBatch")
+		}
+	}
+
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = iter.NextBatch(0)
+	if !errors.Is(err, ErrInvalidBatchSize) {
+		t.Fatal("expected ErrInvalidBatchSize, got", err)
+	}
+}
+
+func BenchmarkRowIterNextBatch(b *testing.B) {
+	buf, length := writeLargeSegment(b, 100_000, 0)
+	for _, max := range []int{1, 64, 1024} {
+		b.Run(fmt.Sprintf("max-%d", max), func(b *testing.B) {
+			r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+			_, err := r.FetchAndLoadMetadata()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				iter, err := r.RowIter(DirectionAscending)
+				if err != nil {
+					b.Fatal(err)
+				}
+				iter.ReuseBlockMemory()
+				for {
+					_, err := iter.NextBatch(max)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRowIterCreationAllocs(t *testing.T) {
+	buf, length := writeLargeSegment(t, 20_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the RowIter itself, regardless of the number of blocks
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1 {
+		t.Fatal("expected 1 allocation, got", allocs, "for", metadata.BlockIndex.Len(), "blocks")
+	}
+}
+
+func BenchmarkNewRowIter(b *testing.B) {
+	buf, length := writeLargeSegment(b, 100_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	_, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRowIterVerifyBlockHashes(t *testing.T) {
+	buf, length := writeLargeSegment(t, 20_000, 0)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt a value in the third block, so the block still decodes
+	var stats []BlockStat
+	metadata.BlockIndex.Ascend(func(item BlockStat) bool {
+		stats = append(stats, item)
+		return true
+	})
+	if len(stats) < 4 {
+		t.Fatal("expected at least 4 blocks, got", len(stats))
+	}
+	corrupted := stats[2]
+	segment := bytes.Clone(buf.Bytes())
+	block := segment[corrupted.Offset : corrupted.Offset+corrupted.BlockSize]
+	block[bytes.Index(block, []byte("value"))] = 'V'
+
+	var rowsBefore uint64
+	for _, stat := range stats[:2] {
+		rowsBefore += stat.RowCount
+	}
+
+	for _, verify := range []bool{false, true} {
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, int(length))
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verify {
+			iter.VerifyBlockHashes()
+		}
+
+		var rows uint64
+		for {
+			_, err = iter.Next()
+			if err != nil {
+				break
+			}
+			rows++
+		}
+
+		if !verify {
+			if !errors.Is(err, io.EOF) || rows != 20_000 {
+				t.Fatal("expected to read every row without verification, got", rows, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrMismatchedBlockHash) || !errors.Is(err, ErrCorrupt) {
+			t.Fatal("expected ErrMismatchedBlockHash, got", err)
+		}
+		if rows != rowsBefore {
+			t.Fatal("expected the error at row", rowsBefore, "got", rows)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("offset %d", corrupted.Offset)) {
+			t.Fatal("expected the error to identify the block, got", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidSplitKey is returned by SplitSegment when the split key would leave one side without rows
+var ErrInvalidSplitKey = errors.New("split key must be greater than the first key and less than or equal to the last key")
+
+// nopWriteCloser adapts an io.Writer for a SegmentWriter, leaving closing to the caller
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// SplitSegment splits a segment in two at splitKey, writing the rows less than splitKey to left, and the rows greater
+// than or equal to splitKey to right. splitKey may fall within a block.
+//
+// Both writers are created with opts, but the right writer gets its own copy of opts.BloomFilter (and
+// opts.BlockedBloomFilter), as they can't share one. Row sequence numbers are kept if opts.RowSequence is enabled.
+func SplitSegment(r *SegmentReader, splitKey []byte, left, right io.Writer, opts SegmentWriterOptions) error {
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		return fmt.Errorf("error in FetchAndLoadMetadata: %w", err)
+	}
+	if bytes.Compare(splitKey, metadata.FirstKey) <= 0 || bytes.Compare(splitKey, metadata.LastKey) > 0 {
+		return fmt.Errorf("%w, got %x for segment range [%x, %x]", ErrInvalidSplitKey, splitKey, metadata.FirstKey, metadata.LastKey)
+	}
+
+	rightOpts := opts
+	if opts.BloomFilter != nil {
+		rightOpts.BloomFilter = opts.BloomFilter.Copy()
+	}
+	if opts.BlockedBloomFilter != nil {
+		rightOpts.BlockedBloomFilter = opts.BlockedBloomFilter.Copy()
+	}
+	leftWriter := NewSegmentWriter(nopWriteCloser{left}, opts)
+	rightWriter := NewSegmentWriter(nopWriteCloser{right}, rightOpts)
+
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		return fmt.Errorf("error in RowIter: %w", err)
+	}
+
+	w := &leftWriter
+	for {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error in RowIter.Next: %w", err)
+		}
+
+		if w == &leftWriter && bytes.Compare(row.Key, splitKey) >= 0 {
+			w = &rightWriter
+		}
+
+		err = w.WriteKVPair(row)
+		if err != nil {
+			return fmt.Errorf("error writing row %x: %w", row.Key, err)
+		}
+	}
+
+	_, _, err = leftWriter.Close()
+	if err != nil {
+		return fmt.Errorf("error in Close for left segment: %w", err)
+	}
+	_, _, err = rightWriter.Close()
+	if err != nil {
+		return fmt.Errorf("error in Close for right segment: %w", err)
+	}
+
+	return nil
+}
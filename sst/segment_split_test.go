@@ -0,0 +1,104 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func readAllRows(t *testing.T, b []byte) []KVPair {
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b)}, len(b))
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []KVPair
+	for {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestSplitSegment(t *testing.T) {
+	buf, length := writeLargeSegment(t, 2_000, 0)
+	input := readAllRows(t, buf.Bytes())
+
+	// key00001000 falls within a block, key00000001 leaves only the first row on the left
+	for _, splitKey := range []string{"key00001000", "key00000001", "key00001999", "key00001000a"} {
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+		left, right := &bytes.Buffer{}, &bytes.Buffer{}
+		err := SplitSegment(&r, []byte(splitKey), left, right, DefaultSegmentWriterOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leftRows := readAllRows(t, left.Bytes())
+		rightRows := readAllRows(t, right.Bytes())
+		if bytes.Compare(leftRows[len(leftRows)-1].Key, []byte(splitKey)) >= 0 {
+			t.Fatal("left segment has key", string(leftRows[len(leftRows)-1].Key), "for split key", splitKey)
+		}
+		if bytes.Compare(rightRows[0].Key, []byte(splitKey)) < 0 {
+			t.Fatal("right segment has key", string(rightRows[0].Key), "for split key", splitKey)
+		}
+
+		union := append(leftRows, rightRows...)
+		if len(union) != len(input) {
+			t.Fatal("expected", len(input), "rows, got", len(union), "for split key", splitKey)
+		}
+		for i := range input {
+			if !bytes.Equal(union[i].Key, input[i].Key) || !bytes.Equal(union[i].Value, input[i].Value) {
+				t.Fatal("mismatched row", i, string(union[i].Key), string(input[i].Key))
+			}
+		}
+	}
+}
+
+func TestSplitSegmentRowSequence(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.RowSequence = true
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 0; i < 500; i++ {
+		err := w.WriteRowWithSeq([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)), uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	left, right := &bytes.Buffer{}, &bytes.Buffer{}
+	err = SplitSegment(&r, []byte("key0250"), left, right, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, row := range append(readAllRows(t, left.Bytes()), readAllRows(t, right.Bytes())...) {
+		if row.Seq != uint64(i+1) {
+			t.Fatal("expected seq", i+1, "got", row.Seq, "for", string(row.Key))
+		}
+	}
+}
+
+func TestSplitSegmentInvalidKey(t *testing.T) {
+	buf, length := writeLargeSegment(t, 100, 0)
+	for _, splitKey := range []string{"a", "key00000000", "key00000099a", "z"} {
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+		err := SplitSegment(&r, []byte(splitKey), &bytes.Buffer{}, &bytes.Buffer{}, DefaultSegmentWriterOptions())
+		if !errors.Is(err, ErrInvalidSplitKey) {
+			t.Fatal("expected ErrInvalidSplitKey for", splitKey, "got", err)
+		}
+	}
+}
@@ -20,6 +20,77 @@ var MagicNumberBytes []byte
 
 const MagicNumber = 69696969696969
 
+const (
+	// backgroundBloomFilterBatch is the number of keys sent to the bloom filter goroutine at a time
+	backgroundBloomFilterBatch = 256
+	// backgroundBloomFilterQueue is the number of batches that can be queued before writes wait on the bloom filter
+	backgroundBloomFilterQueue = 64
+)
+
+// row format bits of the meta block, see SEGMENT.md
+const (
+	rowFormatSequence     = 1 << 0
+	rowFormatValueFlags   = 1 << 1
+	rowFormatEpoch        = 1 << 2
+	rowFormatUserMetadata = 1 << 3
+	rowFormatBlockSize    = 1 << 4
+	rowFormatCreatedAt    = 1 << 5
+	rowFormatDictionary   = 1 << 6
+)
+
+// tombstoneValueLength is stored as the value length of a row to mark it as a tombstone, which has no value bytes.
+// Version 1 segments have no marked tombstones, and a row with an empty value is a tombstone.
+const tombstoneValueLength = math.MaxUint32
+
+// zstdDictionaryID is the ID of trained zstd dictionaries. Each segment has its own dictionary, so the ID does not
+// need to be unique.
+const zstdDictionaryID = 1
+
+// block index types of the meta block, see SEGMENT.md
+const (
+	blockIndexTypeSimple      = 0
+	blockIndexTypePartitioned = 1
+)
+
+// bloom filter types of the bloom filter block, see SEGMENT.md
+const (
+	bloomFilterTypeNone   = 0
+	bloomFilterTypeSingle = 1
+	// 2 is reserved for partitioned bloom filters
+	bloomFilterTypeBlocked = 3
+	bloomFilterTypeXor     = 4
+	bloomFilterTypeRibbon  = 5
+
+	// bloomFilterFlagZSTD is set on the bloom filter type when the filter is zstd compressed
+	bloomFilterFlagZSTD = 1 << 7
+)
+
+// segment versions of the trailer, see SEGMENT.md
+const (
+	// segmentVersion1 meta blocks end after a simple block index without row stats, and have no row format, so
+	// rows with an empty value are tombstones
+	segmentVersion1 = 1
+	// segmentVersion2 meta blocks have the row format after the compression format, and rows mark tombstones with
+	// tombstoneValueLength
+	segmentVersion2 = 2
+
+	// currentSegmentVersion is written by the SegmentWriter, and is the layout of meta blocks returned by
+	// SegmentWriter.Close
+	currentSegmentVersion = segmentVersion2
+)
+
+// trailer flags, stored in the high bits of the segment version byte, see SEGMENT.md
+const (
+	trailerFlagMetaBlockZSTD = 1 << 7
+	trailerFlagsMask         = trailerFlagMetaBlockZSTD
+)
+
+// value flags of the row header
+const (
+	valueFlagNone = 0
+	valueFlagZSTD = 1
+)
+
 func init() {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, MagicNumber)
@@ -33,11 +104,20 @@ func (wc BytesWriteCloser) Close() error {
 }
 
 type (
+	// Syncer is implemented by writers that can flush written data to durable storage, such as *os.File
+	Syncer interface {
+		Sync() error
+	}
+
 	SegmentWriter struct {
-		currentRawBlockSize  uint64
-		currentBlockStartKey []byte
-		blockBuffer          *BytesWriteCloser // the buffer for the (un)compressed block
-		blockWriter          io.WriteCloser    // write to the blockBuffer with optional compression
+		currentRawBlockSize        uint64
+		currentBlockStartKey       []byte
+		currentBlockRowCount       uint64
+		currentBlockTombstoneCount uint64
+		currentBlockMinValueLength uint32
+		currentBlockMaxValueLength uint32
+		blockBuffer                *BytesWriteCloser // the buffer for the (un)compressed block
+		blockWriter                io.WriteCloser    // write to the blockBuffer with optional compression
 
 		// writes to actual destination (S3 &/ file)
 		externalWriter io.Writer
@@ -45,11 +125,54 @@ type (
 		currentByteOffset uint64 // where we are in the file currently, used for block index
 		blockIndex        []BlockStat
 		lastKey           []byte
+		// the final raw block written, if it was the last thing written, so the last key can be recovered when needed
+		lastRawBlock *rawBlock
+		// lastKeyFromRawBlock is whether the last write was WriteRawBlock, so the next row is checked against its
+		// last key
+		lastKeyFromRawBlock bool
+		// reused buffer for encoding a row
+		rowBuf []byte
+		// sampledRows are held until there are enough to train the zstd dictionary, see
+		// SegmentWriterOptions.ZSTDDictionarySampleBytes
+		sampledRows       []sampledRow
+		sampledRowBytes   uint64
+		dictionaryTrained bool
+		// zstdDictionary compresses the data blocks if not nil
+		zstdDictionary []byte
+		// indexPartitions are the partitions of the block index written at Close, see
+		// SegmentWriterOptions.BlockIndexPartitionEntries
+		indexPartitions []BlockStat
+		// valueEncoder compresses values, see SegmentWriterOptions.ValueCompressionThreshold
+		valueEncoder *zstd.Encoder
+		// keyFilterHashes are the hashes of the keys to build the filter from at Close, see
+		// SegmentWriterOptions.KeyFilter
+		keyFilterHashes []uint64
+		// keys to add to the bloom filter at Close, see SegmentWriterOptions.BulkMode
+		bulkKeys [][]byte
+		// bloomKeys feeds batches of keys to the bloom filter goroutine, see SegmentWriterOptions.BackgroundBloomFilter
+		bloomKeys chan [][]byte
+		// bloomBatch is the batch of keys not yet sent to bloomKeys
+		bloomBatch [][]byte
+		// bloomDone is closed when the bloom filter goroutine has added every key
+		bloomDone chan struct{}
 
 		options SegmentWriterOptions
+		// optionsErr is returned from writes if the options are invalid, as NewSegmentWriter can't return it
+		optionsErr error
 
 		closed bool
 	}
+
+	rawBlock struct {
+		stat BlockStat
+		raw  []byte
+	}
+
+	sampledRow struct {
+		row                 []byte
+		key                 []byte
+		originalValueLength int
+	}
 )
 
 // NewSegmentWriter creates a new segment writer and opens the file(s) for writing.
@@ -61,54 +184,333 @@ func NewSegmentWriter(writer io.WriteCloser, opts SegmentWriterOptions) SegmentW
 		externalWriter: writer,
 		blockIndex:     []BlockStat{},
 	}
+	sw.options.DataBlockThresholdBytes, sw.optionsErr = opts.dataBlockThreshold()
+	if sw.optionsErr == nil && opts.Codec != nil {
+		sw.optionsErr = validateWriterCodec(opts.Codec)
+	}
 
 	return sw
 }
 
 var (
-	ErrWriterClosed           = errors.New("segment writer already closed")
-	ErrUnexpectedBytesWritten = errors.New("unexpected number of bytes written")
-	ErrKeyTooLarge            = errors.New("key too large, must be <= max uint16 bytes")
-	ErrValueTooLarge          = errors.New("value too large, must be <= max uin32 bytes")
-	ErrNoRowsWritten          = errors.New("no rows were written, can't have an empty segment file")
-	ErrInvalidKey             = errors.New("invalid key")
+	ErrWriterClosed              = errors.New("segment writer already closed")
+	ErrUnexpectedBytesWritten    = errors.New("unexpected number of bytes written")
+	ErrKeyTooLarge               = errors.New("key too large, must be <= max uint16 bytes")
+	ErrValueTooLarge             = errors.New("value too large, must be < max uint32 bytes")
+	ErrNoRowsWritten             = errors.New("no rows were written, can't have an empty segment file")
+	ErrInvalidKey                = errors.New("invalid key")
+	ErrInvalidRawBlock           = errors.New("invalid raw block")
+	ErrRowFormatMismatch         = fmt.Errorf("%w: source row format does not match the writer", ErrInvalidRawBlock)
+	ErrRowSequenceDisabled       = errors.New("row sequence not enabled, see SegmentWriterOptions.RowSequence")
+	ErrInvalidEncodedRow         = errors.New("invalid encoded row")
+	ErrInvalidDataBlockFillRatio = errors.New("data block fill ratio must be > 0 and <= 1")
 )
 
 // WriteRow writes a given row to the segment. Cannot write after the writer is closed.
 //
 // It is expected that rows are written in order.
 func (s *SegmentWriter) WriteRow(key, val []byte) error {
-	if len(key) > math.MaxUint16 {
-		return fmt.Errorf("%w, got length %d", ErrKeyTooLarge, len(key))
+	_, err := s.writeRow(key, val, 0, false)
+	return err
+}
+
+// WriteTombstone writes a row that deletes the key, which is read with KVPair.Tombstone set. Rows with an empty
+// value are not tombstones.
+//
+// It is expected that rows are written in order.
+func (s *SegmentWriter) WriteTombstone(key []byte) error {
+	_, err := s.writeRow(key, nil, 0, true)
+	return err
+}
+
+// WriteKVPair writes the row as a tombstone if KVPair.Tombstone, otherwise with its value, such as for passing
+// through rows read from other segments. The sequence number is stored if SegmentWriterOptions.RowSequence.
+//
+// It is expected that rows are written in order.
+func (s *SegmentWriter) WriteKVPair(row KVPair) error {
+	_, err := s.writeRow(row.Key, row.Value, row.Seq, row.Tombstone)
+	return err
+}
+
+// WriteRowTracked is WriteRow, but returns the stat of the block that was flushed if the write caused a flush (nil
+// otherwise), such as for building a side index while writing. The flushed block includes the row.
+//
+// The final block is flushed at Close, so it will not be returned.
+func (s *SegmentWriter) WriteRowTracked(key, val []byte) (*BlockStat, error) {
+	return s.writeRow(key, val, 0, false)
+}
+
+// WriteRowWithSeq writes a given row to the segment with a sequence number stored in the row header, which is
+// returned as KVPair.Seq when read. Requires SegmentWriterOptions.RowSequence.
+//
+// It is expected that rows are written in order.
+func (s *SegmentWriter) WriteRowWithSeq(key, val []byte, seq uint64) error {
+	if !s.options.RowSequence {
+		return ErrRowSequenceDisabled
+	}
+	_, err := s.writeRow(key, val, seq, false)
+	return err
+}
+
+// WriteEncodedRow writes a row that is already encoded in the data block row format of this writer (see SEGMENT.md),
+// such as rows passed through from another segment during replication, without re-encoding it. The row header must
+// match the row format of this writer's options: a sequence number if SegmentWriterOptions.RowSequence, and value
+// flags if SegmentWriterOptions.ValueCompressionThreshold is set. Tombstones are encoded with a value length of
+// math.MaxUint32 and no value bytes, or with an empty value if SegmentWriterOptions.LegacyTombstoneSource.
+//
+// The key is not copied out of encoded, so like the key passed to WriteRow, encoded must not be modified before
+// Close. It is expected that rows are written in order.
+func (s *SegmentWriter) WriteEncodedRow(encoded []byte) error {
+	headerLen := s.rowHeaderLength()
+	if len(encoded) < headerLen {
+		return fmt.Errorf("%w: encoded row shorter than the %d byte header", ErrInvalidEncodedRow, headerLen)
+	}
+	keyLen := int(binary.LittleEndian.Uint16(encoded[0:2]))
+	valLen := int(binary.LittleEndian.Uint32(encoded[2:6]))
+	if binary.LittleEndian.Uint32(encoded[2:6]) == tombstoneValueLength {
+		valLen = 0
 	}
-	if len(val) > math.MaxUint32 {
-		return fmt.Errorf("%w, got length %d", ErrValueTooLarge, len(val))
+	if len(encoded) != headerLen+keyLen+valLen {
+		return fmt.Errorf("%w: expected %d bytes for key length %d and value length %d, got %d", ErrInvalidEncodedRow, headerLen+keyLen+valLen, keyLen, valLen, len(encoded))
 	}
 	if s.closed {
 		return ErrWriterClosed
 	}
-	if bytes.Equal([]byte{}, key) {
+	if keyLen == 0 {
 		return fmt.Errorf("key cannot be empty :%w", ErrInvalidKey)
 	}
+
+	if s.options.LegacyTombstoneSource && binary.LittleEndian.Uint32(encoded[2:6]) == 0 {
+		// an empty value is a tombstone in the source, but would be a live row here
+		encoded = bytes.Clone(encoded)
+		binary.LittleEndian.PutUint32(encoded[2:6], tombstoneValueLength)
+	}
+
+	key := encoded[headerLen : headerLen+keyLen]
+	originalValueLength := valLen
+	if s.options.ValueCompressionThreshold > 0 {
+		switch encoded[headerLen-1] {
+		case valueFlagNone:
+		case valueFlagZSTD:
+			// use the uncompressed length from the frame header for the block stats, decompressing the value if
+			// the header doesn't have it (EncodeAll leaves it out of small frames)
+			var header zstd.Header
+			err := header.Decode(encoded[headerLen+keyLen:])
+			if err != nil {
+				return fmt.Errorf("%w: error decoding zstd frame header for key %x: %w", ErrInvalidEncodedRow, key, err)
+			}
+			if header.HasFCS {
+				originalValueLength = int(header.FrameContentSize)
+			} else {
+				value, err := zstdDecodeAll(encoded[headerLen+keyLen:], nil)
+				if err != nil {
+					return fmt.Errorf("%w: error decompressing value for key %x: %w", ErrInvalidEncodedRow, key, err)
+				}
+				originalValueLength = len(value)
+			}
+		default:
+			return fmt.Errorf("%w: unknown value flags %d for key %x", ErrInvalidEncodedRow, encoded[headerLen-1], key)
+		}
+	}
+
+	_, err := s.appendRow(encoded, key, originalValueLength)
+	return err
+}
+
+// writeRow writes the row, returning the stat of the block the row flushed, if any. The seq is only stored if
+// SegmentWriterOptions.RowSequence, and val is ignored for a tombstone.
+func (s *SegmentWriter) writeRow(key, val []byte, seq uint64, tombstone bool) (*BlockStat, error) {
+	if len(key) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w, got length %d", ErrKeyTooLarge, len(key))
+	}
+	if tombstone {
+		val = nil
+	}
+	if len(val) >= tombstoneValueLength {
+		return nil, fmt.Errorf("%w, got length %d", ErrValueTooLarge, len(val))
+	}
+	if s.closed {
+		return nil, ErrWriterClosed
+	}
+	if bytes.Equal([]byte{}, key) {
+		return nil, fmt.Errorf("key cannot be empty :%w", ErrInvalidKey)
+	}
+
+	// compress the value if it's large enough
+	originalValueLength := len(val)
+	valueFlags := byte(valueFlagNone)
+	if s.options.ValueCompressionThreshold > 0 && len(val) > 0 && uint32(len(val)) >= s.options.ValueCompressionThreshold {
+		if s.valueEncoder == nil {
+			enc, err := zstd.NewWriter(nil, s.zstdEncoderOptions()...)
+			if err != nil {
+				return nil, fmt.Errorf("error in zstd.NewWriter for values: %w", err)
+			}
+			s.valueEncoder = enc
+		}
+		val = s.valueEncoder.EncodeAll(val, nil)
+		if len(val) >= tombstoneValueLength {
+			return nil, fmt.Errorf("%w, got compressed length %d", ErrValueTooLarge, len(val))
+		}
+		valueFlags = valueFlagZSTD
+	}
+
+	// encode the row
+	headerLen := s.rowHeaderLength()
+	rowLen := headerLen + len(key) + len(val)
+	if cap(s.rowBuf) < rowLen {
+		s.rowBuf = make([]byte, rowLen)
+	}
+	rowBuf := s.rowBuf[:rowLen]
+	binary.LittleEndian.PutUint16(rowBuf[0:2], uint16(len(key)))
+	binary.LittleEndian.PutUint32(rowBuf[2:6], uint32(len(val)))
+	if tombstone {
+		binary.LittleEndian.PutUint32(rowBuf[2:6], tombstoneValueLength)
+	}
+	if s.options.RowSequence {
+		binary.LittleEndian.PutUint64(rowBuf[6:14], seq)
+	}
+	if s.options.ValueCompressionThreshold > 0 {
+		rowBuf[headerLen-1] = valueFlags
+	}
+	copy(rowBuf[headerLen:], key)
+	copy(rowBuf[headerLen+len(key):], val)
+
+	return s.appendRow(rowBuf, key, originalValueLength)
+}
+
+// hasBloomFilter returns whether the writer has any kind of key filter
+func (s *SegmentWriter) hasBloomFilter() bool {
+	return s.options.KeyFilter != KeyFilterNone || s.options.BlockedBloomFilter != nil || s.options.BloomFilter != nil
+}
+
+// addBloomKey adds the key to the bloom filter, preferring the KeyFilter, then the BlockedBloomFilter
+func (s *SegmentWriter) addBloomKey(key []byte) {
+	if s.options.KeyFilter != KeyFilterNone {
+		s.keyFilterHashes = append(s.keyFilterHashes, xxhash.Sum64(key))
+		return
+	}
+	if s.options.BlockedBloomFilter != nil {
+		s.options.BlockedBloomFilter.Add(key)
+		return
+	}
+	s.options.BloomFilter.Add(key)
+}
+
+// addBackgroundBloomKey queues the key to be added to the bloom filter by the bloom filter goroutine, starting it if
+// needed. Keys are sent in batches to keep channel overhead off the write path.
+func (s *SegmentWriter) addBackgroundBloomKey(key []byte) {
+	if s.bloomKeys == nil {
+		s.bloomKeys = make(chan [][]byte, backgroundBloomFilterQueue)
+		s.bloomDone = make(chan struct{})
+		go func(add func(key []byte), batches <-chan [][]byte, done chan<- struct{}) {
+			defer close(done)
+			for batch := range batches {
+				for _, key := range batch {
+					add(key)
+				}
+			}
+		}(s.addBloomKey, s.bloomKeys, s.bloomDone)
+	}
+
+	s.bloomBatch = append(s.bloomBatch, key)
+	if len(s.bloomBatch) >= backgroundBloomFilterBatch {
+		s.bloomKeys <- s.bloomBatch
+		s.bloomBatch = make([][]byte, 0, backgroundBloomFilterBatch)
+	}
+}
+
+// waitBackgroundBloomFilter sends the final batch of keys to the bloom filter goroutine, and waits for it to add
+// every key. Does nothing if the goroutine was never started, or already stopped.
+func (s *SegmentWriter) waitBackgroundBloomFilter() {
+	if s.bloomKeys == nil {
+		return
+	}
+	if len(s.bloomBatch) > 0 {
+		s.bloomKeys <- s.bloomBatch
+		s.bloomBatch = nil
+	}
+	close(s.bloomKeys)
+	<-s.bloomDone
+	s.bloomKeys = nil
+}
+
+// rowHeaderLength returns the length of the data block row header for the row format of this writer
+func (s *SegmentWriter) rowHeaderLength() int {
+	headerLen := 6
+	if s.options.RowSequence {
+		headerLen += 8
+	}
+	if s.options.ValueCompressionThreshold > 0 {
+		headerLen++
+	}
+	return headerLen
+}
+
+// appendRow writes an encoded row to the current block, returning the stat of the block the row flushed, if any.
+// originalValueLength is the length of the value before any value compression.
+func (s *SegmentWriter) appendRow(row, key []byte, originalValueLength int) (*BlockStat, error) {
+	if s.optionsErr != nil {
+		return nil, s.optionsErr
+	}
+	if s.lastKeyFromRawBlock {
+		err := s.decodeLastRawBlockKey()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(key, s.lastKey) <= 0 {
+			return nil, fmt.Errorf("%w: key must be greater than the last key of the previous raw block", ErrInvalidKey)
+		}
+		s.lastKeyFromRawBlock = false
+	}
 	useZSTD := s.options.ZSTDCompressionLevel > 0
-	useLZ4 := !useZSTD && s.options.LZ4Compression
+	if s.sampleDictionary() {
+		row = bytes.Clone(row)
+		s.sampledRows = append(s.sampledRows, sampledRow{
+			row:                 row,
+			key:                 row[s.rowHeaderLength():][:len(key)],
+			originalValueLength: originalValueLength,
+		})
+		s.sampledRowBytes += uint64(len(row))
+		if s.sampledRowBytes < s.options.ZSTDDictionarySampleBytes {
+			return nil, nil
+		}
+		return s.trainDictionary()
+	}
+	codec := s.blockCodec()
 	if s.blockWriter == nil {
 		// Ensure we are at a base state
 		s.currentBlockStartKey = key
 		s.currentRawBlockSize = 0
-		s.blockBuffer = &BytesWriteCloser{
-			&bytes.Buffer{},
+		s.currentBlockRowCount = 0
+		s.currentBlockTombstoneCount = 0
+		s.currentBlockMinValueLength = 0
+		s.currentBlockMaxValueLength = 0
+		if s.options.BulkMode && s.blockBuffer != nil {
+			// reuse the previous block's buffer
+			s.blockBuffer.Reset()
+		} else {
+			s.blockBuffer = &BytesWriteCloser{
+				&bytes.Buffer{},
+			}
+			if s.options.BulkMode {
+				s.blockBuffer.Grow(int(max(s.options.DataBlockSize, s.options.DataBlockThresholdBytes)))
+			}
 		}
 
 		// create the writer if it doesn't exist, using the correct writer based on compression
-		// todo check lz4 compression
 		if useZSTD {
-			enc, err := zstd.NewWriter(s.blockBuffer, zstd.WithEncoderLevel(zstd.EncoderLevel(s.options.ZSTDCompressionLevel)))
+			encoderOptions := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevel(s.options.ZSTDCompressionLevel))}
+			if s.zstdDictionary != nil {
+				encoderOptions = append(encoderOptions, zstd.WithEncoderDict(s.zstdDictionary))
+			}
+			enc, err := zstd.NewWriter(s.blockBuffer, s.zstdEncoderOptions(encoderOptions...)...)
 			if err != nil {
-				return fmt.Errorf("error in zstd.NewWriter: %w", err)
+				return nil, fmt.Errorf("error in zstd.NewWriter: %w", err)
 			}
 
 			s.blockWriter = enc
+		} else if codec != nil {
+			s.blockWriter = &codecBlockWriter{codec: codec, out: s.blockBuffer}
 		} else {
 			s.blockWriter = s.blockBuffer // just use the external writer directly
 		}
@@ -116,38 +518,55 @@ func (s *SegmentWriter) WriteRow(key, val []byte) error {
 
 	// update the key tracking for final write
 	s.lastKey = key
+	s.lastRawBlock = nil
 
 	// write the row for the current block into the buffer
-	rowBuf := make([]byte, 6+len(key)+len(val))
-	binary.LittleEndian.PutUint16(rowBuf[0:2], uint16(len(key)))
-	binary.LittleEndian.PutUint32(rowBuf[2:6], uint32(len(val)))
-	copy(rowBuf[6:], key)
-	copy(rowBuf[6+len(key):], val)
-
-	_, err := s.blockWriter.Write(rowBuf)
+	_, err := s.blockWriter.Write(row)
 	if err != nil {
-		return fmt.Errorf("error in s.blockWriter.Write (zstd=%t, lz4=%t): %w", useZSTD, useLZ4, err)
+		return nil, fmt.Errorf("error in s.blockWriter.Write (zstd=%t, codec=%v): %w", useZSTD, codec, err)
+	}
+	s.currentRawBlockSize += uint64(len(row))
+	s.currentBlockRowCount++
+	if binary.LittleEndian.Uint32(row[2:6]) == tombstoneValueLength {
+		s.currentBlockTombstoneCount++
+	} else {
+		if s.currentBlockRowCount == s.currentBlockTombstoneCount+1 || uint32(originalValueLength) < s.currentBlockMinValueLength {
+			// first value in the block, or smaller
+			s.currentBlockMinValueLength = uint32(originalValueLength)
+		}
+		s.currentBlockMaxValueLength = max(s.currentBlockMaxValueLength, uint32(originalValueLength))
 	}
-	s.currentRawBlockSize += uint64(len(rowBuf))
 
-	if s.options.BloomFilter != nil {
+	if s.hasBloomFilter() && s.options.BackgroundBloomFilter {
+		s.addBackgroundBloomKey(key)
+	} else if s.hasBloomFilter() && s.options.BulkMode {
+		// add in a single pass at Close
+		s.bulkKeys = append(s.bulkKeys, key)
+	} else if s.hasBloomFilter() {
 		// store the row in the bloom filter if needed
-		s.options.BloomFilter.Add(key)
+		s.addBloomKey(key)
 	}
 
-	if uint64(s.blockBuffer.Len()) >= s.options.DataBlockThresholdBytes {
+	blockLength := uint64(s.blockBuffer.Len())
+	if codec != nil {
+		// the block is only compressed when flushed
+		blockLength = s.currentRawBlockSize
+	}
+	if blockLength >= s.options.DataBlockThresholdBytes {
 		err = s.flushCurrentDataBlock()
 		if err != nil {
-			return fmt.Errorf("error in flushCurrentDataBlock: %w", err)
+			return nil, fmt.Errorf("error in flushCurrentDataBlock: %w", err)
 		}
+		flushed := s.blockIndex[len(s.blockIndex)-1]
+		return &flushed, nil
 	}
 
-	return nil
+	return nil, nil
 }
 
 func (s *SegmentWriter) flushCurrentDataBlock() error {
 	useZSTD := s.options.ZSTDCompressionLevel > 0
-	useLZ4 := !useZSTD && s.options.LZ4Compression
+	codec := s.blockCodec()
 
 	if zstdEncoder, ok := s.blockWriter.(*zstd.Encoder); ok {
 		err := zstdEncoder.Close()
@@ -155,18 +574,28 @@ func (s *SegmentWriter) flushCurrentDataBlock() error {
 			return fmt.Errorf("error in zstdEncode.Close(): %w", err)
 		}
 	}
+	if codecWriter, ok := s.blockWriter.(*codecBlockWriter); ok {
+		err := codecWriter.Close()
+		if err != nil {
+			return fmt.Errorf("error in codecBlockWriter.Close(): %w", err)
+		}
+	}
 
 	// write the metadata to memory for the block start with offset and first key
 	stat := BlockStat{
-		Offset:       s.currentByteOffset,
-		OriginalSize: s.currentRawBlockSize,
-		FirstKey:     s.currentBlockStartKey,
+		Offset:         s.currentByteOffset,
+		OriginalSize:   s.currentRawBlockSize,
+		FirstKey:       s.currentBlockStartKey,
+		RowCount:       s.currentBlockRowCount,
+		TombstoneCount: s.currentBlockTombstoneCount,
+		MinValueLength: s.currentBlockMinValueLength,
+		MaxValueLength: s.currentBlockMaxValueLength,
 	}
-	if useZSTD || useLZ4 {
+	if useZSTD || codec != nil {
 		stat.CompressedSize = uint64(s.blockBuffer.Len())
 	}
 
-	if remainder := s.options.DataBlockSize - uint64(s.blockBuffer.Len())%s.options.DataBlockSize; remainder > 0 {
+	if remainder := s.options.DataBlockSize - uint64(s.blockBuffer.Len())%s.options.DataBlockSize; remainder > 0 && !s.options.DisableBlockPadding {
 		// write the (padded min) multiple of 4k block to the file after compression
 		bytesWritten, err := s.blockBuffer.Write(make([]byte, remainder))
 		if err != nil {
@@ -187,6 +616,11 @@ func (s *SegmentWriter) flushCurrentDataBlock() error {
 
 	s.blockIndex = append(s.blockIndex, stat)
 
+	err := waitForBytes(s.options.RateLimiter, len(blockBytes))
+	if err != nil {
+		return fmt.Errorf("error in waitForBytes: %w", err)
+	}
+
 	// flush the block buffer
 	bytesWritten, err := s.externalWriter.Write(blockBytes)
 	if err != nil {
@@ -203,15 +637,175 @@ func (s *SegmentWriter) flushCurrentDataBlock() error {
 	return nil
 }
 
+// decodeLastRawBlockKey sets lastKey to the last key of the raw block written without decoding, if any
+func (s *SegmentWriter) decodeLastRawBlockKey() error {
+	if s.lastRawBlock == nil {
+		return nil
+	}
+	useZSTD := s.options.ZSTDCompressionLevel > 0
+	rows, err := decodeBlockRows(s.lastRawBlock.raw, s.lastRawBlock.stat, s.rowFormatMetadata(useZSTD, s.blockCodec()))
+	if err != nil {
+		return fmt.Errorf("error in decodeBlockRows for last raw block: %w", err)
+	}
+	s.lastKey = bytes.Clone(rows[len(rows)-1].Key)
+	s.lastRawBlock = nil
+	return nil
+}
+
+// WriteRawBlock appends a pre-formed data block (e.g. from SegmentReader.ReadRawBlock) to the segment verbatim,
+// recording its stat so that Close emits a correct meta block. The stat offset is rewritten to the block's position
+// in this segment. source is the metadata of the segment the block was read from.
+//
+// The block must have been written with the same compression as this writer, and its first key must be greater
+// than any key previously written. Any partially filled block from WriteRow is flushed first. The rows of the
+// source must have the row format of this writer (SegmentWriterOptions.RowSequence and
+// SegmentWriterOptions.ValueCompressionThreshold), otherwise ErrRowFormatMismatch is returned. Blocks compressed
+// with a zstd dictionary (see SegmentWriterOptions.ZSTDDictionarySampleBytes) can't be copied, as the dictionary
+// is not.
+//
+// If a bloom filter is configured, the block is decoded so its keys can be added to the filter. Blocks from
+// version 1 segments need SegmentWriterOptions.LegacyTombstoneSource, and are rejected if they hold
+// any tombstones.
+func (s *SegmentWriter) WriteRawBlock(source *SegmentMetadata, stat BlockStat, raw []byte) error {
+	if s.closed {
+		return ErrWriterClosed
+	}
+	if s.optionsErr != nil {
+		return s.optionsErr
+	}
+	useZSTD := s.options.ZSTDCompressionLevel > 0
+	codec := s.blockCodec()
+	err := s.checkRawBlockSource(source, useZSTD, codec)
+	if err != nil {
+		return err
+	}
+	if uint64(len(raw)) != stat.BlockSize {
+		return fmt.Errorf("%w: expected block size=%d got=%d", ErrInvalidRawBlock, stat.BlockSize, len(raw))
+	}
+	if calculatedHash := xxhash.Sum64(raw); calculatedHash != stat.Hash {
+		return fmt.Errorf("%w: expected hash=%d got=%d", ErrInvalidRawBlock, stat.Hash, calculatedHash)
+	}
+	if useZSTD && s.options.ZSTDDictionarySampleBytes > 0 {
+		return fmt.Errorf("%w: raw blocks can't be written with a zstd dictionary", ErrInvalidRawBlock)
+	}
+	if (stat.CompressedSize > 0) != (useZSTD || codec != nil) {
+		return fmt.Errorf("%w: block compression does not match writer (zstd=%t, codec=%v)", ErrInvalidRawBlock, useZSTD, codec)
+	}
+	if len(stat.FirstKey) == 0 {
+		return fmt.Errorf("block first key cannot be empty: %w", ErrInvalidKey)
+	}
+	if stat.OriginalSize == 0 {
+		return fmt.Errorf("%w: block has no rows", ErrInvalidRawBlock)
+	}
+
+	// flush anything written with WriteRow so the blocks stay in order
+	if s.blockWriter != nil {
+		err := s.flushCurrentDataBlock()
+		if err != nil {
+			return fmt.Errorf("error in flushCurrentDataBlock: %w", err)
+		}
+	}
+
+	err = s.decodeLastRawBlockKey()
+	if err != nil {
+		return err
+	}
+	if s.lastKey != nil && bytes.Compare(stat.FirstKey, s.lastKey) <= 0 {
+		return fmt.Errorf("%w: block first key must be greater than the last written key", ErrInvalidRawBlock)
+	}
+
+	stat.Offset = s.currentByteOffset
+	var rows []KVPair
+	if s.hasBloomFilter() || s.options.LegacyTombstoneSource {
+		rows, err = decodeBlockRows(raw, stat, source)
+		if err != nil {
+			return fmt.Errorf("error in decodeBlockRows: %w", err)
+		}
+	}
+	if s.options.LegacyTombstoneSource {
+		// the empty values are tombstones, which would be live rows in this segment. The row stats are also
+		// recomputed, as the source may predate them.
+		stat.RowCount = uint64(len(rows))
+		stat.TombstoneCount = 0
+		stat.MinValueLength = 0
+		stat.MaxValueLength = 0
+		for i, row := range rows {
+			if row.IsTombstone() {
+				return fmt.Errorf("%w: block has a tombstone at key %x, which must be written as a row", ErrInvalidRawBlock, row.Key)
+			}
+			if i == 0 || uint32(len(row.Value)) < stat.MinValueLength {
+				stat.MinValueLength = uint32(len(row.Value))
+			}
+			stat.MaxValueLength = max(stat.MaxValueLength, uint32(len(row.Value)))
+		}
+	}
+
+	if s.hasBloomFilter() {
+		for _, row := range rows {
+			if s.options.BackgroundBloomFilter {
+				// the rows may share the caller's raw block
+				s.addBackgroundBloomKey(bytes.Clone(row.Key))
+			} else {
+				s.addBloomKey(row.Key)
+			}
+		}
+	}
+	if rows != nil {
+		s.lastKey = bytes.Clone(rows[len(rows)-1].Key)
+		s.lastRawBlock = nil
+	} else {
+		// we don't know the last key without decoding, so hold on to the block in case it's the last one
+		s.lastKey = stat.FirstKey
+		s.lastRawBlock = &rawBlock{stat: stat, raw: raw}
+	}
+	s.lastKeyFromRawBlock = true
+
+	err = waitForBytes(s.options.RateLimiter, len(raw))
+	if err != nil {
+		return fmt.Errorf("error in waitForBytes: %w", err)
+	}
+
+	bytesWritten, err := s.externalWriter.Write(raw)
+	if err != nil {
+		return fmt.Errorf("error writing raw block bytes to external writer: %w", err)
+	}
+	if bytesWritten != len(raw) {
+		return fmt.Errorf("%w - expected=%d wrote=%d", ErrUnexpectedBytesWritten, len(raw), bytesWritten)
+	}
+
+	s.blockIndex = append(s.blockIndex, stat)
+	s.currentByteOffset += uint64(bytesWritten)
+	return nil
+}
+
 // Close finishes writing the segment file by writing the final metadata to the file and closing the writer.
 //
-// Once this has completed then the segment is considered durably stored.
+// Once this has completed then the segment is considered durably stored. For file writers, set
+// SegmentWriterOptions.Sync to enforce this.
 //
-// Returns the size of the file, the metadata bytes (useful for caching)
+// Returns the size of the file, the metadata bytes (useful for caching, always uncompressed so they can be passed to
+// SegmentReader.BytesToMetadata)
+//
+// Returns ErrNoRowsWritten only if nothing at all was written. Tombstones are rows, so a segment of only
+// tombstones (e.g. from compaction) can be written to shadow lower levels.
 func (s *SegmentWriter) Close() (uint64, []byte, error) {
-	defer s.blockWriter.Close()
+	if s.valueEncoder != nil {
+		defer s.valueEncoder.Close()
+	}
+	// stop the bloom filter goroutine if we return early
+	defer s.waitBackgroundBloomFilter()
+
+	// write any rows held for the dictionary, training it with what was written
+	if s.sampleDictionary() && len(s.sampledRows) > 0 {
+		_, err := s.trainDictionary()
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in trainDictionary: %w", err)
+		}
+	}
+
 	// flush the current block if needed
 	if s.blockWriter != nil {
+		defer s.blockWriter.Close()
 		err := s.flushCurrentDataBlock()
 		if err != nil {
 			return 0, nil, fmt.Errorf("error in flushCurrentDataBlock: %w", err)
@@ -222,15 +816,48 @@ func (s *SegmentWriter) Close() (uint64, []byte, error) {
 		return 0, nil, ErrNoRowsWritten
 	}
 
+	err := s.decodeLastRawBlockKey()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if s.hasBloomFilter() {
+		for _, key := range s.bulkKeys {
+			s.addBloomKey(key)
+		}
+		s.bulkKeys = nil
+	}
+	// the bloom filter must be complete before it is written to the meta block
+	s.waitBackgroundBloomFilter()
+
+	err = s.writeIndexPartitions()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in writeIndexPartitions: %w", err)
+	}
+
 	// write the meta block
 	metaBlockStartOffset := s.currentByteOffset
-	metaBlockBytes := s.generateMetaBlock()
-	bytesWritten, err := s.externalWriter.Write(metaBlockBytes)
+	metaBlockBytes, err := s.generateMetaBlock()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in generateMetaBlock: %w", err)
+	}
+	storedMetaBlockBytes := metaBlockBytes
+	segmentVersion := byte(currentSegmentVersion)
+	if s.options.MetaBlockZSTDCompression {
+		enc, err := zstd.NewWriter(nil, s.zstdEncoderOptions()...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in zstd.NewWriter for meta block: %w", err)
+		}
+		storedMetaBlockBytes = enc.EncodeAll(metaBlockBytes, nil)
+		enc.Close()
+		segmentVersion |= trailerFlagMetaBlockZSTD
+	}
+	bytesWritten, err := s.externalWriter.Write(storedMetaBlockBytes)
 	if err != nil {
 		return 0, nil, fmt.Errorf("error writing meta block to external writer: %w", err)
 	}
-	if bytesWritten != len(metaBlockBytes) {
-		return 0, nil, fmt.Errorf("%w (meta block) - expected=%d wrote=%d", ErrUnexpectedBytesWritten, len(metaBlockBytes), bytesWritten)
+	if bytesWritten != len(storedMetaBlockBytes) {
+		return 0, nil, fmt.Errorf("%w (meta block) - expected=%d wrote=%d", ErrUnexpectedBytesWritten, len(storedMetaBlockBytes), bytesWritten)
 	}
 	s.currentByteOffset += uint64(bytesWritten)
 
@@ -245,7 +872,7 @@ func (s *SegmentWriter) Close() (uint64, []byte, error) {
 	s.currentByteOffset += uint64(bytesWritten)
 
 	// Write the meta block hash
-	metaHash := xxhash.Sum64(metaBlockBytes)
+	metaHash := xxhash.Sum64(storedMetaBlockBytes)
 	bytesWritten, err = s.externalWriter.Write(binary.LittleEndian.AppendUint64([]byte{}, metaHash))
 	if err != nil {
 		return 0, nil, fmt.Errorf("error writing block hash bytes to external writer: %w", err)
@@ -256,7 +883,7 @@ func (s *SegmentWriter) Close() (uint64, []byte, error) {
 	s.currentByteOffset += uint64(bytesWritten)
 
 	// Write the segment file version
-	bytesWritten, err = s.externalWriter.Write([]byte{1})
+	bytesWritten, err = s.externalWriter.Write([]byte{segmentVersion})
 	if err != nil {
 		return 0, nil, fmt.Errorf("error writing version bytes to external writer: %w", err)
 	}
@@ -275,13 +902,136 @@ func (s *SegmentWriter) Close() (uint64, []byte, error) {
 	}
 	s.currentByteOffset += uint64(bytesWritten)
 
+	if syncer, ok := s.externalWriter.(Syncer); ok && s.options.Sync {
+		err = syncer.Sync()
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in Sync: %w", err)
+		}
+	}
+
 	// close the writer so it can't be reused
 	s.closed = true
 
 	return s.currentByteOffset, metaBlockBytes, nil
 }
 
-func (s *SegmentWriter) generateMetaBlock() []byte {
+// zstdEncoderOptions adds the options shared by all zstd encoders of the writer
+func (s *SegmentWriter) zstdEncoderOptions(opts ...zstd.EOption) []zstd.EOption {
+	if s.options.Deterministic {
+		// a single stream always produces the same output for the same input
+		opts = append(opts, zstd.WithEncoderConcurrency(1))
+	}
+	return opts
+}
+
+// sampleDictionary returns whether rows are still being held to train the zstd dictionary
+func (s *SegmentWriter) sampleDictionary() bool {
+	return s.options.ZSTDCompressionLevel > 0 && s.options.ZSTDDictionarySampleBytes > 0 && !s.dictionaryTrained
+}
+
+// trainDictionary trains the zstd dictionary from the sampled rows, then writes them, returning the stat of the last
+// block they flushed, if any
+func (s *SegmentWriter) trainDictionary() (*BlockStat, error) {
+	sampled := s.sampledRows
+	s.sampledRows = nil
+	s.dictionaryTrained = true
+
+	contents := make([][]byte, len(sampled))
+	var history []byte
+	for i, row := range sampled {
+		contents[i] = row.row
+		history = append(history, row.row...)
+	}
+	dictionary, err := buildZSTDDictionary(zstd.BuildDictOptions{
+		ID:       zstdDictionaryID,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.EncoderLevel(s.options.ZSTDCompressionLevel),
+	})
+	if err == nil {
+		s.zstdDictionary = dictionary
+	}
+	// otherwise there weren't enough rows to train on, so the segment is written without a dictionary
+
+	var flushed *BlockStat
+	for _, row := range sampled {
+		stat, err := s.appendRow(row.row, row.key, row.originalValueLength)
+		if err != nil {
+			return nil, err
+		}
+		if stat != nil {
+			flushed = stat
+		}
+	}
+	return flushed, nil
+}
+
+// buildZSTDDictionary is zstd.BuildDict, returning an error rather than panicking on samples without enough
+// distinct content to train on
+func buildZSTDDictionary(opts zstd.BuildDictOptions) (dictionary []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			dictionary, err = nil, fmt.Errorf("error in zstd.BuildDict: %v", r)
+		}
+	}()
+	return zstd.BuildDict(opts)
+}
+
+// blockCodec returns the codec data blocks are compressed with, nil if none or zstd
+func (s *SegmentWriter) blockCodec() Codec {
+	if s.options.ZSTDCompressionLevel > 0 {
+		return nil
+	}
+	if s.options.LZ4Compression {
+		return lz4Codec{}
+	}
+	return s.options.Codec
+}
+
+// checkRawBlockSource returns an error if blocks of the source segment can't be copied verbatim by WriteRawBlock,
+// as they are compressed or their rows encoded differently than this writer
+func (s *SegmentWriter) checkRawBlockSource(source *SegmentMetadata, useZSTD bool, codec Codec) error {
+	if source == nil {
+		return fmt.Errorf("%w: source segment metadata is required", ErrInvalidRawBlock)
+	}
+	sourceCodecID, codecID := byte(CodecIDNone), byte(CodecIDNone)
+	if source.Codec != nil {
+		sourceCodecID = source.Codec.ID()
+	}
+	if codec != nil {
+		codecID = codec.ID()
+	}
+	writerValueCompression := s.options.ValueCompressionThreshold > 0
+
+	switch {
+	case source.ZSTDCompression != useZSTD || sourceCodecID != codecID:
+		return fmt.Errorf("%w: source compression (zstd=%t, codec ID %02x) does not match writer (zstd=%t, codec ID %02x)", ErrInvalidRawBlock, source.ZSTDCompression, sourceCodecID, useZSTD, codecID)
+	case source.ZSTDDictionary != nil:
+		return fmt.Errorf("%w: source blocks are compressed with a zstd dictionary", ErrInvalidRawBlock)
+	case source.RowSequence != s.options.RowSequence:
+		return fmt.Errorf("%w: source row sequence=%t, writer row sequence=%t", ErrRowFormatMismatch, source.RowSequence, s.options.RowSequence)
+	case source.ValueCompression != writerValueCompression:
+		return fmt.Errorf("%w: source value compression=%t, writer value compression=%t", ErrRowFormatMismatch, source.ValueCompression, writerValueCompression)
+	case source.Tombstones == s.options.LegacyTombstoneSource:
+		return fmt.Errorf("%w: source tombstones=%t, writer LegacyTombstoneSource=%t", ErrRowFormatMismatch, source.Tombstones, s.options.LegacyTombstoneSource)
+	}
+	return nil
+}
+
+// rowFormatMetadata returns the metadata needed to decode the blocks of this writer
+func (s *SegmentWriter) rowFormatMetadata(useZSTD bool, codec Codec) *SegmentMetadata {
+	return &SegmentMetadata{
+		ZSTDCompression:  useZSTD,
+		LZ4Compression:   codec != nil && codec.ID() == CodecIDLZ4,
+		Codec:            codec,
+		RowSequence:      s.options.RowSequence,
+		ValueCompression: s.options.ValueCompressionThreshold > 0,
+		Tombstones:       true,
+	}
+}
+
+func (s *SegmentWriter) generateMetaBlock() ([]byte, error) {
 	var metaBlock bytes.Buffer
 
 	// write the first and last key
@@ -292,41 +1042,187 @@ func (s *SegmentWriter) generateMetaBlock() []byte {
 	metaBlock.Write(s.lastKey)
 
 	// write the bloom filter type and bloom filter (if using it)
-	if s.options.BloomFilter != nil {
-		metaBlock.Write([]byte{1}) // using bloom filter
-		var bloomBuffer bytes.Buffer
-		s.options.BloomFilter.WriteTo(&bloomBuffer)
-		metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, uint64(bloomBuffer.Len()))) // write byte length
-		metaBlock.Write(bloomBuffer.Bytes())                                                   // write bloom filter
-	} else {
-		metaBlock.Write([]byte{0}) // not using bloom filter
+	filterType, bloomBytes, err := s.bloomFilterBlock()
+	if err != nil {
+		return nil, fmt.Errorf("error in bloomFilterBlock: %w", err)
+	}
+	metaBlock.Write([]byte{filterType})
+	if filterType != bloomFilterTypeNone {
+		metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, uint64(len(bloomBytes)))) // write byte length
+		metaBlock.Write(bloomBytes)                                                          // write bloom filter
 	}
 
 	// write the compression
-	useZSTD := s.options.ZSTDCompressionLevel > 0
-	useLZ4 := !useZSTD && s.options.LZ4Compression
-	if useZSTD {
-		metaBlock.Write([]byte{1})
-	} else if useLZ4 {
-		metaBlock.Write([]byte{2})
+	if s.options.ZSTDCompressionLevel > 0 {
+		metaBlock.Write([]byte{CodecIDZSTD})
+	} else if codec := s.blockCodec(); codec != nil {
+		metaBlock.Write([]byte{codec.ID()})
 	} else {
+		metaBlock.Write([]byte{CodecIDNone})
+	}
+
+	// write the row format
+	var rowFormat byte
+	if s.options.RowSequence {
+		rowFormat |= rowFormatSequence
+	}
+	if s.options.ValueCompressionThreshold > 0 {
+		rowFormat |= rowFormatValueFlags
+	}
+	if s.options.Epoch > 0 {
+		rowFormat |= rowFormatEpoch
+	}
+	if len(s.options.UserMetadata) > 0 {
+		rowFormat |= rowFormatUserMetadata
+	}
+	rowFormat |= rowFormatBlockSize
+	createdAt := s.options.createdAt()
+	if !createdAt.IsZero() {
+		rowFormat |= rowFormatCreatedAt
+	}
+	if s.zstdDictionary != nil {
+		rowFormat |= rowFormatDictionary
+	}
+	metaBlock.Write([]byte{rowFormat})
+	if s.options.Epoch > 0 {
+		metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, s.options.Epoch))
+	}
+
+	metaBlock.Write(s.generateBlockIndex())
+
+	// write the user metadata
+	if len(s.options.UserMetadata) > 0 {
+		metaBlock.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(s.options.UserMetadata))))
+		metaBlock.Write(s.options.UserMetadata)
+	}
+
+	// new fields are last, so readers that don't know about them stop before them
+	metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, s.options.DataBlockSize))
+	metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, s.options.DataBlockThresholdBytes))
+	if s.options.DisableBlockPadding {
 		metaBlock.Write([]byte{0})
+	} else {
+		metaBlock.Write([]byte{1})
+	}
+	if !createdAt.IsZero() {
+		metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, uint64(createdAt.UnixNano())))
+	}
+	if s.zstdDictionary != nil {
+		metaBlock.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(s.zstdDictionary))))
+		metaBlock.Write(s.zstdDictionary)
 	}
 
-	// write 0 byte to indicate not a partitioned block index
-	metaBlock.Write([]byte{0})
+	return metaBlock.Bytes(), nil
+}
 
-	// write the number of block index entries
-	metaBlock.Write(binary.LittleEndian.AppendUint64([]byte{}, uint64(len(s.blockIndex))))
+// bloomFilterBlock returns the bloom filter type byte and serialized filter for the meta block, compressing the
+// filter if BloomFilterZSTDCompression
+func (s *SegmentWriter) bloomFilterBlock() (byte, []byte, error) {
+	var filterType byte
+	var filter Filter
+	if s.options.KeyFilter != KeyFilterNone {
+		var err error
+		filter, err = buildKeyFilter(s.options.KeyFilter, s.keyFilterHashes)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error in buildKeyFilter: %w", err)
+		}
+		filterType = bloomFilterTypeXor
+		if s.options.KeyFilter == KeyFilterRibbon {
+			filterType = bloomFilterTypeRibbon
+		}
+	} else if s.options.BlockedBloomFilter != nil {
+		filterType = bloomFilterTypeBlocked
+		filter = s.options.BlockedBloomFilter
+	} else if s.options.BloomFilter != nil {
+		filterType = bloomFilterTypeSingle
+		filter = s.options.BloomFilter
+	} else {
+		return bloomFilterTypeNone, nil, nil
+	}
 
-	// write the block index items
-	for _, block := range s.blockIndex {
-		metaBlock.Write(block.toBytes())
+	var bloomBuffer bytes.Buffer
+	_, err := filter.WriteTo(&bloomBuffer)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in WriteTo for filter type %d: %w", filterType, err)
 	}
 
-	return metaBlock.Bytes()
+	if !s.options.BloomFilterZSTDCompression {
+		return filterType, bloomBuffer.Bytes(), nil
+	}
+
+	enc, err := zstd.NewWriter(nil, s.zstdEncoderOptions()...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error in zstd.NewWriter for bloom filter: %w", err)
+	}
+	defer enc.Close()
+	return filterType | bloomFilterFlagZSTD, enc.EncodeAll(bloomBuffer.Bytes(), nil), nil
 }
 
+// generateBlockIndex returns the block index of the meta block, which is the top level index of the partitions if
+// writeIndexPartitions wrote any
 func (s *SegmentWriter) generateBlockIndex() []byte {
-	panic("todo")
+	if s.indexPartitions != nil {
+		return appendBlockIndexEntries([]byte{blockIndexTypePartitioned}, s.indexPartitions)
+	}
+	return appendBlockIndexEntries([]byte{blockIndexTypeSimple}, s.blockIndex)
+}
+
+// writeIndexPartitions writes the block index as partitions after the data blocks, if there are more blocks than
+// SegmentWriterOptions.BlockIndexPartitionEntries. Each partition is recorded in indexPartitions with a BlockStat,
+// totalling the stats of its blocks.
+func (s *SegmentWriter) writeIndexPartitions() error {
+	entries := s.options.BlockIndexPartitionEntries
+	if entries <= 0 || len(s.blockIndex) <= entries {
+		return nil
+	}
+
+	for start := 0; start < len(s.blockIndex); start += entries {
+		blocks := s.blockIndex[start:min(start+entries, len(s.blockIndex))]
+		partition := appendBlockIndexEntries(nil, blocks)
+		stat := BlockStat{
+			FirstKey:     blocks[0].FirstKey,
+			Offset:       s.currentByteOffset,
+			BlockSize:    uint64(len(partition)),
+			OriginalSize: uint64(len(partition)),
+			Hash:         xxhash.Sum64(partition),
+		}
+		for _, block := range blocks {
+			stat.RowCount += block.RowCount
+			stat.TombstoneCount += block.TombstoneCount
+			if block.RowCount == block.TombstoneCount {
+				// no values
+				continue
+			}
+			if stat.RowCount-stat.TombstoneCount == block.RowCount-block.TombstoneCount || block.MinValueLength < stat.MinValueLength {
+				// first block with values, or smaller
+				stat.MinValueLength = block.MinValueLength
+			}
+			stat.MaxValueLength = max(stat.MaxValueLength, block.MaxValueLength)
+		}
+
+		err := waitForBytes(s.options.RateLimiter, len(partition))
+		if err != nil {
+			return fmt.Errorf("error in waitForBytes: %w", err)
+		}
+		bytesWritten, err := s.externalWriter.Write(partition)
+		if err != nil {
+			return fmt.Errorf("error writing index partition to external writer: %w", err)
+		}
+		if bytesWritten != len(partition) {
+			return fmt.Errorf("%w (index partition) - expected=%d wrote=%d", ErrUnexpectedBytesWritten, len(partition), bytesWritten)
+		}
+		s.currentByteOffset += uint64(bytesWritten)
+		s.indexPartitions = append(s.indexPartitions, stat)
+	}
+
+	return nil
+}
+
+// appendBlockIndexEntries appends the number of entries, then each entry, to dst
+func appendBlockIndexEntries(dst []byte, entries []BlockStat) []byte {
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(len(entries)))
+	for _, entry := range entries {
+		dst = append(dst, entry.toBytes()...)
+	}
+	return dst
 }
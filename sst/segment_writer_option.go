@@ -1,27 +1,172 @@
 package sst
 
-import "github.com/bits-and-blooms/bloom"
+import (
+	"fmt"
+	"time"
+
+	"github.com/bits-and-blooms/bloom"
+	"golang.org/x/time/rate"
+)
 
 type SegmentWriterOptions struct {
 	BloomFilter *bloom.BloomFilter
 
 	DataBlockThresholdBytes uint64
 	DataBlockSize           uint64
+	// DataBlockFillRatio sets DataBlockThresholdBytes to this fraction of DataBlockSize when not 0, so the two stay
+	// consistent when DataBlockSize changes (e.g. 0.875 for 3584 of 4096). Must be > 0 and <= 1.
+	DataBlockFillRatio float64
 	// if provided, will also write the segment to a local directory. Write will abort if local OR remote fails.
 	LocalCacheDir *string
 
 	ZSTDCompressionLevel int // if not 0, then use this
 
+	// ZSTDDictionarySampleBytes trains a zstd dictionary from the first rows written, up to this many bytes, which
+	// compresses every data block of the segment with ZSTDCompressionLevel. This helps segments of many small,
+	// similar rows, which compress poorly block by block. The dictionary is stored in the meta block, and is about
+	// the size of the sample, so keep it small (e.g. 16KiB to 64KiB). Sampled rows are held until the sample is
+	// complete, so WriteRowTracked only returns the last block flushed when they are written. Segments with too
+	// few rows to train a dictionary are written without one. Training may break ties differently between runs, so
+	// segments with a dictionary are not guaranteed to be byte-identical with Deterministic. Disabled if 0.
+	ZSTDDictionarySampleBytes uint64
+
+	// LZ4Compression compresses data blocks with the LZ4 block format when ZSTDCompressionLevel is 0, which is
+	// faster to decompress than zstd at a lower ratio. Blocks are filled to DataBlockThresholdBytes before
+	// compression, so set DisableBlockPadding to keep the savings.
 	LZ4Compression bool
+
+	// Codec compresses data blocks when ZSTDCompressionLevel is 0 and LZ4Compression is false, such as SnappyCodec.
+	// Blocks are compressed whole like LZ4Compression. Custom codecs must be registered with RegisterCodec, by both
+	// the writer and readers, or writes return ErrUnknownCodec.
+	Codec Codec
+
+	// RowSequence stores a uint64 sequence number in every row header, see SegmentWriter.WriteRowWithSeq.
+	// Rows written with WriteRow will have a sequence number of 0.
+	RowSequence bool
+
+	// ValueCompressionThreshold compresses individual values at least this many bytes with zstd, independently of
+	// block compression, so a few large values don't dominate a block. Adds a value flags byte to each row header.
+	// Disabled if 0.
+	ValueCompressionThreshold uint32
+
+	// LegacyTombstoneSource indicates that rows passed to SegmentWriter.WriteEncodedRow and blocks passed to
+	// SegmentWriter.WriteRawBlock come from version 1 segments (without SegmentMetadata.Tombstones), where a row
+	// with an empty value is a tombstone. Encoded rows with an empty value are written as tombstones, and raw
+	// blocks with any are rejected with ErrInvalidRawBlock, so their rows must be written instead.
+	LegacyTombstoneSource bool
+
+	// Sync will call Sync() on the writer at the end of Close if it implements Syncer (e.g. *os.File), so the
+	// segment is durably stored when Close returns.
+	Sync bool
+
+	// BulkMode optimizes for write throughput, such as for an initial data import. Keys are added to the bloom
+	// filter in a single pass at Close instead of on every write, and block buffers are preallocated and reused.
+	// Written keys are held until Close, so memory grows with the total size of the keys.
+	BulkMode bool
+
+	// BackgroundBloomFilter adds keys to the bloom filter on a background goroutine, so writes don't wait on
+	// BloomFilter.Add. The filter is complete before Close writes the meta block, and must not be used until Close
+	// returns. Takes precedence over the single pass of BulkMode. Keys are held until they are added, so the keys
+	// passed to WriteRow must not be modified before Close.
+	BackgroundBloomFilter bool
+
+	// DisableBlockPadding writes data blocks at their (compressed) size, rather than padding them to a multiple of
+	// DataBlockSize. This makes for smaller segments, at the cost of blocks no longer being aligned.
+	DisableBlockPadding bool
+
+	// Epoch tags the segment with a write epoch, stored in the meta block as SegmentMetadata.Epoch, so readers
+	// can read as of an epoch (see snapshot_reader.Reader.GetRowAsOf). Not stored if 0.
+	Epoch uint64
+
+	// RateLimiter paces data block writes in bytes per second, waiting before each block is written. Share a limiter
+	// with the SegmentReaderOptions.RateLimiter of the input segments to throttle compaction IO as a whole.
+	// Disabled if nil.
+	RateLimiter *rate.Limiter
+
+	// Deterministic forces single stream zstd encoding, so that writers given identical rows and options produce
+	// byte-identical segments (e.g. for content-addressable segments).
+	Deterministic bool
+
+	// MetaBlockZSTDCompression compresses the meta block with zstd, flagged in the segment trailer, which shrinks
+	// the metadata of segments with many blocks. Lazily loaded bloom filters can't be read from a compressed meta
+	// block, so readers will load the bloom filter with the rest of the metadata.
+	MetaBlockZSTDCompression bool
+
+	// UserMetadata is an opaque blob stored in the meta block, and exposed to readers as
+	// SegmentMetadata.UserMetadata. Not stored if empty.
+	UserMetadata []byte
+
+	// BlockedBloomFilter is used instead of BloomFilter (which is ignored) when set, keeping the bits of each key in
+	// a single cache line for better cache behavior with large key counts. See NewBlockedBloomFilterWithEstimates.
+	BlockedBloomFilter *BlockedBloomFilter
+
+	// KeyFilter builds a static XorFilter or RibbonFilter from every key at Close, used instead of BloomFilter and
+	// BlockedBloomFilter (which are ignored) when not KeyFilterNone. It is sized for the keys that were written, so
+	// needs no estimate, and is smaller than a bloom filter at the same false positive rate. Only the 8 byte hash of
+	// each key is held until Close. Exposed to readers as SegmentMetadata.KeyFilter.
+	KeyFilter KeyFilterType
+
+	// BloomFilterZSTDCompression compresses the bloom filter within the meta block with zstd, which shrinks segments
+	// with few keys for the size of their bloom filter, as the mostly empty filter compresses well.
+	BloomFilterZSTDCompression bool
+
+	// BlockIndexPartitionEntries splits the block index into partitions of this many entries when the segment has
+	// more blocks than that, keeping the meta block small for very large segments. The partitions are written after
+	// the data blocks, with a top level index of them in the meta block, so readers can load only the partitions
+	// they need, see SegmentReaderOptions.LazyBlockIndex. Disabled if 0.
+	BlockIndexPartitionEntries int
+
+	// CreatedAt is stored in the meta block, and exposed to readers as SegmentMetadata.CreatedAt. Uses the time of
+	// Close if zero, unless Deterministic is set, in which case it is not stored.
+	CreatedAt time.Time
 }
 
 func DefaultSegmentWriterOptions() SegmentWriterOptions {
 	return SegmentWriterOptions{
-		BloomFilter:             bloom.NewWithEstimates(100_000, 0.000001), // 351.02KiB estimated, about 1/100k chance of false positive
-		DataBlockThresholdBytes: 3584,
-		DataBlockSize:           4096,
-		LocalCacheDir:           nil,
-		ZSTDCompressionLevel:    0,
-		LZ4Compression:          false,
+		BloomFilter:                bloom.NewWithEstimates(100_000, DefaultBloomFilterFalsePositiveRate), // 351.02KiB estimated, about 1/100k chance of false positive
+		DataBlockThresholdBytes:    3584,
+		DataBlockSize:              4096,
+		DataBlockFillRatio:         0,
+		LocalCacheDir:              nil,
+		ZSTDCompressionLevel:       0,
+		ZSTDDictionarySampleBytes:  0,
+		BlockIndexPartitionEntries: 0,
+		LZ4Compression:             false,
+		Codec:                      nil,
+		RowSequence:                false,
+		ValueCompressionThreshold:  0,
+		LegacyTombstoneSource:      false,
+		Sync:                       false,
+		BulkMode:                   false,
+		BackgroundBloomFilter:      false,
+		DisableBlockPadding:        false,
+		Epoch:                      0,
+		RateLimiter:                nil,
+		Deterministic:              false,
+		MetaBlockZSTDCompression:   false,
+		UserMetadata:               nil,
+		BlockedBloomFilter:         nil,
+		KeyFilter:                  KeyFilterNone,
+		BloomFilterZSTDCompression: false,
+		CreatedAt:                  time.Time{},
+	}
+}
+
+// createdAt returns CreatedAt, or the current time if zero and not Deterministic
+func (o SegmentWriterOptions) createdAt() time.Time {
+	if o.CreatedAt.IsZero() && !o.Deterministic {
+		return time.Now()
+	}
+	return o.CreatedAt
+}
+
+// dataBlockThreshold returns DataBlockThresholdBytes, or derives it from DataBlockFillRatio if set
+func (o SegmentWriterOptions) dataBlockThreshold() (uint64, error) {
+	if o.DataBlockFillRatio == 0 {
+		return o.DataBlockThresholdBytes, nil
+	}
+	if !(o.DataBlockFillRatio > 0 && o.DataBlockFillRatio <= 1) {
+		return 0, fmt.Errorf("%w, got %f", ErrInvalidDataBlockFillRatio, o.DataBlockFillRatio)
 	}
+	return max(1, uint64(o.DataBlockFillRatio*float64(o.DataBlockSize))), nil
 }
@@ -2,11 +2,20 @@ package sst
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestSegmentWriterNoCompression(t *testing.T) {
@@ -125,3 +134,1538 @@ func TestEmptyKey(t *testing.T) {
 		t.Fatal("did not get invalid key error, got:", err)
 	}
 }
+
+func TestSegmentWriterRawBlocks(t *testing.T) {
+	for _, zstdLevel := range []int{0, 1} {
+		for _, withBloom := range []bool{false, true} {
+			t.Run(fmt.Sprintf("zstd=%d bloom=%t", zstdLevel, withBloom), func(t *testing.T) {
+				// write the source segment
+				b := &bytes.Buffer{}
+				opts := DefaultSegmentWriterOptions()
+				opts.BloomFilter = nil
+				opts.ZSTDCompressionLevel = zstdLevel
+				w := NewSegmentWriter(
+					BytesWriteCloser{
+						b,
+					}, opts)
+				for i := 0; i < 500; i++ {
+					key := []byte(fmt.Sprintf("key%03d", i))
+					val := []byte(fmt.Sprintf("value%03d", i))
+					err := w.WriteRow(key, val)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				segmentLength, _, err := w.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r := NewSegmentReader(
+					BytesReadSeekCloser{
+						Reader: bytes.NewReader(b.Bytes()),
+					}, int(segmentLength))
+				metadata, err := r.FetchAndLoadMetadata()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// copy every block verbatim into a new segment
+				copied := &bytes.Buffer{}
+				copyOpts := DefaultSegmentWriterOptions()
+				if !withBloom {
+					copyOpts.BloomFilter = nil
+				}
+				copyOpts.ZSTDCompressionLevel = zstdLevel
+				cw := NewSegmentWriter(
+					BytesWriteCloser{
+						copied,
+					}, copyOpts)
+				metadata.BlockIndex.Ascend(func(item BlockStat) bool {
+					raw, err := r.ReadRawBlock(item)
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = cw.WriteRawBlock(metadata, item, raw)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return true
+				})
+				copiedLength, _, err := cw.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cr := NewSegmentReader(
+					BytesReadSeekCloser{
+						Reader: bytes.NewReader(copied.Bytes()),
+					}, int(copiedLength))
+				copiedMetadata, err := cr.FetchAndLoadMetadata()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(metadata.FirstKey, copiedMetadata.FirstKey) || !bytes.Equal(metadata.LastKey, copiedMetadata.LastKey) {
+					t.Fatal("first/last key mismatch, got", string(copiedMetadata.FirstKey), string(copiedMetadata.LastKey))
+				}
+				if metadata.BlockIndex.Len() != copiedMetadata.BlockIndex.Len() {
+					t.Fatal("block index size mismatch")
+				}
+				if withBloom != (copiedMetadata.BloomFilter != nil) {
+					t.Fatal("unexpected bloom filter presence")
+				}
+
+				// verify identical reads
+				iter, err := r.RowIter(DirectionAscending)
+				if err != nil {
+					t.Fatal(err)
+				}
+				copiedIter, err := cr.RowIter(DirectionAscending)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rowCount := 0
+				for {
+					row, err := iter.Next()
+					copiedRow, copiedErr := copiedIter.Next()
+					if errors.Is(err, io.EOF) && errors.Is(copiedErr, io.EOF) {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if copiedErr != nil {
+						t.Fatal(copiedErr)
+					}
+					if !bytes.Equal(row.Key, copiedRow.Key) || !bytes.Equal(row.Value, copiedRow.Value) {
+						t.Fatal("row mismatch", string(row.Key), string(copiedRow.Key))
+					}
+					rowCount++
+				}
+				if rowCount != 500 {
+					t.Fatal("expected 500 rows, got", rowCount)
+				}
+
+				row, err := cr.GetRow([]byte("key250"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(row.Value, []byte("value250")) {
+					t.Fatal("unexpected value", string(row.Value))
+				}
+			})
+		}
+	}
+}
+
+func TestSegmentWriterRawBlockInvalid(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			b,
+		}, opts)
+	err := w.WriteRow([]byte("key1"), []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(
+		BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		}, int(segmentLength))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := metadata.BlockIndex.Min()
+	raw, err := r.ReadRawBlock(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw := NewSegmentWriter(
+		BytesWriteCloser{
+			&bytes.Buffer{},
+		}, opts)
+	err = cw.WriteRow([]byte("key2"), []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// out of order block
+	err = cw.WriteRawBlock(metadata, stat, raw)
+	if !errors.Is(err, ErrInvalidRawBlock) {
+		t.Fatal("did not get invalid raw block error, got:", err)
+	}
+
+	// corrupted block
+	corrupted := bytes.Clone(raw)
+	corrupted[0]++
+	stat.FirstKey = []byte("key3")
+	err = cw.WriteRawBlock(metadata, stat, corrupted)
+	if !errors.Is(err, ErrInvalidRawBlock) {
+		t.Fatal("did not get invalid raw block error, got:", err)
+	}
+}
+
+func TestSegmentWriterRawBlockOverlap(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	for i := 1; i <= 5; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewSegmentReader(BytesReadSeekCloser{Reader: bytes.NewReader(b.Bytes())}, int(segmentLength))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := metadata.BlockIndex.Min()
+	raw, err := r.ReadRawBlock(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+	err = cw.WriteRawBlock(metadata, stat, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows must be after the last key of the raw block, not just its first key
+	err = cw.WriteRow([]byte("key3"), []byte("value3"))
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey, got", err)
+	}
+
+	// as must the next raw block
+	overlapping := stat
+	overlapping.FirstKey = []byte("key3")
+	err = cw.WriteRawBlock(metadata, overlapping, raw)
+	if !errors.Is(err, ErrInvalidRawBlock) {
+		t.Fatal("expected ErrInvalidRawBlock, got", err)
+	}
+
+	err = cw.WriteRow([]byte("key6"), []byte("value6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = cw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentWriterRawBlockRowFormat(t *testing.T) {
+	// readSource writes a segment with the options, returning its metadata and first raw block
+	readSource := func(opts SegmentWriterOptions) (*SegmentMetadata, BlockStat, []byte) {
+		b := &bytes.Buffer{}
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		err := w.WriteKVPair(KVPair{Key: []byte("key1"), Value: bytes.Repeat([]byte("v"), 100), Seq: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, _ := metadata.BlockIndex.Min()
+		raw, err := r.ReadRawBlock(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata, stat, raw
+	}
+
+	plain := DefaultSegmentWriterOptions()
+	plain.BloomFilter = nil
+	withSequence := plain
+	withSequence.RowSequence = true
+	withValueCompression := plain
+	withValueCompression.ValueCompressionThreshold = 10
+	withZSTD := plain
+	withZSTD.ZSTDCompressionLevel = 1
+
+	for _, tc := range []struct {
+		name     string
+		source   SegmentWriterOptions
+		writer   SegmentWriterOptions
+		expected error
+	}{
+		{"same row format", withSequence, withSequence, nil},
+		{"source row sequence", withSequence, plain, ErrRowFormatMismatch},
+		{"writer row sequence", plain, withSequence, ErrRowFormatMismatch},
+		{"source value compression", withValueCompression, plain, ErrRowFormatMismatch},
+		{"source compression", withZSTD, plain, ErrInvalidRawBlock},
+	} {
+		metadata, stat, raw := readSource(tc.source)
+		w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, tc.writer)
+		err := w.WriteRawBlock(metadata, stat, raw)
+		if !errors.Is(err, tc.expected) {
+			t.Fatal("expected", tc.expected, "got", err, "for", tc.name)
+		}
+	}
+
+	// version 1 segments mark tombstones with an empty value, see TestSegmentWriterLegacyTombstoneSource
+	segment, err := os.ReadFile(filepath.Join("testdata", "v1.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := metadata.BlockIndex.Min()
+	raw, err := r.ReadRawBlock(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, plain)
+	err = w.WriteRawBlock(metadata, stat, raw)
+	if !errors.Is(err, ErrRowFormatMismatch) {
+		t.Fatal("expected ErrRowFormatMismatch for a version 1 source, got", err)
+	}
+	metadata, _, _ = readSource(plain)
+	legacy := plain
+	legacy.LegacyTombstoneSource = true
+	w = NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, legacy)
+	err = w.WriteRawBlock(metadata, stat, raw)
+	if !errors.Is(err, ErrRowFormatMismatch) {
+		t.Fatal("expected ErrRowFormatMismatch for LegacyTombstoneSource with a version 2 source, got", err)
+	}
+}
+
+func TestSegmentWriterLegacyTombstoneSource(t *testing.T) {
+	// copy a version 1 segment, where rows with an empty value are tombstones
+	segment, err := os.ReadFile(filepath.Join("testdata", "v1.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	sourceMetadata, err := source.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultSegmentWriterOptions()
+	opts.LegacyTombstoneSource = true
+	b := &bytes.Buffer{}
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	var rawBlocks, rowBlocks int
+	sourceMetadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		raw, err := source.ReadRawBlock(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// blocks without a tombstone are copied verbatim, and get row stats even though the source index has none
+		err = w.WriteRawBlock(sourceMetadata, stat, raw)
+		if err == nil {
+			rawBlocks++
+			return true
+		}
+		if !errors.Is(err, ErrInvalidRawBlock) {
+			t.Fatal("expected ErrInvalidRawBlock, got", err)
+		}
+
+		// a block with a tombstone can't be copied verbatim, so its encoded rows are written, with the empty values
+		// written as tombstones
+		rowBlocks++
+		rows, err := source.ReadBlockWithStat(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			encoded := binary.LittleEndian.AppendUint16(nil, uint16(len(row.Key)))
+			encoded = binary.LittleEndian.AppendUint32(encoded, uint32(len(row.Value)))
+			encoded = append(append(encoded, row.Key...), row.Value...)
+			err = w.WriteEncodedRow(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true
+	})
+	if rawBlocks == 0 || rowBlocks == 0 {
+		t.Fatal("expected both raw and row blocks, got", rawBlocks, rowBlocks)
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.Tombstones || metadata.RowCount != 50 || metadata.TombstoneCount != 5 || metadata.MinValueLength != 9 || metadata.MaxValueLength != 9 {
+		t.Fatal("unexpected row stats", metadata.RowCount, metadata.TombstoneCount, metadata.MinValueLength, metadata.MaxValueLength)
+	}
+	row, err := r.GetRow([]byte("key-025"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !row.IsTombstone() {
+		t.Fatal("expected the empty encoded value to be a tombstone")
+	}
+	row, err = r.GetRow([]byte("key-026"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.IsTombstone() || string(row.Value) != "value-026" {
+		t.Fatal("unexpected row", row)
+	}
+}
+
+func TestSegmentWriterRowSequence(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.RowSequence = true
+	opts.ZSTDCompressionLevel = 1
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			b,
+		}, opts)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := []byte(fmt.Sprintf("value%03d", i))
+		var err error
+		if i%2 == 0 {
+			err = w.WriteRowWithSeq(key, val, uint64(1000-i))
+		} else {
+			// rows without a sequence number get 0
+			err = w.WriteRow(key, val)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(
+		BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		}, int(segmentLength))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.RowSequence {
+		t.Fatal("expected row sequence in metadata")
+	}
+
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			if i != 500 {
+				t.Fatal("expected 500 rows, got", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(row.Key) != fmt.Sprintf("key%03d", i) || string(row.Value) != fmt.Sprintf("value%03d", i) {
+			t.Fatal("unexpected row", string(row.Key), string(row.Value))
+		}
+		expectedSeq := uint64(0)
+		if i%2 == 0 {
+			expectedSeq = uint64(1000 - i)
+		}
+		if row.Seq != expectedSeq {
+			t.Fatal("unexpected seq for", string(row.Key), "got", row.Seq)
+		}
+	}
+
+	row, err := r.GetRow([]byte("key100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Seq != 900 {
+		t.Fatal("unexpected seq", row.Seq)
+	}
+
+	// must enable the option
+	w = NewSegmentWriter(
+		BytesWriteCloser{
+			&bytes.Buffer{},
+		}, DefaultSegmentWriterOptions())
+	err = w.WriteRowWithSeq([]byte("key"), []byte("value"), 1)
+	if !errors.Is(err, ErrRowSequenceDisabled) {
+		t.Fatal("did not get row sequence disabled error, got:", err)
+	}
+}
+
+func TestSegmentWriterTombstoneCount(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			b,
+		}, opts)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := []byte(fmt.Sprintf("value%03d", i))
+		var err error
+		if i%5 == 0 {
+			err = w.WriteTombstone(key)
+		} else {
+			err = w.WriteRow(key, val)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.BlockIndex.Len() < 2 {
+		t.Fatal("expected multiple blocks, got", metadata.BlockIndex.Len())
+	}
+	if metadata.RowCount != 500 {
+		t.Fatal("unexpected row count", metadata.RowCount)
+	}
+	if metadata.TombstoneCount != 100 {
+		t.Fatal("unexpected tombstone count", metadata.TombstoneCount)
+	}
+	if ratio := metadata.TombstoneRatio(); ratio != 0.2 {
+		t.Fatal("unexpected tombstone ratio", ratio)
+	}
+	if ratio := (&SegmentMetadata{}).TombstoneRatio(); ratio != 0 {
+		t.Fatal("unexpected empty tombstone ratio", ratio)
+	}
+}
+
+// syncRecordingWriter records the number of Sync calls, and whether any writes happened after a sync
+type syncRecordingWriter struct {
+	BytesWriteCloser
+	syncs          int
+	writeAfterSync bool
+}
+
+func (s *syncRecordingWriter) Write(p []byte) (int, error) {
+	if s.syncs > 0 {
+		s.writeAfterSync = true
+	}
+	return s.BytesWriteCloser.Write(p)
+}
+
+func (s *syncRecordingWriter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestSegmentWriterSync(t *testing.T) {
+	for _, sync := range []bool{false, true} {
+		writer := &syncRecordingWriter{
+			BytesWriteCloser: BytesWriteCloser{
+				&bytes.Buffer{},
+			},
+		}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.Sync = sync
+		w := NewSegmentWriter(writer, opts)
+		for i := 0; i < 200; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if writer.syncs != 0 {
+			t.Fatal("synced before Close")
+		}
+		_, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedSyncs := 0
+		if sync {
+			expectedSyncs = 1
+		}
+		if writer.syncs != expectedSyncs {
+			t.Fatal("expected", expectedSyncs, "syncs, got", writer.syncs)
+		}
+		if writer.writeAfterSync {
+			t.Fatal("wrote after sync")
+		}
+	}
+}
+
+func TestSegmentWriterValueLengthStats(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	w := NewSegmentWriter(
+		BytesWriteCloser{
+			b,
+		}, opts)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		// values get smaller, so the smallest is in the last block
+		val := []byte(strings.Repeat("a", 600-i))
+		var err error
+		if i%5 == 0 {
+			// tombstones are excluded
+			err = w.WriteTombstone(key)
+		} else {
+			err = w.WriteRow(key, val)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, metadataBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.BlockIndex.Len() < 2 {
+		t.Fatal("expected multiple blocks, got", metadata.BlockIndex.Len())
+	}
+	if metadata.MinValueLength != 101 {
+		t.Fatal("unexpected min value length", metadata.MinValueLength)
+	}
+	if metadata.MaxValueLength != 599 {
+		t.Fatal("unexpected max value length", metadata.MaxValueLength)
+	}
+
+	// only tombstones
+	w = NewSegmentWriter(
+		BytesWriteCloser{
+			&bytes.Buffer{},
+		}, opts)
+	err = w.WriteTombstone([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, metadataBytes, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = (&SegmentReader{}).BytesToMetadata(metadataBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.MinValueLength != 0 || metadata.MaxValueLength != 0 {
+		t.Fatal("unexpected value lengths", metadata.MinValueLength, metadata.MaxValueLength)
+	}
+}
+
+func TestSegmentWriterBulkMode(t *testing.T) {
+	for _, disablePadding := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BulkMode = true
+		opts.DisableBlockPadding = disablePadding
+		w := NewSegmentWriter(
+			BytesWriteCloser{
+				b,
+			}, opts)
+
+		for i := 0; i < 2000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		segmentLen, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		}, int(segmentLen))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+			if padded := stat.BlockSize%opts.DataBlockSize == 0; padded == disablePadding {
+				t.Fatal("unexpected block size", stat.BlockSize, "with padding disabled", disablePadding)
+			}
+			return true
+		})
+
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if !metadata.BloomFilter.Test(key) {
+				t.Fatal("key missing from bloom filter", string(key))
+			}
+			row, err := r.GetRow(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(row.Value) != fmt.Sprintf("value%04d", i) {
+				t.Fatal("unexpected value", string(row.Value))
+			}
+		}
+	}
+}
+
+func TestSegmentWriterBackgroundBloomFilter(t *testing.T) {
+	for _, bulk := range []bool{false, true} {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BulkMode = bulk
+		opts.BackgroundBloomFilter = true
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		// more than a batch of keys, and not a multiple of one
+		for i := 0; i < 5000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, metaBytes, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, err := (&SegmentReader{}).BytesToMetadata(metaBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5000; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if !metadata.BloomFilter.Test(key) {
+				t.Fatal("key missing from bloom filter", string(key), "in bulk mode", bulk)
+			}
+		}
+	}
+}
+
+func BenchmarkSegmentWriter(b *testing.B) {
+	const rows = 100_000
+	keys := make([][]byte, rows)
+	vals := make([][]byte, rows)
+	totalBytes := 0
+	for i := 0; i < rows; i++ {
+		keys[i] = []byte(fmt.Sprintf("key%08d", i))
+		vals[i] = bytes.Repeat([]byte{byte(i)}, 100)
+		totalBytes += len(keys[i]) + len(vals[i])
+	}
+
+	bulkOpts := DefaultSegmentWriterOptions()
+	bulkOpts.BulkMode = true
+	bulkOpts.DisableBlockPadding = true
+
+	backgroundOpts := DefaultSegmentWriterOptions()
+	backgroundOpts.BackgroundBloomFilter = true
+
+	bulkBackgroundOpts := bulkOpts
+	bulkBackgroundOpts.BloomFilter = bulkOpts.BloomFilter.Copy()
+	bulkBackgroundOpts.BackgroundBloomFilter = true
+
+	for name, opts := range map[string]SegmentWriterOptions{
+		"default":         DefaultSegmentWriterOptions(),
+		"background":      backgroundOpts,
+		"bulk":            bulkOpts,
+		"bulk-background": bulkBackgroundOpts,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(totalBytes))
+			sink := &bytes.Buffer{}
+			sink.Grow(2 * totalBytes)
+			for n := 0; n < b.N; n++ {
+				opts.BloomFilter.ClearAll()
+				sink.Reset()
+				w := NewSegmentWriter(
+					BytesWriteCloser{
+						sink,
+					}, opts)
+				for i := 0; i < rows; i++ {
+					err := w.WriteRow(keys[i], vals[i])
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				_, _, err := w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentWriterValueCompression(t *testing.T) {
+	for _, zstdLevel := range []int{0, 1} {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.ZSTDCompressionLevel = zstdLevel
+		opts.ValueCompressionThreshold = 1024
+		w := NewSegmentWriter(
+			BytesWriteCloser{
+				b,
+			}, opts)
+
+		// large compressible values mixed with small ones and tombstones in the same block
+		values := map[string][]byte{}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			switch i % 3 {
+			case 0:
+				values[key] = bytes.Repeat([]byte(key), 1000)
+			case 1:
+				values[key] = []byte("small")
+			case 2:
+				values[key] = nil
+			}
+			err := w.WriteRow([]byte(key), values[key])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		segmentLength, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{
+			Reader: bytes.NewReader(b.Bytes()),
+		}, int(segmentLength))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !metadata.ValueCompression {
+			t.Fatal("expected value compression")
+		}
+		if metadata.BlockIndex.Len() != 1 {
+			t.Fatal("expected the large values to be compressed into one block, got blocks", metadata.BlockIndex.Len())
+		}
+		if metadata.MaxValueLength != 6000 {
+			t.Fatal("expected value stats to use the uncompressed length, got", metadata.MaxValueLength)
+		}
+
+		stat, _ := metadata.BlockIndex.Min()
+		rows, err := r.ReadBlockWithStat(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(values) {
+			t.Fatal("unexpected row count", len(rows))
+		}
+		for _, row := range rows {
+			if !bytes.Equal(row.Value, values[string(row.Key)]) {
+				t.Fatal("unexpected value for", string(row.Key))
+			}
+		}
+	}
+}
+
+func TestSegmentWriterDeterministic(t *testing.T) {
+	writeSegment := func() []byte {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.ZSTDCompressionLevel = 3
+		opts.ValueCompressionThreshold = 64
+		opts.Deterministic = true
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			val := bytes.Repeat([]byte(fmt.Sprintf("value%d", i*7919)), i%20)
+			err := w.WriteRow(key, val)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	first := writeSegment()
+	second := writeSegment()
+	if !bytes.Equal(first, second) {
+		t.Fatal("segments are not byte-identical")
+	}
+}
+
+func TestSegmentWriterWriteRowTracked(t *testing.T) {
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+
+	var flushedStats []BlockStat
+	var blockBytes uint64
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		val := bytes.Repeat([]byte("v"), i%50)
+		flushed, err := w.WriteRowTracked(key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// uncompressed row header is the key and value length
+		blockBytes += uint64(6 + len(key) + len(val))
+		crossed := blockBytes >= opts.DataBlockThresholdBytes
+		if crossed != (flushed != nil) {
+			t.Fatal("unexpected flush at row", i, "block bytes", blockBytes, "flushed", flushed != nil)
+		}
+		if flushed == nil {
+			continue
+		}
+		if flushed.OriginalSize != blockBytes {
+			t.Fatal("unexpected flushed block size", flushed.OriginalSize, "expected", blockBytes)
+		}
+		flushedStats = append(flushedStats, *flushed)
+		blockBytes = 0
+	}
+	_, metaBytes, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flushedStats) < 2 {
+		t.Fatal("expected multiple flushes, got", len(flushedStats))
+	}
+
+	// every flushed block is in the block index, with the final block flushed at Close
+	metadata, err := (&SegmentReader{}).BytesToMetadata(metaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.BlockIndex.Len() != len(flushedStats)+1 {
+		t.Fatal("unexpected block count", metadata.BlockIndex.Len())
+	}
+	for _, stat := range flushedStats {
+		indexed, found := metadata.BlockIndex.Get(stat)
+		if !found || indexed.Offset != stat.Offset || indexed.Hash != stat.Hash || indexed.RowCount != stat.RowCount {
+			t.Fatal("flushed block not in the block index", string(stat.FirstKey))
+		}
+	}
+}
+
+func TestSegmentWriterMetaBlockCompression(t *testing.T) {
+	writeSegment := func(compress bool) ([]byte, []byte) {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.MetaBlockZSTDCompression = compress
+		opts.CreatedAt = time.Unix(1_700_000_000, 0)
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 20_000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%06d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, metaBytes, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes(), metaBytes
+	}
+	metaRegionLength := func(segment []byte) int {
+		return len(segment) - int(binary.LittleEndian.Uint64(segment[len(segment)-25:])) - 25
+	}
+
+	uncompressed, uncompressedMetaBytes := writeSegment(false)
+	compressed, compressedMetaBytes := writeSegment(true)
+	if metaRegionLength(compressed) >= metaRegionLength(uncompressed) {
+		t.Fatal("expected a smaller meta region, got", metaRegionLength(compressed), "uncompressed", metaRegionLength(uncompressed))
+	}
+	if !bytes.Equal(compressedMetaBytes, uncompressedMetaBytes) {
+		t.Fatal("expected Close to return the uncompressed meta block")
+	}
+
+	for _, lazy := range []bool{false, true} {
+		readerOpts := DefaultSegmentReaderOptions()
+		readerOpts.LazyBloomFilter = lazy
+		r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(compressed)}, len(compressed), readerOpts)
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.BlockIndex.Len() < 100 {
+			t.Fatal("expected many blocks, got", metadata.BlockIndex.Len())
+		}
+		if string(metadata.FirstKey) != "key000000" || string(metadata.LastKey) != "key019999" || metadata.RowCount != 20_000 {
+			t.Fatal("unexpected metadata", string(metadata.FirstKey), string(metadata.LastKey), metadata.RowCount)
+		}
+		if metadata.BloomFilter == nil {
+			t.Fatal("expected the bloom filter to be loaded from the compressed meta block")
+		}
+
+		row, err := r.GetRow([]byte("key012345"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(row.Value) != "value012345" {
+			t.Fatal("unexpected value", string(row.Value))
+		}
+	}
+}
+
+func TestSegmentWriterUserMetadata(t *testing.T) {
+	writeSegment := func(userMetadata []byte) ([]byte, []byte) {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.UserMetadata = userMetadata
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 2_000; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%06d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, metaBytes, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes(), metaBytes
+	}
+
+	userMetadata := []byte(`{"table":"users","partition":3}`)
+	segment, metaBytes := writeSegment(userMetadata)
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(metadata.UserMetadata, userMetadata) {
+		t.Fatal("expected user metadata", string(userMetadata), "got", string(metadata.UserMetadata))
+	}
+	metadata, err = r.BytesToMetadata(metaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(metadata.UserMetadata, userMetadata) {
+		t.Fatal("expected user metadata from the meta block bytes, got", string(metadata.UserMetadata))
+	}
+
+	// a version 1 reader rejects the segment by its version, rather than misreading the meta block
+	_, err = readMetadataVersion1(segment)
+	if !errors.Is(err, errVersion1UnknownVersion) {
+		t.Fatal("expected the version 1 reader to reject the segment version, got", err)
+	}
+
+	// version 1 segments have no user metadata
+	v1Segment, err := os.ReadFile(filepath.Join("testdata", "v1.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockCount, err := readMetadataVersion1(v1Segment)
+	if err != nil {
+		t.Fatal("version 1 reader can't read a version 1 segment:", err)
+	}
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(v1Segment)}, len(v1Segment))
+	metadata, err = r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.UserMetadata != nil || metadata.BlockIndex.Len() != blockCount {
+		t.Fatal("unexpected version 1 metadata", string(metadata.UserMetadata), metadata.BlockIndex.Len())
+	}
+
+	segment, _ = writeSegment(nil)
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(segment)}, len(segment))
+	metadata, err = r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.UserMetadata != nil {
+		t.Fatal("expected no user metadata, got", string(metadata.UserMetadata))
+	}
+}
+
+var errVersion1UnknownVersion = errors.New("unknown segment version")
+
+// readMetadataVersion1 is a frozen copy of how the first release of the SegmentReader loaded the metadata of a
+// segment, returning the number of blocks in the block index. It only knew segment version 1.
+func readMetadataVersion1(segment []byte) (blockCount int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidMetaBlock, r)
+		}
+	}()
+
+	trailer := segment[len(segment)-25:]
+	if binary.LittleEndian.Uint64(trailer[17:]) != MagicNumber {
+		return 0, ErrInvalidMagicNumber
+	}
+	if trailer[16] != 1 {
+		return 0, fmt.Errorf("%w: expected=%d got=%d", errVersion1UnknownVersion, 1, trailer[16])
+	}
+	metaBlockOffset := binary.LittleEndian.Uint64(trailer[0:8])
+	metaBlockBytes := segment[metaBlockOffset : len(segment)-25]
+	if xxhash.Sum64(metaBlockBytes) != binary.LittleEndian.Uint64(trailer[8:16]) {
+		return 0, ErrMismatchedMetaBlockHash
+	}
+
+	metaReader := bytes.NewReader(metaBlockBytes)
+	// first and last key
+	for i := 0; i < 2; i++ {
+		mustReadBytes(metaReader, int(binary.LittleEndian.Uint16(mustReadBytes(metaReader, 2))))
+	}
+	// bloom filter
+	if mustReadBytes(metaReader, 1)[0] == 1 {
+		mustReadBytes(metaReader, int(binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8))))
+	}
+	// compression, then the block index type
+	mustReadBytes(metaReader, 1)
+	mustReadBytes(metaReader, 1)
+	numEntries := int(binary.LittleEndian.Uint64(mustReadBytes(metaReader, 8)))
+	if numEntries == 0 {
+		return 0, fmt.Errorf("%w: had no data block entries", ErrInvalidMetaBlock)
+	}
+	for i := 0; i < numEntries; i++ {
+		mustReadBytes(metaReader, int(binary.LittleEndian.Uint16(mustReadBytes(metaReader, 2))))
+		mustReadBytes(metaReader, 40)
+	}
+
+	return numEntries, nil
+}
+
+func TestSegmentWriterWriteEncodedRow(t *testing.T) {
+	valueEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encodeRow encodes a row in the data block row format of opts, like SegmentWriter.writeRow
+	encodeRow := func(opts SegmentWriterOptions, key, val []byte, seq uint64) []byte {
+		valueFlags := byte(valueFlagNone)
+		if opts.ValueCompressionThreshold > 0 && len(val) > 0 && uint32(len(val)) >= opts.ValueCompressionThreshold {
+			val = valueEncoder.EncodeAll(val, nil)
+			valueFlags = valueFlagZSTD
+		}
+		row := binary.LittleEndian.AppendUint16(nil, uint16(len(key)))
+		row = binary.LittleEndian.AppendUint32(row, uint32(len(val)))
+		if opts.RowSequence {
+			row = binary.LittleEndian.AppendUint64(row, seq)
+		}
+		if opts.ValueCompressionThreshold > 0 {
+			row = append(row, valueFlags)
+		}
+		row = append(row, key...)
+		return append(row, val...)
+	}
+
+	for _, format := range []struct {
+		rowSequence               bool
+		valueCompressionThreshold uint32
+	}{
+		{false, 0},
+		{true, 0},
+		{true, 64},
+	} {
+		opts := DefaultSegmentWriterOptions()
+		opts.RowSequence = format.rowSequence
+		opts.ValueCompressionThreshold = format.valueCompressionThreshold
+		opts.CreatedAt = time.Unix(1_700_000_000, 0)
+
+		rowBytes, encodedBytes := &bytes.Buffer{}, &bytes.Buffer{}
+		rowWriter := NewSegmentWriter(BytesWriteCloser{rowBytes}, opts)
+		encodedOpts := opts
+		encodedOpts.BloomFilter = opts.BloomFilter.Copy()
+		encodedWriter := NewSegmentWriter(BytesWriteCloser{encodedBytes}, encodedOpts)
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			val := bytes.Repeat([]byte(fmt.Sprintf("value%d", i)), i%20)
+			if opts.RowSequence {
+				err = rowWriter.WriteRowWithSeq(key, val, uint64(i+1))
+			} else {
+				err = rowWriter.WriteRow(key, val)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = encodedWriter.WriteEncodedRow(encodeRow(opts, key, val, uint64(i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, rowMeta, err := rowWriter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, encodedMeta, err := encodedWriter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rowBytes.Bytes(), encodedBytes.Bytes()) || !bytes.Equal(rowMeta, encodedMeta) {
+			t.Fatal("expected identical segments for format", format)
+		}
+	}
+}
+
+func TestSegmentWriterWriteEncodedRowInvalid(t *testing.T) {
+	opts := DefaultSegmentWriterOptions()
+	opts.ValueCompressionThreshold = 64
+	w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+
+	for name, encoded := range map[string][]byte{
+		"short header":    {3, 0, 0, 0},
+		"length mismatch": {3, 0, 5, 0, 0, 0, valueFlagNone, 'k', 'e', 'y', 'v'},
+		"value flags":     {3, 0, 1, 0, 0, 0, 7, 'k', 'e', 'y', 'v'},
+		"zstd value":      {3, 0, 1, 0, 0, 0, valueFlagZSTD, 'k', 'e', 'y', 'v'},
+	} {
+		err := w.WriteEncodedRow(encoded)
+		if !errors.Is(err, ErrInvalidEncodedRow) {
+			t.Fatal("expected ErrInvalidEncodedRow for", name, "got", err)
+		}
+	}
+
+	err := w.WriteEncodedRow([]byte{0, 0, 1, 0, 0, 0, valueFlagNone, 'v'})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey for an empty key, got", err)
+	}
+}
+
+func TestSegmentWriterDataBlockFillRatio(t *testing.T) {
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.DataBlockSize = 8192
+	opts.DataBlockFillRatio = 0.5
+	b := &bytes.Buffer{}
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	if w.options.DataBlockThresholdBytes != 4096 {
+		t.Fatal("expected a derived threshold of 4096, got", w.options.DataBlockThresholdBytes)
+	}
+
+	// every row is the same length
+	var rowLength uint64
+	for i := 0; i < 2_000; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		val := []byte(fmt.Sprintf("value%08d", i))
+		rowLength = uint64(w.rowHeaderLength() + len(key) + len(val))
+		err := w.WriteRow(key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks roll over on the row that reaches the threshold
+	last, _ := metadata.BlockIndex.Max()
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if stat.Offset != last.Offset && (stat.OriginalSize < 4096 || stat.OriginalSize >= 4096+rowLength) {
+			t.Fatal("expected blocks to fill to the threshold, got", stat.OriginalSize)
+		}
+		if stat.BlockSize != 8192 {
+			t.Fatal("expected blocks padded to 8192, got", stat.BlockSize)
+		}
+		return true
+	})
+
+	for _, ratio := range []float64{-0.5, 1.5, math.NaN()} {
+		opts := DefaultSegmentWriterOptions()
+		opts.DataBlockFillRatio = ratio
+		w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+		err := w.WriteRow([]byte("key"), []byte("value"))
+		if !errors.Is(err, ErrInvalidDataBlockFillRatio) {
+			t.Fatal("expected ErrInvalidDataBlockFillRatio for", ratio, "got", err)
+		}
+	}
+}
+
+func TestSegmentWriterRecordsBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		blockSize      uint64
+		fillRatio      float64
+		threshold      uint64
+		disablePadding bool
+	}{
+		{blockSize: 4096, threshold: 4096},
+		{blockSize: 8192, fillRatio: 0.5, threshold: 4096},
+		{blockSize: 16384, threshold: 16384, disablePadding: true},
+	} {
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.DataBlockSize = tc.blockSize
+		opts.DataBlockThresholdBytes = tc.blockSize
+		opts.DataBlockFillRatio = tc.fillRatio
+		opts.DisableBlockPadding = tc.disablePadding
+		b := &bytes.Buffer{}
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < 100; i++ {
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.DataBlockSize != tc.blockSize {
+			t.Fatal("expected data block size", tc.blockSize, "got", metadata.DataBlockSize)
+		}
+		if metadata.DataBlockThresholdBytes != tc.threshold {
+			t.Fatal("expected data block threshold", tc.threshold, "got", metadata.DataBlockThresholdBytes)
+		}
+		if metadata.DataBlockPadding == tc.disablePadding {
+			t.Fatal("expected data block padding", !tc.disablePadding, "got", metadata.DataBlockPadding)
+		}
+	}
+}
+
+func TestSegmentWriterCreatedAt(t *testing.T) {
+	readCreatedAt := func(opts SegmentWriterOptions) time.Time {
+		opts.BloomFilter = nil
+		b := &bytes.Buffer{}
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		err := w.WriteRow([]byte("key"), []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.CreatedAt
+	}
+
+	opts := DefaultSegmentWriterOptions()
+	opts.CreatedAt = time.Unix(1_700_000_000, 123)
+	if createdAt := readCreatedAt(opts); !createdAt.Equal(opts.CreatedAt) {
+		t.Fatal("expected created at", opts.CreatedAt, "got", createdAt)
+	}
+
+	// defaults to the time of Close
+	before := time.Now()
+	createdAt := readCreatedAt(DefaultSegmentWriterOptions())
+	if createdAt.Before(before) || createdAt.After(time.Now()) {
+		t.Fatal("expected created at to be the time of Close, got", createdAt)
+	}
+
+	// not stored for deterministic segments
+	opts = DefaultSegmentWriterOptions()
+	opts.Deterministic = true
+	if createdAt := readCreatedAt(opts); !createdAt.IsZero() {
+		t.Fatal("expected no created at for a deterministic segment, got", createdAt)
+	}
+}
+
+func TestSegmentWriterLZ4(t *testing.T) {
+	// a random row doesn't compress, so the block is stored as is
+	b := &bytes.Buffer{}
+	opts := DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.LZ4Compression = true
+	opts.DisableBlockPadding = true
+	w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+	key, value := make([]byte, 16), make([]byte, 2_000)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rand.Read(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteRow(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if stat.CompressedSize != stat.OriginalSize || stat.BlockSize != stat.OriginalSize {
+			t.Fatal("expected the block to be stored as is, got", stat.CompressedSize, stat.OriginalSize, stat.BlockSize)
+		}
+		rows, err := r.ReadBlockWithStat(stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || !bytes.Equal(rows[0].Key, key) || !bytes.Equal(rows[0].Value, value) {
+			t.Fatal("unexpected rows", len(rows))
+		}
+		return true
+	})
+
+	// blocks are filled by their uncompressed size
+	buf := &bytes.Buffer{}
+	opts = DefaultSegmentWriterOptions()
+	opts.BloomFilter = nil
+	opts.LZ4Compression = true
+	w = NewSegmentWriter(BytesWriteCloser{buf}, opts)
+	for i := 0; i < 2_000; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("value%08d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	length, _, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(buf.Bytes())}, int(length))
+	metadata, err = r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _ := metadata.BlockIndex.Max()
+	metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+		if stat.Offset != last.Offset && stat.OriginalSize < opts.DataBlockThresholdBytes {
+			t.Fatal("expected the block to be filled to the threshold, got", stat.OriginalSize)
+		}
+		if stat.BlockSize != opts.DataBlockSize {
+			t.Fatal("expected the block to be padded to", opts.DataBlockSize, "got", stat.BlockSize)
+		}
+		return true
+	})
+}
+
+func TestSegmentWriterZSTDDictionary(t *testing.T) {
+	writeSegment := func(sampleBytes uint64, rows int) (SegmentReader, *SegmentMetadata) {
+		b := &bytes.Buffer{}
+		opts := DefaultSegmentWriterOptions()
+		opts.BloomFilter = nil
+		opts.ZSTDCompressionLevel = 1
+		opts.ZSTDDictionarySampleBytes = sampleBytes
+		opts.DataBlockThresholdBytes = 512
+		opts.DataBlockSize = 512
+		opts.DisableBlockPadding = true
+		opts.Deterministic = true
+		w := NewSegmentWriter(BytesWriteCloser{b}, opts)
+		for i := 0; i < rows; i++ {
+			value := fmt.Sprintf(`{"id":%d,"name":"user-%d","status":"active","region":"us-east-1"}`, i, i%97)
+			err := w.WriteRow([]byte(fmt.Sprintf("key%08d", i)), []byte(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		length, _, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewSegmentReader(BytesReadSeekCloser{bytes.NewReader(b.Bytes())}, int(length))
+		metadata, err := r.FetchAndLoadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter, err := r.RowIter(DirectionAscending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			row, err := iter.Next()
+			if errors.Is(err, io.EOF) {
+				if i != rows {
+					t.Fatal("expected", rows, "rows, got", i)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(row.Key) != fmt.Sprintf("key%08d", i) {
+				t.Fatal("unexpected key", string(row.Key))
+			}
+		}
+		return r, metadata
+	}
+	compressedSize := func(metadata *SegmentMetadata) (size uint64) {
+		metadata.BlockIndex.Ascend(func(stat BlockStat) bool {
+			size += stat.CompressedSize
+			return true
+		})
+		return
+	}
+
+	_, plain := writeSegment(0, 5_000)
+	r, withDictionary := writeSegment(16*1024, 5_000)
+	if plain.ZSTDDictionary != nil || withDictionary.ZSTDDictionary == nil {
+		t.Fatal("expected only the sampled segment to have a dictionary")
+	}
+	if compressedSize(withDictionary) >= compressedSize(plain) {
+		t.Fatal("expected the dictionary to shrink the blocks, got", compressedSize(withDictionary), compressedSize(plain))
+	}
+	t.Log("blocks without dictionary", compressedSize(plain), "with dictionary", compressedSize(withDictionary), "dictionary", len(withDictionary.ZSTDDictionary))
+
+	// dictionary blocks can't be copied to another segment
+	stat, _ := withDictionary.BlockIndex.Min()
+	raw, err := r.ReadRawBlock(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultSegmentWriterOptions()
+	opts.ZSTDCompressionLevel = 1
+	opts.ZSTDDictionarySampleBytes = 16 * 1024
+	w := NewSegmentWriter(BytesWriteCloser{&bytes.Buffer{}}, opts)
+	err = w.WriteRawBlock(withDictionary, stat, raw)
+	if !errors.Is(err, ErrInvalidRawBlock) {
+		t.Fatal("expected ErrInvalidRawBlock, got", err)
+	}
+
+	// too few rows to train a dictionary
+	_, metadata := writeSegment(16*1024, 1)
+	if metadata.ZSTDDictionary != nil {
+		t.Fatal("expected no dictionary for a single row")
+	}
+}
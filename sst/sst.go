@@ -1,7 +0,0 @@
-package sst
-
-import "github.com/danthegoodman1/objectkv/gologger"
-
-var (
-	globalLogger = gologger.NewLogger()
-)
@@ -0,0 +1,37 @@
+package sst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrInvalidRateLimiter = errors.New("invalid rate limiter")
+
+// waitForBytes blocks until the limiter allows n bytes, waiting in chunks of the limiter burst so blocks larger
+// than the burst can still be paced. Does nothing if the limiter is nil.
+//
+// This is checked between blocks, so compaction (reading blocks from input segments and writing them to an output
+// segment) can be paced to keep from saturating a shared remote store.
+func waitForBytes(limiter *rate.Limiter, n int) error {
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := min(n, limiter.Burst())
+		if chunk <= 0 {
+			// a burst of 0 would never allow any bytes
+			return fmt.Errorf("%w: rate limiter has no burst", ErrInvalidRateLimiter)
+		}
+		err := limiter.WaitN(context.Background(), chunk)
+		if err != nil {
+			return fmt.Errorf("error in limiter.WaitN: %w", err)
+		}
+		n -= chunk
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestCompactionRateLimit(t *testing.T) {
+	input := &bytes.Buffer{}
+	w := NewSegmentWriter(BytesWriteCloser{input}, DefaultSegmentWriterOptions())
+	for i := 0; i < 200; i++ {
+		err := w.WriteRow([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte("v"), 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputLength, _, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shared between the input reader and output writer
+	const bytesPerSecond = 200_000
+	limiter := rate.NewLimiter(bytesPerSecond, 4096)
+
+	readerOpts := DefaultSegmentReaderOptions()
+	readerOpts.RateLimiter = limiter
+	r := NewSegmentReaderWithOptions(BytesReadSeekCloser{bytes.NewReader(input.Bytes())}, int(inputLength), readerOpts)
+	metadata, err := r.FetchAndLoadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writerOpts := DefaultSegmentWriterOptions()
+	writerOpts.RateLimiter = limiter
+	output := &bytes.Buffer{}
+	ow := NewSegmentWriter(BytesWriteCloser{output}, writerOpts)
+
+	start := time.Now()
+	iter, err := r.RowIter(DirectionAscending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		row, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ow.WriteRow(row.Key, row.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = ow.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	var blockBytes int
+	metadata.BlockIndex.Ascend(func(item BlockStat) bool {
+		blockBytes += int(item.BlockSize)
+		return true
+	})
+	// everything was read, then written, minus the initial burst
+	expected := time.Duration(float64(2*blockBytes-limiter.Burst()) / bytesPerSecond * float64(time.Second))
+	t.Log("block bytes", blockBytes, "elapsed", elapsed, "expected", expected)
+	if elapsed < expected*9/10 || elapsed > expected*3/2 {
+		t.Fatal("compaction did not respect the rate limit, elapsed", elapsed, "expected", expected)
+	}
+
+	// blocks larger than the burst are waited for in chunks
+	err = waitForBytes(rate.NewLimiter(bytesPerSecond, 10), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitForBytes(rate.NewLimiter(bytesPerSecond, 0), 1000)
+	if !errors.Is(err, ErrInvalidRateLimiter) {
+		t.Fatal("expected invalid rate limiter, got", err)
+	}
+}
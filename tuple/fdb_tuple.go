@@ -22,6 +22,7 @@ package tuple
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -146,6 +147,32 @@ func (v Versionstamp) Bytes() []byte {
 	return scratch[:]
 }
 
+// Uint64BE is an unsigned integer element packed as a fixed 8 byte big-endian value, rather than the variable length
+// integer encoding of uint64. Packed elements sort numerically, which suits timestamp or counter keys where the
+// layout is fixed. Unpacks as Uint64BE.
+type Uint64BE uint64
+
+// Int64BE is a signed integer element packed as a fixed 8 byte big-endian value with the sign bit flipped, so
+// negative values sort before positive values. Unpacks as Int64BE.
+type Int64BE int64
+
+// Boundary is a sentinel TupleElement that packs after any other element in its position, so Pack(x, Boundary) is
+// an exclusive upper bound for every tuple starting with x, e.g. Tuple{"users", Boundary}.Pack() for the end of
+// the "users" keys. It packs to the single byte 0xff, the same as the end of RangeKeys.
+//
+// Unlike a Strinc (increment the last byte) of Pack(x), it does not cover sibling tuples whose last element
+// shares a prefix, as the element terminator is part of the packed prefix, e.g. Tuple{"tab", Boundary} does not
+// include Tuple{"table"}.
+//
+// Boundary only marks range ends, packed bytes containing it can't be unpacked.
+var Boundary = boundary{}
+
+type boundary struct{}
+
+func (boundary) String() string {
+	return "Boundary"
+}
+
 // Type codes: These prefix the different elements in a packed Tuple
 // to indicate what type they are.
 const nilCode = 0x00
@@ -161,6 +188,10 @@ const falseCode = 0x26
 const trueCode = 0x27
 const uuidCode = 0x30
 const versionstampCode = 0x33
+const uint64BECode = 0x34
+const int64BECode = 0x35
+const uintCode = 0x36
+const boundaryCode = 0xff
 
 var sizeLimits = []uint64{
 	1<<(0*8) - 1,
@@ -199,6 +230,8 @@ func adjustFloatBytes(b []byte, encode bool) {
 type packer struct {
 	versionstampPos int32
 	buf             []byte
+	// typed packs uint and uint64 elements with uintCode, see PackTyped
+	typed bool
 }
 
 func newPacker() *packer {
@@ -251,6 +284,19 @@ func (p *packer) encodeUint(i uint64) {
 	p.putBytes(scratch[8-n:])
 }
 
+// encodeTypedUint encodes an unsigned integer as uintCode, the byte length, then the minimal big-endian bytes, so
+// they sort numerically
+func (p *packer) encodeTypedUint(i uint64) {
+	n := bisectLeft(i)
+	var scratch [8]byte
+
+	p.putByte(uintCode)
+	p.putByte(byte(n))
+	binary.BigEndian.PutUint64(scratch[:], i)
+
+	p.putBytes(scratch[8-n:])
+}
+
 func (p *packer) encodeInt(i int64) {
 	if i >= 0 {
 		p.encodeUint(uint64(i))
@@ -332,6 +378,11 @@ func (p *packer) encodeUUID(u UUID) {
 	p.putBytes(u[:])
 }
 
+func (p *packer) encodeFixedUint(code byte, u uint64) {
+	p.putByte(code)
+	p.putBytes(binary.BigEndian.AppendUint64(nil, u))
+}
+
 func (p *packer) encodeVersionstamp(v Versionstamp) {
 	p.putByte(versionstampCode)
 
@@ -366,9 +417,17 @@ func (p *packer) encodeTuple(t Tuple, nested bool, versionstamps bool) {
 		case int64:
 			p.encodeInt(e)
 		case uint:
-			p.encodeUint(uint64(e))
+			if p.typed {
+				p.encodeTypedUint(uint64(e))
+			} else {
+				p.encodeUint(uint64(e))
+			}
 		case uint64:
-			p.encodeUint(e)
+			if p.typed {
+				p.encodeTypedUint(e)
+			} else {
+				p.encodeUint(e)
+			}
 		case *big.Int:
 			p.encodeBigInt(e)
 		case big.Int:
@@ -391,6 +450,13 @@ func (p *packer) encodeTuple(t Tuple, nested bool, versionstamps bool) {
 			}
 		case UUID:
 			p.encodeUUID(e)
+		case Uint64BE:
+			p.encodeFixedUint(uint64BECode, uint64(e))
+		case Int64BE:
+			// flip the sign bit so negative values sort first
+			p.encodeFixedUint(int64BECode, uint64(e)^(1<<63))
+		case boundary:
+			p.putByte(boundaryCode)
 		case Versionstamp:
 			if versionstamps == false && e.TransactionVersion == incompleteTransactionVersion {
 				panic(fmt.Sprintf("Incomplete Versionstamp included in vanilla tuple pack"))
@@ -398,6 +464,10 @@ func (p *packer) encodeTuple(t Tuple, nested bool, versionstamps bool) {
 
 			p.encodeVersionstamp(e)
 		default:
+			if registered, found := lookupTypeByElement(e); found {
+				p.encodeBytes(registered.code, registered.encode(e))
+				break
+			}
 			panic(fmt.Sprintf("unencodable element at index %d (%v, type %T)", i, t[i], t[i]))
 		}
 	}
@@ -410,7 +480,7 @@ func (p *packer) encodeTuple(t Tuple, nested bool, versionstamps bool) {
 // Pack returns a new byte slice encoding the provided tuple. Pack will panic if
 // the tuple contains an element of any type other than []byte,
 // fdb.KeyConvertible, string, int64, int, uint64, uint, *big.Int, big.Int, float32,
-// float64, bool, tuple.UUID, tuple.Versionstamp, nil, or a Tuple with elements of
+// float64, bool, tuple.UUID, tuple.Uint64BE, tuple.Int64BE, tuple.Versionstamp, nil, or a Tuple with elements of
 // valid types. It will also panic if an integer is specified with a value outside
 // the range [-2**2040+1, 2**2040-1]
 //
@@ -426,12 +496,36 @@ func (t Tuple) Pack() []byte {
 	return p.buf
 }
 
+// PackTyped is like Pack, but uint and uint64 elements are packed with their own type code, so UnpackTyped returns
+// them as uint64 rather than int64. Unsigned elements packed this way sort numerically with each other, but after
+// every signed integer, rather than with them, and the packed bytes are not readable by other FoundationDB tuple
+// implementations.
+func (t Tuple) PackTyped() []byte {
+	p := newPacker()
+	p.typed = true
+	p.encodeTuple(t, false, false)
+	return p.buf
+}
+
+// ErrInvalidTuple is returned when bytes do not correctly encode a tuple, the error includes the offset and type code
+// of the element that could not be decoded
+var ErrInvalidTuple = errors.New("invalid tuple")
+
+// invalidTupleError creates an error wrapping ErrInvalidTuple with the offset and type code of the element
+func invalidTupleError(offset int, code byte, format string, args ...any) error {
+	return fmt.Errorf("%w at offset %d (type 0x%02x): %s", ErrInvalidTuple, offset, code, fmt.Sprintf(format, args...))
+}
+
+// findTerminator returns the index of the terminating 0x00 byte, or -1 if there is none
 func findTerminator(b []byte) int {
 	bp := b
 	var length int
 
 	for {
 		idx := bytes.IndexByte(bp, 0x00)
+		if idx < 0 {
+			return -1
+		}
 		length += idx
 		if idx+1 == len(bp) || bp[idx+1] != 0xFF {
 			break
@@ -488,6 +582,19 @@ func decodeInt(b []byte) (interface{}, int) {
 	return uint64(ret), n + 1
 }
 
+// decodeTypedUint decodes an unsigned integer from encodeTypedUint. If not typed, it is normalized like decodeInt.
+func decodeTypedUint(b []byte, typed bool) (interface{}, int) {
+	n := int(b[1])
+	bp := make([]byte, 8)
+	copy(bp[8-n:], b[2:n+2])
+
+	ret := binary.BigEndian.Uint64(bp)
+	if !typed && ret <= math.MaxInt64 {
+		return int64(ret), n + 2
+	}
+	return ret, n + 2
+}
+
 func decodeBigInt(b []byte) (interface{}, int) {
 	val := new(big.Int)
 	offset := 1
@@ -559,7 +666,9 @@ func decodeVersionstamp(b []byte) (Versionstamp, int) {
 	}, versionstampLength + 1
 }
 
-func decodeTuple(b []byte, nested bool) (Tuple, int, error) {
+// decodeTuple decodes the tuple in b, where base is the offset of b in the original bytes for errors. If typed,
+// unsigned integers from PackTyped are decoded as uint64.
+func decodeTuple(b []byte, base int, nested, typed bool) (Tuple, int, error) {
 	var t Tuple
 
 	var i int
@@ -568,6 +677,42 @@ func decodeTuple(b []byte, nested bool) (Tuple, int, error) {
 		var el interface{}
 		var off int
 
+		// the number of bytes the element needs, checked before decoding
+		var need int
+		switch {
+		case b[i] == bytesCode || b[i] == stringCode:
+			if findTerminator(b[i+1:]) < 0 {
+				return nil, i, invalidTupleError(base+i, b[i], "missing terminator")
+			}
+		case negIntStart+1 < b[i] && b[i] < posIntEnd:
+			n := int(b[i]) - intZeroCode
+			need = max(n, -n) + 1
+		case b[i] == negIntStart || b[i] == posIntEnd:
+			if i+1 >= len(b) {
+				need = 2
+				break
+			}
+			length := int(b[i+1])
+			if b[i] == negIntStart {
+				length ^= 0xff
+			}
+			need = length + 2
+		case b[i] == negIntStart+1:
+			need = 9
+		case b[i] == uintCode:
+			if i+1 >= len(b) {
+				need = 2
+				break
+			}
+			if b[i+1] > 8 {
+				return nil, i, invalidTupleError(base+i, b[i], "invalid unsigned integer length %d", b[i+1])
+			}
+			need = int(b[i+1]) + 2
+		}
+		if i+need > len(b) {
+			return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode integer")
+		}
+
 		switch {
 		case b[i] == nilCode:
 			if !nested {
@@ -591,12 +736,12 @@ func decodeTuple(b []byte, nested bool) (Tuple, int, error) {
 			el, off = decodeBigInt(b[i:])
 		case b[i] == floatCode:
 			if i+5 > len(b) {
-				return nil, i, fmt.Errorf("insufficient bytes to decode float starting at position %d of byte array for tuple", i)
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode float")
 			}
 			el, off = decodeFloat(b[i:])
 		case b[i] == doubleCode:
 			if i+9 > len(b) {
-				return nil, i, fmt.Errorf("insufficient bytes to decode double starting at position %d of byte array for tuple", i)
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode double")
 			}
 			el, off = decodeDouble(b[i:])
 		case b[i] == trueCode:
@@ -607,36 +752,75 @@ func decodeTuple(b []byte, nested bool) (Tuple, int, error) {
 			off = 1
 		case b[i] == uuidCode:
 			if i+17 > len(b) {
-				return nil, i, fmt.Errorf("insufficient bytes to decode UUID starting at position %d of byte array for tuple", i)
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode UUID")
 			}
 			el, off = decodeUUID(b[i:])
+		case b[i] == uint64BECode:
+			if i+9 > len(b) {
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode Uint64BE")
+			}
+			el, off = Uint64BE(binary.BigEndian.Uint64(b[i+1:i+9])), 9
+		case b[i] == int64BECode:
+			if i+9 > len(b) {
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode Int64BE")
+			}
+			el, off = Int64BE(binary.BigEndian.Uint64(b[i+1:i+9])^(1<<63)), 9
+		case b[i] == uintCode:
+			el, off = decodeTypedUint(b[i:], typed)
 		case b[i] == versionstampCode:
 			if i+versionstampLength+1 > len(b) {
-				return nil, i, fmt.Errorf("insufficient bytes to decode Versionstamp starting at position %d of byte array for tuple", i)
+				return nil, i, invalidTupleError(base+i, b[i], "insufficient bytes to decode Versionstamp")
 			}
 			el, off = decodeVersionstamp(b[i:])
 		case b[i] == nestedCode:
 			var err error
-			el, off, err = decodeTuple(b[i+1:], true)
+			el, off, err = decodeTuple(b[i+1:], base+i+1, true, typed)
 			if err != nil {
+				// already has the offset of the nested element
 				return nil, i, err
 			}
 			off++
 		default:
-			return nil, i, fmt.Errorf("unable to decode tuple element with unknown typecode %02x", b[i])
+			registered, found := lookupTypeByCode(b[i])
+			if !found {
+				return nil, i, invalidTupleError(base+i, b[i], "unknown type code")
+			}
+			if findTerminator(b[i+1:]) < 0 {
+				return nil, i, invalidTupleError(base+i, b[i], "missing terminator")
+			}
+			var encoded []byte
+			encoded, off = fdbDecodeBytes(b[i:])
+			var err error
+			el, err = registered.decode(encoded)
+			if err != nil {
+				return nil, i, fmt.Errorf("%w at offset %d (type 0x%02x): error decoding registered type %s: %w", ErrInvalidTuple, base+i, b[i], registered.t, err)
+			}
 		}
 
 		t = append(t, el)
 		i += off
 	}
 
+	if nested {
+		// never found the terminating 0x00
+		return nil, i, invalidTupleError(base-1, nestedCode, "missing nested tuple terminator")
+	}
+
 	return t, i, nil
 }
 
 // Unpack returns the tuple encoded by the provided byte slice, or an error if
 // the key does not correctly encode a tuple.
 func Unpack(b []byte) (Tuple, error) {
-	t, _, err := decodeTuple(b, false)
+	t, _, err := decodeTuple(b, 0, false, false)
+	return t, err
+}
+
+// UnpackTyped is like Unpack, but keeps the signedness of unsigned integers packed with PackTyped, returning them
+// as uint64. Unpack returns them as int64 (or uint64 if too large), the same as unsigned integers packed with Pack,
+// whose encoding does not record the signedness.
+func UnpackTyped(b []byte) (Tuple, error) {
+	t, _, err := decodeTuple(b, 0, false, true)
 	return t, err
 }
 
@@ -644,11 +828,44 @@ func Unpack(b []byte) (Tuple, error) {
 // represents all keys that encode tuples strictly starting with a Tuple (that
 // is, all tuples of greater length than the Tuple of which the Tuple is a
 // prefix).
+//
+// The range is [start, end), and only includes tuples extending t by one or more elements, not t itself or sibling
+// tuples whose last element shares a prefix, e.g. (a, "tab") does not include (a, "table"), as the string
+// terminator is part of the packed prefix.
 func (t Tuple) RangeKeys() ([]byte, []byte) {
 	p := t.Pack()
 	return concat(p, 0x00), concat(p, 0xFF)
 }
 
+// PackRange returns the byte range [startKey, endKey) between two tuples, for range scans such as
+// snapshot_reader.Reader.GetRange.
+//
+// The start tuple is included and the end tuple is excluded, as are tuples extending them, e.g. PackRange((a, 1),
+// (a, 5)) includes (a, 1) and (a, 4, "x") but not (a, 5) or (a, 5, "x"). To include tuples extending end, use
+// Boundary as its last element, e.g. (a, 5, Boundary).
+func PackRange(start, end Tuple) ([]byte, []byte) {
+	return start.Pack(), end.Pack()
+}
+
+// Concat returns a new Tuple with the elements of other appended to the elements of t. This is useful for
+// building composite keys from a base subspace tuple and a suffix, e.g. base.Concat(suffix).
+//
+// Packing the result is identical to packing a Tuple of the combined elements.
+func (t Tuple) Concat(other Tuple) Tuple {
+	r := make(Tuple, len(t)+len(other))
+	copy(r, t)
+	copy(r[len(t):], other)
+	return r
+}
+
+// Slice returns a new Tuple with the elements [i, j) of t. It will panic if the indexes are out of range, like
+// slicing does.
+func (t Tuple) Slice(i, j int) Tuple {
+	r := make(Tuple, j-i)
+	copy(r, t[i:j])
+	return r
+}
+
 func concat(a []byte, b ...byte) []byte {
 	r := make([]byte, len(a)+len(b))
 	copy(r, a)
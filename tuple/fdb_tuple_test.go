@@ -2,7 +2,10 @@ package tuple
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"reflect"
 	"sort"
@@ -153,6 +156,62 @@ func TestTupleBrokenTuples(t *testing.T) {
 	}
 }
 
+func TestTupleDecodeErrorOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr string
+	}{
+		{
+			name:    "unterminated bytes",
+			input:   []byte{bytesCode, 'a'},
+			wantErr: "invalid tuple at offset 0 (type 0x01)",
+		},
+		{
+			name:    "truncated float after string",
+			input:   append(Tuple{"ab"}.Pack(), floatCode, 0x00),
+			wantErr: "invalid tuple at offset 4 (type 0x20)",
+		},
+		{
+			name:    "truncated int",
+			input:   []byte{0x15, 0x01, 0x18, 0x01},
+			wantErr: "invalid tuple at offset 2 (type 0x18)",
+		},
+		{
+			name:    "truncated big int",
+			input:   []byte{trueCode, posIntEnd, 0x05, 0x01},
+			wantErr: "invalid tuple at offset 1 (type 0x1d)",
+		},
+		{
+			name:    "unknown type code",
+			input:   append(Tuple{true, false}.Pack(), 0xFF),
+			wantErr: "invalid tuple at offset 2 (type 0xff)",
+		},
+		{
+			name:    "truncated double in nested tuple",
+			input:   []byte{0x15, 0x01, nestedCode, stringCode, 'x', 0x00, doubleCode, 0x00},
+			wantErr: "invalid tuple at offset 6 (type 0x21)",
+		},
+		{
+			name:    "unterminated nested tuple",
+			input:   []byte{trueCode, nestedCode, stringCode, 'x', 0x00},
+			wantErr: "invalid tuple at offset 1 (type 0x05)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unpack(tt.input)
+			if !errors.Is(err, ErrInvalidTuple) {
+				t.Fatalf("Unpack() error = %v, want ErrInvalidTuple", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Unpack() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestTuplePanicCases(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -243,3 +302,364 @@ func convertTupleToStrings(t Tuple) []string {
 	}
 	return result
 }
+
+func TestTupleConcat(t *testing.T) {
+	base := Tuple{"users", int64(42)}
+	suffix := Tuple{"posts", []byte{1, 2, 3}, true}
+
+	combined := base.Concat(suffix)
+	if !bytes.Equal(combined.Pack(), Tuple{"users", int64(42), "posts", []byte{1, 2, 3}, true}.Pack()) {
+		t.Errorf("Concat() packing did not match packing the combined tuple")
+	}
+
+	// concatenating should not modify the base
+	other := base.Concat(Tuple{"comments"})
+	if !reflect.DeepEqual(combined.Slice(0, 3), Tuple{"users", int64(42), "posts"}) {
+		t.Errorf("Concat() modified a previous result, got %v", combined)
+	}
+	if len(base) != 2 || len(other) != 3 {
+		t.Errorf("Concat() modified the base tuple")
+	}
+
+	if !bytes.Equal(base.Concat(nil).Pack(), base.Pack()) {
+		t.Errorf("Concat() with an empty tuple did not match the base")
+	}
+	if !bytes.Equal(Tuple{}.Concat(suffix).Pack(), suffix.Pack()) {
+		t.Errorf("Concat() onto an empty tuple did not match the suffix")
+	}
+}
+
+func TestTupleSlice(t *testing.T) {
+	tup := Tuple{"a", "b", "c", "d"}
+
+	tests := []struct {
+		name     string
+		i, j     int
+		expected Tuple
+	}{
+		{
+			name:     "full",
+			i:        0,
+			j:        4,
+			expected: Tuple{"a", "b", "c", "d"},
+		},
+		{
+			name:     "prefix",
+			i:        0,
+			j:        2,
+			expected: Tuple{"a", "b"},
+		},
+		{
+			name:     "suffix",
+			i:        2,
+			j:        4,
+			expected: Tuple{"c", "d"},
+		},
+		{
+			name:     "empty",
+			i:        2,
+			j:        2,
+			expected: Tuple{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tup.Slice(tt.i, tt.j)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Slice() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+
+	// slicing then concatenating should pack the same as the original
+	if !bytes.Equal(tup.Slice(0, 1).Concat(tup.Slice(1, 4)).Pack(), tup.Pack()) {
+		t.Errorf("Slice() and Concat() did not round trip")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Slice() out of range did not panic")
+		}
+	}()
+	tup.Slice(2, 5)
+}
+
+func TestTupleUUID(t *testing.T) {
+	uuids := make([]UUID, 100)
+	for i := range uuids {
+		_, err := rand.Read(uuids[i][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// include the edges
+	uuids = append(uuids, UUID{}, UUID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	packed := make([][]byte, len(uuids))
+	for i, u := range uuids {
+		packed[i] = Tuple{u}.Pack()
+
+		// fixed width
+		if len(packed[i]) != 17 {
+			t.Fatalf("expected 17 packed bytes, got %d", len(packed[i]))
+		}
+
+		// round trip
+		unpacked, err := Unpack(packed[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(unpacked, Tuple{u}) {
+			t.Errorf("UUID round trip mismatch: got %v, want %v", unpacked, u)
+		}
+	}
+
+	// packed ordering is the same as the raw bytes
+	for i := range uuids {
+		for j := range uuids {
+			if bytes.Compare(packed[i], packed[j]) != bytes.Compare(uuids[i][:], uuids[j][:]) {
+				t.Fatalf("packed ordering mismatch between %v and %v", uuids[i], uuids[j])
+			}
+		}
+	}
+
+	// nested with other elements keeps the UUID ordering
+	first := Tuple{"user", uuids[len(uuids)-2], "a"}.Pack()
+	second := Tuple{"user", uuids[len(uuids)-1], "a"}.Pack()
+	if bytes.Compare(first, second) >= 0 {
+		t.Errorf("expected the smaller UUID to sort first")
+	}
+
+	// truncated
+	_, err := Unpack(packed[0][:16])
+	if err == nil || !strings.Contains(err.Error(), "insufficient bytes to decode UUID") {
+		t.Errorf("expected truncated UUID error, got %v", err)
+	}
+}
+
+func TestRangeKeysElementPrefix(t *testing.T) {
+	start, end := Tuple{"tenant", "tab"}.RangeKeys()
+	inRange := func(tuple Tuple) bool {
+		packed := tuple.Pack()
+		return bytes.Compare(packed, start) >= 0 && bytes.Compare(packed, end) < 0
+	}
+
+	for _, tuple := range []Tuple{
+		{"tenant", "tab", int64(1)},
+		{"tenant", "tab", nil},
+		{"tenant", "tab", "id", "more"},
+		{"tenant", "tab", []byte{0xff}},
+		{"tenant", "tab", Tuple{"nested"}},
+		{"tenant", "tab", true},
+	} {
+		if !inRange(tuple) {
+			t.Fatal("expected tuple in range", tuple)
+		}
+	}
+
+	for _, tuple := range []Tuple{
+		{"tenant", "tab"},
+		{"tenant", "table"},
+		{"tenant", "table", int64(1)},
+		{"tenant", "ta", int64(1)},
+		{"tenant", "tab\x00", int64(1)},
+		{"tenant", []byte("tab"), int64(1)},
+		{"tenant2", "tab", int64(1)},
+	} {
+		if inRange(tuple) {
+			t.Fatal("expected tuple out of range", tuple)
+		}
+	}
+}
+
+func TestTupleBoundary(t *testing.T) {
+	end := Tuple{"tenant", "tab", Boundary}.Pack()
+	_, rangeEnd := Tuple{"tenant", "tab"}.RangeKeys()
+	if !bytes.Equal(end, rangeEnd) {
+		t.Fatal("expected Boundary to pack to the RangeKeys end", Printable(end), Printable(rangeEnd))
+	}
+
+	for _, tuple := range []Tuple{
+		{"tenant", "tab"},
+		{"tenant", "tab", nil},
+		{"tenant", "tab", int64(math.MaxInt64)},
+		{"tenant", "tab", []byte{0xff, 0xff}},
+		{"tenant", "tab", "\xff\xff"},
+		{"tenant", "tab", Tuple{"nested", Boundary}},
+		{"tenant", "tab", true},
+		{"tenant", "tab", UUID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"tenant", "tab", math.Inf(1)},
+	} {
+		packed := tuple.Pack()
+		if bytes.Compare(packed, end) >= 0 {
+			t.Fatal("expected tuple before the boundary", tuple)
+		}
+	}
+
+	// sibling tuples sharing a prefix are after the boundary
+	for _, tuple := range []Tuple{
+		{"tenant", "table"},
+		{"tenant", "tab\x00"},
+		{"tenant2"},
+	} {
+		if bytes.Compare(tuple.Pack(), end) <= 0 {
+			t.Fatal("expected tuple after the boundary", tuple)
+		}
+	}
+
+	// a nested boundary sorts after the nested tuple's elements
+	nestedEnd := Tuple{Tuple{"a", Boundary}}.Pack()
+	if bytes.Compare(nestedEnd, Tuple{Tuple{"a", "z"}}.Pack()) <= 0 {
+		t.Fatal("expected nested boundary after nested elements")
+	}
+
+	str := Tuple{"a", Boundary}.String()
+	if str != `("a", Boundary)` {
+		t.Fatal("unexpected string", str)
+	}
+}
+
+func TestPackRange(t *testing.T) {
+	start, end := PackRange(Tuple{"a", int64(1)}, Tuple{"a", int64(5)})
+	inRange := func(tuple Tuple) bool {
+		packed := tuple.Pack()
+		return bytes.Compare(packed, start) >= 0 && bytes.Compare(packed, end) < 0
+	}
+
+	for _, tuple := range []Tuple{
+		{"a", int64(1)},
+		{"a", int64(1), "x"},
+		{"a", int64(3)},
+		{"a", int64(4), nil},
+		{"a", int64(4), Tuple{"nested"}},
+	} {
+		if !inRange(tuple) {
+			t.Fatal("expected tuple in range", tuple)
+		}
+	}
+
+	for _, tuple := range []Tuple{
+		{"a"},
+		{"a", int64(0)},
+		{"a", int64(0), "x"},
+		{"a", int64(5)},
+		{"a", int64(5), "x"},
+		{"a", int64(6)},
+		{"b", int64(3)},
+	} {
+		if inRange(tuple) {
+			t.Fatal("expected tuple out of range", tuple)
+		}
+	}
+
+	// Boundary includes the tuples extending end
+	_, end = PackRange(Tuple{"a", int64(1)}, Tuple{"a", int64(5), Boundary})
+	if !inRange(Tuple{"a", int64(5), "x"}) || inRange(Tuple{"a", int64(6)}) {
+		t.Fatal("expected Boundary to include tuples extending end")
+	}
+}
+
+func TestTupleFixedWidthIntegers(t *testing.T) {
+	for _, tuple := range []Tuple{
+		{Uint64BE(0)},
+		{Uint64BE(1)},
+		{Uint64BE(math.MaxUint64)},
+		{Int64BE(math.MinInt64)},
+		{Int64BE(-1)},
+		{Int64BE(0)},
+		{Int64BE(math.MaxInt64)},
+	} {
+		packed := tuple.Pack()
+		if len(packed) != 9 {
+			t.Fatal("expected a fixed 9 byte encoding, got", len(packed), "for", tuple)
+		}
+		unpacked, err := Unpack(packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(unpacked, tuple) {
+			t.Fatal("expected", tuple, "got", unpacked)
+		}
+	}
+
+	// signed values sort numerically across the zero boundary
+	signed := []Int64BE{math.MinInt64, -1 << 32, -256, -1, 0, 1, 255, 1 << 32, math.MaxInt64}
+	for i := 1; i < len(signed); i++ {
+		if bytes.Compare(Tuple{signed[i-1]}.Pack(), Tuple{signed[i]}.Pack()) >= 0 {
+			t.Fatal("expected", signed[i-1], "to sort before", signed[i])
+		}
+	}
+	unsigned := []Uint64BE{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for i := 1; i < len(unsigned); i++ {
+		if bytes.Compare(Tuple{unsigned[i-1]}.Pack(), Tuple{unsigned[i]}.Pack()) >= 0 {
+			t.Fatal("expected", unsigned[i-1], "to sort before", unsigned[i])
+		}
+	}
+
+	// round trip within a composite key
+	key := Tuple{"events", Int64BE(-5), Uint64BE(42), "id"}
+	unpacked, err := Unpack(key.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unpacked, key) {
+		t.Fatal("expected", key, "got", unpacked)
+	}
+
+	_, err = Unpack([]byte{uint64BECode, 0x00, 0x01})
+	if !errors.Is(err, ErrInvalidTuple) {
+		t.Fatal("expected ErrInvalidTuple for a truncated Uint64BE, got", err)
+	}
+}
+
+func TestTupleTypedUnpack(t *testing.T) {
+	tuple := Tuple{uint64(0), uint64(123), uint(7), uint64(math.MaxUint64), int64(123), int64(-5), "id", Tuple{uint64(9), int64(9)}}
+	packed := tuple.PackTyped()
+
+	unpacked, err := UnpackTyped(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Tuple{uint64(0), uint64(123), uint64(7), uint64(math.MaxUint64), int64(123), int64(-5), "id", Tuple{uint64(9), int64(9)}}
+	if !reflect.DeepEqual(unpacked, expected) {
+		t.Fatal("expected", expected, "got", unpacked)
+	}
+
+	// Unpack normalizes them the same as integers packed with Pack
+	unpacked, err = Unpack(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := Unpack(tuple.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unpacked, normalized) {
+		t.Fatal("expected", normalized, "got", unpacked)
+	}
+
+	// the Pack encoding does not record the signedness
+	unpacked, err = UnpackTyped(Tuple{uint64(123)}.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := unpacked[0].(int64); !ok {
+		t.Fatalf("expected int64, got %T", unpacked[0])
+	}
+
+	// typed unsigned values sort numerically
+	unsigned := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for i := 1; i < len(unsigned); i++ {
+		if bytes.Compare(Tuple{unsigned[i-1]}.PackTyped(), Tuple{unsigned[i]}.PackTyped()) >= 0 {
+			t.Fatal("expected", unsigned[i-1], "to sort before", unsigned[i])
+		}
+	}
+
+	for _, invalid := range [][]byte{{uintCode}, {uintCode, 0x02, 0x01}, {uintCode, 0x09, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		_, err = UnpackTyped(invalid)
+		if !errors.Is(err, ErrInvalidTuple) {
+			t.Fatal("expected ErrInvalidTuple for", invalid, "got", err)
+		}
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"reflect"
 )
 
+// HierarchicalTuple is a tuple of []byte or string levels. A nil level is a placeholder (e.g. for an "any" level
+// when constructing ranges). As the last level it sorts before its concrete siblings, otherwise its subtree sorts
+// after theirs, so entries still order by hierarchy first.
 type HierarchicalTuple []any
 
 // Pack creates a tuple using byte elements
@@ -14,37 +17,33 @@ func (ht HierarchicalTuple) Pack() ([]byte, error) {
 }
 
 func (ht HierarchicalTuple) pack(skip int) ([]byte, error) {
-	if len(ht) == 0 {
-		// treat it as normal
-		t := Tuple{}
-		for _, element := range ht {
-			t = append(t, element)
-		}
-		return t.Pack(), nil
-	}
-
-	temp := make([][]byte, len(ht))
-	// Validate and convert elements
+	t := Tuple{}
 	for i, element := range ht {
+		// For all but the last item, we must prepend 0xff
+		hierarchical := i < len(ht)-skip
 		switch v := element.(type) {
 		case []byte:
-			temp[i] = v
+			if hierarchical {
+				v = append([]byte{0xff}, v...)
+			}
+			t = append(t, v)
 		case string:
-			temp[i] = []byte(v)
+			if hierarchical {
+				v = "\xff" + v
+			}
+			t = append(t, []byte(v))
+		case nil:
+			if hierarchical {
+				// a nested tuple sorts after the 0xff prefixed bytes of the concrete levels
+				t = append(t, Tuple{})
+			} else {
+				t = append(t, nil)
+			}
 		default:
 			return nil, fmt.Errorf("%w: got %T at index %d", ErrInvalidHierarchicalElement, element, i)
 		}
 	}
 
-	for i := 0; i < len(temp)-skip; i++ {
-		// For all but the last item, we must append 0xff
-		temp[i] = append([]byte{0xff}, temp[i]...)
-	}
-
-	t := Tuple{}
-	for _, element := range temp {
-		t = append(t, element)
-	}
 	return t.Pack(), nil
 }
 
@@ -59,22 +58,35 @@ func DecodeHierarchical(b []byte) (HierarchicalTuple, error) {
 	temp := make([]any, len(tuple))
 
 	for i, element := range tuple {
-		if b, ok := element.([]byte); ok {
-			temp[i] = b
+		last := i == len(tuple)-1
+		switch v := element.(type) {
+		case []byte:
+			if !last {
+				// For all but the last item, we must rip off the leading 0xff
+				if len(v) == 0 || v[0] != 0xff {
+					if i == 0 {
+						return nil, fmt.Errorf("%w: first element did not start with hierarchical byte", ErrInvalidHierarchicalElement)
+					}
+					return nil, fmt.Errorf("%w: element %d did not start with hierarchical byte", ErrInvalidHierarchicalElement, i)
+				}
+				v = v[1:]
+			}
+			temp[i] = v
 			continue
+		case Tuple:
+			if !last && len(v) == 0 {
+				temp[i] = nil
+				continue
+			}
+		case nil:
+			if last {
+				temp[i] = nil
+				continue
+			}
 		}
 		return nil, fmt.Errorf("%w: got %s", ErrInvalidHierarchicalElement, reflect.TypeOf(element))
 	}
 
-	if len(temp) > 1 && temp[0].([]byte)[0] != 0xff {
-		return nil, fmt.Errorf("%w: first element did not start with hierarchical byte", ErrInvalidHierarchicalElement)
-	}
-
-	for i := 0; i < len(temp)-1; i++ {
-		// For all but the last item, we must rip off the trailing 0xff
-		temp[i] = temp[i].([]byte)[1:]
-	}
-
 	return temp, nil
 }
 
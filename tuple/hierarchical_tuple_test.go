@@ -85,6 +85,16 @@ func TestHierarchicalInvalidInput(t *testing.T) {
 			input:   Tuple{[]byte("hey"), []byte("ho")}.Pack(),
 			wantErr: "first element did not start with hierarchical byte",
 		},
+		{
+			name:    "nil before the last element",
+			input:   Tuple{[]byte{0xff, 'a'}, nil, []byte("b")}.Pack(),
+			wantErr: "invalid hierarchical element",
+		},
+		{
+			name:    "truncated",
+			input:   append(Tuple{[]byte{0xff, 'a'}}.Pack(), bytesCode, 'b'),
+			wantErr: "invalid tuple at offset 4 (type 0x01)",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -154,3 +164,75 @@ func TestHierarchicalRangeKeys(t *testing.T) {
 		t.Fatalf("end range %q was not less than dirA1 %q", endRange, dirA1)
 	}
 }
+
+func TestHierarchicalNil(t *testing.T) {
+	// in hierarchical order
+	tuples := []HierarchicalTuple{
+		{nil},
+		{[]byte("dir")},
+		{[]byte("dir"), nil},
+		{[]byte("dir"), []byte("")},
+		{[]byte("dir"), []byte("a")},
+		{[]byte("dir"), []byte("a"), []byte("1")},
+		{[]byte("dir"), nil, []byte("1")},
+		{nil, []byte("a")},
+	}
+
+	keys := make([][]byte, len(tuples))
+	for i, ht := range tuples {
+		key, err := ht.Pack()
+		if err != nil {
+			t.Fatalf("%v.Pack() failed: %v", ht, err)
+		}
+		keys[i] = key
+
+		decoded, err := DecodeHierarchical(key)
+		if err != nil {
+			t.Fatalf("DecodeHierarchical(%q) failed: %v", key, err)
+		}
+		if len(decoded) != len(ht) {
+			t.Fatalf("DecodeHierarchical(%q) = %v, want %v", key, decoded, ht)
+		}
+		for j := range ht {
+			if ht[j] == nil {
+				if decoded[j] != nil {
+					t.Fatalf("DecodeHierarchical(%q) = %v, want nil at index %d", key, decoded, j)
+				}
+				continue
+			}
+			if decoded[j] == nil || !bytes.Equal(decoded[j].([]byte), ht[j].([]byte)) {
+				t.Fatalf("DecodeHierarchical(%q) = %v, want %v", key, decoded, ht)
+			}
+		}
+	}
+
+	for i := 0; i < len(keys)-1; i++ {
+		if bytes.Compare(keys[i], keys[i+1]) >= 0 {
+			t.Fatalf("Keys not in correct order at position %d and %d, %q >= %q", i, i+1, keys[i], keys[i+1])
+		}
+	}
+
+	// a nil last level is a direct child, its subtree isn't
+	start, end, err := HierarchicalTuple{[]byte("dir")}.RangeKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(keys[2], start) < 0 || bytes.Compare(keys[2], end) >= 0 {
+		t.Fatalf("expected %q in the range [%q, %q)", keys[2], start, end)
+	}
+	if bytes.Compare(keys[6], end) < 0 {
+		t.Fatalf("expected %q after the range end %q", keys[6], end)
+	}
+
+	// the children of a nil level
+	start, end, err = HierarchicalTuple{[]byte("dir"), nil}.RangeKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		inRange := bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+		if inRange != (i == 6) {
+			t.Fatalf("unexpected range membership %v for %q in [%q, %q)", inRange, key, start, end)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package tuple
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+)
+
+type (
+	// EncodeFunc encodes a custom type into bytes that sort in the same order as the values
+	EncodeFunc func(e TupleElement) []byte
+	// DecodeFunc decodes the bytes from an EncodeFunc back into the custom type
+	DecodeFunc func(b []byte) (TupleElement, error)
+
+	registeredType struct {
+		code   byte
+		t      reflect.Type
+		encode EncodeFunc
+		decode DecodeFunc
+	}
+)
+
+// The FoundationDB tuple spec reserves these type codes for user types
+const (
+	userTypeCodeStart = 0x40
+	userTypeCodeEnd   = 0x4f
+)
+
+var (
+	ErrInvalidTypeCode        = errors.New("invalid type code, must be in the user type range [0x40, 0x4f]")
+	ErrTypeAlreadyRegistered  = errors.New("type already registered")
+	ErrTypeCodeAlreadyInUse   = errors.New("type code already in use")
+	ErrCannotRegisterType     = errors.New("cannot register a type that is natively encodable")
+	registeredTypesMu         = &sync.RWMutex{}
+	registeredTypesByType     = map[reflect.Type]registeredType{}
+	registeredTypesByTypeCode = map[byte]registeredType{}
+)
+
+// RegisterType allows a custom Go type to be packed and unpacked in a Tuple with its own type code, which must be
+// in the user type range [0x40, 0x4f]. Elements of the type are ordered first by type code, then by the bytes
+// returned from encode, so encode must produce bytes that sort in the same order as the values.
+//
+// Types should be registered before any tuples containing them are packed or unpacked, such as in an init function.
+func RegisterType(t reflect.Type, code byte, encode EncodeFunc, decode DecodeFunc) error {
+	if code < userTypeCodeStart || code > userTypeCodeEnd {
+		return fmt.Errorf("%w: got %02x", ErrInvalidTypeCode, code)
+	}
+	if isNativeType(t) {
+		return fmt.Errorf("%w: %s", ErrCannotRegisterType, t)
+	}
+
+	registeredTypesMu.Lock()
+	defer registeredTypesMu.Unlock()
+
+	if _, exists := registeredTypesByType[t]; exists {
+		return fmt.Errorf("%w: %s", ErrTypeAlreadyRegistered, t)
+	}
+	if existing, exists := registeredTypesByTypeCode[code]; exists {
+		return fmt.Errorf("%w: %02x used by %s", ErrTypeCodeAlreadyInUse, code, existing.t)
+	}
+
+	registered := registeredType{
+		code:   code,
+		t:      t,
+		encode: encode,
+		decode: decode,
+	}
+	registeredTypesByType[t] = registered
+	registeredTypesByTypeCode[code] = registered
+	return nil
+}
+
+// isNativeType returns whether the type is handled by the tuple encoding directly, so would never use a registered
+// type
+func isNativeType(t reflect.Type) bool {
+	switch reflect.Zero(t).Interface().(type) {
+	case Tuple, int, int64, uint, uint64, *big.Int, big.Int, []byte, string, float32, float64, bool, UUID, Uint64BE, Int64BE, Versionstamp:
+		return true
+	}
+	return false
+}
+
+func lookupTypeByElement(e TupleElement) (registeredType, bool) {
+	registeredTypesMu.RLock()
+	defer registeredTypesMu.RUnlock()
+	registered, found := registeredTypesByType[reflect.TypeOf(e)]
+	return registered, found
+}
+
+func lookupTypeByCode(code byte) (registeredType, bool) {
+	registeredTypesMu.RLock()
+	defer registeredTypesMu.RUnlock()
+	registered, found := registeredTypesByTypeCode[code]
+	return registered, found
+}
@@ -0,0 +1,93 @@
+package tuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testPoint struct {
+	X, Y uint32
+}
+
+func init() {
+	err := RegisterType(reflect.TypeOf(testPoint{}), 0x40, func(e TupleElement) []byte {
+		point := e.(testPoint)
+		b := binary.BigEndian.AppendUint32(nil, point.X)
+		return binary.BigEndian.AppendUint32(b, point.Y)
+	}, func(b []byte) (TupleElement, error) {
+		if len(b) != 8 {
+			return nil, errors.New("expected 8 bytes")
+		}
+		return testPoint{
+			X: binary.BigEndian.Uint32(b[:4]),
+			Y: binary.BigEndian.Uint32(b[4:]),
+		}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterTypeRoundTrip(t *testing.T) {
+	// 0 bytes in the encoding must be escaped
+	original := Tuple{"points", testPoint{X: 0, Y: 256}, Tuple{testPoint{X: 1, Y: 2}, nil}, int64(1)}
+	unpacked, err := Unpack(original.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(original, unpacked) {
+		t.Fatal("tuples not equal", original, unpacked)
+	}
+}
+
+func TestRegisterTypeOrdering(t *testing.T) {
+	ordered := []Tuple{
+		{"points", testPoint{X: 0, Y: 0}},
+		{"points", testPoint{X: 0, Y: 1}},
+		{"points", testPoint{X: 0, Y: 256}},
+		{"points", testPoint{X: 1, Y: 0}},
+		{"points", testPoint{X: 256, Y: 0}},
+		{"points", testPoint{X: 256, Y: 0}, "a"},
+	}
+	for i := 1; i < len(ordered); i++ {
+		if bytes.Compare(ordered[i-1].Pack(), ordered[i].Pack()) >= 0 {
+			t.Fatal("tuples out of order", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestRegisterTypeErrors(t *testing.T) {
+	type other struct{}
+	encode := func(e TupleElement) []byte {
+		return nil
+	}
+	decode := func(b []byte) (TupleElement, error) {
+		return other{}, nil
+	}
+
+	err := RegisterType(reflect.TypeOf(other{}), 0x30, encode, decode)
+	if !errors.Is(err, ErrInvalidTypeCode) {
+		t.Fatal("expected invalid type code, got", err)
+	}
+	err = RegisterType(reflect.TypeOf(other{}), 0x40, encode, decode)
+	if !errors.Is(err, ErrTypeCodeAlreadyInUse) {
+		t.Fatal("expected type code in use, got", err)
+	}
+	err = RegisterType(reflect.TypeOf(testPoint{}), 0x41, encode, decode)
+	if !errors.Is(err, ErrTypeAlreadyRegistered) {
+		t.Fatal("expected type already registered, got", err)
+	}
+	err = RegisterType(reflect.TypeOf(""), 0x41, encode, decode)
+	if !errors.Is(err, ErrCannotRegisterType) {
+		t.Fatal("expected cannot register type, got", err)
+	}
+
+	// unregistered user type codes still fail to decode
+	_, err = Unpack([]byte{0x4f, 0x00})
+	if err == nil {
+		t.Fatal("expected error decoding unregistered type code")
+	}
+}